@@ -1,21 +1,355 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/Dimedrolity/go-chartographer/internal/app"
+	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
 )
 
 func main() {
-	dataDirPath := os.Args[1]
-	// TODO вынести хост и порт сервера и макс. размер тайла в os.Args
-	const (
-		port        = "8080"
-		tileMaxSize = 1000
-	)
+	if len(os.Args) > 1 && os.Args[1] == "migrate-tiles" {
+		migrateTiles(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compress-tiles" {
+		compressTiles(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "retile" {
+		retile(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		fsck(os.Args[2:])
+		return
+	}
+
+	serve()
+}
+
+func serve() {
+	cfg := &app.Config{}
+	var tileFormat string
+	var writeBack bool
+	var durability string
+	var demo int64
+	writeBackConfig := &imgstore.WriteBackConfig{}
+
+	flag.StringVar(&cfg.Port, "port", "8080", "порт HTTP сервера")
+	flag.IntVar(&cfg.TileMaxSize, "tile-size", 1000, "максимальный размер тайла по ширине и высоте")
+	flag.StringVar(&tileFormat, "tile-format", string(imgstore.FormatBmp), "формат хранения тайлов: bmp или raw")
+	flag.BoolVar(&cfg.TileCompress, "tile-compress", false, "сжимать тайлы на диске алгоритмом DEFLATE")
+	flag.BoolVar(&cfg.TileChecksum, "tile-checksum", false,
+		"хранить тайлы с контрольной суммой и проверять ее при чтении; включает проверку целостности /admin/scrub, "+
+			"если задан токен администратора")
+	flag.DurationVar(&cfg.ScrubInterval, "scrub-interval", 0,
+		"период фоновой проверки целостности тайлов, 0 - только по запросу POST /admin/scrub")
+	flag.StringVar(&cfg.ScrubSnapshot, "scrub-snapshot", "",
+		"URL хранилища с копией тайлов, из которой восстанавливаются поврежденные тайлы")
+	flag.StringVar(&cfg.TileStore, "tiles", "",
+		"URL хранилища тайлов: file:///data[?dedup=true], pack:///data[?compact=1m&open=256], mem://, "+
+			"s3://bucket/prefix[?endpoint=&region=&retries=]; по умолчанию - каталог с данными")
+	flag.StringVar(&cfg.MetaStore, "meta", "mem://",
+		"URL хранилища метаданных изображений: mem:// или log:///data/meta")
+	flag.Int64Var(&demo, "demo", 0,
+		"демонстрационный запуск без диска: тайлы и метаданные хранятся в памяти, тайлы занимают не больше указанного числа байт")
+	flag.BoolVar(&cfg.TileMmap, "tile-mmap", false, "отображать файлы тайлов в память (mmap), только для формата raw")
+	flag.IntVar(&cfg.TileMmapMax, "tile-mmap-max", 1024, "сколько тайлов отображается в память одновременно")
+	flag.Int64Var(&cfg.TileCacheSize, "tile-cache", 0, "размер кэша декодированных тайлов в байтах, 0 - без кэша")
+	flag.BoolVar(&writeBack, "write-back", false, "накапливать измененные тайлы в памяти и сохранять их в фоне")
+	flag.StringVar(&durability, "durability", "async",
+		"режим отложенной записи: async - подтверждать запись до сохранения, sync - после")
+	flag.DurationVar(&writeBackConfig.FlushInterval, "flush-interval", time.Second,
+		"период сохранения измененных тайлов")
+	flag.Int64Var(&writeBackConfig.MaxDirtyBytes, "max-dirty", 256<<20,
+		"размер измененных тайлов в байтах, при котором они сохраняются досрочно")
+	flag.DurationVar(&cfg.GCInterval, "gc-interval", 0,
+		"период удаления тайлов, оставшихся от недосозданных и недоудаленных изображений, 0 - без удаления; "+
+			"недоступно с -meta mem:// и тайлами в S3")
+	flag.DurationVar(&cfg.GCGrace, "gc-grace", time.Hour,
+		"сколько тайлы должны оставаться без ссылок из метаданных, прежде чем будут удалены")
+	flag.IntVar(&cfg.Concurrency, "concurrency", runtime.NumCPU(),
+		"сколько тайлов фрагмента обрабатывается одновременно, 1 - последовательно")
+	flag.IntVar(&cfg.MaxRevisions, "max-revisions", 100,
+		"сколько последних ревизий изображения хранится для отмены и чтения прошлых версий, 0 - без ограничения")
+	flag.DurationVar(&cfg.Timeouts.Create, "create-timeout", 0, "срок создания изображения, 0 - без ограничения")
+	flag.DurationVar(&cfg.Timeouts.SetFragment, "set-timeout", 0, "срок восстановления фрагмента, 0 - без ограничения")
+	flag.DurationVar(&cfg.Timeouts.GetFragment, "get-timeout", 0, "срок получения фрагмента, 0 - без ограничения")
+	flag.DurationVar(&cfg.Timeouts.Delete, "delete-timeout", 0, "срок удаления изображения, 0 - без ограничения")
+	flag.DurationVar(&cfg.Timeouts.Retile, "retile-timeout", 0, "срок перераскладки тайлов, 0 - без ограничения")
+	// 2 Гбайт по условию задачи, часть оставляем под остальные нужды процесса.
+	flag.Int64Var(&cfg.MemoryBudget, "mem-budget", 1<<30,
+		"сколько байт могут одновременно занимать декодируемые фрагменты и тайлы, 0 - без ограничения; "+
+			"при отложенной записи включает 2*max-dirty под измененные тайлы")
+	flag.DurationVar(&cfg.MemoryWait, "mem-wait", 5*time.Second,
+		"сколько запрос ожидает освобождения памяти, прежде чем получить отказ 503")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Использование:\n"+
+			"  %[1]s [флаги] <путь до каталога с данными>\n"+
+			"  %[1]s -tiles <URL хранилища тайлов> [флаги]\n"+
+			"  %[1]s -demo <байт> [флаги]\n"+
+			"  %[1]s migrate-tiles [флаги] <путь до каталога с данными>\n"+
+			"  %[1]s compress-tiles [флаги] <путь до каталога с данными>\n"+
+			"  %[1]s retile [флаги] <id изображения>...\n"+
+			"  %[1]s fsck [флаги] <путь до каталога с данными>\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"Ключи доступа к S3 читаются из переменных окружения AWS_ACCESS_KEY_ID и AWS_SECRET_ACCESS_KEY.\n"+
+				"Токен доступа к /admin/ (заголовок \"Authorization: Bearer <токен>\") читается из переменной окружения "+
+				"CHARTOGRAPHER_ADMIN_TOKEN, без токена пути /admin/ недоступны.")
+	}
+	flag.Parse()
+	cfg.AdminToken = os.Getenv("CHARTOGRAPHER_ADMIN_TOKEN")
+
+	// Демонстрационный запуск - краткая запись -tiles mem://?limit=<байт> -meta mem://.
+	if demo > 0 {
+		if flag.NArg() > 0 || cfg.TileStore != "" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		cfg.TileStore = fmt.Sprintf("mem://?limit=%d", demo)
+		cfg.MetaStore = "mem://"
+	}
+
+	// Каталог с данными - краткая запись -tiles file://<каталог>.
+	if flag.NArg() > 1 || (flag.NArg() == 1) == (cfg.TileStore != "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.NArg() == 1 {
+		cfg.TileStore = flag.Arg(0)
+	}
+
+	format, err := imgstore.ParseFormat(tileFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.TileFormat = format
+
+	if writeBack {
+		writeBackConfig.Durability, err = imgstore.ParseDurability(durability)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.TileWriteBack = writeBackConfig
+	}
+
+	if err := app.Run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateTiles перекодирует тайлы в каталоге с данными из одного формата в другой.
+func migrateTiles(args []string) {
+	fs := flag.NewFlagSet("migrate-tiles", flag.ExitOnError)
+	from := fs.String("from", string(imgstore.FormatBmp), "исходный формат тайлов")
+	to := fs.String("to", string(imgstore.FormatRaw), "целевой формат тайлов")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Использование: %s migrate-tiles [флаги] <путь до каталога с данными>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	fromFormat, err := imgstore.ParseFormat(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	toFormat, err := imgstore.ParseFormat(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := imgstore.MigrateTiles(context.Background(), fs.Arg(0), fromFormat, toFormat)
+	if err != nil {
+		log.Fatalf("перекодировано тайлов: %d, ошибка: %v", n, err)
+	}
+
+	log.Printf("перекодировано тайлов: %d", n)
+}
+
+// compressTiles сжимает или распаковывает тайлы в каталоге с данными и выводит занимаемое ими место до и после.
+func compressTiles(args []string) {
+	fs := flag.NewFlagSet("compress-tiles", flag.ExitOnError)
+	format := fs.String("format", string(imgstore.FormatBmp), "формат тайлов")
+	decompress := fs.Bool("decompress", false, "распаковать сжатые тайлы")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Использование: %s compress-tiles [флаги] <путь до каталога с данными>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir := fs.Arg(0)
+
+	f, err := imgstore.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logUsage("до", dir, f)
 
-	if err := app.Run(port, dataDirPath, tileMaxSize); err != nil {
+	n, err := imgstore.CompressTiles(context.Background(), dir, f, *decompress)
+	if err != nil {
+		log.Fatalf("обработано тайлов: %d, ошибка: %v", n, err)
+	}
+	log.Printf("обработано тайлов: %d", n)
+
+	logUsage("после", dir, f)
+}
+
+// logUsage выводит место, занимаемое несжатыми и сжатыми тайлами формата f в каталоге dir.
+func logUsage(when, dir string, f imgstore.Format) {
+	for _, ext := range []string{f.Ext(), f.Ext() + imgstore.FlateExt} {
+		repo, err := imgstore.NewFileSystemTileRepo(dir, ext)
+		if err != nil {
+			log.Fatal(err)
+		}
+		u, err := repo.Usage()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("%s: тайлы *%s: %d шт., на диске %d байт, без сжатия %d байт",
+			when, ext, u.Tiles, u.Stored, u.Original)
+	}
+}
+
+// retile перестраивает тайлы изображений на запущенном сервере, не останавливая его.
+// Метаданные изображений хранятся в памяти сервера, поэтому перераскладка выполняется через API.
+func retile(args []string) {
+	fs := flag.NewFlagSet("retile", flag.ExitOnError)
+	addr := fs.String("addr", "http://localhost:8080", "адрес сервера")
+	layout := fs.String("layout", string(tileutils.LayoutSquare),
+		"новая раскладка тайлов: square, strip, adaptive или rect:WxH")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Использование: %s retile [флаги] <id изображения>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	_, err := tileutils.ParseLayout(*layout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, id := range fs.Args() {
+		u := fmt.Sprintf("%s/chartas/%s/retile?layout=%s", *addr, url.PathEscape(id), url.QueryEscape(*layout))
+		resp, err := http.Post(u, "", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("%s: %s: %s", id, resp.Status, strings.TrimSpace(string(body)))
+		}
+
+		log.Printf("%s: раскладка тайлов %s", id, body)
+	}
+}
+
+// fsck сверяет метаданные изображений с тайлами в каталоге с данными и при -repair исправляет несоответствия.
+// Завершается с кодом 1, если остались неисправленные несоответствия.
+func fsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	meta := fs.String("meta", "", "URL хранилища метаданных изображений, например log:///data/meta")
+	format := fs.String("format", string(imgstore.FormatBmp), "формат тайлов")
+	compress := fs.Bool("compress", false, "тайлы сжаты алгоритмом DEFLATE")
+	checksum := fs.Bool("checksum", false, "тайлы хранятся с контрольной суммой")
+	repair := fs.Bool("repair", false, "исправить несоответствия: поврежденные тайлы заменяются черными")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Использование: %s fsck -meta <URL> [флаги] <путь до каталога с данными>\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "Проверка выполняется, пока сервер остановлен.")
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 || *meta == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	err := app.CheckFsck(*meta)
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	f, err := imgstore.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ext := f.Ext()
+	if *compress {
+		ext += imgstore.FlateExt
+	}
+	if *checksum {
+		ext += imgstore.ChecksumExt
+	}
+	fsRepo, err := imgstore.NewFileSystemTileRepo(fs.Arg(0), ext)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var repo imgstore.Repository = fsRepo
+	if *checksum {
+		repo = imgstore.NewChecksumRepo(repo)
+	}
+	if *compress {
+		repo = imgstore.NewFlateRepository(repo)
+	}
+	service, err := imgstore.NewService(f, repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	images, err := app.OpenMetaStore(*meta)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := chart.Fsck(context.Background(), images, fsRepo, service, *repair)
+	if c, ok := images.(io.Closer); ok {
+		_ = c.Close()
+	}
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unrepaired := report.Unrepaired()
+	log.Printf("проверено изображений: %d, тайлов: %d, несоответствий: %d, не исправлено: %d",
+		report.Images, report.Tiles, len(report.Issues), unrepaired)
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
 }
@@ -1,26 +1,390 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/Dimedrolity/go-chartographer/internal/chart"
 	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
 	"github.com/Dimedrolity/go-chartographer/internal/server"
-	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/membudget"
+	"github.com/Dimedrolity/go-chartographer/pkg/metrics"
 )
 
+// Config - параметры запуска приложения.
+type Config struct {
+	Port string
+	// TileStore - URL хранилища тайлов, например file:///data или s3://bucket/prefix, см. OpenTileStore.
+	TileStore string
+	// MetaStore - URL хранилища метаданных изображений, например mem:// или log:///data/meta, см. OpenMetaStore.
+	MetaStore   string
+	TileMaxSize int
+	TileFormat  imgstore.Format
+	// TileCompress - сжимать тайлы алгоритмом DEFLATE.
+	TileCompress bool
+	// TileChecksum - хранить тайлы с контрольной суммой и проверять ее при чтении.
+	TileChecksum bool
+	// TileMmap - отображать файлы тайлов в память (mmap). Только для формата raw.
+	TileMmap bool
+	// TileMmapMax - сколько тайлов отображается в память одновременно, давно использованные вытесняются.
+	TileMmapMax int
+	// TileCacheSize - размер кэша декодированных тайлов в байтах. 0 - без кэша.
+	TileCacheSize int64
+	// TileWriteBack - параметры отложенной записи тайлов. nil - тайлы сохраняются сразу.
+	TileWriteBack *imgstore.WriteBackConfig
+
+	// ScrubInterval - период фоновой проверки целостности тайлов. 0 - только по запросу. Требует TileChecksum.
+	ScrubInterval time.Duration
+	// ScrubSnapshot - URL хранилища с копией тайлов, из которой восстанавливаются поврежденные тайлы.
+	// Пустая строка - без восстановления. Требует TileChecksum.
+	ScrubSnapshot string
+	// AdminToken - токен доступа к проверке целостности /admin/scrub. Пустая строка - проверка доступна только в фоне.
+	AdminToken string
+
+	// GCInterval - период сборки мусора - тайлов, на которые не ссылаются метаданные изображений. 0 - без сборки.
+	// Сборка недоступна с метаданными в памяти и с тайлами в S3, см. checkGC.
+	GCInterval time.Duration
+	// GCGrace - сколько набор тайлов должен оставаться без ссылок, прежде чем сборка его удалит.
+	GCGrace time.Duration
+
+	// Concurrency - сколько тайлов фрагмента обрабатывается одновременно.
+	Concurrency int
+	// MaxRevisions - сколько последних ревизий хранится в истории изображения. 0 - без ограничения.
+	MaxRevisions int
+
+	// Timeouts - сроки выполнения операций над изображениями.
+	Timeouts server.Timeouts
+
+	// MemoryBudget - сколько байт памяти могут одновременно занимать декодируемые фрагменты и тайлы,
+	// включая измененные тайлы отложенной записи, см. fragmentBudget. 0 - без ограничения.
+	MemoryBudget int64
+	// MemoryWait - сколько запрос ожидает освобождения памяти, прежде чем получить отказ 503.
+	MemoryWait time.Duration
+}
+
+// shutdownTimeout - сколько сервер ожидает завершения начатых запросов при остановке.
+const shutdownTimeout = 30 * time.Second
+
 // Run инициализирует зависимости сервера и запускает его.
-func Run(port, dataDirPath string, tileMaxSize int) error {
-	tileRepo, err := imgstore.NewFileSystemTileRepo(dataDirPath)
+// По сигналу SIGINT или SIGTERM сервер останавливается, накопленные тайлы сохраняются.
+func Run(cfg *Config) error {
+	ext := cfg.TileFormat.Ext()
+	if cfg.TileCompress {
+		ext += imgstore.FlateExt
+	}
+	if cfg.TileChecksum {
+		ext += imgstore.ChecksumExt
+	} else if cfg.ScrubInterval > 0 || cfg.ScrubSnapshot != "" {
+		return errors.New("проверка целостности тайлов требует хранения тайлов с контрольной суммой")
+	}
+	if cfg.GCInterval > 0 {
+		if err := checkGC(cfg.TileStore, cfg.MetaStore); err != nil {
+			return err
+		}
+	}
+
+	registry := metrics.NewRegistry()
+
+	// closers закрываются в обратном порядке: сначала декораторы, затем декорируемые ими хранилища.
+	var closers []io.Closer
+	defer func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i].Close(); err != nil {
+				log.Printf("закрытие хранилища: %v", err)
+			}
+		}
+	}()
+
+	repo, err := OpenTileStore(cfg.TileStore, ext)
 	if err != nil {
 		return err
 	}
+	if c, ok := repo.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+	switch r := repo.(type) {
+	case *imgstore.PackRepository:
+		registerPackMetrics(registry, r)
+	case *imgstore.DedupRepository:
+		registerDedupMetrics(registry, r)
+	case *imgstore.MemoryRepository:
+		registerMemoryMetrics(registry, r)
+	}
+	// Отображение в память работает с файлами тайлов напрямую.
+	fsRepo, _ := repo.(*imgstore.FileSystemTileRepository)
+	listTileSets := tileSetLister(repo)
 
-	bmpService := imgstore.NewBmpService(tileRepo)
+	// Контрольная сумма считается по сохраняемым байтам, поэтому обнаруживает и повреждение сжатых тайлов.
+	var checksumRepo *imgstore.ChecksumRepository
+	if cfg.TileChecksum {
+		checksumRepo = imgstore.NewChecksumRepo(repo)
+		registerChecksumMetrics(registry, checksumRepo)
+		repo = checksumRepo
+	}
+
+	// Сжатые тайлы одинакового содержимого совпадают, поэтому сжатие выполняется до дедупликации.
+	if cfg.TileCompress {
+		flateRepo := imgstore.NewFlateRepository(repo)
+		registerFlateMetrics(registry, flateRepo)
+		repo = flateRepo
+	}
+
+	tileService, err := newTileService(cfg, fsRepo, repo)
+	if err != nil {
+		return err
+	}
+
+	if c, ok := tileService.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+
+	imageRepo, err := OpenMetaStore(cfg.MetaStore)
+	if err != nil {
+		return err
+	}
+	if c, ok := imageRepo.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+
+	budgetBytes, err := fragmentBudget(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.TileWriteBack != nil {
+		writeBack := imgstore.NewWriteBackService(tileService, *cfg.TileWriteBack)
+		registerWriteBackMetrics(registry, writeBack)
+		closers = append(closers, writeBack)
+		tileService = writeBack
+	}
+
+	if cfg.TileCacheSize > 0 {
+		cached := imgstore.NewCachedService(tileService, cfg.TileCacheSize)
+		registerCacheMetrics(registry, cached)
+		tileService = cached
+	}
+
+	var budget *membudget.Budget
+	if budgetBytes > 0 {
+		budget = membudget.NewBudget(budgetBytes, cfg.MemoryWait)
+		registerBudgetMetrics(registry, budget)
+	}
 
-	imageRepo := kvstore.NewInMemoryStore()
 	adapter := &chart.ImageAdapter{}
-	chartService := chart.NewChartographerService(imageRepo, bmpService, adapter, tileMaxSize)
-	config := server.NewConfig(port)
+	chartService := chart.NewChartographerService(imageRepo, tileService, adapter, cfg.TileMaxSize, budget,
+		cfg.Concurrency, cfg.MaxRevisions)
+
+	config := server.NewConfig(cfg.Port)
+	config.Metrics = registry
+	config.Timeouts = cfg.Timeouts
+
+	if cfg.GCInterval > 0 {
+		if listTileSets == nil {
+			return errors.New("сборка мусора не поддерживается хранилищем тайлов")
+		}
+		collector := chart.NewCollector(chartService, listTileSets, cfg.GCInterval, cfg.GCGrace)
+		registerGCMetrics(registry, collector)
+		closers = append(closers, collector)
+	}
+
+	if checksumRepo != nil {
+		var snapshot imgstore.Repository
+		if cfg.ScrubSnapshot != "" {
+			snapshotRepo, err := OpenTileStore(cfg.ScrubSnapshot, ext)
+			if err != nil {
+				return err
+			}
+			if c, ok := snapshotRepo.(io.Closer); ok {
+				closers = append(closers, c)
+			}
+			snapshot = imgstore.NewChecksumRepo(snapshotRepo)
+		}
+
+		scrubber := chart.NewScrubber(chartService, checksumRepo, snapshot, cfg.ScrubInterval)
+		registerScrubMetrics(registry, scrubber)
+		closers = append(closers, scrubber)
+		config.Scrubber = scrubber
+		config.AdminToken = cfg.AdminToken
+		if cfg.AdminToken == "" {
+			log.Print("токен администратора не задан, проверка целостности /admin/scrub недоступна")
+		}
+	}
+
 	srv := server.NewServer(config, chartService)
 
-	return srv.Run()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Run()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-stop:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// tileSetLister возвращает функцию, перечисляющую наборы тайлов хранилища repo для сборки мусора,
+// или nil, если хранилище не умеет их перечислять.
+func tileSetLister(repo imgstore.Repository) chart.TileSetLister {
+	switch r := repo.(type) {
+	case *imgstore.FileSystemTileRepository:
+		return func(context.Context) ([]string, error) { return r.TileSets() }
+	case *imgstore.DedupRepository:
+		return func(context.Context) ([]string, error) { return r.TileSets() }
+	case *imgstore.PackRepository:
+		return func(context.Context) ([]string, error) { return r.Images() }
+	case *imgstore.MemoryRepository:
+		return func(context.Context) ([]string, error) { return r.Images(), nil }
+	case *imgstore.S3Repository:
+		return r.Images
+	}
+	return nil
+}
+
+// fragmentBudget возвращает, сколько памяти из MemoryBudget остается декодируемым фрагментам и тайлам.
+// Измененные тайлы отложенной записи занимают до 2*MaxDirtyBytes: при этом размере они сбрасываются
+// в вызывающей горутине, - поэтому столько вычитается из бюджета. 0 - без ограничения.
+func fragmentBudget(cfg *Config) (int64, error) {
+	if cfg.MemoryBudget <= 0 || cfg.TileWriteBack == nil {
+		return cfg.MemoryBudget, nil
+	}
+
+	dirty := cfg.TileWriteBack.MaxDirtyBytes
+	if dirty <= 0 {
+		return 0, errors.New("при ограничении памяти отложенная запись требует ограничения размера измененных тайлов")
+	}
+	rest := cfg.MemoryBudget - 2*dirty
+	if rest <= 0 {
+		return 0, fmt.Errorf("ограничение памяти %d байт не вмещает измененные тайлы отложенной записи: "+
+			"нужно больше %d байт", cfg.MemoryBudget, 2*dirty)
+	}
+	return rest, nil
+}
+
+// newTileService создает сервис тайлов поверх repo. Отображение в память работает с файлами fsRepo напрямую,
+// fsRepo равен nil, если тайлы хранятся не в файлах на диске.
+func newTileService(cfg *Config, fsRepo *imgstore.FileSystemTileRepository, repo imgstore.Repository) (imgstore.Service, error) {
+	if !cfg.TileMmap {
+		return imgstore.NewService(cfg.TileFormat, repo)
+	}
+
+	if cfg.TileFormat != imgstore.FormatRaw {
+		return nil, fmt.Errorf("mmap поддерживается только для формата тайлов %s", imgstore.FormatRaw)
+	}
+	if cfg.TileCompress {
+		return nil, errors.New("mmap не поддерживается для сжатых тайлов")
+	}
+	if cfg.TileChecksum {
+		return nil, errors.New("mmap не поддерживается для тайлов с контрольной суммой")
+	}
+	if fsRepo == nil {
+		return nil, errors.New("mmap поддерживается только для хранилища тайлов file без дедупликации")
+	}
+	return imgstore.NewMmapService(fsRepo, cfg.TileMmapMax), nil
+}
+
+func registerBudgetMetrics(r *metrics.Registry, b *membudget.Budget) {
+	r.GaugeFunc("chartographer_memory_budget_used_bytes",
+		"Память, зарезервированная под декодируемые фрагменты и тайлы.",
+		func() float64 { return float64(b.Used()) })
+	r.GaugeFunc("chartographer_memory_budget_limit_bytes",
+		"Размер бюджета памяти.",
+		func() float64 { return float64(b.Limit()) })
+}
+
+func registerCacheMetrics(r *metrics.Registry, c *imgstore.CachedService) {
+	r.CounterFunc("chartographer_tile_cache_hits_total",
+		"Обращения к тайлам, найденным в кэше.",
+		func() float64 { return float64(c.Hits()) })
+	r.CounterFunc("chartographer_tile_cache_misses_total",
+		"Обращения к тайлам, отсутствующим в кэше.",
+		func() float64 { return float64(c.Misses()) })
+	r.GaugeFunc("chartographer_tile_cache_bytes",
+		"Размер декодированных тайлов в кэше.",
+		func() float64 { return float64(c.Bytes()) })
+}
+
+func registerFlateMetrics(r *metrics.Registry, f *imgstore.FlateRepository) {
+	r.CounterFunc("chartographer_tile_flate_original_bytes_total",
+		"Размер сохраненных тайлов до сжатия.",
+		func() float64 { return float64(f.Original()) })
+	r.CounterFunc("chartographer_tile_flate_compressed_bytes_total",
+		"Размер сохраненных тайлов после сжатия.",
+		func() float64 { return float64(f.Compressed()) })
+}
+
+func registerPackMetrics(r *metrics.Registry, p *imgstore.PackRepository) {
+	r.GaugeFunc("chartographer_tile_pack_garbage_bytes",
+		"Размер устаревших записей тайлов в открытых упаковках.",
+		func() float64 { return float64(p.Garbage()) })
+	r.CounterFunc("chartographer_tile_pack_reclaimed_bytes_total",
+		"Место, освобожденное уплотнением упаковок.",
+		func() float64 { return float64(p.Reclaimed()) })
+	r.GaugeFunc("chartographer_tile_pack_open",
+		"Открытые упаковки тайлов.",
+		func() float64 { return float64(p.OpenPacks()) })
+}
+
+func registerDedupMetrics(r *metrics.Registry, d *imgstore.DedupRepository) {
+	r.GaugeFunc("chartographer_tile_dedup_blobs",
+		"Количество уникальных тайлов на диске.",
+		func() float64 { return float64(d.Blobs()) })
+}
+
+func registerMemoryMetrics(r *metrics.Registry, m *imgstore.MemoryRepository) {
+	r.GaugeFunc("chartographer_tile_memory_bytes",
+		"Размер тайлов в памяти.",
+		func() float64 { return float64(m.Bytes()) })
+}
+
+func registerChecksumMetrics(r *metrics.Registry, c *imgstore.ChecksumRepository) {
+	r.CounterFunc("chartographer_tile_checksum_mismatches_total",
+		"Чтения тайлов, контрольная сумма которых не совпала с сохраненной.",
+		func() float64 { return float64(c.Mismatches()) })
+}
+
+func registerScrubMetrics(r *metrics.Registry, s *chart.Scrubber) {
+	r.CounterFunc("chartographer_scrub_runs_total",
+		"Завершенные проверки целостности тайлов.",
+		func() float64 { return float64(s.Runs()) })
+	r.GaugeFunc("chartographer_scrub_corrupted_tiles",
+		"Поврежденные тайлы, найденные последней проверкой целостности.",
+		func() float64 { return float64(len(s.Report().Corrupted)) })
+	r.GaugeFunc("chartographer_scrub_missing_tiles",
+		"Отсутствующие тайлы, найденные последней проверкой целостности.",
+		func() float64 { return float64(len(s.Report().Missing)) })
+	r.CounterFunc("chartographer_scrub_restored_tiles_total",
+		"Тайлы, восстановленные из снимка.",
+		func() float64 { return float64(s.Restored()) })
+}
+
+func registerGCMetrics(r *metrics.Registry, c *chart.Collector) {
+	r.CounterFunc("chartographer_gc_runs_total",
+		"Завершенные сборки мусора тайлов.",
+		func() float64 { return float64(c.Runs()) })
+	r.CounterFunc("chartographer_gc_removed_tile_sets_total",
+		"Наборы тайлов, удаленные сборкой мусора.",
+		func() float64 { return float64(c.Removed()) })
+}
+
+func registerWriteBackMetrics(r *metrics.Registry, w *imgstore.WriteBackService) {
+	r.GaugeFunc("chartographer_tile_writeback_dirty_bytes",
+		"Размер измененных тайлов, ожидающих сохранения.",
+		func() float64 { return float64(w.DirtyBytes()) })
 }
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/s3"
+)
+
+// Хранилища выбираются по URL, схема которого определяет вид хранилища:
+//
+//	тайлы:
+//	  file:///data              файлы тайлов в каталоге, ?dedup=true - с дедупликацией
+//	  pack:///data              упаковки тайлов в каталоге, ?compact=1m - период уплотнения, 0 - без уплотнения,
+//	                            ?open=256 - сколько упаковок открыто одновременно
+//	  mem://                    тайлы в памяти, ?limit= - сколько байт могут занимать тайлы
+//	  s3://bucket/prefix        бакет S3-совместимого хранилища, ?endpoint=, ?region=, ?retries=,
+//	                            ключи доступа - из AWS_ACCESS_KEY_ID и AWS_SECRET_ACCESS_KEY
+//	метаданные:
+//	  mem://                    в памяти
+//	  log:///data/meta          в памяти с журналом на диске
+//
+// Путь без схемы считается каталогом с файлами тайлов (file).
+// Относительный путь записывается без третьей косой черты: file://data.
+
+// TileStoreOpener создает хранилище тайлов с расширением файлов ext по URL.
+type TileStoreOpener func(u *url.URL, ext string) (imgstore.Repository, error)
+
+// MetaStoreOpener создает хранилище метаданных изображений по URL.
+type MetaStoreOpener func(u *url.URL) (kvstore.Store, error)
+
+var (
+	storesMu   sync.RWMutex
+	tileStores = map[string]TileStoreOpener{
+		"file": openFileTiles,
+		"pack": openPackTiles,
+		"mem":  openMemoryTiles,
+		"s3":   openS3Tiles,
+	}
+	metaStores = map[string]MetaStoreOpener{
+		"mem": openMemoryMeta,
+		"log": openLogMeta,
+	}
+)
+
+// RegisterTileStore регистрирует хранилище тайлов со схемой URL scheme, заменяя прежнее.
+func RegisterTileStore(scheme string, open TileStoreOpener) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	tileStores[scheme] = open
+}
+
+// RegisterMetaStore регистрирует хранилище метаданных со схемой URL scheme, заменяя прежнее.
+func RegisterMetaStore(scheme string, open MetaStoreOpener) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	metaStores[scheme] = open
+}
+
+// OpenTileStore создает хранилище тайлов по URL rawURL.
+// Хранилище может реализовывать io.Closer, тогда его нужно закрыть после использования.
+func OpenTileStore(rawURL, ext string) (imgstore.Repository, error) {
+	u, err := parseStoreURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	storesMu.RLock()
+	open, ok := tileStores[u.Scheme]
+	schemes := make([]string, 0, len(tileStores))
+	for scheme := range tileStores {
+		schemes = append(schemes, scheme)
+	}
+	storesMu.RUnlock()
+	if !ok {
+		return nil, unknownScheme("тайлов", u.Scheme, schemes)
+	}
+	return open(u, ext)
+}
+
+// OpenMetaStore создает хранилище метаданных изображений по URL rawURL.
+// Хранилище может реализовывать io.Closer, тогда его нужно закрыть после использования.
+func OpenMetaStore(rawURL string) (kvstore.Store, error) {
+	u, err := parseStoreURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	storesMu.RLock()
+	open, ok := metaStores[u.Scheme]
+	schemes := make([]string, 0, len(metaStores))
+	for scheme := range metaStores {
+		schemes = append(schemes, scheme)
+	}
+	storesMu.RUnlock()
+	if !ok {
+		return nil, unknownScheme("метаданных", u.Scheme, schemes)
+	}
+	return open(u)
+}
+
+// checkGC проверяет, что сборка мусора не удалит тайлы существующих изображений.
+// Метаданные в памяти не знают об изображениях, созданных до перезапуска или другим процессом с общими тайлами,
+// а хранилище S3 обычно разделяется несколькими процессами со своими метаданными.
+func checkGC(tileStore, metaStore string) error {
+	meta, err := parseStoreURL(metaStore)
+	if err != nil {
+		return err
+	}
+	if meta.Scheme == "mem" {
+		return errors.New("сборка мусора недоступна с метаданными в памяти: " +
+			"она удалит тайлы изображений, которых нет в метаданных этого процесса")
+	}
+
+	tiles, err := parseStoreURL(tileStore)
+	if err != nil {
+		return err
+	}
+	if tiles.Scheme == "s3" {
+		return errors.New("сборка мусора недоступна с тайлами в S3: " +
+			"хранилище может разделяться процессами с разными метаданными")
+	}
+	return nil
+}
+
+// CheckFsck проверяет, что fsck с метаданными metaStore не удалит тайлы существующих изображений:
+// в метаданных в памяти нет ни одного изображения, поэтому все каталоги тайлов считались бы лишними.
+func CheckFsck(metaStore string) error {
+	meta, err := parseStoreURL(metaStore)
+	if err != nil {
+		return err
+	}
+	if meta.Scheme == "mem" {
+		return errors.New("fsck недоступен с метаданными в памяти: все каталоги тайлов считались бы лишними")
+	}
+	return nil
+}
+
+// parseStoreURL разбирает URL хранилища. Путь без схемы считается URL file.
+func parseStoreURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		return &url.URL{Scheme: "file", Path: rawURL}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("URL хранилища %q: %w", rawURL, err)
+	}
+	return u, nil
+}
+
+func unknownScheme(kind, scheme string, schemes []string) error {
+	sort.Strings(schemes)
+	return fmt.Errorf("неизвестное хранилище %s %q, поддерживаются: %s", kind, scheme, strings.Join(schemes, ", "))
+}
+
+// localPath возвращает путь на диске из URL: file:///data - абсолютный путь, file://data - относительный.
+func localPath(u *url.URL) (string, error) {
+	path := filepath.FromSlash(u.Host + u.Path)
+	if path == "" {
+		return "", fmt.Errorf("в URL хранилища %s не указан путь", u.Scheme)
+	}
+	return path, nil
+}
+
+// queryBool возвращает логический параметр name URL, по умолчанию false.
+func queryBool(u *url.URL, name string) (bool, error) {
+	v := u.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("параметр %s URL хранилища: %w", name, err)
+	}
+	return b, nil
+}
+
+func openFileTiles(u *url.URL, ext string) (imgstore.Repository, error) {
+	path, err := localPath(u)
+	if err != nil {
+		return nil, err
+	}
+	dedup, err := queryBool(u, "dedup")
+	if err != nil {
+		return nil, err
+	}
+
+	if dedup {
+		return imgstore.NewDedupRepo(path, ext)
+	}
+	return imgstore.NewFileSystemTileRepo(path, ext)
+}
+
+// Параметры упаковок по умолчанию: период уплотнения и сколько упаковок открыто одновременно.
+const (
+	defaultPackCompact = time.Minute
+	defaultPackOpen    = 256
+)
+
+func openPackTiles(u *url.URL, ext string) (imgstore.Repository, error) {
+	path, err := localPath(u)
+	if err != nil {
+		return nil, err
+	}
+
+	compact := defaultPackCompact
+	if v := u.Query().Get("compact"); v != "" {
+		compact, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("параметр compact URL хранилища: %w", err)
+		}
+	}
+
+	maxOpen := defaultPackOpen
+	if v := u.Query().Get("open"); v != "" {
+		maxOpen, err = strconv.Atoi(v)
+		if err != nil || maxOpen < 1 {
+			return nil, fmt.Errorf("параметр open URL хранилища: некорректное количество %q", v)
+		}
+	}
+	return imgstore.NewPackRepo(path, ext, compact, maxOpen)
+}
+
+func openMemoryTiles(u *url.URL, _ string) (imgstore.Repository, error) {
+	var limit int64
+	if v := u.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("параметр limit URL хранилища: некорректный размер %q", v)
+		}
+	}
+	return imgstore.NewMemoryRepo(limit), nil
+}
+
+// Параметры S3 по умолчанию.
+const (
+	defaultS3Endpoint   = "https://s3.amazonaws.com"
+	defaultS3Retries    = 3
+	defaultS3RetryDelay = 100 * time.Millisecond
+)
+
+func openS3Tiles(u *url.URL, ext string) (imgstore.Repository, error) {
+	q := u.Query()
+	cfg := s3.Config{
+		Endpoint: defaultS3Endpoint,
+		Region:   q.Get("region"),
+		Bucket:   u.Host,
+		Credentials: s3.Credentials{
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		},
+		MaxRetries: defaultS3Retries,
+		RetryDelay: defaultS3RetryDelay,
+	}
+	if v := q.Get("endpoint"); v != "" {
+		cfg.Endpoint = v
+	}
+	if v := q.Get("retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("параметр retries URL хранилища: %w", err)
+		}
+		cfg.MaxRetries = n
+	}
+
+	client, err := s3.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return imgstore.NewS3Repo(client, strings.TrimPrefix(u.Path, "/"), ext), nil
+}
+
+func openMemoryMeta(*url.URL) (kvstore.Store, error) {
+	return kvstore.NewInMemoryStore(), nil
+}
+
+func openLogMeta(u *url.URL) (kvstore.Store, error) {
+	path, err := localPath(u)
+	if err != nil {
+		return nil, err
+	}
+	return kvstore.NewLogStore(path, decodeImage)
+}
+
+// decodeImage восстанавливает метаданные изображения, сохраненные журналом.
+func decodeImage(b []byte) (interface{}, error) {
+	img := &chart.TiledImage{}
+	err := json.Unmarshal(b, img)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
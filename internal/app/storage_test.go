@@ -0,0 +1,114 @@
+package app_test
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/app"
+	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/s3/s3test"
+)
+
+func TestOpenTileStore(t *testing.T) {
+	Convey("Вид хранилища тайлов должен определяться схемой URL", t, func() {
+		dir := t.TempDir()
+		srv := s3test.NewServer()
+		defer srv.Close()
+		srv.CreateBucket("bucket")
+
+		for url, want := range map[string]interface{}{
+			dir:                                      &imgstore.FileSystemTileRepository{},
+			"file://" + dir:                          &imgstore.FileSystemTileRepository{},
+			"file://" + dir + "?dedup=true":          &imgstore.DedupRepository{},
+			"pack://" + dir + "?compact=0&open=2":    &imgstore.PackRepository{},
+			"mem://":                                 &imgstore.MemoryRepository{},
+			"s3://bucket/prefix?endpoint=" + srv.URL: &imgstore.S3Repository{},
+		} {
+			repo, err := app.OpenTileStore(url, ".bmp")
+			So(err, ShouldBeNil)
+			So(repo, ShouldHaveSameTypeAs, want)
+
+			So(repo.SaveTile(context.Background(), "0", 0, 0, []byte("tile")), ShouldBeNil)
+			b, err := repo.GetTile(context.Background(), "0", 0, 0)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "tile")
+			So(repo.DeleteImage(context.Background(), "0"), ShouldBeNil)
+
+			if c, ok := repo.(io.Closer); ok {
+				So(c.Close(), ShouldBeNil)
+			}
+		}
+	})
+
+	Convey("Неизвестная схема и некорректные параметры должны давать ошибку", t, func() {
+		for _, url := range []string{
+			"ftp://data",
+			"file://" + t.TempDir() + "?dedup=maybe",
+			"pack://" + t.TempDir() + "?compact=often",
+			"pack://" + t.TempDir() + "?open=0",
+			"s3://?endpoint=http://localhost",
+		} {
+			_, err := app.OpenTileStore(url, ".bmp")
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestOpenMetaStore(t *testing.T) {
+	Convey("Метаданные в журнале должны сохраняться между открытиями", t, func() {
+		url := "log://" + filepath.Join(t.TempDir(), "meta")
+
+		store, err := app.OpenMetaStore(url)
+		So(err, ShouldBeNil)
+		img := &chart.TiledImage{Id: "0", Width: 10, Height: 20,
+			Layout: tileutils.Layout{Kind: tileutils.LayoutStrip}, TileWidth: 10, TileHeight: 5}
+		So(store.Add(img.Id, img), ShouldBeNil)
+		So(store.(io.Closer).Close(), ShouldBeNil)
+
+		store, err = app.OpenMetaStore(url)
+		So(err, ShouldBeNil)
+		defer store.(io.Closer).Close()
+		got, err := store.Get("0")
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+	})
+
+	Convey("Хранилище mem:// должно храниться в памяти, неизвестная схема - давать ошибку", t, func() {
+		store, err := app.OpenMetaStore("mem://")
+		So(err, ShouldBeNil)
+		So(store, ShouldHaveSameTypeAs, &kvstore.InMemoryStore{})
+
+		_, err = app.OpenMetaStore("redis://localhost")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRun_GC(t *testing.T) {
+	Convey("Сборка мусора не должна запускаться, если может удалить тайлы существующих изображений", t, func() {
+		dir := t.TempDir()
+
+		err := app.Run(&app.Config{TileStore: dir, MetaStore: "mem://", GCInterval: time.Minute})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "метаданными в памяти")
+
+		err = app.Run(&app.Config{TileStore: "s3://bucket/prefix", MetaStore: "log://" + filepath.Join(dir, "meta"),
+			GCInterval: time.Minute})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "S3")
+	})
+}
+
+func TestCheckFsck(t *testing.T) {
+	Convey("fsck не должен запускаться с метаданными в памяти", t, func() {
+		So(app.CheckFsck("mem://"), ShouldNotBeNil)
+		So(app.CheckFsck("log://"+filepath.Join(t.TempDir(), "meta")), ShouldBeNil)
+	})
+}
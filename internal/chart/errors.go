@@ -9,6 +9,25 @@ var ErrNotExist = errors.New("изображение не найдено")
 
 var ErrNotOverlaps = errors.New("изображение и фрагмент не пересекаются по координатам")
 
+// ErrRevisionNotExist означает, что у изображения нет ревизии с таким номером
+// или ее история удалена перераскладкой тайлов.
+var ErrRevisionNotExist = errors.New("ревизия изображения не найдена")
+
+// ErrNothingToUndo означает, что у изображения нет изменений, которые можно отменить.
+var ErrNothingToUndo = errors.New("нет изменений для отмены")
+
+// ErrBusy означает, что для обработки запроса не хватает памяти, запрос стоит повторить позже.
+var ErrBusy = errors.New("недостаточно памяти для обработки запроса, повторите позже")
+
+// ErrRetiling означает, что тайлы изображения перестраиваются и изображение пока нельзя изменять.
+var ErrRetiling = errors.New("тайлы изображения перестраиваются, повторите позже")
+
+// ErrFsckDedup означает, что тайлы хранятся с дедупликацией и Fsck прочитал бы вместо них хэши содержимого.
+var ErrFsckDedup = errors.New("fsck не поддерживает каталог тайлов с дедупликацией")
+
+// ErrFormat означает, что данные не являются изображением поддерживаемого формата.
+var ErrFormat = errors.New("некорректное изображение")
+
 // SizeError означает, что ширина/высота изображения за пределом минимального/максимального значения
 type SizeError struct {
 	minWidth, width, maxWidth,
@@ -20,3 +39,14 @@ func (e *SizeError) Error() string {
 		fmt.Sprintf("height в диапазоне [%d; %d].\n", e.minHeight, e.maxHeight) +
 		fmt.Sprintf("Получено width=%d, height=%d", e.width, e.height)
 }
+
+// DeclaredSizeError означает, что изображение в заголовке меньше заявленного размера.
+type DeclaredSizeError struct {
+	declaredWidth, declaredHeight,
+	width, height int
+}
+
+func (e *DeclaredSizeError) Error() string {
+	return fmt.Sprintf("размер изображения в заголовке %dx%d меньше заявленного width=%d, height=%d",
+		e.width, e.height, e.declaredWidth, e.declaredHeight)
+}
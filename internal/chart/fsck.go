@@ -0,0 +1,254 @@
+package chart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"sort"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+)
+
+// FsckKind - вид несоответствия метаданных изображений и тайлов на диске.
+type FsckKind string
+
+const (
+	// FsckMissingTile - тайла изображения нет на диске. Исправляется созданием черного тайла.
+	FsckMissingTile FsckKind = "missing-tile"
+	// FsckUndecodable - тайл не декодируется. Исправляется заменой черным тайлом.
+	FsckUndecodable FsckKind = "undecodable"
+	// FsckTileSize - размер тайла не совпадает с размером по сетке изображения.
+	// Исправляется пересозданием тайла нужного размера с сохранением пересекающейся части.
+	FsckTileSize FsckKind = "tile-size"
+	// FsckExtraTile - тайл на диске не входит в сетку изображения. Исправляется удалением.
+	FsckExtraTile FsckKind = "extra-tile"
+	// FsckOrphanDir - каталог тайлов, на который не ссылаются метаданные. Исправляется удалением.
+	FsckOrphanDir FsckKind = "orphan-dir"
+	// FsckTempFile - оставшийся временный файл. Исправляется удалением.
+	FsckTempFile FsckKind = "temp-file"
+)
+
+// FsckIssue - несоответствие, найденное Fsck.
+type FsckIssue struct {
+	Kind FsckKind
+	// Image - id изображения, для FsckOrphanDir - имя каталога.
+	Image string
+	// X и Y - координаты тайла в изображении.
+	X, Y int
+	// Path - путь временного файла.
+	Path   string
+	Detail string
+	// Repaired означает, что несоответствие исправлено.
+	Repaired bool
+}
+
+func (i FsckIssue) String() string {
+	var s string
+	switch i.Kind {
+	case FsckOrphanDir:
+		s = fmt.Sprintf("%s: каталог %s", i.Kind, i.Image)
+	case FsckTempFile:
+		s = fmt.Sprintf("%s: %s", i.Kind, i.Path)
+	default:
+		s = fmt.Sprintf("%s: тайл (%d; %d) изображения %s", i.Kind, i.X, i.Y, i.Image)
+	}
+	if i.Detail != "" {
+		s += ": " + i.Detail
+	}
+	if i.Repaired {
+		s += " - исправлено"
+	}
+	return s
+}
+
+// FsckReport - результат Fsck.
+type FsckReport struct {
+	// Images и Tiles - сколько изображений и тайлов проверено.
+	Images, Tiles int
+	Issues        []FsckIssue
+}
+
+// Unrepaired возвращает, сколько несоответствий осталось неисправленными.
+func (r *FsckReport) Unrepaired() int {
+	n := 0
+	for _, i := range r.Issues {
+		if !i.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck сверяет метаданные изображений images с тайлами в хранилище repo: находит отсутствующие,
+// не декодируемые и лишние тайлы, тайлы неверного размера, каталоги без метаданных и временные файлы.
+// Тайлы читаются и сохраняются сервисом service поверх repo. При repair несоответствия исправляются,
+// данные поврежденных тайлов при этом теряются.
+//
+// Проверка выполняется, пока сервис остановлен: иначе тайлы, записываемые в этот момент, могут
+// считаться лишними или поврежденными. Каталог DedupRepository не проверяется, возвращается ErrFsckDedup:
+// его тайлы считались бы не декодируемыми, а исправление затерло бы их хэши.
+func Fsck(ctx context.Context, images kvstore.Store, repo *imgstore.FileSystemTileRepository, service imgstore.Service,
+	repair bool) (FsckReport, error) {
+	var report FsckReport
+
+	dedup, err := repo.Deduplicated()
+	if err != nil {
+		return report, err
+	}
+	if dedup {
+		return report, ErrFsckDedup
+	}
+
+	ids := images.Keys()
+	sort.Strings(ids)
+	tileSets := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		value, err := images.Get(id)
+		if err != nil {
+			return report, err
+		}
+		img, ok := value.(*TiledImage)
+		if !ok {
+			return report, fmt.Errorf("метаданные изображения %s: неизвестный тип %T", id, value)
+		}
+		// Копии тайлов ревизий принадлежат изображению, но их сетку Fsck не сверяет.
+		for _, tileSet := range img.tileSets() {
+			tileSets[tileSet] = true
+		}
+
+		err = fsckImage(ctx, img, repo, service, repair, &report)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// Каталог без тайлов не принадлежит хранилищу, например это каталог журнала метаданных.
+	dirs, err := repo.TileSets()
+	if err != nil {
+		return report, err
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if tileSets[dir] {
+			continue
+		}
+
+		issue := FsckIssue{Kind: FsckOrphanDir, Image: dir}
+		if repair {
+			err = repo.DeleteImage(ctx, dir)
+			if err != nil {
+				return report, err
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	temps, err := repo.TempFiles()
+	if err != nil {
+		return report, err
+	}
+	for _, path := range temps {
+		issue := FsckIssue{Kind: FsckTempFile, Path: path}
+		if repair {
+			err = os.Remove(path)
+			if err != nil {
+				return report, err
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	return report, nil
+}
+
+// fsckImage проверяет тайлы изображения img и дописывает несоответствия в report.
+func fsckImage(ctx context.Context, img *TiledImage, repo *imgstore.FileSystemTileRepository, service imgstore.Service,
+	repair bool, report *FsckReport) error {
+	expected := make(map[image.Point]bool)
+	for _, t := range img.Tiles() {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		expected[t.Min] = true
+
+		issue, err := fsckTile(ctx, img, t, service, repair)
+		if err != nil {
+			return err
+		}
+		if issue != nil {
+			report.Issues = append(report.Issues, *issue)
+		}
+	}
+	report.Images++
+	report.Tiles += len(expected)
+
+	stored, err := repo.Tiles(img.tileSet())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Y < stored[j].Y || stored[i].Y == stored[j].Y && stored[i].X < stored[j].X
+	})
+	for _, p := range stored {
+		if expected[p] {
+			continue
+		}
+
+		issue := FsckIssue{Kind: FsckExtraTile, Image: img.Id, X: p.X, Y: p.Y}
+		if repair {
+			err = repo.DeleteTile(img.tileSet(), p.X, p.Y)
+			if err != nil {
+				return err
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	return nil
+}
+
+// fsckTile проверяет тайл t изображения img и возвращает несоответствие или nil.
+// Ошибка возвращается, только если не удалось исправить несоответствие.
+func fsckTile(ctx context.Context, img *TiledImage, t image.Rectangle, service imgstore.Service,
+	repair bool) (*FsckIssue, error) {
+	issue := &FsckIssue{Image: img.Id, X: t.Min.X, Y: t.Min.Y}
+	// Пересоздаваемый тайл черный, как у нового изображения.
+	tile := newOpaqueRGBA(image.Rect(0, 0, t.Dx(), t.Dy())).(*image.RGBA)
+
+	got, err := service.GetTile(ctx, img.tileSet(), t.Min.X, t.Min.Y)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		issue.Kind = FsckMissingTile
+	case err != nil:
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		issue.Kind = FsckUndecodable
+		issue.Detail = err.Error()
+	case got.Bounds().Dx() != t.Dx() || got.Bounds().Dy() != t.Dy():
+		issue.Kind = FsckTileSize
+		issue.Detail = fmt.Sprintf("размер %dx%d, по сетке %dx%d", got.Bounds().Dx(), got.Bounds().Dy(), t.Dx(), t.Dy())
+		draw.Draw(tile, tile.Rect, got, got.Bounds().Min, draw.Src)
+	default:
+		return nil, nil
+	}
+
+	if repair {
+		err = service.SaveTile(ctx, img.tileSet(), t.Min.X, t.Min.Y, tile)
+		if err != nil {
+			return nil, err
+		}
+		issue.Repaired = true
+	}
+	return issue, nil
+}
@@ -0,0 +1,121 @@
+package chart_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+)
+
+func TestFsck(t *testing.T) {
+	Convey("Fsck должен находить несоответствия метаданных и тайлов на диске, а с repair - исправлять их", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		service := imgstore.NewBmpService(repo)
+		images := kvstore.NewInMemoryStore()
+		cs := chart.NewChartographerService(images, service, &chart.ImageAdapter{}, 100, nil, 4, 0)
+
+		// Изображения 250x180 из 6 тайлов.
+		img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+		_, err = cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		report, err := chart.Fsck(ctx, images, repo, service, false)
+		So(err, ShouldBeNil)
+		So(report.Images, ShouldEqual, 2)
+		So(report.Tiles, ShouldEqual, 12)
+		So(report.Issues, ShouldBeEmpty)
+
+		red := color.RGBA{R: 0xFF, A: 0xFF}
+		small := image.NewRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(small, small.Rect, image.NewUniform(red), image.Point{}, draw.Src)
+
+		So(repo.DeleteTile(img.Id, 100, 0), ShouldBeNil)
+		So(repo.SaveTile(ctx, img.Id, 0, 100, []byte("не bmp")), ShouldBeNil)
+		So(service.SaveTile(ctx, img.Id, 200, 0, small), ShouldBeNil)
+		So(service.SaveTile(ctx, img.Id, 300, 0, small), ShouldBeNil)
+		So(service.SaveTile(ctx, "orphan", 0, 0, small), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, img.Id, "tile.tmp"), nil, 0666), ShouldBeNil)
+		// Каталог без тайлов, например с журналом метаданных, не должен считаться лишним.
+		So(os.Mkdir(filepath.Join(dir, "meta"), 0777), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, "meta", "images.log"), nil, 0666), ShouldBeNil)
+
+		want := []chart.FsckKind{
+			chart.FsckMissingTile, chart.FsckTileSize, chart.FsckUndecodable,
+			chart.FsckExtraTile, chart.FsckOrphanDir, chart.FsckTempFile,
+		}
+		kinds := func(r chart.FsckReport) []chart.FsckKind {
+			got := make([]chart.FsckKind, 0, len(r.Issues))
+			for _, i := range r.Issues {
+				got = append(got, i.Kind)
+			}
+			return got
+		}
+
+		Convey("Без repair несоответствия должны только попадать в отчет", func() {
+			report, err := chart.Fsck(ctx, images, repo, service, false)
+			So(err, ShouldBeNil)
+			So(kinds(report), ShouldResemble, want)
+			So(report.Unrepaired(), ShouldEqual, len(want))
+			So(report.Issues[0].String(), ShouldEqual, "missing-tile: тайл (100; 0) изображения "+img.Id)
+
+			_, err = os.Stat(filepath.Join(dir, "orphan"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("С repair все несоответствия должны исправляться, а изображение - читаться", func() {
+			report, err := chart.Fsck(ctx, images, repo, service, true)
+			So(err, ShouldBeNil)
+			So(kinds(report), ShouldResemble, want)
+			So(report.Unrepaired(), ShouldEqual, 0)
+
+			report, err = chart.Fsck(ctx, images, repo, service, false)
+			So(err, ShouldBeNil)
+			So(report.Issues, ShouldBeEmpty)
+			_, err = os.Stat(filepath.Join(dir, "meta", "images.log"))
+			So(err, ShouldBeNil)
+
+			got, err := cs.GetFragment(ctx, img, 0, 0, 250, 180)
+			So(err, ShouldBeNil)
+			// Пересекающаяся часть тайла неверного размера сохраняется.
+			So(got.At(205, 5), ShouldResemble, red)
+			So(got.At(215, 15), ShouldResemble, color.RGBA{A: 0xFF})
+		})
+	})
+}
+
+func TestFsck_Dedup(t *testing.T) {
+	Convey("Fsck должен отказываться проверять каталог с дедупликацией и не менять его", t, func() {
+		dir := t.TempDir()
+		dedup, err := imgstore.NewDedupRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		images := kvstore.NewInMemoryStore()
+		cs := chart.NewChartographerService(images, imgstore.NewBmpService(dedup), &chart.ImageAdapter{}, 100, nil, 4, 0)
+		img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+		before, err := dedup.GetTile(ctx, img.Id, 0, 0)
+		So(err, ShouldBeNil)
+
+		repo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		_, err = chart.Fsck(ctx, images, repo, imgstore.NewBmpService(repo), true)
+		So(errors.Is(err, chart.ErrFsckDedup), ShouldBeTrue)
+
+		after, err := dedup.GetTile(ctx, img.Id, 0, 0)
+		So(err, ShouldBeNil)
+		So(bytes.Equal(after, before), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,180 @@
+package chart
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TileSetLister перечисляет наборы тайлов, которые есть в хранилище тайлов.
+type TileSetLister func(ctx context.Context) ([]string, error)
+
+// Collector - сборщик мусора: удаляет наборы тайлов, на которые не ссылаются метаданные изображений,
+// в том числе история ревизий.
+// Такие тайлы остаются от недосозданных и недоудаленных изображений и от прерванных перераскладок,
+// если их не удалось удалить сразу или процесс остановился.
+// Наборы тайлов, которые записываются в этот момент, не удаляются.
+//
+// Набор удаляется, только если остается без ссылок дольше grace, начиная со сборки, впервые нашедшей его таким.
+// Так не удаляются тайлы, метаданные которых записываются другим процессом или появятся после восстановления.
+type Collector struct {
+	cs    *ChartographerService
+	list  TileSetLister
+	grace time.Duration
+
+	// runMu не дает сборкам выполняться одновременно.
+	runMu sync.Mutex
+	// orphans - когда сборка впервые нашла набор тайлов без ссылок. Изменяется под runMu.
+	orphans map[string]time.Time
+
+	// runs и removed - сколько сборок завершено и наборов тайлов удалено.
+	runs, removed int64
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewCollector создает сборщик мусора тайлов сервиса cs, наборы тайлов которого перечисляет list.
+// Набор тайлов удаляется, если остается без ссылок не меньше grace, при grace <= 0 - сразу.
+// При interval > 0 запускает фоновую сборку, которую нужно остановить методом Close.
+func NewCollector(cs *ChartographerService, list TileSetLister, interval, grace time.Duration) *Collector {
+	c := &Collector{
+		cs:      cs,
+		list:    list,
+		grace:   grace,
+		orphans: make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}
+	if interval > 0 {
+		c.wg.Add(1)
+		go c.loop(interval)
+	}
+	return c
+}
+
+func (c *Collector) loop(interval time.Duration) {
+	defer c.wg.Done()
+
+	// Сборка прерывается остановкой.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.done
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := c.Collect(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("сборка мусора тайлов: %v", err)
+			}
+			continue
+		}
+		if len(removed) > 0 {
+			log.Printf("сборка мусора тайлов: удалено наборов тайлов: %d", len(removed))
+		}
+	}
+}
+
+// Collect удаляет наборы тайлов, на которые не ссылаются метаданные изображений дольше grace, и возвращает их.
+// Одновременно выполняется одна сборка, следующая ожидает ее завершения.
+func (c *Collector) Collect(ctx context.Context) ([]string, error) {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	stored, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Записываемые наборы запоминаются до чтения метаданных: набор, запись которого завершится
+	// после этого, к моменту чтения метаданных уже будет в них.
+	pending := c.cs.pending.snapshot()
+	referenced := make(map[string]bool)
+	for _, id := range c.cs.imageRepo.Keys() {
+		img, err := c.cs.GetImage(ctx, id)
+		if err != nil {
+			// Изображение удалено после получения ключей.
+			if errors.Is(err, ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		for _, tileSet := range img.tileSets() {
+			referenced[tileSet] = true
+		}
+	}
+
+	// Наборы, которые перестали быть без ссылок или исчезли, забываются.
+	now := time.Now()
+	orphans := make(map[string]time.Time)
+	defer func() { c.orphans = orphans }()
+
+	sort.Strings(stored)
+	removed := []string{}
+	for i, tileSet := range stored {
+		if _, ok := pending[tileSet]; ok || referenced[tileSet] {
+			continue
+		}
+
+		first, ok := c.orphans[tileSet]
+		if !ok {
+			first = now
+		}
+		if now.Sub(first) < c.grace {
+			orphans[tileSet] = first
+			continue
+		}
+
+		err = c.cs.tileService.DeleteImage(ctx, tileSet)
+		if err != nil {
+			// Неудаленный и непросмотренные наборы сохраняют время, когда их впервые нашли без ссылок,
+			// иначе каждая неудачная сборка начинала бы для них grace заново.
+			for _, rest := range stored[i:] {
+				if first, ok := c.orphans[rest]; ok {
+					orphans[rest] = first
+				}
+			}
+			return removed, err
+		}
+		removed = append(removed, tileSet)
+		atomic.AddInt64(&c.removed, 1)
+	}
+	atomic.AddInt64(&c.runs, 1)
+
+	return removed, nil
+}
+
+// Runs возвращает, сколько сборок завершено.
+func (c *Collector) Runs() int64 {
+	return atomic.LoadInt64(&c.runs)
+}
+
+// Removed возвращает, сколько наборов тайлов удалено.
+func (c *Collector) Removed() int64 {
+	return atomic.LoadInt64(&c.removed)
+}
+
+// Close останавливает фоновую сборку и ожидает ее завершения.
+func (c *Collector) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.wg.Wait()
+	return nil
+}
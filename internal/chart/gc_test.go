@@ -0,0 +1,120 @@
+package chart_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/fault"
+	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+)
+
+func TestCollector(t *testing.T) {
+	Convey("Сборщик мусора должен удалять только наборы тайлов без метаданных", t, func() {
+		tiles := imgstore.NewMemoryRepo(0)
+		faults := fault.NewInjector(fault.Config{}, 1)
+		cs := chart.NewChartographerService(kvstore.NewInMemoryStore(),
+			imgstore.NewBmpService(imgstore.NewFaultRepo(tiles, faults)), &chart.ImageAdapter{}, 100, nil, 4, 0)
+		c := chart.NewCollector(cs, func(context.Context) ([]string, error) { return tiles.Images(), nil }, 0, 0)
+		defer c.Close()
+
+		img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+		used := tiles.Bytes()
+
+		Convey("Тайлы существующих изображений не должны удаляться", func() {
+			removed, err := c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldBeEmpty)
+			So(tiles.Bytes(), ShouldEqual, used)
+			So(c.Runs(), ShouldEqual, 1)
+		})
+
+		Convey("Тайлы без метаданных должны удаляться", func() {
+			So(tiles.SaveTile(ctx, "orphan", 0, 0, []byte{1, 2, 3}), ShouldBeNil)
+
+			removed, err := c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldResemble, []string{"orphan"})
+			So(tiles.Bytes(), ShouldEqual, used)
+			So(c.Removed(), ShouldEqual, 1)
+		})
+
+		Convey("При ошибке создания изображения тайлы должны удаляться сразу", func() {
+			faults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 2})
+			_, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+			So(err, ShouldNotBeNil)
+			So(tiles.Bytes(), ShouldEqual, used)
+		})
+
+		Convey("Тайлы, не удаленные вместе с изображением, должен удалить сборщик", func() {
+			faults.Set(fault.Config{Ops: []string{"DeleteImage"}, ErrorRate: 1})
+			So(cs.DeleteImage(ctx, img.Id), ShouldBeNil)
+			_, err := cs.GetImage(ctx, img.Id)
+			So(err, ShouldEqual, chart.ErrNotExist)
+			So(tiles.Bytes(), ShouldEqual, used)
+
+			faults.Set(fault.Config{})
+			removed, err := c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldResemble, []string{img.Id})
+			So(tiles.Bytes(), ShouldEqual, 0)
+		})
+	})
+	Convey("Тайлы без метаданных должны удаляться не раньше, чем через grace", t, func() {
+		const grace = 50 * time.Millisecond
+		tiles := imgstore.NewMemoryRepo(0)
+		faults := fault.NewInjector(fault.Config{}, 1)
+		cs := chart.NewChartographerService(kvstore.NewInMemoryStore(),
+			imgstore.NewBmpService(imgstore.NewFaultRepo(tiles, faults)), &chart.ImageAdapter{}, 100, nil, 4, 0)
+		c := chart.NewCollector(cs, func(context.Context) ([]string, error) { return tiles.Images(), nil }, 0, grace)
+		defer c.Close()
+
+		So(tiles.SaveTile(ctx, "orphan", 0, 0, []byte{1, 2, 3}), ShouldBeNil)
+		removed, err := c.Collect(ctx)
+		So(err, ShouldBeNil)
+		So(removed, ShouldBeEmpty)
+
+		time.Sleep(grace)
+		So(tiles.SaveTile(ctx, "late", 0, 0, []byte{1, 2, 3}), ShouldBeNil)
+		removed, err = c.Collect(ctx)
+		So(err, ShouldBeNil)
+		So(removed, ShouldResemble, []string{"orphan"})
+
+		Convey("Ошибка удаления не должна начинать grace заново для неудаленных наборов", func() {
+			So(tiles.SaveTile(ctx, "next", 0, 0, []byte{1, 2, 3}), ShouldBeNil)
+			removed, err := c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldBeEmpty)
+			time.Sleep(grace)
+
+			faults.Set(fault.Config{Ops: []string{"DeleteImage"}, ErrorRate: 1})
+			_, err = c.Collect(ctx)
+			So(errors.Is(err, fault.ErrInjected), ShouldBeTrue)
+
+			faults.Set(fault.Config{})
+			removed, err = c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldResemble, []string{"late", "next"})
+		})
+
+		Convey("Набор, снова найденный без ссылок после удаления, должен ждать grace заново", func() {
+			So(tiles.DeleteImage(ctx, "late"), ShouldBeNil)
+			removed, err := c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldBeEmpty)
+
+			So(tiles.SaveTile(ctx, "late", 0, 0, []byte{1, 2, 3}), ShouldBeNil)
+			time.Sleep(grace / 2)
+			removed, err = c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldBeEmpty)
+		})
+	})
+}
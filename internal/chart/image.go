@@ -1,12 +1,178 @@
 package chart
 
-import "image"
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+)
 
 // TiledImage - изображение, разделенное на части тайлы.
 // Деление на тайлы необходимо, чтобы приложение не помещать в оперативную память изображения больших размеров.
 type TiledImage struct {
 	Id            string
 	Width, Height int
-	TileMaxSize   int // Определяет максимальный размер тайла по ширине и высоте.
-	Tiles         []image.Rectangle
+	// Layout - раскладка тайлов, выбранная при создании изображения.
+	Layout tileutils.Layout
+	// TileWidth и TileHeight - размер тайлов сетки изображения, крайние тайлы могут быть меньше.
+	TileWidth, TileHeight int
+	// TileSet - под каким id тайлы изображения лежат в хранилище тайлов. Пустая строка означает Id.
+	// Меняется при перераскладке: новые тайлы записываются рядом со старыми, а не поверх них.
+	TileSet string
+	// Revision - номер текущей ревизии, 0 - только что созданное изображение.
+	Revision int
+	// History - ревизии по возрастанию номеров, последняя - текущая.
+	// При перераскладке история удаляется, поэтому может начинаться не с первой ревизии.
+	History []Revision
+}
+
+// Revision - изменение изображения наложением фрагмента или отменой изменений.
+// Части тайлов Tiles внутри измененной части до изменения хранятся в отдельном наборе тайлов ревизии
+// под координатами своих левых верхних углов.
+type Revision struct {
+	Number int       `json:"number"`
+	Time   time.Time `json:"time"`
+	// X, Y, Width и Height - измененная часть изображения.
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Tiles - левые верхние углы измененных тайлов.
+	Tiles []TilePoint `json:"tiles"`
+	// RevertTo - для отмены номер ревизии, к виду после которой возвращено изображение, иначе nil.
+	RevertTo *int `json:"revertTo,omitempty"`
+}
+
+// TilePoint - левый верхний угол тайла в координатах изображения.
+type TilePoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+func (p TilePoint) point() image.Point {
+	return image.Pt(p.X, p.Y)
+}
+
+func (img *TiledImage) tileSet() string {
+	if img.TileSet == "" {
+		return img.Id
+	}
+	return img.TileSet
+}
+
+func (rev Revision) rect() image.Rectangle {
+	return image.Rect(rev.X, rev.Y, rev.X+rev.Width, rev.Y+rev.Height)
+}
+
+// revisionTileSet возвращает набор тайлов с копиями частей тайлов до ревизии n.
+func (img *TiledImage) revisionTileSet(n int) string {
+	return fmt.Sprintf("%s.r%d", img.tileSet(), n)
+}
+
+// tileSets возвращает все наборы тайлов изображения: текущие тайлы и копии частей тайлов ревизий.
+func (img *TiledImage) tileSets() []string {
+	sets := make([]string, 0, len(img.History)+1)
+	sets = append(sets, img.tileSet())
+	for _, rev := range img.History {
+		sets = append(sets, img.revisionTileSet(rev.Number))
+	}
+	return sets
+}
+
+// revisionRegions возвращает части тайлов, сохраненные в набор тайлов ревизии rev.
+// Часть хранится под координатами своего левого верхнего угла.
+func (img *TiledImage) revisionRegions(rev Revision) []image.Rectangle {
+	saved := make(map[image.Point]bool, len(rev.Tiles))
+	for _, p := range rev.Tiles {
+		saved[p.point()] = true
+	}
+
+	var regions []image.Rectangle
+	for _, t := range img.OverlappedTiles(rev.rect()) {
+		if saved[t.Min] {
+			regions = append(regions, t.Intersect(rev.rect()))
+		}
+	}
+	return regions
+}
+
+// hasRevision сообщает, можно ли получить изображение в виде после ревизии n.
+func (img *TiledImage) hasRevision(n int) bool {
+	return n >= img.Revision-len(img.History) && n <= img.Revision
+}
+
+// laterChanges возвращает части изображения, измененные после ревизии n.
+func (img *TiledImage) laterChanges(n int) []image.Rectangle {
+	var changes []image.Rectangle
+	for _, rev := range img.History {
+		if rev.Number > n {
+			changes = append(changes, rev.rect())
+		}
+	}
+	return changes
+}
+
+// undoTarget возвращает ревизию, к виду после которой изображение возвращает отмена последнего изменения.
+// Вид после ревизии отмены совпадает с видом после ревизии, к которой она вернула изображение,
+// поэтому отмены пропускаются и повторная отмена продолжает возвращать изображение назад.
+// Возможна ошибка ErrNothingToUndo.
+func (img *TiledImage) undoTarget() (int, error) {
+	n := img.Revision
+	for _, rev := range img.reversedHistory() {
+		if rev.Number == n && rev.RevertTo != nil {
+			n = *rev.RevertTo
+		}
+	}
+
+	if n == 0 || !img.hasRevision(n-1) {
+		return 0, ErrNothingToUndo
+	}
+	return n - 1, nil
+}
+
+// reversedHistory возвращает ревизии истории по убыванию номеров.
+func (img *TiledImage) reversedHistory() []Revision {
+	reversed := make([]Revision, len(img.History))
+	for i, rev := range img.History {
+		reversed[len(img.History)-1-i] = rev
+	}
+	return reversed
+}
+
+// withRevision возвращает копию метаданных с ревизией rev в конце истории.
+func (img *TiledImage) withRevision(rev Revision) *TiledImage {
+	c := *img
+	c.Revision = rev.Number
+	c.History = make([]Revision, len(img.History), len(img.History)+1)
+	copy(c.History, img.History)
+	c.History = append(c.History, rev)
+	return &c
+}
+
+// trimHistory возвращает копию метаданных, в истории которой не больше max последних ревизий,
+// и удаленные из истории ревизии. При max <= 0 история не сокращается.
+func (img *TiledImage) trimHistory(max int) (*TiledImage, []Revision) {
+	if max <= 0 || len(img.History) <= max {
+		return img, nil
+	}
+
+	c := *img
+	n := len(img.History) - max
+	c.History = img.History[n:]
+	return &c, img.History[:n]
+}
+
+func (img *TiledImage) grid() tileutils.Grid {
+	return tileutils.Grid{TileWidth: img.TileWidth, TileHeight: img.TileHeight}
+}
+
+// Tiles возвращает все тайлы изображения. Тайлы не хранятся, а вычисляются по размеру изображения и сетке тайлов.
+func (img *TiledImage) Tiles() []image.Rectangle {
+	return img.grid().Tiles(img.Width, img.Height)
+}
+
+// OverlappedTiles возвращает тайлы изображения, которые пересекаются с прямоугольником r.
+func (img *TiledImage) OverlappedTiles(r image.Rectangle) []image.Rectangle {
+	return img.grid().Overlapped(img.Width, img.Height, r)
 }
@@ -0,0 +1,142 @@
+package chart
+
+import (
+	"sync"
+)
+
+// imageLocks - блокировки изображений, согласующие операции с тайлами и перераскладку тайлов.
+// Записи создаются при обращении к изображению и удаляются, когда им никто не пользуется.
+type imageLocks struct {
+	mu sync.Mutex
+	m  map[string]*imageLock
+}
+
+type imageLock struct {
+	// refs, writers и retiling защищены imageLocks.mu.
+	refs int
+	// writers - сколько фрагментов записывается в изображение.
+	writers int
+	// retiling означает, что тайлы изображения перестраиваются, запись запрещена.
+	retiling bool
+	// idle оповещает перераскладку о завершении записей.
+	idle *sync.Cond
+
+	// tiles удерживается на чтение на время операции с тайлами,
+	// а на запись - на время замены метаданных изображения после перераскладки.
+	tiles sync.RWMutex
+
+	// history удерживается на время записи фрагмента и чтения прошлых ревизий:
+	// ревизии нумеруются по порядку, а копии тайлов должны соответствовать своей ревизии.
+	history sync.Mutex
+}
+
+func newImageLocks() *imageLocks {
+	return &imageLocks{m: make(map[string]*imageLock)}
+}
+
+// acquire возвращает запись изображения id. После использования ее нужно вернуть методом release.
+func (l *imageLocks) acquire(id string) *imageLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lk, ok := l.m[id]
+	if !ok {
+		lk = &imageLock{idle: sync.NewCond(&l.mu)}
+		l.m[id] = lk
+	}
+	lk.refs++
+	return lk
+}
+
+func (l *imageLocks) release(id string, lk *imageLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lk.refs--
+	if lk.refs == 0 {
+		delete(l.m, id)
+	}
+}
+
+// beginWrite регистрирует запись в изображение.
+// Возможна ошибка ErrRetiling.
+func (l *imageLocks) beginWrite(lk *imageLock) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lk.retiling {
+		return ErrRetiling
+	}
+	lk.writers++
+	return nil
+}
+
+func (l *imageLocks) endWrite(lk *imageLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lk.writers--
+	if lk.writers == 0 {
+		lk.idle.Broadcast()
+	}
+}
+
+// beginRetile запрещает запись в изображение и ожидает завершения начатых записей.
+// Возможна ошибка ErrRetiling, если тайлы изображения уже перестраиваются.
+func (l *imageLocks) beginRetile(lk *imageLock) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lk.retiling {
+		return ErrRetiling
+	}
+	lk.retiling = true
+	for lk.writers > 0 {
+		lk.idle.Wait()
+	}
+	return nil
+}
+
+func (l *imageLocks) endRetile(lk *imageLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lk.retiling = false
+}
+
+// pendingTileSets - наборы тайлов, которые записываются и еще не попали в метаданные изображений:
+// тайлы создаваемого изображения и новые тайлы перераскладки. Сборщик мусора их не удаляет.
+type pendingTileSets struct {
+	mu sync.Mutex
+	m  map[string]struct{}
+}
+
+func newPendingTileSets() *pendingTileSets {
+	return &pendingTileSets{m: make(map[string]struct{})}
+}
+
+func (p *pendingTileSets) add(tileSet string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.m[tileSet] = struct{}{}
+}
+
+func (p *pendingTileSets) remove(tileSet string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.m, tileSet)
+}
+
+// snapshot возвращает копию записываемых наборов тайлов.
+func (p *pendingTileSets) snapshot() map[string]struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := make(map[string]struct{}, len(p.m))
+	for tileSet := range p.m {
+		m[tileSet] = struct{}{}
+	}
+	return m
+}
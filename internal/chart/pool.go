@@ -0,0 +1,80 @@
+package chart
+
+import (
+	"context"
+	"image"
+	"sync"
+)
+
+// forEachTile вызывает fn для каждого тайла, обрабатывая одновременно не более concurrency тайлов.
+// Возвращает первую ошибку, после нее обработка еще не начатых тайлов отменяется,
+// а ctx, переданный в уже начатые вызовы fn, отменяется.
+// При отмене ctx возвращает ctx.Err().
+func forEachTile(ctx context.Context, tiles []image.Rectangle, concurrency int,
+	fn func(ctx context.Context, t image.Rectangle) error) error {
+	if concurrency <= 1 || len(tiles) <= 1 {
+		for _, t := range tiles {
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+
+			err = fn(ctx, t)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if concurrency > len(tiles) {
+		concurrency = len(tiles)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	queue := make(chan image.Rectangle)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for t := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				err := fn(ctx, t)
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, t := range tiles {
+		select {
+		case queue <- t:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
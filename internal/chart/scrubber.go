@@ -0,0 +1,335 @@
+package chart
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+// CorruptTile - поврежденный или отсутствующий тайл, найденный проверкой целостности.
+type CorruptTile struct {
+	// Image - id изображения, TileSet - набор тайлов: текущие тайлы или копии ревизии,
+	// X и Y - координаты тайла в изображении.
+	Image   string `json:"image"`
+	TileSet string `json:"tileSet"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Error   string `json:"error"`
+	// Restored означает, что тайл восстановлен из снимка.
+	Restored bool `json:"restored"`
+	// RestoreError - почему тайл не удалось восстановить из снимка.
+	RestoreError string `json:"restoreError,omitempty"`
+}
+
+// ScrubReport - результат проверки целостности тайлов.
+type ScrubReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Images и Tiles - сколько изображений и тайлов проверено, включая копии тайлов ревизий.
+	Images    int           `json:"images"`
+	Tiles     int           `json:"tiles"`
+	Corrupted []CorruptTile `json:"corrupted"`
+	// Missing - тайлы, которых нет в хранилище.
+	Missing []CorruptTile `json:"missing"`
+}
+
+// Scrubber проверяет целостность тайлов всех изображений: в фоне с периодом interval и по запросу методом Scrub.
+// Поврежденным считается тайл, который не удается прочитать из хранилища tiles, например из-за несовпадения
+// контрольной суммы (imgstore.ErrChecksum), поэтому tiles должно хранить тайлы с контрольной суммой,
+// см. imgstore.ChecksumRepository.
+//
+// Тайлы, измененные в памяти сервиса (см. imgstore.Flusher), перед повторной проверкой сохраняются в tiles,
+// иначе еще не сохраненный тайл считался бы отсутствующим.
+//
+// Если задан снимок snapshot - хранилище с копией тайлов, - поврежденные и отсутствующие тайлы
+// восстанавливаются из него записью через сервис тайлов cs. Изменения тайла после снимка при этом теряются.
+type Scrubber struct {
+	cs       *ChartographerService
+	tiles    imgstore.Repository
+	snapshot imgstore.Repository
+
+	// running равен 1, пока выполняется проверка. Проверки не выполняются одновременно.
+	running int32
+
+	mu sync.Mutex
+	// report - результат последней завершенной проверки.
+	report ScrubReport
+
+	// runs и restored - сколько проверок завершено и тайлов восстановлено.
+	runs, restored int64
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewScrubber создает Scrubber тайлов изображений сервиса cs, хранящихся в tiles.
+// snapshot - хранилище с копией тайлов для восстановления, nil - без восстановления.
+// При interval > 0 запускает фоновую проверку, которую нужно остановить методом Close.
+func NewScrubber(cs *ChartographerService, tiles, snapshot imgstore.Repository, interval time.Duration) *Scrubber {
+	s := &Scrubber{
+		cs:       cs,
+		tiles:    tiles,
+		snapshot: snapshot,
+		done:     make(chan struct{}),
+	}
+	if interval > 0 {
+		s.wg.Add(1)
+		go s.loop(interval)
+	}
+	return s
+}
+
+func (s *Scrubber) loop(interval time.Duration) {
+	defer s.wg.Done()
+
+	// Проверка прерывается остановкой.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.done
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		report, err := s.Scrub(ctx)
+		// Проверка, запущенная по запросу, заменяет фоновую.
+		if errors.Is(err, ErrScrubRunning) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("проверка целостности тайлов: %v", err)
+			}
+			continue
+		}
+		if len(report.Corrupted) > 0 || len(report.Missing) > 0 {
+			log.Printf("проверка целостности тайлов: повреждено %d и отсутствует %d из %d тайлов",
+				len(report.Corrupted), len(report.Missing), report.Tiles)
+		}
+	}
+}
+
+// ErrScrubRunning означает, что проверка целостности уже выполняется.
+var ErrScrubRunning = errors.New("проверка целостности уже выполняется")
+
+// Scrub проверяет тайлы всех изображений и восстанавливает поврежденные из снимка.
+// Одновременно выполняется одна проверка, пока она не завершится, Scrub возвращает ErrScrubRunning.
+// Результат проверки, прерванной ошибкой, не сохраняется.
+func (s *Scrubber) Scrub(ctx context.Context) (ScrubReport, error) {
+	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
+		return ScrubReport{}, ErrScrubRunning
+	}
+	defer atomic.StoreInt32(&s.running, 0)
+
+	report := ScrubReport{
+		Started:   time.Now(),
+		Corrupted: []CorruptTile{},
+		Missing:   []CorruptTile{},
+	}
+
+	ids := s.cs.imageRepo.Keys()
+	sort.Strings(ids)
+	for _, id := range ids {
+		err := s.scrubImage(ctx, id, &report)
+		if err != nil {
+			return report, err
+		}
+	}
+	report.Finished = time.Now()
+
+	s.mu.Lock()
+	s.report = report
+	s.mu.Unlock()
+	atomic.AddInt64(&s.runs, 1)
+
+	return report, nil
+}
+
+// scrubTile - проверяемый тайл набора тайлов tileSet с координатами (x; y).
+type scrubTile struct {
+	tileSet string
+	x, y    int
+}
+
+// scrubTiles возвращает тайлы всех наборов тайлов изображения img: текущие тайлы и копии тайлов ревизий.
+func scrubTiles(img *TiledImage) []scrubTile {
+	var tiles []scrubTile
+	for _, t := range img.Tiles() {
+		tiles = append(tiles, scrubTile{tileSet: img.tileSet(), x: t.Min.X, y: t.Min.Y})
+	}
+	for _, rev := range img.History {
+		for _, r := range img.revisionRegions(rev) {
+			tiles = append(tiles, scrubTile{tileSet: img.revisionTileSet(rev.Number), x: r.Min.X, y: r.Min.Y})
+		}
+	}
+	return tiles
+}
+
+// scrubImage проверяет тайлы всех наборов тайлов изображения id и дописывает поврежденные в report.
+// Возможна ошибка отмены ctx.
+func (s *Scrubber) scrubImage(ctx context.Context, id string, report *ScrubReport) error {
+	img, err := s.cs.GetImage(ctx, id)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Тайлы проверяются без блокировок, чтобы не задерживать запись фрагментов.
+	// Тайл, прочитанный одновременно с записью, может оказаться поврежденным, поэтому проверяется повторно.
+	tiles := scrubTiles(img)
+	var suspects []scrubTile
+	for _, t := range tiles {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		if s.verify(ctx, t) != nil {
+			suspects = append(suspects, t)
+		}
+	}
+	report.Images++
+	report.Tiles += len(tiles)
+
+	if len(suspects) == 0 {
+		return nil
+	}
+	return s.recheck(ctx, img, suspects, report)
+}
+
+// verify читает тайл t и возвращает ошибку чтения.
+func (s *Scrubber) verify(ctx context.Context, t scrubTile) error {
+	_, err := s.tiles.GetTile(ctx, t.tileSet, t.x, t.y)
+	return err
+}
+
+// recheck повторно проверяет тайлы suspects изображения old при запрещенной записи в изображение
+// и восстанавливает поврежденные и отсутствующие из снимка.
+// Если изображение удалено или его тайлы перестраиваются, проверка откладывается до следующего раза.
+func (s *Scrubber) recheck(ctx context.Context, old *TiledImage, suspects []scrubTile, report *ScrubReport) error {
+	lk := s.cs.locks.acquire(old.Id)
+	defer s.cs.locks.release(old.Id, lk)
+
+	// Запись запрещается так же, как на время перераскладки, начатые записи завершаются.
+	err := s.cs.locks.beginRetile(lk)
+	if errors.Is(err, ErrRetiling) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer s.cs.locks.endRetile(lk)
+
+	img, err := s.cs.GetImage(ctx, old.Id)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Наборы тайлов изображения могли смениться перераскладкой или сокращением истории.
+	current := make(map[string]bool)
+	for _, tileSet := range img.tileSets() {
+		current[tileSet] = true
+	}
+
+	if f, ok := s.cs.tileService.(imgstore.Flusher); ok {
+		err = f.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range suspects {
+		if !current[t.tileSet] {
+			continue
+		}
+
+		err = s.verify(ctx, t)
+		if err == nil {
+			continue
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		corrupt := CorruptTile{Image: img.Id, TileSet: t.tileSet, X: t.x, Y: t.y, Error: err.Error()}
+		if s.snapshot != nil {
+			restoreErr := s.restore(ctx, t)
+			if restoreErr != nil {
+				corrupt.RestoreError = restoreErr.Error()
+			} else {
+				corrupt.Restored = true
+				atomic.AddInt64(&s.restored, 1)
+			}
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			report.Missing = append(report.Missing, corrupt)
+		} else {
+			report.Corrupted = append(report.Corrupted, corrupt)
+		}
+	}
+	return nil
+}
+
+// restore заменяет тайл t копией из снимка, если копия не повреждена.
+// Тайл записывается через сервис тайлов, чтобы не остаться устаревшим в его кэше.
+func (s *Scrubber) restore(ctx context.Context, t scrubTile) error {
+	b, err := s.snapshot.GetTile(ctx, t.tileSet, t.x, t.y)
+	if err != nil {
+		return err
+	}
+	tile, err := s.cs.tileService.Decode(b)
+	if err != nil {
+		return err
+	}
+	return s.cs.tileService.SaveTile(ctx, t.tileSet, t.x, t.y, tile)
+}
+
+// Report возвращает результат последней завершенной проверки.
+// До первой проверки время Finished нулевое.
+func (s *Scrubber) Report() ScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.report
+}
+
+// Runs возвращает, сколько проверок завершено.
+func (s *Scrubber) Runs() int64 {
+	return atomic.LoadInt64(&s.runs)
+}
+
+// Restored возвращает, сколько тайлов восстановлено из снимка.
+func (s *Scrubber) Restored() int64 {
+	return atomic.LoadInt64(&s.restored)
+}
+
+// Close останавливает фоновую проверку и ожидает ее завершения.
+func (s *Scrubber) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+	return nil
+}
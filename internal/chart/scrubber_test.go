@@ -0,0 +1,206 @@
+package chart_test
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+)
+
+// corruptTile инвертирует последний байт тайла (x; y) изображения id в хранилище repo.
+func corruptTile(repo imgstore.Repository, id string, x, y int) {
+	b, err := repo.GetTile(ctx, id, x, y)
+	So(err, ShouldBeNil)
+	_, err = repo.WriteTileAt(ctx, id, x, y, []byte{^b[len(b)-1]}, int64(len(b)-1))
+	So(err, ShouldBeNil)
+}
+
+func TestScrubber(t *testing.T) {
+	Convey("Проверка целостности должна находить поврежденные тайлы и восстанавливать их из снимка", t, func() {
+		inner := imgstore.NewMemoryRepo(0)
+		tiles := imgstore.NewChecksumRepo(inner)
+		cs := chart.NewChartographerService(kvstore.NewInMemoryStore(), imgstore.NewBmpService(tiles),
+			&chart.ImageAdapter{}, 100, nil, 4, 0)
+
+		// Изображения 250x180 из 6 тайлов.
+		img1, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+		img2, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		red := color.RGBA{R: 0xFF, A: 0xFF}
+		fragment := image.NewRGBA(image.Rect(0, 0, 250, 180))
+		draw.Draw(fragment, fragment.Rect, image.NewUniform(red), image.Point{}, draw.Src)
+		So(cs.SetFragment(ctx, img1, 0, 0, fragment), ShouldBeNil)
+
+		// Снимок содержит копию тайлов только первого изображения.
+		snapshot := imgstore.NewChecksumRepo(imgstore.NewMemoryRepo(0))
+		for _, t := range img1.Tiles() {
+			b, err := tiles.GetTile(ctx, img1.Id, t.Min.X, t.Min.Y)
+			So(err, ShouldBeNil)
+			So(snapshot.SaveTile(ctx, img1.Id, t.Min.X, t.Min.Y, b), ShouldBeNil)
+		}
+
+		corruptTile(inner, img1.Id, 100, 0)
+		corruptTile(inner, img2.Id, 0, 100)
+
+		Convey("Без снимка поврежденные тайлы должны только попадать в отчет", func() {
+			s := chart.NewScrubber(cs, tiles, nil, 0)
+			defer s.Close()
+
+			report, err := s.Scrub(ctx)
+			So(err, ShouldBeNil)
+			So(report.Images, ShouldEqual, 2)
+			// 12 текущих тайлов и 6 копий ревизии первого изображения.
+			So(report.Tiles, ShouldEqual, 18)
+			So(report.Corrupted, ShouldHaveLength, 2)
+			for _, c := range report.Corrupted {
+				So(c.Restored, ShouldBeFalse)
+				So(c.Error, ShouldNotBeEmpty)
+			}
+			So(s.Report(), ShouldResemble, report)
+			So(s.Runs(), ShouldEqual, 1)
+
+			_, err = cs.GetFragment(ctx, img1, 100, 0, 10, 10)
+			So(errors.Is(err, imgstore.ErrChecksum), ShouldBeTrue)
+		})
+
+		Convey("Со снимком тайлы, копия которых есть в снимке, должны восстанавливаться", func() {
+			s := chart.NewScrubber(cs, tiles, snapshot, 0)
+			defer s.Close()
+
+			report, err := s.Scrub(ctx)
+			So(err, ShouldBeNil)
+			So(report.Corrupted, ShouldHaveLength, 2)
+			for _, c := range report.Corrupted {
+				if c.Image == img1.Id {
+					So(c.Restored, ShouldBeTrue)
+					So(image.Pt(c.X, c.Y), ShouldResemble, image.Pt(100, 0))
+				} else {
+					So(c.Restored, ShouldBeFalse)
+					So(c.RestoreError, ShouldNotBeEmpty)
+				}
+			}
+			So(s.Restored(), ShouldEqual, 1)
+
+			got, err := cs.GetFragment(ctx, img1, 0, 0, 250, 180)
+			So(err, ShouldBeNil)
+			So(got.At(150, 50), ShouldResemble, red)
+
+			report, err = s.Scrub(ctx)
+			So(err, ShouldBeNil)
+			So(report.Corrupted, ShouldHaveLength, 1)
+		})
+
+		Convey("Поврежденные и отсутствующие копии тайлов ревизий должны попадать в отчет", func() {
+			s := chart.NewScrubber(cs, tiles, nil, 0)
+			defer s.Close()
+
+			revSet := img1.Id + ".r1"
+			corruptTile(inner, revSet, 100, 100)
+			So(inner.DeleteImage(ctx, img2.Id), ShouldBeNil)
+
+			report, err := s.Scrub(ctx)
+			So(err, ShouldBeNil)
+			// Поврежденные тайлы второго изображения удалены вместе с остальными.
+			So(report.Corrupted, ShouldHaveLength, 2)
+			var corrupted []image.Point
+			for _, c := range report.Corrupted {
+				if c.TileSet == revSet {
+					corrupted = append(corrupted, image.Pt(c.X, c.Y))
+				}
+			}
+			So(corrupted, ShouldResemble, []image.Point{image.Pt(100, 100)})
+			So(report.Missing, ShouldHaveLength, 6)
+			for _, m := range report.Missing {
+				So(m.Image, ShouldEqual, img2.Id)
+			}
+		})
+
+		Convey("Фоновая проверка должна выполняться периодически до остановки", func() {
+			s := chart.NewScrubber(cs, tiles, nil, 10*time.Millisecond)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for s.Runs() < 2 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			So(s.Close(), ShouldBeNil)
+			So(s.Runs(), ShouldBeGreaterThanOrEqualTo, 2)
+			So(s.Report().Corrupted, ShouldHaveLength, 2)
+		})
+
+		Convey("Проверка, запущенная во время другой проверки, должна давать ErrScrubRunning", func() {
+			blocking := &TestBlockingRepo{Repository: tiles, started: make(chan struct{}), resume: make(chan struct{})}
+			s := chart.NewScrubber(cs, blocking, nil, 0)
+			defer s.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := s.Scrub(ctx)
+				done <- err
+			}()
+			<-blocking.started
+
+			_, err := s.Scrub(ctx)
+			So(errors.Is(err, chart.ErrScrubRunning), ShouldBeTrue)
+
+			close(blocking.resume)
+			So(<-done, ShouldBeNil)
+			So(s.Runs(), ShouldEqual, 1)
+
+			_, err = s.Scrub(ctx)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestScrubber_WriteBack(t *testing.T) {
+	Convey("Еще не сохраненные тайлы не должны считаться поврежденными или отсутствующими", t, func() {
+		inner := imgstore.NewMemoryRepo(0)
+		tiles := imgstore.NewChecksumRepo(inner)
+		writeBack := imgstore.NewWriteBackService(imgstore.NewBmpService(tiles), imgstore.WriteBackConfig{})
+		defer writeBack.Close()
+		cs := chart.NewChartographerService(kvstore.NewInMemoryStore(), imgstore.NewCachedService(writeBack, 1<<20),
+			&chart.ImageAdapter{}, 100, nil, 4, 0)
+
+		img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+		So(inner.Tiles(img.Id), ShouldEqual, 0)
+
+		s := chart.NewScrubber(cs, tiles, nil, 0)
+		defer s.Close()
+
+		report, err := s.Scrub(ctx)
+		So(err, ShouldBeNil)
+		So(report.Tiles, ShouldEqual, 6)
+		So(report.Corrupted, ShouldBeEmpty)
+		So(report.Missing, ShouldBeEmpty)
+		So(inner.Tiles(img.Id), ShouldEqual, 6)
+	})
+}
+
+// TestBlockingRepo приостанавливает первое чтение тайла до закрытия resume, сообщая о нем закрытием started.
+type TestBlockingRepo struct {
+	imgstore.Repository
+	started, resume chan struct{}
+	once            sync.Once
+}
+
+func (r *TestBlockingRepo) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	r.once.Do(func() {
+		close(r.started)
+		<-r.resume
+	})
+	return r.Repository.GetTile(ctx, id, x, y)
+}
@@ -1,17 +1,43 @@
 package chart
 
-import "image"
+import (
+	"context"
+	"image"
+
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+)
 
 // Service определяет бизнес логику обработки изображений.
+// Методы с параметром ctx прекращают работу при его отмене и возвращают ctx.Err().
 type Service interface {
-	AddImage(width, height int) (*TiledImage, error)
-	GetImage(id string) (*TiledImage, error)
-	DeleteImage(id string) error
+	// AddImage создает изображение, разделенное на тайлы раскладки layout.
+	AddImage(ctx context.Context, width, height int, layout tileutils.Layout) (*TiledImage, error)
+	GetImage(ctx context.Context, id string) (*TiledImage, error)
+	DeleteImage(ctx context.Context, id string) error
+	// Retile перестраивает тайлы изображения по раскладке layout, не прекращая чтение изображения.
+	Retile(ctx context.Context, id string, layout tileutils.Layout) (*TiledImage, error)
+
+	// Revert возвращает изображение к виду после ревизии to, записывая отмену новой ревизией.
+	Revert(ctx context.Context, id string, to int) (*TiledImage, error)
+	// Undo отменяет последнее изменение изображения, записывая отмену новой ревизией.
+	Undo(ctx context.Context, id string) (*TiledImage, error)
 
 	// SetFragment - восстановление (установка) фрагмента изображения.
-	SetFragment(img *TiledImage, x int, y int, fragment image.Image) error
-	GetFragment(img *TiledImage, x, y, width, height int) (image.Image, error)
+	SetFragment(ctx context.Context, img *TiledImage, x int, y int, fragment image.Image) error
+	GetFragment(ctx context.Context, img *TiledImage, x, y, width, height int) (image.Image, error)
+	// GetRevisionFragment возвращает фрагмент изображения в виде после ревизии revision.
+	GetRevisionFragment(ctx context.Context, img *TiledImage, revision, x, y, width, height int) (image.Image, error)
+	// ValidateFragment проверяет размер фрагмента и его пересечение с изображением.
+	ValidateFragment(img *TiledImage, x, y, width, height int) error
+	// Reserve резервирует память под фрагмент размера width x height и его тайлы на время обработки.
+	// Работать с фрагментом нужно через возвращенный контекст, тогда тайлы резервируются из этой памяти.
+	// Функцию release необходимо вызвать после окончания работы с фрагментом.
+	Reserve(ctx context.Context, width, height int) (reserved context.Context, release func(), err error)
 
 	Encode(img image.Image) ([]byte, error)
-	Decode(b []byte) (image.Image, error)
+	// Decode декодирует изображение и обрезает его до заявленного размера width x height.
+	Decode(b []byte, width, height int) (image.Image, error)
+	// DecodeConfig декодирует только заголовок изображения и проверяет размер
+	// на ограничения фрагмента и соответствие заявленному размеру width x height.
+	DecodeConfig(b []byte, width, height int) (image.Config, error)
 }
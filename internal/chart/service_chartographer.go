@@ -1,17 +1,20 @@
 package chart
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
 	"image"
 	"image/color"
-	"image/draw"
+	"log"
+	"time"
 
 	"github.com/google/uuid"
 
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
 	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
 	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/membudget"
 )
 
 type ChartographerService struct {
@@ -19,14 +22,29 @@ type ChartographerService struct {
 	tileService imgstore.Service
 	adapter     RectShifter
 	tileMaxSize int // Определяет максимальный размер тайла по ширине и высоте.
+	// budget ограничивает память под одновременно декодируемые фрагменты и тайлы. nil - без ограничения.
+	budget *membudget.Budget
+	// concurrency - сколько тайлов фрагмента обрабатывается одновременно. 1 и меньше - последовательно.
+	concurrency int
+	// maxRevisions - сколько последних ревизий хранится в истории изображения. 0 - без ограничения.
+	maxRevisions int
+	locks        *imageLocks
+	// pending - записываемые наборы тайлов, см. Collector.
+	pending *pendingTileSets
 }
 
-func NewChartographerService(imageRepo kvstore.Store, tileRepo imgstore.Service, adapter RectShifter, tileMaxSize int) *ChartographerService {
+func NewChartographerService(imageRepo kvstore.Store, tileRepo imgstore.Service, adapter RectShifter, tileMaxSize int,
+	budget *membudget.Budget, concurrency, maxRevisions int) *ChartographerService {
 	return &ChartographerService{
-		imageRepo:   imageRepo,
-		tileService: tileRepo,
-		adapter:     adapter,
-		tileMaxSize: tileMaxSize,
+		imageRepo:    imageRepo,
+		tileService:  tileRepo,
+		adapter:      adapter,
+		tileMaxSize:  tileMaxSize,
+		budget:       budget,
+		concurrency:  concurrency,
+		maxRevisions: maxRevisions,
+		locks:        newImageLocks(),
+		pending:      newPendingTileSets(),
 	}
 }
 
@@ -37,10 +55,12 @@ const (
 	maxHeight = 50_000
 )
 
-// AddImage разделяет размеры изображения на тайлы, создает image.RGBA изображения в соответствии с тайлами,
-// сохраняет тайлы с помощью репозитория тайлов.
-// Возможна ошибка типа *SizeError
-func (cs *ChartographerService) AddImage(width, height int) (*TiledImage, error) {
+// AddImage разделяет размеры изображения на тайлы раскладки layout, создает image.RGBA изображения
+// в соответствии с тайлами, сохраняет тайлы с помощью репозитория тайлов.
+// Метаданные изображения сохраняются после всех тайлов, поэтому недосозданное изображение недоступно.
+// При ошибке созданные тайлы удаляются, а если удалить их не удалось - их удалит сборщик мусора (Collector).
+// Возможны ошибки типа *SizeError и tileutils.ErrLayout.
+func (cs *ChartographerService) AddImage(ctx context.Context, width, height int, layout tileutils.Layout) (*TiledImage, error) {
 	if width < minWidth || width > maxWidth ||
 		height < minHeight || height > maxHeight {
 		return nil, &SizeError{
@@ -49,29 +69,147 @@ func (cs *ChartographerService) AddImage(width, height int) (*TiledImage, error)
 		}
 	}
 
-	tiles := tileutils.CreateTiles(width, height, cs.tileMaxSize)
+	grid, err := layout.Grid(width, height, cs.tileMaxSize)
+	if err != nil {
+		return nil, err
+	}
 
 	img := &TiledImage{
-		Id:          uuid.NewString(),
-		Width:       width,
-		Height:      height,
-		TileMaxSize: cs.tileMaxSize,
-		Tiles:       tiles,
+		Id:         uuid.NewString(),
+		Width:      width,
+		Height:     height,
+		Layout:     layout,
+		TileWidth:  grid.TileWidth,
+		TileHeight: grid.TileHeight,
 	}
-	cs.imageRepo.Add(img.Id, img)
 
-	for _, t := range img.Tiles {
-		i := newOpaqueRGBA(t)
+	cs.pending.add(img.tileSet())
+	defer cs.pending.remove(img.tileSet())
 
-		err := cs.tileService.SaveTile(img.Id, t.Min.X, t.Min.Y, i)
+	for _, t := range img.Tiles() {
+		err = ctx.Err()
+		if err == nil {
+			err = cs.createTile(ctx, img.tileSet(), t)
+		}
 		if err != nil {
+			cs.discardTiles(img.tileSet())
 			return nil, err
 		}
 	}
 
+	err = cs.imageRepo.Add(img.Id, img)
+	if err != nil {
+		cs.discardTiles(img.tileSet())
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// discardTiles удаляет тайлы tileSet, на которые не ссылаются метаданные.
+// ctx операции может быть уже отменен, поэтому тайлы удаляются без него.
+// Если удалить тайлы не удалось, их удалит сборщик мусора.
+func (cs *ChartographerService) discardTiles(tileSet string) {
+	_ = cs.tileService.DeleteImage(context.Background(), tileSet)
+}
+
+func (cs *ChartographerService) createTile(ctx context.Context, id string, t image.Rectangle) error {
+	release, err := cs.reserve(ctx, tileCost(t))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return cs.tileService.SaveTile(ctx, id, t.Min.X, t.Min.Y, newOpaqueRGBA(t))
+}
+
+// Retile перестраивает тайлы изображения id по раскладке layout с текущим максимальным размером тайла.
+// Новые тайлы записываются отдельно от старых, изображение в это время доступно для чтения,
+// а запись фрагментов и удаление отклоняются с ошибкой ErrRetiling.
+// После записи всех новых тайлов метаданные изображения заменяются, затем старые тайлы удаляются.
+// Копии тайлов ревизий относятся к старой сетке, поэтому тоже удаляются: прошлые ревизии становятся недоступны,
+// номер текущей ревизии сохраняется.
+// При ошибке новые тайлы удаляются, изображение остается прежним.
+// Возможны ошибки ErrNotExist, ErrRetiling, tileutils.ErrLayout и другие.
+func (cs *ChartographerService) Retile(ctx context.Context, id string, layout tileutils.Layout) (*TiledImage, error) {
+	lk := cs.locks.acquire(id)
+	defer cs.locks.release(id, lk)
+
+	err := cs.locks.beginRetile(lk)
+	if err != nil {
+		return nil, err
+	}
+	defer cs.locks.endRetile(lk)
+
+	old, err := cs.GetImage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	grid, err := layout.Grid(old.Width, old.Height, cs.tileMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &TiledImage{
+		Id:         old.Id,
+		Width:      old.Width,
+		Height:     old.Height,
+		Layout:     layout,
+		TileWidth:  grid.TileWidth,
+		TileHeight: grid.TileHeight,
+		TileSet:    uuid.NewString(),
+		Revision:   old.Revision,
+	}
+
+	cs.pending.add(img.tileSet())
+	defer cs.pending.remove(img.tileSet())
+
+	// Новые тайлы не пересекаются, поэтому их можно собирать параллельно.
+	err = forEachTile(ctx, img.Tiles(), cs.concurrency, func(ctx context.Context, t image.Rectangle) error {
+		return cs.copyTile(ctx, old, img.tileSet(), t)
+	})
+	if err != nil {
+		cs.discardTiles(img.tileSet())
+		return nil, err
+	}
+
+	// Замена метаданных ожидает завершения начатых чтений старых тайлов.
+	lk.tiles.Lock()
+	err = cs.imageRepo.Add(id, img)
+	lk.tiles.Unlock()
+	if err != nil {
+		cs.discardTiles(img.tileSet())
+		return nil, err
+	}
+
+	// Ошибка удаления старых тайлов не отменяет перераскладку: метаданные уже заменены.
+	for _, tileSet := range old.tileSets() {
+		cs.discardTiles(tileSet)
+	}
+
 	return img, nil
 }
 
+// copyTile собирает тайл t из пересекающихся с ним тайлов изображения old и сохраняет его в набор тайлов tileSet.
+func (cs *ChartographerService) copyTile(ctx context.Context, old *TiledImage, tileSet string, t image.Rectangle) error {
+	release, err := cs.reserve(ctx, tileCost(t))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tile := image.NewRGBA(t)
+	for _, oldTile := range old.OverlappedTiles(t) {
+		err = cs.getTileFragment(ctx, old.tileSet(), oldTile, tile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cs.tileService.SaveTile(ctx, tileSet, t.Min.X, t.Min.Y, tile)
+}
+
 // newOpaqueRGBA создает image.RGBA и устанавливает alpha-канал максимальным значением.
 // Таким образом, изображение в дальнейшем будет кодироваться без учета альфа канала (24-бит на пиксель).
 func newOpaqueRGBA(r image.Rectangle) image.Image {
@@ -86,10 +224,29 @@ func newOpaqueRGBA(r image.Rectangle) image.Image {
 	return img
 }
 
-// DeleteImage - удаление изображения по id.
-// Возможна ошибка ErrNotExist и другие.
-func (cs *ChartographerService) DeleteImage(id string) error {
-	err := cs.imageRepo.Delete(id)
+// DeleteImage - удаление изображения по id. Сначала удаляются метаданные, затем тайлы и копии тайлов ревизий.
+// Ошибка удаления метаданных оставляет изображение прежним.
+// Возможны ошибки ErrNotExist, ErrRetiling и другие.
+func (cs *ChartographerService) DeleteImage(ctx context.Context, id string) error {
+	lk := cs.locks.acquire(id)
+	defer cs.locks.release(id, lk)
+
+	err := cs.locks.beginWrite(lk)
+	if err != nil {
+		return err
+	}
+	defer cs.locks.endWrite(lk)
+
+	// Запись фрагмента, ожидающая удаления, не должна вернуть метаданные изображения.
+	lk.history.Lock()
+	defer lk.history.Unlock()
+
+	img, err := cs.GetImage(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = cs.imageRepo.Delete(id)
 	if err != nil {
 		if errors.Is(err, kvstore.ErrNotExist) {
 			return ErrNotExist
@@ -98,9 +255,13 @@ func (cs *ChartographerService) DeleteImage(id string) error {
 		return err
 	}
 
-	err = cs.tileService.DeleteImage(id)
-	if err != nil {
-		return err
+	// Метаданные удалены, изображение больше недоступно, поэтому ошибка удаления тайлов не возвращается:
+	// оставшиеся тайлы удалит сборщик мусора.
+	for _, tileSet := range img.tileSets() {
+		err = cs.tileService.DeleteImage(context.Background(), tileSet)
+		if err != nil {
+			log.Printf("удаление тайлов изображения %s: %v", id, err)
+		}
 	}
 
 	return nil
@@ -112,10 +273,40 @@ func (cs *ChartographerService) DeleteImage(id string) error {
 //
 // Меняется существующий массив байт изображения, это производительнее чем создавать абсолютно новое изображение.
 //
+// Каждая запись - новая ревизия изображения: перед записью изменяемая часть тайлов копируется в набор тайлов ревизии,
+// после записи ревизия добавляется в историю метаданных. Фрагменты одного изображения записываются по одному.
+// Если запись тайлов прервалась ошибкой, тайлы возвращаются к прежнему виду из копий, а ревизия не добавляется.
+//
 // Примечание:
 // если фрагмент частично выходит за границы изображения, то часть фрагмента вне изображения игнорируется.
-// Возможна ошибка ErrNotOverlaps и другие.
-func (cs *ChartographerService) SetFragment(img *TiledImage, x int, y int, fragment image.Image) error {
+// Возможны ошибки ErrNotExist, ErrNotOverlaps, ErrRetiling и другие.
+func (cs *ChartographerService) SetFragment(ctx context.Context, img *TiledImage, x int, y int, fragment image.Image) error {
+	lk := cs.locks.acquire(img.Id)
+	defer cs.locks.release(img.Id, lk)
+
+	err := cs.locks.beginWrite(lk)
+	if err != nil {
+		return err
+	}
+	defer cs.locks.endWrite(lk)
+
+	lk.tiles.RLock()
+	defer lk.tiles.RUnlock()
+
+	lk.history.Lock()
+	defer lk.history.Unlock()
+
+	// Изображение могло быть удалено, а его история - дополниться, пока запись ожидала очереди.
+	_, err = cs.imageRepo.Get(img.Id)
+	if err != nil {
+		if errors.Is(err, kvstore.ErrNotExist) {
+			return ErrNotExist
+		}
+
+		return err
+	}
+	img = cs.current(img)
+
 	cs.adapter.ShiftRect(fragment, x, y)
 
 	imgRect := image.Rect(0, 0, img.Width, img.Height)
@@ -124,24 +315,223 @@ func (cs *ChartographerService) SetFragment(img *TiledImage, x int, y int, fragm
 		return ErrNotOverlaps
 	}
 
-	overlapped := tileutils.OverlappedTiles(img.Tiles, fragment.Bounds())
-	for _, t := range overlapped {
-		tileImg, err := cs.tileService.GetTile(img.Id, t.Min.X, t.Min.Y)
+	changed := imgRect.Intersect(fragment.Bounds())
+	_, err = cs.writeRevision(ctx, img, changed, img.OverlappedTiles(changed), nil,
+		func(ctx context.Context, t image.Rectangle) error {
+			return cs.setTileFragment(ctx, img.tileSet(), t, fragment)
+		})
+	return err
+}
+
+// writeRevision записывает новую ревизию изображения img, изменяющую часть changed в тайлах tiles:
+// копирует пересечения тайлов с changed в набор тайлов ревизии, изменяет каждый тайл функцией write
+// и добавляет ревизию в историю. revertTo - для отмены номер ревизии, к виду после которой возвращается изображение,
+// иначе nil. Возвращает новые метаданные.
+//
+// Если изменение тайлов прервалось ошибкой, тайлы восстанавливаются из копий и ревизия не добавляется.
+// Если не удалось и восстановление, ревизия добавляется: часть тайлов могла измениться, и ее можно отменить.
+// Ревизии сверх maxRevisions удаляются из истории вместе с копиями, не удаленные копии удалит Collector.
+// Вызывается под блокировкой истории изображения.
+func (cs *ChartographerService) writeRevision(ctx context.Context, img *TiledImage, changed image.Rectangle,
+	tiles []image.Rectangle, revertTo *int, write func(ctx context.Context, t image.Rectangle) error) (*TiledImage, error) {
+	rev := Revision{
+		Number:   img.Revision + 1,
+		Time:     time.Now(),
+		X:        changed.Min.X,
+		Y:        changed.Min.Y,
+		Width:    changed.Dx(),
+		Height:   changed.Dy(),
+		Tiles:    make([]TilePoint, 0, len(tiles)),
+		RevertTo: revertTo,
+	}
+	for _, t := range tiles {
+		rev.Tiles = append(rev.Tiles, TilePoint{X: t.Min.X, Y: t.Min.Y})
+	}
+
+	revSet := img.revisionTileSet(rev.Number)
+	cs.pending.add(revSet)
+	defer cs.pending.remove(revSet)
+
+	// Тайлы не пересекаются, поэтому их можно копировать и изменять параллельно.
+	err := forEachTile(ctx, tiles, cs.concurrency, func(ctx context.Context, t image.Rectangle) error {
+		return cs.copyTileRegion(ctx, img.tileSet(), t, t.Intersect(changed), revSet)
+	})
+	if err != nil {
+		cs.discardTiles(revSet)
+		return nil, err
+	}
+
+	writeErr := forEachTile(ctx, tiles, cs.concurrency, write)
+	if writeErr != nil {
+		// Запрос мог быть отменен, а восстановление нельзя прерывать.
+		err = forEachTile(detach(ctx), tiles, cs.concurrency, func(ctx context.Context, t image.Rectangle) error {
+			return cs.restoreTileRegion(ctx, img.tileSet(), t, t.Intersect(changed), revSet)
+		})
+		if err == nil {
+			cs.discardTiles(revSet)
+			return nil, writeErr
+		}
+	}
+
+	updated, dropped := img.withRevision(rev).trimHistory(cs.maxRevisions)
+	err = cs.imageRepo.Add(img.Id, updated)
+	if err != nil {
+		cs.discardTiles(revSet)
+		if writeErr != nil {
+			return nil, writeErr
+		}
+		return nil, err
+	}
+
+	// Прошлые ревизии читаются под блокировкой истории, поэтому копии удаленных ревизий никто не читает.
+	for _, old := range dropped {
+		cs.discardTiles(img.revisionTileSet(old.Number))
+	}
+
+	return updated, writeErr
+}
+
+// copyTileRegion сохраняет часть r тайла t из набора тайлов tileSet в набор тайлов dst под координатами r.Min.
+func (cs *ChartographerService) copyTileRegion(ctx context.Context, tileSet string, t, r image.Rectangle, dst string) error {
+	// Резервируется весь тайл: хранилище может декодировать его целиком, например, в формате BMP.
+	release, err := cs.reserve(ctx, tileCost(t))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	region := image.NewRGBA(r)
+	err = cs.tileService.ReadTileRegion(ctx, tileSet, t.Min.X, t.Min.Y, r, region)
+	if err != nil {
+		return err
+	}
+
+	return cs.tileService.SaveTile(ctx, dst, r.Min.X, r.Min.Y, region)
+}
+
+// restoreTileRegion записывает в часть r тайла t набора тайлов tileSet ее копию из набора тайлов src,
+// сохраненную copyTileRegion.
+func (cs *ChartographerService) restoreTileRegion(ctx context.Context, tileSet string, t, r image.Rectangle, src string) error {
+	release, err := cs.reserve(ctx, tileCost(t))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	region := image.NewRGBA(r)
+	err = cs.tileService.ReadTileRegion(ctx, src, r.Min.X, r.Min.Y, r, region)
+	if err != nil {
+		return err
+	}
+
+	return cs.tileService.WriteTileRegion(ctx, tileSet, t.Min.X, t.Min.Y, r, region)
+}
+
+// Revert возвращает изображение id к виду после ревизии to: части тайлов, измененные после нее,
+// собираются из копий, сохраненных перед изменениями, и записываются в тайлы.
+// Отмена записывается как новая ревизия, поэтому ее тоже можно отменить.
+// Возвращает новые метаданные изображения.
+// Возможны ошибки ErrNotExist, ErrRevisionNotExist, ErrRetiling и другие.
+func (cs *ChartographerService) Revert(ctx context.Context, id string, to int) (*TiledImage, error) {
+	return cs.revert(ctx, id, func(img *TiledImage) (int, error) {
+		if !img.hasRevision(to) {
+			return 0, ErrRevisionNotExist
+		}
+		return to, nil
+	})
+}
+
+// Undo отменяет последнее изменение изображения id, см. TiledImage.undoTarget.
+// Возвращает новые метаданные изображения.
+// Возможны ошибки ErrNotExist, ErrNothingToUndo, ErrRetiling и другие.
+func (cs *ChartographerService) Undo(ctx context.Context, id string) (*TiledImage, error) {
+	return cs.revert(ctx, id, (*TiledImage).undoTarget)
+}
+
+// revert возвращает изображение id к виду после ревизии, которую выбирает target по актуальным метаданным.
+// Измененной частью ревизии отмены считается прямоугольник, охватывающий все части, измененные после ревизии.
+func (cs *ChartographerService) revert(ctx context.Context, id string,
+	target func(img *TiledImage) (int, error)) (*TiledImage, error) {
+	lk := cs.locks.acquire(id)
+	defer cs.locks.release(id, lk)
+
+	err := cs.locks.beginWrite(lk)
+	if err != nil {
+		return nil, err
+	}
+	defer cs.locks.endWrite(lk)
+
+	lk.tiles.RLock()
+	defer lk.tiles.RUnlock()
+
+	lk.history.Lock()
+	defer lk.history.Unlock()
+
+	img, err := cs.GetImage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := target(img)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := img.laterChanges(to)
+	var changed image.Rectangle
+	for _, r := range changes {
+		changed = changed.Union(r)
+	}
+	var tiles []image.Rectangle
+	for _, t := range img.OverlappedTiles(changed) {
+		for _, r := range changes {
+			if t.Overlaps(r) {
+				tiles = append(tiles, t)
+				break
+			}
+		}
+	}
+
+	return cs.writeRevision(ctx, img, changed, tiles, &to, func(ctx context.Context, t image.Rectangle) error {
+		release, err := cs.reserve(ctx, tileCost(t))
 		if err != nil {
 			return err
 		}
+		defer release()
 
-		cs.adapter.ShiftRect(tileImg, t.Min.X, t.Min.Y)
+		r := t.Intersect(changed)
+		region := image.NewRGBA(r)
+		err = cs.readRevisionRegion(ctx, img, to, t, region)
+		if err != nil {
+			return err
+		}
+
+		return cs.tileService.WriteTileRegion(ctx, img.tileSet(), t.Min.X, t.Min.Y, r, region)
+	})
+}
 
-		mutableTile, ok := tileImg.(draw.Image)
-		if !ok {
-			return errors.New("изображение должно реализовывать draw.Image")
+// readRevisionRegion копирует во фрагмент пересекающуюся с ним часть тайла t в виде после ревизии n:
+// сначала из текущих тайлов, затем поверх - части, сохраненные перед каждой более поздней ревизией,
+// от поздних ревизий к ранним. Вызывающий резервирует память под тайл t.
+func (cs *ChartographerService) readRevisionRegion(ctx context.Context, img *TiledImage, n int, t image.Rectangle,
+	fragment *image.RGBA) error {
+	err := cs.tileService.ReadTileRegion(ctx, img.tileSet(), t.Min.X, t.Min.Y, t.Intersect(fragment.Bounds()), fragment)
+	if err != nil {
+		return err
+	}
+
+	for _, rev := range img.reversedHistory() {
+		if rev.Number <= n {
+			break
 		}
 
-		intersect := t.Intersect(fragment.Bounds())
-		draw.Draw(mutableTile, intersect, fragment, intersect.Bounds().Min, draw.Src)
+		saved := t.Intersect(rev.rect())
+		r := saved.Intersect(fragment.Bounds())
+		if r.Empty() {
+			continue
+		}
 
-		err = cs.tileService.SaveTile(img.Id, t.Min.X, t.Min.Y, mutableTile)
+		err = cs.tileService.ReadTileRegion(ctx, img.revisionTileSet(rev.Number), saved.Min.X, saved.Min.Y, r, fragment)
 		if err != nil {
 			return err
 		}
@@ -150,6 +540,19 @@ func (cs *ChartographerService) SetFragment(img *TiledImage, x int, y int, fragm
 	return nil
 }
 
+// setTileFragment накладывает на тайл t пересекающуюся с ним часть фрагмента.
+func (cs *ChartographerService) setTileFragment(ctx context.Context, id string, t image.Rectangle, fragment image.Image) error {
+	// Резервируется весь тайл: хранилище может декодировать его целиком, например, в формате BMP.
+	release, err := cs.reserve(ctx, tileCost(t))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	intersect := t.Intersect(fragment.Bounds())
+	return cs.tileService.WriteTileRegion(ctx, id, t.Min.X, t.Min.Y, intersect, fragment)
+}
+
 const (
 	fragmentMinWidth  = 1
 	fragmentMinHeight = 1
@@ -157,46 +560,211 @@ const (
 	fragmentMaxHeight = 5_000
 )
 
-// GetFragment возвращает фрагмент изображения id, начиная с координат изобржаения (x; y) по ширине width и высоте height.
-// Возвращаемое изображение будет иметь начальные координаты (x; y).
-// Примечание: часть фрагмента вне границ изображения будет иметь чёрный цвет (цвет по умолчанию).
-// Возможны ошибки SizeError, ErrNotOverlaps и другие.
-func (cs *ChartographerService) GetFragment(img *TiledImage, x, y, width, height int) (image.Image, error) {
+func checkFragmentSize(width, height int) error {
 	if width < fragmentMinWidth || width > fragmentMaxWidth ||
 		height < fragmentMinHeight || height > fragmentMaxHeight {
-		return nil, &SizeError{
+		return &SizeError{
 			minWidth: fragmentMinWidth, width: width, maxWidth: fragmentMaxWidth,
 			minHeight: fragmentMinHeight, height: height, maxHeight: fragmentMaxHeight,
 		}
 	}
 
+	return nil
+}
+
+// ValidateFragment проверяет, что размер фрагмента width x height не выходит за ограничения
+// и фрагмент с координатами (x; y) пересекается с изображением.
+// Возможны ошибки SizeError, ErrNotOverlaps.
+func (cs *ChartographerService) ValidateFragment(img *TiledImage, x, y, width, height int) error {
+	err := checkFragmentSize(width, height)
+	if err != nil {
+		return err
+	}
+
 	imgRect := image.Rect(0, 0, img.Width, img.Height)
 	fragmentRect := image.Rect(x, y, x+width, y+height)
 	if !imgRect.Overlaps(fragmentRect) {
-		return nil, ErrNotOverlaps
+		return ErrNotOverlaps
 	}
 
-	fragment := image.NewRGBA(fragmentRect)
-	overlapped := tileutils.OverlappedTiles(img.Tiles, fragment.Bounds())
+	return nil
+}
 
-	for _, t := range overlapped {
-		tileImg, err := cs.tileService.GetTile(img.Id, t.Min.X, t.Min.Y)
+// GetFragment возвращает фрагмент изображения id, начиная с координат изобржаения (x; y) по ширине width и высоте height.
+// Возвращаемое изображение будет иметь начальные координаты (x; y).
+// Примечание: часть фрагмента вне границ изображения будет иметь чёрный цвет (цвет по умолчанию).
+// Возможны ошибки SizeError, ErrNotOverlaps и другие.
+func (cs *ChartographerService) GetFragment(ctx context.Context, img *TiledImage, x, y, width, height int) (image.Image, error) {
+	err := cs.ValidateFragment(img, x, y, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	lk := cs.locks.acquire(img.Id)
+	defer cs.locks.release(img.Id, lk)
+
+	lk.tiles.RLock()
+	defer lk.tiles.RUnlock()
+	img = cs.current(img)
+
+	fragment := image.NewRGBA(image.Rect(x, y, x+width, y+height))
+	overlapped := img.OverlappedTiles(fragment.Bounds())
+
+	// Тайлы копируются в непересекающиеся части фрагмента, поэтому их можно обрабатывать параллельно.
+	err = forEachTile(ctx, overlapped, cs.concurrency, func(ctx context.Context, t image.Rectangle) error {
+		return cs.getTileFragment(ctx, img.tileSet(), t, fragment)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fragment, nil
+}
+
+// GetRevisionFragment возвращает фрагмент изображения в виде после ревизии revision, параметры как у GetFragment.
+// Части тайлов, измененные после ревизии, читаются из копий, сохраненных перед изменениями, остальные - из текущих тайлов.
+// Чтение ожидает завершения записи фрагментов в изображение.
+// Возможны ошибки ErrRevisionNotExist, SizeError, ErrNotOverlaps и другие.
+func (cs *ChartographerService) GetRevisionFragment(ctx context.Context, img *TiledImage, revision, x, y, width, height int) (image.Image, error) {
+	err := cs.ValidateFragment(img, x, y, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	lk := cs.locks.acquire(img.Id)
+	defer cs.locks.release(img.Id, lk)
+
+	lk.tiles.RLock()
+	defer lk.tiles.RUnlock()
+
+	lk.history.Lock()
+	defer lk.history.Unlock()
+	img = cs.current(img)
+
+	if !img.hasRevision(revision) {
+		return nil, ErrRevisionNotExist
+	}
+
+	fragment := image.NewRGBA(image.Rect(x, y, x+width, y+height))
+	overlapped := img.OverlappedTiles(fragment.Bounds())
+
+	err = forEachTile(ctx, overlapped, cs.concurrency, func(ctx context.Context, t image.Rectangle) error {
+		release, err := cs.reserve(ctx, tileCost(t))
 		if err != nil {
-			return nil, err
+			return err
 		}
+		defer release()
 
-		cs.adapter.ShiftRect(tileImg, t.Min.X, t.Min.Y)
-
-		intersect := t.Intersect(fragment.Bounds())
-		draw.Draw(fragment, intersect, tileImg, intersect.Min, draw.Src)
+		return cs.readRevisionRegion(ctx, img, revision, t, fragment)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return fragment, nil
 }
 
+// getTileFragment копирует во фрагмент пересекающуюся с ним часть тайла t.
+func (cs *ChartographerService) getTileFragment(ctx context.Context, id string, t image.Rectangle, fragment *image.RGBA) error {
+	release, err := cs.reserve(ctx, tileCost(t))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	intersect := t.Intersect(fragment.Bounds())
+	return cs.tileService.ReadTileRegion(ctx, id, t.Min.X, t.Min.Y, intersect, fragment)
+}
+
+// Оценка памяти на пиксель: декодированный image.RGBA и закодированные 24-битные байты.
+const (
+	rgbaPixelSize    = 4
+	encodedPixelSize = 3
+)
+
+func pixelsCost(width, height int) int64 {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+
+	return int64(width) * int64(height) * (rgbaPixelSize + encodedPixelSize)
+}
+
+func tileCost(t image.Rectangle) int64 {
+	return pixelsCost(t.Dx(), t.Dy())
+}
+
+// reservationKey - ключ контекста, под которым Reserve передает память, зарезервированную под тайлы запроса.
+type reservationKey struct{}
+
+// Reserve резервирует в бюджете память под фрагмент размера width x height и под тайлы,
+// которые одновременно обрабатываются при работе с ним.
+// Тайлы запроса резервируются из этой памяти через возвращенный контекст, а не из общего бюджета:
+// иначе запросы, удерживающие память под фрагменты, могли бы бесконечно ждать друг друга.
+// Размер проверяется на те же ограничения, что и в GetFragment.
+// Возможны ошибки SizeError и ErrBusy.
+func (cs *ChartographerService) Reserve(ctx context.Context, width, height int) (context.Context, func(), error) {
+	err := checkFragmentSize(width, height)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cs.budget == nil {
+		return ctx, func() {}, nil
+	}
+
+	tiles := cs.tilesCost()
+	release, err := reserve(ctx, cs.budget, pixelsCost(width, height)+tiles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Тайлы резервирует не больше concurrency обработчиков одновременно, поэтому ждать памяти им не нужно.
+	return context.WithValue(ctx, reservationKey{}, membudget.NewBudget(tiles, 0)), release, nil
+}
+
+// tilesCost возвращает память под тайлы, которые обрабатываются одновременно.
+// Тайл любой раскладки не больше tileMaxSize x tileMaxSize.
+func (cs *ChartographerService) tilesCost() int64 {
+	workers := cs.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	return int64(workers) * pixelsCost(cs.tileMaxSize, cs.tileMaxSize)
+}
+
+// reserve резервирует память под тайл: из резерва запроса, если он сделан через Reserve, иначе из общего бюджета.
+func (cs *ChartographerService) reserve(ctx context.Context, n int64) (release func(), err error) {
+	budget, ok := ctx.Value(reservationKey{}).(*membudget.Budget)
+	if !ok {
+		budget = cs.budget
+	}
+
+	return reserve(ctx, budget, n)
+}
+
+func reserve(ctx context.Context, budget *membudget.Budget, n int64) (release func(), err error) {
+	err = budget.Reserve(ctx, n)
+	if err != nil {
+		if errors.Is(err, membudget.ErrExhausted) {
+			return nil, ErrBusy
+		}
+
+		return nil, err
+	}
+
+	return func() { budget.Release(n) }, nil
+}
+
+// detach возвращает контекст без отмены, сохраняющий резерв памяти запроса.
+func detach(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), reservationKey{}, ctx.Value(reservationKey{}))
+}
+
 // GetImage - получение изображения по id.
 // Возможна ошибка ErrNotExist и другие.
-func (cs *ChartographerService) GetImage(id string) (*TiledImage, error) {
+func (cs *ChartographerService) GetImage(ctx context.Context, id string) (*TiledImage, error) {
 	i, err := cs.imageRepo.Get(id)
 	if err != nil {
 		if errors.Is(err, kvstore.ErrNotExist) {
@@ -214,10 +782,91 @@ func (cs *ChartographerService) GetImage(id string) (*TiledImage, error) {
 	return img, nil
 }
 
+// current возвращает актуальные метаданные изображения img.
+// Метаданные, полученные до перераскладки тайлов, ссылаются на удаленные тайлы, поэтому перечитываются.
+// Вызывается под блокировкой тайлов изображения.
+func (cs *ChartographerService) current(img *TiledImage) *TiledImage {
+	i, err := cs.imageRepo.Get(img.Id)
+	if err != nil {
+		return img
+	}
+
+	stored, ok := i.(*TiledImage)
+	if !ok || stored == nil {
+		return img
+	}
+	return stored
+}
+
 func (cs *ChartographerService) Encode(img image.Image) ([]byte, error) {
 	return cs.tileService.Encode(img)
 }
 
-func (cs *ChartographerService) Decode(b []byte) (image.Image, error) {
-	return cs.tileService.Decode(b)
+// Decode декодирует фрагмент и обрезает его до заявленного размера width x height,
+// оставляя левую верхнюю часть изображения.
+// До выделения памяти под пиксели проверяется заголовок, см. DecodeConfig.
+// Возможны ошибки ErrFormat, SizeError, DeclaredSizeError.
+func (cs *ChartographerService) Decode(b []byte, width, height int) (image.Image, error) {
+	config, err := cs.DecodeConfig(b, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := cs.tileService.Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+
+	if config.Width == width && config.Height == height {
+		return img, nil
+	}
+
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return nil, fmt.Errorf("%w: обрезка изображения %T не поддерживается", ErrFormat, img)
+	}
+
+	crop := image.Rect(0, 0, width, height).Add(img.Bounds().Min)
+	return sub.SubImage(crop), nil
+}
+
+// DecodeConfig декодирует заголовок фрагмента и проверяет, что размер в заголовке
+// не выходит за ограничения фрагмента и не меньше заявленного width x height.
+// Изображение больше заявленного размера допустимо, Decode обрежет его.
+// Возможны ошибки ErrFormat, SizeError, DeclaredSizeError.
+func (cs *ChartographerService) DecodeConfig(b []byte, width, height int) (image.Config, error) {
+	err := checkFragmentSize(width, height)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	config, err := cs.decodeConfig(b)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	if config.Width < width || config.Height < height {
+		return image.Config{}, &DeclaredSizeError{
+			declaredWidth: width, declaredHeight: height,
+			width: config.Width, height: config.Height,
+		}
+	}
+
+	return config, nil
+}
+
+func (cs *ChartographerService) decodeConfig(b []byte) (image.Config, error) {
+	config, err := cs.tileService.DecodeConfig(b)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+
+	err = checkFragmentSize(config.Width, config.Height)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return config, nil
 }
@@ -1,43 +1,46 @@
 package chart_test
 
 import (
+	"context"
 	"errors"
 	"image"
 	"image/color"
+	"image/draw"
+	"math/rand"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 
 	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
 	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/fault"
 	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/membudget"
 )
 
+var ctx = context.Background()
+
 // region Создание изображения
 
-// TestTileService - заглушка (stub)
-type tileKey struct {
-	x, y int
-}
+// TestTileService - сервис тайлов в формате BMP над хранилищем в памяти.
 type TestTileService struct {
 	imgstore.Service
-	images map[string]map[tileKey]image.Image
+	repo *imgstore.MemoryRepository
 }
 
-func (r *TestTileService) GetTile(id string, x int, y int) (image.Image, error) {
-	return r.images[id][tileKey{x: x, y: y}], nil
+func newTestTileService() *TestTileService {
+	repo := imgstore.NewMemoryRepo(0)
+	return &TestTileService{Service: imgstore.NewBmpService(repo), repo: repo}
 }
-func (r *TestTileService) SaveTile(id string, x int, y int, img image.Image) error {
-	_, ok := r.images[id]
-	if !ok {
-		r.images[id] = make(map[tileKey]image.Image)
-	}
-	r.images[id][tileKey{x: x, y: y}] = img
-	return nil
-}
-func (r *TestTileService) DeleteImage(id string) error {
-	delete(r.images, id)
-	return nil
+
+// pixel возвращает цвет пикселя (x; y) изображения id из сохраненного тайла с началом (tileX; tileY).
+func (s *TestTileService) pixel(id string, tileX, tileY, x, y int) color.RGBA {
+	tile, err := s.GetTile(ctx, id, tileX, tileY)
+	So(err, ShouldBeNil)
+	return color.RGBAModel.Convert(tile.At(x-tileX, y-tileY)).(color.RGBA)
 }
 
 //TestImageRepo - заглушка (stub)
@@ -46,8 +49,9 @@ type TestImageRepo struct {
 	images map[string]*chart.TiledImage
 }
 
-func (r *TestImageRepo) Add(key string, value interface{}) {
+func (r *TestImageRepo) Add(key string, value interface{}) error {
 	r.images[key] = value.(*chart.TiledImage)
+	return nil
 }
 
 func (r *TestImageRepo) Get(key string) (interface{}, error) {
@@ -62,13 +66,19 @@ type TestTileServiceEmpty struct {
 	imgstore.Service
 }
 
-func (s TestTileServiceEmpty) SaveTile(string, int, int, image.Image) error {
+func (s TestTileServiceEmpty) SaveTile(context.Context, string, int, int, image.Image) error {
 	return nil
 }
-func (s TestTileServiceEmpty) GetTile(string, int, int) (image.Image, error) {
+func (s TestTileServiceEmpty) GetTile(context.Context, string, int, int) (image.Image, error) {
 	return nil, nil
 }
-func (s TestTileServiceEmpty) DeleteImage(string) error {
+func (s TestTileServiceEmpty) ReadTileRegion(context.Context, string, int, int, image.Rectangle, *image.RGBA) error {
+	return nil
+}
+func (s TestTileServiceEmpty) WriteTileRegion(context.Context, string, int, int, image.Rectangle, image.Image) error {
+	return nil
+}
+func (s TestTileServiceEmpty) DeleteImage(context.Context, string) error {
 	return nil
 }
 
@@ -80,7 +90,7 @@ func TestNewRGBA(t *testing.T) {
 	imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
 	tileRepo := &TestTileServiceEmpty{}
 	tileMaxSize := 1000
-	chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, tileMaxSize)
+	chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, tileMaxSize, nil, 1, 0)
 
 	Convey("init", t, func() {
 		const (
@@ -93,7 +103,7 @@ func TestNewRGBA(t *testing.T) {
 		// Позитивные тесты
 
 		testSize := func(width, height int) {
-			img, err := chartService.AddImage(width, height)
+			img, err := chartService.AddImage(ctx, width, height, tileutils.Layout{})
 			So(err, ShouldBeNil)
 
 			So(img.Width, ShouldEqual, width)
@@ -111,24 +121,93 @@ func TestNewRGBA(t *testing.T) {
 		var errSize *chart.SizeError
 
 		Convey("test minWidth-1", func() {
-			_, err := chartService.AddImage(minWidth-1, 1)
+			_, err := chartService.AddImage(ctx, minWidth-1, 1, tileutils.Layout{})
 			So(errors.As(err, &errSize), ShouldBeTrue)
 		})
 		Convey("test minHeight-1", func() {
-			_, err := chartService.AddImage(1, minHeight-1)
+			_, err := chartService.AddImage(ctx, 1, minHeight-1, tileutils.Layout{})
 			So(errors.As(err, &errSize), ShouldBeTrue)
 		})
 		Convey("test maxWidth+1", func() {
-			_, err := chartService.AddImage(maxWidth+1, 1)
+			_, err := chartService.AddImage(ctx, maxWidth+1, 1, tileutils.Layout{})
 			So(errors.As(err, &errSize), ShouldBeTrue)
 		})
 		Convey("test maxHeight+1", func() {
-			_, err := chartService.AddImage(1, maxHeight+1)
+			_, err := chartService.AddImage(ctx, 1, maxHeight+1, tileutils.Layout{})
 			So(errors.As(err, &errSize), ShouldBeTrue)
 		})
 	})
 }
 
+func TestAddImage_Layout(t *testing.T) {
+	const (
+		width       = 25
+		height      = 12
+		tileMaxSize = 10
+	)
+
+	Convey("Тайлы изображения должны соответствовать раскладке, выбранной при создании", t, func() {
+		for _, tc := range []struct {
+			layout                tileutils.Layout
+			tileWidth, tileHeight int
+			tiles                 int
+		}{
+			{layout: tileutils.Layout{}, tileWidth: 10, tileHeight: 10, tiles: 6},
+			{layout: tileutils.Layout{Kind: tileutils.LayoutRect, TileWidth: 20, TileHeight: 5}, tileWidth: 20, tileHeight: 5, tiles: 6},
+			{layout: tileutils.Layout{Kind: tileutils.LayoutStrip}, tileWidth: 25, tileHeight: 4, tiles: 3},
+			{layout: tileutils.Layout{Kind: tileutils.LayoutAdaptive}, tileWidth: 9, tileHeight: 6, tiles: 6},
+		} {
+			imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+			tileRepo := newTestTileService()
+			chartService := chart.NewChartographerService(imageRepo, tileRepo, &chart.ImageAdapter{}, tileMaxSize, nil, 1, 0)
+
+			img, err := chartService.AddImage(ctx, width, height, tc.layout)
+			So(err, ShouldBeNil)
+			So(img.Layout, ShouldResemble, tc.layout)
+			So(img.TileWidth, ShouldEqual, tc.tileWidth)
+			So(img.TileHeight, ShouldEqual, tc.tileHeight)
+			So(tileRepo.repo.Tiles(img.Id), ShouldEqual, tc.tiles)
+
+			fragment := image.NewRGBA(image.Rect(0, 0, 7, 7))
+			for y := 0; y < 7; y++ {
+				for x := 0; x < 7; x++ {
+					fragment.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 0xFF})
+				}
+			}
+			err = chartService.SetFragment(ctx, img, 8, 3, fragment)
+			So(err, ShouldBeNil)
+
+			got, err := chartService.GetFragment(ctx, img, 8, 3, 7, 7)
+			So(err, ShouldBeNil)
+			for y := 0; y < 7; y++ {
+				for x := 0; x < 7; x++ {
+					So(got.At(8+x, 3+y), ShouldResemble, color.RGBA{R: uint8(x), G: uint8(y), A: 0xFF})
+				}
+			}
+		}
+	})
+
+	Convey("Тайл раскладки больше максимальной площади должен давать ошибку ErrLayout", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		chartService := chart.NewChartographerService(imageRepo, &TestTileServiceEmpty{}, nil, tileMaxSize, nil, 1, 0)
+
+		_, err := chartService.AddImage(ctx, width, height,
+			tileutils.Layout{Kind: tileutils.LayoutRect, TileWidth: 20, TileHeight: 10})
+		So(errors.Is(err, tileutils.ErrLayout), ShouldBeTrue)
+		So(imageRepo.images, ShouldBeEmpty)
+	})
+
+	Convey("Раскладка rect:1x1 на изображении максимального размера должна давать ошибку ErrLayout", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		chartService := chart.NewChartographerService(imageRepo, &TestTileServiceEmpty{}, nil, 1000, nil, 1, 0)
+
+		_, err := chartService.AddImage(ctx, 20_000, 50_000,
+			tileutils.Layout{Kind: tileutils.LayoutRect, TileWidth: 1, TileHeight: 1})
+		So(errors.Is(err, tileutils.ErrLayout), ShouldBeTrue)
+		So(imageRepo.images, ShouldBeEmpty)
+	})
+}
+
 // endregion Создание изображения
 
 // region Получение фрагмента изображения
@@ -137,10 +216,10 @@ func TestGetFragment_In(t *testing.T) {
 	Convey("Fragment когда прямоугольник фрагмента полностью лежит в прямоугольнике изображения.\n"+
 		"После вызова функции Fragment красный пиксель изображения должен появиться в фрагменте", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 1000
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const imgSize = 2
 		img := image.NewRGBA(image.Rect(0, 0, imgSize, imgSize))
@@ -152,7 +231,7 @@ func TestGetFragment_In(t *testing.T) {
 		img.SetRGBA(redX, redY, red)
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, 0, 0, img) // чтобы getTile, вызываемый в chart.GetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, 0, 0, img), ShouldBeNil) // тайл, который прочитает chart.GetFragment
 
 		const (
 			x              = 1
@@ -166,12 +245,13 @@ func TestGetFragment_In(t *testing.T) {
 		So(fragmentRect.In(img.Bounds()), ShouldBeTrue)
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  img.Bounds().Dx(),
-			Height: img.Bounds().Dy(),
-			Tiles:  []image.Rectangle{img.Bounds()},
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
-		fragment, err := chartService.GetFragment(tiledImg, x, y, fragmentWidth, fragmentHeight)
+		fragment, err := chartService.GetFragment(ctx, tiledImg, x, y, fragmentWidth, fragmentHeight)
 		So(err, ShouldBeNil)
 
 		bounds := fragment.Bounds()
@@ -186,10 +266,10 @@ func TestGetFragment_PartIntersect(t *testing.T) {
 	Convey("Fragment когда прямоугольники пересекаются, но фрагмент частично вне прямоугольника изображения\n"+
 		"После вызова функции Fragment во фрагменте должен появиться один красный пиксель", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 1000
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			imgWidth  = 2
@@ -204,7 +284,7 @@ func TestGetFragment_PartIntersect(t *testing.T) {
 		img.SetRGBA(redX, redY, red)
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, 0, 0, img) // чтобы getTile, вызываемый в chart.GetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, 0, 0, img), ShouldBeNil) // тайл, который прочитает chart.GetFragment
 
 		const (
 			x              = redX
@@ -214,17 +294,18 @@ func TestGetFragment_PartIntersect(t *testing.T) {
 		)
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  img.Bounds().Dx(),
-			Height: img.Bounds().Dy(),
-			Tiles:  []image.Rectangle{img.Bounds()},
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 
 		// Убеждаемся, что прямоугольники пересекаются, но фрагмент частично вне прямоугольника изображения
 		fragmentRect := image.Rect(x, y, x+fragmentWidth, y+fragmentHeight)
 		So(fragmentRect.Bounds().Overlaps(img.Bounds()) && !fragmentRect.Bounds().In(img.Bounds()), ShouldBeTrue)
 
-		fragment, err := chartService.GetFragment(tiledImg, x, y, fragmentWidth, fragmentHeight)
+		fragment, err := chartService.GetFragment(ctx, tiledImg, x, y, fragmentWidth, fragmentHeight)
 		So(err, ShouldBeNil)
 
 		bounds := fragment.Bounds()
@@ -248,9 +329,9 @@ func TestGetFragment_NotOverlaps(t *testing.T) {
 	Convey("Fragment когда прямоугольники не пересекаются\n"+
 		"Результатом Fragment должно быть полностью черное изображение", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		tileMaxSize := 1000
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, tileMaxSize, nil, 1, 0)
 
 		const (
 			imgWidth  = 2
@@ -265,7 +346,7 @@ func TestGetFragment_NotOverlaps(t *testing.T) {
 		img.SetRGBA(redX, redY, red)
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, 0, 0, img) // чтобы getTile, вызываемый в chart.GetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, 0, 0, img), ShouldBeNil) // тайл, который прочитает chart.GetFragment
 
 		const (
 			x              = imgWidth
@@ -279,13 +360,13 @@ func TestGetFragment_NotOverlaps(t *testing.T) {
 		So(fragmentRect.Overlaps(img.Bounds()), ShouldBeFalse)
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  img.Bounds().Dx(),
-			Height: img.Bounds().Dy(),
-
-			Tiles: []image.Rectangle{img.Bounds()},
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
-		_, err := chartService.GetFragment(tiledImg, x, y, fragmentWidth, fragmentHeight)
+		_, err := chartService.GetFragment(ctx, tiledImg, x, y, fragmentWidth, fragmentHeight)
 
 		So(errors.Is(err, chart.ErrNotOverlaps), ShouldBeTrue)
 	})
@@ -296,10 +377,10 @@ func TestGetFragment_In_NotFirstTile(t *testing.T) {
 		"и параметры x,y,width,height относятся не к первому тайлу\n"+
 		"После вызова функции GetFragment красный пиксель фрагмента должен появиться в изображении", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 10
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			tileX      = 10
@@ -317,17 +398,18 @@ func TestGetFragment_In_NotFirstTile(t *testing.T) {
 		img.SetRGBA(redX, redY, red)
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, tileX, tileY, img) // чтобы getTile, вызываемый в chart.GetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, tileX, tileY, img), ShouldBeNil) // тайл, который прочитает chart.GetFragment
 
 		const (
 			imgWidth  = 15
 			imgHeight = 15
 		)
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  imgWidth,
-			Height: imgHeight,
-			Tiles:  []image.Rectangle{image.Rect(tileX, tileY, tileX+tileWidth, tileY+tileHeight)},
+			Id:         id,
+			Width:      imgWidth,
+			Height:     imgHeight,
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 
 		const (
@@ -341,7 +423,7 @@ func TestGetFragment_In_NotFirstTile(t *testing.T) {
 		imgRect := image.Rect(0, 0, imgWidth, imgHeight)
 		So(fragmentRect.In(imgRect), ShouldBeTrue)
 
-		fragment, err := chartService.GetFragment(tiledImg, x, y, fragmentWidth, fragmentHeight)
+		fragment, err := chartService.GetFragment(ctx, tiledImg, x, y, fragmentWidth, fragmentHeight)
 		So(err, ShouldBeNil)
 
 		bounds := fragment.Bounds()
@@ -361,10 +443,10 @@ func TestGetFragment_In_TwoTiles(t *testing.T) {
 		"и фрагмент затрагивает 2 тайла.\n"+
 		"Результат GetFragment должен иметь пиксели изображения", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 10
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			tile1X0 = 0
@@ -395,8 +477,8 @@ func TestGetFragment_In_TwoTiles(t *testing.T) {
 		t2.SetRGBA(greenX, greenY, green)
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, tile1X0, tile1Y0, t1) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
-		_ = tileRepo.SaveTile(id, tile2X0, tile2Y0, t2) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, tile1X0, tile1Y0, t1), ShouldBeNil) // тайл, который прочитает chart.SetFragment
+		So(tileRepo.SaveTile(ctx, id, tile2X0, tile2Y0, t2), ShouldBeNil) // тайл, который прочитает chart.SetFragment
 
 		const (
 			imgWidth  = 15
@@ -404,13 +486,11 @@ func TestGetFragment_In_TwoTiles(t *testing.T) {
 		)
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  imgWidth,
-			Height: imgHeight,
-			Tiles: []image.Rectangle{
-				t1.Bounds(),
-				t2.Bounds(),
-			},
+			Id:         id,
+			Width:      imgWidth,
+			Height:     imgHeight,
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 		imageRepo.Add(id, tiledImg)
 
@@ -426,7 +506,7 @@ func TestGetFragment_In_TwoTiles(t *testing.T) {
 		fragmentRect := image.Rect(x, y, x+fragmentWidth, y+fragmentHeight)
 		So(fragmentRect.In(imgRect), ShouldBeTrue)
 
-		fragment, err := chartService.GetFragment(tiledImg, x, y, fragmentWidth, fragmentHeight)
+		fragment, err := chartService.GetFragment(ctx, tiledImg, x, y, fragmentWidth, fragmentHeight)
 		So(err, ShouldBeNil)
 
 		So(fragment.At(redX, redY), ShouldResemble, red)
@@ -436,20 +516,21 @@ func TestGetFragment_In_TwoTiles(t *testing.T) {
 
 func TestGetFragment_Size(t *testing.T) {
 	imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-	tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+	tileRepo := newTestTileService()
 	adapter := &TestAdapterEmpty{}
 	tileMaxSize := 1000
-	chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+	chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 	emptyImg := image.NewRGBA(image.Rect(0, 0, 1, 1))
 	const id = "0"
-	_ = tileRepo.SaveTile(id, 0, 0, emptyImg) // чтобы getTile, вызываемый в chart.GetFragment, возвращал стаб
+	_ = tileRepo.SaveTile(ctx, id, 0, 0, emptyImg) // тайл, который прочитает chart.GetFragment
 
 	tiledEmptyImg := &chart.TiledImage{
-		Id:     id,
-		Width:  emptyImg.Bounds().Dx(),
-		Height: emptyImg.Bounds().Dy(),
-		Tiles:  []image.Rectangle{emptyImg.Bounds()},
+		Id:         id,
+		Width:      emptyImg.Bounds().Dx(),
+		Height:     emptyImg.Bounds().Dy(),
+		TileWidth:  tileMaxSize,
+		TileHeight: tileMaxSize,
 	}
 
 	const (
@@ -462,7 +543,7 @@ func TestGetFragment_Size(t *testing.T) {
 	// Позитивные тесты
 
 	testSize := func(width, height int) {
-		img, err := chartService.GetFragment(tiledEmptyImg, 0, 0, width, height)
+		img, err := chartService.GetFragment(ctx, tiledEmptyImg, 0, 0, width, height)
 		So(err, ShouldBeNil)
 
 		rect := img.Bounds()
@@ -480,19 +561,19 @@ func TestGetFragment_Size(t *testing.T) {
 
 	var errSize *chart.SizeError
 	Convey("test minWidth-1", t, func() {
-		_, err := chartService.GetFragment(tiledEmptyImg, 0, 0, fragmentMinWidth-1, 1)
+		_, err := chartService.GetFragment(ctx, tiledEmptyImg, 0, 0, fragmentMinWidth-1, 1)
 		So(errors.As(err, &errSize), ShouldBeTrue)
 	})
 	Convey("test minHeight-1", t, func() {
-		_, err := chartService.GetFragment(tiledEmptyImg, 0, 0, 1, fragmentMinHeight-1)
+		_, err := chartService.GetFragment(ctx, tiledEmptyImg, 0, 0, 1, fragmentMinHeight-1)
 		So(errors.As(err, &errSize), ShouldBeTrue)
 	})
 	Convey("test maxWidth+1", t, func() {
-		_, err := chartService.GetFragment(tiledEmptyImg, 0, 0, fragmentMaxWidth+1, 1)
+		_, err := chartService.GetFragment(ctx, tiledEmptyImg, 0, 0, fragmentMaxWidth+1, 1)
 		So(errors.As(err, &errSize), ShouldBeTrue)
 	})
 	Convey("test maxHeight+1", t, func() {
-		_, err := chartService.GetFragment(tiledEmptyImg, 0, 0, 1, fragmentMaxHeight+1)
+		_, err := chartService.GetFragment(ctx, tiledEmptyImg, 0, 0, 1, fragmentMaxHeight+1)
 		So(errors.As(err, &errSize), ShouldBeTrue)
 	})
 }
@@ -505,10 +586,10 @@ func TestSetFragment_In(t *testing.T) {
 	Convey("SetFragment когда прямоугольник фрагмента полностью лежит в прямоугольнике изображения.\n"+
 		"После вызова функции SetFragment красный пиксель фрагмента должен появиться в изображении", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 1000
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			imgWidth  = 2
@@ -517,13 +598,14 @@ func TestSetFragment_In(t *testing.T) {
 		img := image.NewRGBA(image.Rect(0, 0, imgWidth, imgHeight))
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, 0, 0, img) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, 0, 0, img), ShouldBeNil) // тайл, который прочитает chart.SetFragment
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  img.Bounds().Dx(),
-			Height: img.Bounds().Dy(),
-			Tiles:  []image.Rectangle{img.Bounds()},
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 
 		const (
@@ -545,7 +627,7 @@ func TestSetFragment_In(t *testing.T) {
 		// Убеждаемся, что прямоугольник фрагмента полностью лежит в прямоугольнике изображения
 		So(fragment.Bounds().In(img.Bounds()), ShouldBeTrue)
 
-		err := chartService.SetFragment(tiledImg, 0, 0, fragment)
+		err := chartService.SetFragment(ctx, tiledImg, 0, 0, fragment)
 		So(err, ShouldBeNil)
 
 		const (
@@ -559,7 +641,7 @@ func TestSetFragment_In(t *testing.T) {
 					c = red
 				}
 
-				So(img.At(x, y), ShouldResemble, c)
+				So(tileRepo.pixel(id, 0, 0, x, y), ShouldResemble, c)
 			}
 		}
 	})
@@ -570,10 +652,10 @@ func TestSetFragment_NotOverlaps(t *testing.T) {
 		"После вызова функции SetFragment красный пиксель фрагмента не должен появиться в изображении, "+
 		"так как прямоугольники не пересекаются", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 1000
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			imgWidth  = 2
@@ -582,13 +664,14 @@ func TestSetFragment_NotOverlaps(t *testing.T) {
 		img := image.NewRGBA(image.Rect(0, 0, imgWidth, imgHeight))
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, 0, 0, img) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, 0, 0, img), ShouldBeNil) // тайл, который прочитает chart.SetFragment
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  img.Bounds().Dx(),
-			Height: img.Bounds().Dy(),
-			Tiles:  []image.Rectangle{img.Bounds()},
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 
 		const (
@@ -611,7 +694,7 @@ func TestSetFragment_NotOverlaps(t *testing.T) {
 		// Убеждаемся, что прямоугольники не пересекаются
 		So(!fragment.Bounds().Overlaps(img.Bounds()), ShouldBeTrue)
 
-		err := chartService.SetFragment(tiledImg, 0, 0, fragment)
+		err := chartService.SetFragment(ctx, tiledImg, 0, 0, fragment)
 		So(errors.Is(err, chart.ErrNotOverlaps), ShouldBeTrue)
 
 		for x := 0; x < imgWidth; x++ {
@@ -627,10 +710,10 @@ func TestSetFragment_PartIntersect(t *testing.T) {
 	Convey("SetFragment когда прямоугольники пересекаются, но фрагмент частично вне прямоугольника изображения\n"+
 		"После вызова функции SetFragment красный пиксель фрагмента должен появиться в изображении", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		tileMaxSize := 1000
 		adapter := &TestAdapterEmpty{}
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			imgWidth  = 2
@@ -639,13 +722,14 @@ func TestSetFragment_PartIntersect(t *testing.T) {
 		img := image.NewRGBA(image.Rect(0, 0, imgWidth, imgHeight))
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, 0, 0, img) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, 0, 0, img), ShouldBeNil) // тайл, который прочитает chart.SetFragment
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  img.Bounds().Dx(),
-			Height: img.Bounds().Dy(),
-			Tiles:  []image.Rectangle{img.Bounds()},
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 
 		const (
@@ -670,7 +754,7 @@ func TestSetFragment_PartIntersect(t *testing.T) {
 		// Убеждаемся, что прямоугольники пересекаются, но фрагмент частично вне прямоугольника изображения
 		So(fragment.Bounds().Overlaps(img.Bounds()) && !fragment.Bounds().In(img.Bounds()), ShouldBeTrue)
 
-		err := chartService.SetFragment(tiledImg, 0, 0, fragment)
+		err := chartService.SetFragment(ctx, tiledImg, 0, 0, fragment)
 		So(err, ShouldBeNil)
 
 		for x := 0; x < imgWidth; x++ {
@@ -680,7 +764,7 @@ func TestSetFragment_PartIntersect(t *testing.T) {
 					c = red
 				}
 
-				So(img.At(x, y), ShouldResemble, c)
+				So(tileRepo.pixel(id, 0, 0, x, y), ShouldResemble, c)
 			}
 		}
 	})
@@ -691,10 +775,10 @@ func TestSetFragment_In_NotFirstTile(t *testing.T) {
 		"и параметры x,y,width,height относятся не к первому тайлу\n"+
 		"После вызова функции SetFragment красный пиксель фрагмента должен появиться в изображении", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 10
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			tileX      = 10
@@ -705,17 +789,18 @@ func TestSetFragment_In_NotFirstTile(t *testing.T) {
 		img := image.NewRGBA(image.Rect(tileX, tileY, tileX+tileWidth, tileY+tileHeight))
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, tileX, tileY, img) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, tileX, tileY, img), ShouldBeNil) // тайл, который прочитает chart.SetFragment
 
 		const (
 			imgWidth  = 15
 			imgHeight = 15
 		)
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  imgWidth,
-			Height: imgHeight,
-			Tiles:  []image.Rectangle{img.Bounds()},
+			Id:         id,
+			Width:      imgWidth,
+			Height:     imgHeight,
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 
 		const (
@@ -734,10 +819,10 @@ func TestSetFragment_In_NotFirstTile(t *testing.T) {
 		imgRect := image.Rect(0, 0, imgWidth, imgHeight)
 		So(fragment.Bounds().In(imgRect), ShouldBeTrue)
 
-		err := chartService.SetFragment(tiledImg, 0, 0, fragment)
+		err := chartService.SetFragment(ctx, tiledImg, 0, 0, fragment)
 		So(err, ShouldBeNil)
 
-		So(img.At(x, y), ShouldResemble, red)
+		So(tileRepo.pixel(id, tileX, tileY, x, y), ShouldResemble, red)
 	})
 }
 
@@ -746,10 +831,10 @@ func TestSetFragment_In_TwoTiles(t *testing.T) {
 		"и фрагмент затрагивает 2 тайла.\n"+
 		"После вызова функции SetFragment красные пиксели фрагмента должны появиться в изображении", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
+		tileRepo := newTestTileService()
 		adapter := &TestAdapterEmpty{}
 		tileMaxSize := 10
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, adapter, tileMaxSize, nil, 1, 0)
 
 		const (
 			tile1X0 = 0
@@ -767,8 +852,8 @@ func TestSetFragment_In_TwoTiles(t *testing.T) {
 		t2 := image.NewRGBA(image.Rect(tile2X0, tile2Y0, tile2X1, tile2Y1))
 
 		const id = "0"
-		_ = tileRepo.SaveTile(id, tile1X0, tile1Y0, t1) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
-		_ = tileRepo.SaveTile(id, tile2X0, tile2Y0, t2) // чтобы getTile, вызываемый в chart.SetFragment, возвращал стаб
+		So(tileRepo.SaveTile(ctx, id, tile1X0, tile1Y0, t1), ShouldBeNil) // тайл, который прочитает chart.SetFragment
+		So(tileRepo.SaveTile(ctx, id, tile2X0, tile2Y0, t2), ShouldBeNil) // тайл, который прочитает chart.SetFragment
 
 		const (
 			imgWidth  = 15
@@ -776,13 +861,11 @@ func TestSetFragment_In_TwoTiles(t *testing.T) {
 		)
 
 		tiledImg := &chart.TiledImage{
-			Id:     id,
-			Width:  imgWidth,
-			Height: imgHeight,
-			Tiles: []image.Rectangle{
-				t1.Bounds(),
-				t2.Bounds(),
-			},
+			Id:         id,
+			Width:      imgWidth,
+			Height:     imgHeight,
+			TileWidth:  tileMaxSize,
+			TileHeight: tileMaxSize,
 		}
 
 		const (
@@ -803,7 +886,7 @@ func TestSetFragment_In_TwoTiles(t *testing.T) {
 		imgRect := image.Rect(0, 0, imgWidth, imgHeight)
 		So(fragment.Bounds().In(imgRect), ShouldBeTrue)
 
-		err := chartService.SetFragment(tiledImg, 0, 0, fragment)
+		err := chartService.SetFragment(ctx, tiledImg, 0, 0, fragment)
 		So(err, ShouldBeNil)
 
 		const (
@@ -814,8 +897,28 @@ func TestSetFragment_In_TwoTiles(t *testing.T) {
 			imgGreenX = 10
 			imgGreenY = 0
 		)
-		So(t1.At(imgRedX, imgRedY), ShouldResemble, red)
-		So(t2.At(imgGreenX, imgGreenY), ShouldResemble, green)
+		So(tileRepo.pixel(id, tile1X0, tile1Y0, imgRedX, imgRedY), ShouldResemble, red)
+		So(tileRepo.pixel(id, tile2X0, tile2Y0, imgGreenX, imgGreenY), ShouldResemble, green)
+	})
+}
+
+type TestImageRepoGetError struct {
+	kvstore.Store
+}
+
+var errImageRepo = errors.New("хранилище метаданных недоступно")
+
+func (r *TestImageRepoGetError) Get(string) (interface{}, error) {
+	return nil, errImageRepo
+}
+
+func TestSetFragment_ImageRepoError(t *testing.T) {
+	Convey("Ошибка чтения метаданных должна возвращаться, а тайлы - не меняться", t, func() {
+		chartService := chart.NewChartographerService(&TestImageRepoGetError{}, &TestTileServiceEmpty{}, nil, 10, nil, 1, 0)
+
+		img := &chart.TiledImage{Id: "0", Width: 10, Height: 10, TileWidth: 10, TileHeight: 10}
+		err := chartService.SetFragment(ctx, img, 0, 0, image.NewRGBA(image.Rect(0, 0, 5, 5)))
+		So(errors.Is(err, errImageRepo), ShouldBeTrue)
 	})
 }
 
@@ -826,8 +929,8 @@ func TestSetFragment_In_TwoTiles(t *testing.T) {
 func TestDeleteImage_Success(t *testing.T) {
 	Convey("Должно удалить все данные изображения", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0)
+		tileRepo := newTestTileService()
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0, nil, 1, 0)
 
 		const id = "0"
 		tiledImg := &chart.TiledImage{
@@ -836,21 +939,21 @@ func TestDeleteImage_Success(t *testing.T) {
 		imageRepo.Add(id, tiledImg)
 
 		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
-		_ = tileRepo.SaveTile(id, 0, 0, img)
+		_ = tileRepo.SaveTile(ctx, id, 0, 0, img)
 
 		getImg, _ := imageRepo.Get(id)
 		So(getImg, ShouldNotBeNil)
 
-		getTile, _ := tileRepo.GetTile(id, 0, 0)
+		getTile, _ := tileRepo.GetTile(ctx, id, 0, 0)
 		So(getTile, ShouldNotBeNil)
 
-		err := chartService.DeleteImage(id)
+		err := chartService.DeleteImage(ctx, id)
 		So(err, ShouldBeNil)
 
 		getImg, _ = imageRepo.Get(id)
 		So(getImg, ShouldBeNil)
 
-		getTile, _ = tileRepo.GetTile(id, 0, 0)
+		getTile, _ = tileRepo.GetTile(ctx, id, 0, 0)
 		So(getTile, ShouldBeNil)
 	})
 }
@@ -859,6 +962,9 @@ type TestImageRepoDeleteNotExist struct {
 	kvstore.Store
 }
 
+func (r *TestImageRepoDeleteNotExist) Get(string) (interface{}, error) {
+	return nil, kvstore.ErrNotExist
+}
 func (r *TestImageRepoDeleteNotExist) Delete(string) error {
 	return kvstore.ErrNotExist
 }
@@ -866,10 +972,10 @@ func (r *TestImageRepoDeleteNotExist) Delete(string) error {
 func TestDeleteImage_NotExist(t *testing.T) {
 	Convey("При запросе несуществующего изображения должна быть ошибка", t, func() {
 		imageRepo := &TestImageRepoDeleteNotExist{}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0)
+		tileRepo := newTestTileService()
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0, nil, 1, 0)
 
-		err := chartService.DeleteImage("0")
+		err := chartService.DeleteImage(ctx, "0")
 		So(errors.Is(err, chart.ErrNotExist), ShouldBeTrue)
 	})
 }
@@ -889,10 +995,10 @@ func (r *TestImageRepoGetNotExist) Get(string) (interface{}, error) {
 func TestGetImage_NotExist(t *testing.T) {
 	Convey("При запросе несуществующего изображения должна быть ошибка", t, func() {
 		imageRepo := &TestImageRepoGetNotExist{}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0)
+		tileRepo := newTestTileService()
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0, nil, 1, 0)
 
-		_, err := chartService.GetImage("0")
+		_, err := chartService.GetImage(ctx, "0")
 		So(errors.Is(err, chart.ErrNotExist), ShouldBeTrue)
 	})
 }
@@ -900,8 +1006,8 @@ func TestGetImage_NotExist(t *testing.T) {
 func TestGetImage_Success(t *testing.T) {
 	Convey("Должно удалить все данные изображения", t, func() {
 		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
-		tileRepo := &TestTileService{images: make(map[string]map[tileKey]image.Image)}
-		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0)
+		tileRepo := newTestTileService()
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 0, nil, 1, 0)
 
 		const id = "0"
 		tiledImg := &chart.TiledImage{
@@ -909,10 +1015,961 @@ func TestGetImage_Success(t *testing.T) {
 		}
 		imageRepo.Add(id, tiledImg)
 
-		img, err := chartService.GetImage(id)
+		img, err := chartService.GetImage(ctx, id)
 		So(err, ShouldBeNil)
 		So(img, ShouldResemble, tiledImg)
 	})
 }
 
 // endregion Получение изображения
+
+// region Бюджет памяти
+
+func TestReserve_Busy(t *testing.T) {
+	Convey("Резервирование сверх бюджета должно вернуть ErrBusy, после освобождения - снова проходить", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileRepo := &TestTileServiceEmpty{}
+		budget := membudget.NewBudget(1_000, 0)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 5, budget, 1, 0)
+
+		_, release, err := chartService.Reserve(ctx, 10, 10)
+		So(err, ShouldBeNil)
+		So(budget.Used(), ShouldBeGreaterThan, 0)
+
+		_, _, err = chartService.Reserve(ctx, 10, 10)
+		So(errors.Is(err, chart.ErrBusy), ShouldBeTrue)
+
+		release()
+		So(budget.Used(), ShouldEqual, 0)
+
+		_, _, err = chartService.Reserve(ctx, 10, 10)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestReserve_Size(t *testing.T) {
+	Convey("Резервирование фрагмента некорректного размера должно вернуть SizeError", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileRepo := &TestTileServiceEmpty{}
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, nil, 1000, nil, 1, 0)
+
+		var errSize *chart.SizeError
+		_, _, err := chartService.Reserve(ctx, 0, 1)
+		So(errors.As(err, &errSize), ShouldBeTrue)
+	})
+}
+
+func TestReserve_Tiles(t *testing.T) {
+	Convey("Тайлы фрагмента должны резервироваться из памяти, зарезервированной под запрос", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileRepo := newTestTileService()
+		// Бюджета хватает ровно на один фрагмент 1x1 вместе с тайлом 2x2.
+		budget := membudget.NewBudget(35, 0)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, &TestAdapterEmpty{}, 2, budget, 1, 0)
+
+		img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		const id = "0"
+		_ = tileRepo.SaveTile(ctx, id, 0, 0, img)
+
+		tiledImg := &chart.TiledImage{
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  2,
+			TileHeight: 2,
+		}
+
+		reserved, release, err := chartService.Reserve(ctx, 1, 1)
+		So(err, ShouldBeNil)
+		So(budget.Used(), ShouldEqual, 35)
+
+		Convey("с контекстом резерва фрагмент получается без обращения к общему бюджету", func() {
+			_, err = chartService.GetFragment(reserved, tiledImg, 0, 0, 1, 1)
+			So(err, ShouldBeNil)
+			So(budget.Used(), ShouldEqual, 35)
+		})
+
+		Convey("без контекста резерва тайлу не хватает общего бюджета", func() {
+			_, err = chartService.GetFragment(ctx, tiledImg, 0, 0, 1, 1)
+			So(errors.Is(err, chart.ErrBusy), ShouldBeTrue)
+		})
+
+		release()
+		So(budget.Used(), ShouldEqual, 0)
+	})
+}
+
+func TestGetFragment_Busy(t *testing.T) {
+	Convey("GetFragment должен вернуть ErrBusy, если тайл не помещается в бюджет памяти", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileRepo := newTestTileService()
+		budget := membudget.NewBudget(1, 0)
+		chartService := chart.NewChartographerService(imageRepo, tileRepo, &TestAdapterEmpty{}, 1000, budget, 1, 0)
+
+		img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		const id = "0"
+		_ = tileRepo.SaveTile(ctx, id, 0, 0, img)
+
+		tiledImg := &chart.TiledImage{
+			Id:         id,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+			TileWidth:  1000,
+			TileHeight: 1000,
+		}
+
+		_, err := chartService.GetFragment(ctx, tiledImg, 0, 0, 1, 1)
+		So(errors.Is(err, chart.ErrBusy), ShouldBeTrue)
+		So(budget.Used(), ShouldEqual, 0)
+	})
+}
+
+// endregion Бюджет памяти
+
+// region Декодирование фрагмента
+
+func encodeBmp(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.RGBA{A: 255}) // чтобы Encode распознал как 24-битное
+
+	b, _ := imgstore.NewBmpService(nil).Encode(img)
+	return b
+}
+
+func TestDecodeConfig(t *testing.T) {
+	imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+	tileService := imgstore.NewBmpService(nil)
+	chartService := chart.NewChartographerService(imageRepo, tileService, nil, 1000, nil, 1, 0)
+
+	Convey("Размер в заголовке совпадает с заявленным", t, func() {
+		config, err := chartService.DecodeConfig(encodeBmp(2, 3), 2, 3)
+		So(err, ShouldBeNil)
+		So(config.Width, ShouldEqual, 2)
+		So(config.Height, ShouldEqual, 3)
+	})
+
+	Convey("Размер в заголовке не совпадает с заявленным", t, func() {
+		var errDeclared *chart.DeclaredSizeError
+		_, err := chartService.DecodeConfig(encodeBmp(2, 3), 3, 2)
+		So(errors.As(err, &errDeclared), ShouldBeTrue)
+	})
+
+	Convey("Размер в заголовке больше максимального размера фрагмента", t, func() {
+		var errSize *chart.SizeError
+		_, err := chartService.DecodeConfig(encodeBmp(5_001, 1), 5_001, 1)
+		So(errors.As(err, &errSize), ShouldBeTrue)
+
+		_, err = chartService.Decode(encodeBmp(5_001, 1), 5_000, 1)
+		So(errors.As(err, &errSize), ShouldBeTrue)
+	})
+
+	Convey("Заявленный размер больше максимального размера фрагмента", t, func() {
+		var errSize *chart.SizeError
+		_, err := chartService.DecodeConfig(encodeBmp(1, 1), 5_001, 1)
+		So(errors.As(err, &errSize), ShouldBeTrue)
+	})
+
+	Convey("Не изображение", t, func() {
+		_, err := chartService.DecodeConfig([]byte("not a bmp"), 1, 1)
+		So(errors.Is(err, chart.ErrFormat), ShouldBeTrue)
+
+		_, err = chartService.Decode([]byte("not a bmp"), 1, 1)
+		So(errors.Is(err, chart.ErrFormat), ShouldBeTrue)
+	})
+}
+
+func TestDecode_Crop(t *testing.T) {
+	Convey("Изображение больше заявленного размера должно обрезаться до левой верхней части", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileService := imgstore.NewBmpService(nil)
+		chartService := chart.NewChartographerService(imageRepo, tileService, nil, 1000, nil, 1, 0)
+
+		src := image.NewRGBA(image.Rect(0, 0, 3, 3))
+		red := color.RGBA{R: 255, A: 255}
+		green := color.RGBA{G: 255, A: 255}
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 3; x++ {
+				src.SetRGBA(x, y, green)
+			}
+		}
+		src.SetRGBA(1, 0, red)
+		b, err := tileService.Encode(src)
+		So(err, ShouldBeNil)
+
+		config, err := chartService.DecodeConfig(b, 2, 1)
+		So(err, ShouldBeNil)
+		So(config.Width, ShouldEqual, 3)
+
+		fragment, err := chartService.Decode(b, 2, 1)
+		So(err, ShouldBeNil)
+		So(fragment.Bounds(), ShouldResemble, image.Rect(0, 0, 2, 1))
+		So(fragment.At(0, 0), ShouldResemble, green)
+		So(fragment.At(1, 0), ShouldResemble, red)
+
+		// Обрезанный фрагмент должен корректно смещаться при наложении на изображение.
+		(&chart.ImageAdapter{}).ShiftRect(fragment, 5, 5)
+		So(fragment.At(6, 5), ShouldResemble, red)
+	})
+}
+
+func TestValidateFragment(t *testing.T) {
+	imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+	chartService := chart.NewChartographerService(imageRepo, &TestTileServiceEmpty{}, nil, 1000, nil, 1, 0)
+	img := &chart.TiledImage{Id: "0", Width: 10, Height: 10}
+
+	Convey("Фрагмент пересекается с изображением", t, func() {
+		So(chartService.ValidateFragment(img, 9, 9, 5, 5), ShouldBeNil)
+	})
+	Convey("Фрагмент не пересекается с изображением", t, func() {
+		err := chartService.ValidateFragment(img, 10, 0, 5, 5)
+		So(errors.Is(err, chart.ErrNotOverlaps), ShouldBeTrue)
+	})
+	Convey("Некорректный размер фрагмента", t, func() {
+		var errSize *chart.SizeError
+		err := chartService.ValidateFragment(img, 0, 0, 0, 5)
+		So(errors.As(err, &errSize), ShouldBeTrue)
+	})
+}
+
+// endregion Декодирование фрагмента
+
+// region Параллельная обработка тайлов
+
+// TestTileServiceSlow - заглушка, запоминающая наибольшее число одновременно обрабатываемых тайлов.
+type TestTileServiceSlow struct {
+	TestTileServiceEmpty
+	err error
+
+	mu               sync.Mutex
+	calls            int
+	inFlight, maxFly int
+}
+
+func (s *TestTileServiceSlow) process() error {
+	s.mu.Lock()
+	s.calls++
+	s.inFlight++
+	if s.inFlight > s.maxFly {
+		s.maxFly = s.inFlight
+	}
+	s.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	return s.err
+}
+func (s *TestTileServiceSlow) ReadTileRegion(context.Context, string, int, int, image.Rectangle, *image.RGBA) error {
+	return s.process()
+}
+func (s *TestTileServiceSlow) WriteTileRegion(context.Context, string, int, int, image.Rectangle, image.Image) error {
+	return s.process()
+}
+
+func TestFragment_Concurrency(t *testing.T) {
+	const (
+		concurrency = 4
+		// При максимальном размере тайла 1 изображение 4x4 состоит из 16 тайлов.
+		imgSize = 4
+	)
+
+	Convey("Одновременно должно обрабатываться не больше concurrency тайлов", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileService := &TestTileServiceSlow{}
+		chartService := chart.NewChartographerService(imageRepo, tileService, &TestAdapterEmpty{}, 1, nil, concurrency, 0)
+
+		img, err := chartService.AddImage(ctx, imgSize, imgSize, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		_, err = chartService.GetFragment(ctx, img, 0, 0, imgSize, imgSize)
+		So(err, ShouldBeNil)
+		So(tileService.calls, ShouldEqual, imgSize*imgSize)
+		So(tileService.maxFly, ShouldBeGreaterThan, 1)
+		So(tileService.maxFly, ShouldBeLessThanOrEqualTo, concurrency)
+
+		// Перед записью каждый тайл читается для копии в ревизию.
+		err = chartService.SetFragment(ctx, img, 0, 0, image.NewRGBA(image.Rect(0, 0, imgSize, imgSize)))
+		So(err, ShouldBeNil)
+		So(tileService.calls, ShouldEqual, 3*imgSize*imgSize)
+		So(tileService.maxFly, ShouldBeLessThanOrEqualTo, concurrency)
+	})
+
+	Convey("Первая ошибка должна возвращаться, а необработанные тайлы - пропускаться", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		errTile := errors.New("ошибка тайла")
+		tileService := &TestTileServiceSlow{err: errTile}
+		chartService := chart.NewChartographerService(imageRepo, tileService, &TestAdapterEmpty{}, 1, nil, concurrency, 0)
+
+		img, err := chartService.AddImage(ctx, imgSize, imgSize, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		_, err = chartService.GetFragment(ctx, img, 0, 0, imgSize, imgSize)
+		So(errors.Is(err, errTile), ShouldBeTrue)
+		So(tileService.calls, ShouldBeLessThanOrEqualTo, concurrency)
+	})
+
+	Convey("Параллельная обработка должна давать тот же результат, что и последовательная", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileService := newTestTileService()
+		chartService := chart.NewChartographerService(imageRepo, tileService, &chart.ImageAdapter{}, 1, nil, concurrency, 0)
+
+		img, err := chartService.AddImage(ctx, imgSize, imgSize, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		fragment := image.NewRGBA(image.Rect(0, 0, imgSize, imgSize))
+		for y := 0; y < imgSize; y++ {
+			for x := 0; x < imgSize; x++ {
+				fragment.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 0xFF})
+			}
+		}
+		err = chartService.SetFragment(ctx, img, 1, 1, fragment)
+		So(err, ShouldBeNil)
+
+		got, err := chartService.GetFragment(ctx, img, 0, 0, imgSize, imgSize)
+		So(err, ShouldBeNil)
+		for y := 0; y < imgSize; y++ {
+			for x := 0; x < imgSize; x++ {
+				expected := color.RGBA{A: 0xFF}
+				if x >= 1 && y >= 1 {
+					expected = color.RGBA{R: uint8(x - 1), G: uint8(y - 1), A: 0xFF}
+				}
+				So(got.At(x, y), ShouldResemble, expected)
+			}
+		}
+	})
+}
+
+func TestFragment_Cancel(t *testing.T) {
+	Convey("После отмены контекста тайлы не должны обрабатываться", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileService := &TestTileServiceSlow{}
+		chartService := chart.NewChartographerService(imageRepo, tileService, &TestAdapterEmpty{}, 1, nil, 4, 0)
+
+		img, err := chartService.AddImage(ctx, 4, 4, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err = chartService.GetFragment(cancelled, img, 0, 0, 4, 4)
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+		err = chartService.SetFragment(cancelled, img, 0, 0, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+		_, err = chartService.AddImage(cancelled, 4, 4, tileutils.Layout{})
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+		So(tileService.calls, ShouldEqual, 0)
+	})
+
+	Convey("Истечение срока во время обработки должно прекращать ее", t, func() {
+		imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+		tileService := &TestTileServiceSlow{}
+		chartService := chart.NewChartographerService(imageRepo, tileService, &TestAdapterEmpty{}, 1, nil, 1, 0)
+
+		// 100 тайлов по 5 мс.
+		img, err := chartService.AddImage(ctx, 10, 10, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+
+		_, err = chartService.GetFragment(deadline, img, 0, 0, 10, 10)
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		So(tileService.calls, ShouldBeLessThan, 100)
+	})
+}
+
+// endregion Параллельная обработка тайлов
+
+// region Перераскладка тайлов
+
+// TestTileServiceRetile - заглушка, приостанавливающая сохранение тайлов перераскладки.
+type TestTileServiceRetile struct {
+	*TestTileService
+	// resume - после закрытия сохранение продолжается. nil - тайлы сохраняются без задержки.
+	resume chan struct{}
+	// saving закрывается при первом приостановленном сохранении.
+	saving chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func (s *TestTileServiceRetile) SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error {
+	if s.resume != nil {
+		s.once.Do(func() { close(s.saving) })
+		<-s.resume
+		if s.err != nil {
+			return s.err
+		}
+	}
+	return s.TestTileService.SaveTile(ctx, id, x, y, img)
+}
+
+func newRetileService() (*chart.ChartographerService, *TestImageRepo, *TestTileServiceRetile) {
+	imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+	tileService := &TestTileServiceRetile{
+		TestTileService: newTestTileService(),
+	}
+	chartService := chart.NewChartographerService(imageRepo, tileService, &chart.ImageAdapter{}, 10, nil, 1, 0)
+	return chartService, imageRepo, tileService
+}
+
+func TestRetile(t *testing.T) {
+	const (
+		width  = 25
+		height = 12
+	)
+
+	Convey("После перераскладки пиксели изображения не должны меняться, а старые тайлы - удаляться", t, func() {
+		chartService, imageRepo, tileService := newRetileService()
+
+		img, err := chartService.AddImage(ctx, width, height, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		fragment := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				fragment.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 0xFF})
+			}
+		}
+		err = chartService.SetFragment(ctx, img, 0, 0, fragment)
+		So(err, ShouldBeNil)
+		before, err := chartService.GetFragment(ctx, img, 0, 0, width, height)
+		So(err, ShouldBeNil)
+
+		retiled, err := chartService.Retile(ctx, img.Id, tileutils.Layout{Kind: tileutils.LayoutStrip})
+		So(err, ShouldBeNil)
+		So(retiled.Id, ShouldEqual, img.Id)
+		So(retiled.TileWidth, ShouldEqual, width)
+		So(imageRepo.images[img.Id], ShouldEqual, retiled)
+
+		So(tileService.repo.Images(), ShouldHaveLength, 1)
+		So(tileService.repo.Images(), ShouldNotContain, img.Id)
+		So(tileService.repo.Tiles(retiled.TileSet), ShouldEqual, 3)
+
+		after, err := chartService.GetFragment(ctx, retiled, 0, 0, width, height)
+		So(err, ShouldBeNil)
+		So(after, ShouldResemble, before)
+
+		// Метаданные, полученные до перераскладки, должны перечитываться.
+		stale, err := chartService.GetFragment(ctx, img, 0, 0, width, height)
+		So(err, ShouldBeNil)
+		So(stale, ShouldResemble, before)
+	})
+
+	Convey("Во время перераскладки изображение должно читаться, а запись и удаление - отклоняться", t, func() {
+		chartService, _, tileService := newRetileService()
+
+		img, err := chartService.AddImage(ctx, width, height, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		tileService.resume = make(chan struct{})
+		tileService.saving = make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			_, err := chartService.Retile(ctx, img.Id, tileutils.Layout{Kind: tileutils.LayoutStrip})
+			done <- err
+		}()
+		<-tileService.saving
+
+		_, err = chartService.GetFragment(ctx, img, 0, 0, width, height)
+		So(err, ShouldBeNil)
+
+		err = chartService.SetFragment(ctx, img, 0, 0, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+		So(errors.Is(err, chart.ErrRetiling), ShouldBeTrue)
+
+		err = chartService.DeleteImage(ctx, img.Id)
+		So(errors.Is(err, chart.ErrRetiling), ShouldBeTrue)
+
+		_, err = chartService.Retile(ctx, img.Id, tileutils.Layout{})
+		So(errors.Is(err, chart.ErrRetiling), ShouldBeTrue)
+
+		close(tileService.resume)
+		So(<-done, ShouldBeNil)
+
+		err = chartService.SetFragment(ctx, img, 0, 0, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("При ошибке перераскладки изображение должно остаться прежним", t, func() {
+		chartService, imageRepo, tileService := newRetileService()
+
+		img, err := chartService.AddImage(ctx, width, height, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		tileService.resume = make(chan struct{})
+		tileService.saving = make(chan struct{})
+		tileService.err = errors.New("ошибка сохранения")
+		close(tileService.resume)
+
+		_, err = chartService.Retile(ctx, img.Id, tileutils.Layout{Kind: tileutils.LayoutStrip})
+		So(errors.Is(err, tileService.err), ShouldBeTrue)
+
+		So(imageRepo.images[img.Id], ShouldEqual, img)
+		So(tileService.repo.Images(), ShouldHaveLength, 1)
+		So(tileService.repo.Tiles(img.Id), ShouldEqual, 6)
+	})
+
+	Convey("Перераскладка rect:1x1 изображения максимального размера должна давать ошибку ErrLayout", t, func() {
+		chartService, imageRepo, tileService := newRetileService()
+
+		img := &chart.TiledImage{Id: "0", Width: 20_000, Height: 50_000, TileWidth: 10, TileHeight: 10}
+		imageRepo.images[img.Id] = img
+
+		_, err := chartService.Retile(ctx, img.Id, tileutils.Layout{Kind: tileutils.LayoutRect, TileWidth: 1, TileHeight: 1})
+		So(errors.Is(err, tileutils.ErrLayout), ShouldBeTrue)
+		So(imageRepo.images[img.Id], ShouldEqual, img)
+		So(tileService.repo.Images(), ShouldBeEmpty)
+	})
+
+	Convey("Перераскладка несуществующего изображения должна давать ErrNotExist", t, func() {
+		chartService := chart.NewChartographerService(&TestImageRepoGetNotExist{}, &TestTileServiceEmpty{}, nil, 10, nil, 1, 0)
+
+		_, err := chartService.Retile(ctx, "0", tileutils.Layout{})
+		So(errors.Is(err, chart.ErrNotExist), ShouldBeTrue)
+	})
+}
+
+// endregion Перераскладка тайлов
+
+// region Раскладки тайлов
+
+// benchmarkLayouts сравнивает раскладки тайлов на изображении в формате raw.
+// Построчный экспорт читает изображение полосами на всю ширину, как при кодировании в BMP,
+// произвольный доступ читает небольшие фрагменты в случайных местах.
+func benchmarkLayouts(b *testing.B, read func(b *testing.B, cs *chart.ChartographerService, img *chart.TiledImage)) {
+	const (
+		imgSize     = 2100
+		tileMaxSize = 250
+	)
+
+	for _, layout := range []tileutils.Layout{
+		{Kind: tileutils.LayoutSquare},
+		{Kind: tileutils.LayoutRect, TileWidth: 500, TileHeight: 125},
+		{Kind: tileutils.LayoutStrip},
+		{Kind: tileutils.LayoutAdaptive},
+	} {
+		b.Run(layout.String(), func(b *testing.B) {
+			repo, err := imgstore.NewFileSystemTileRepo(b.TempDir(), imgstore.FormatRaw.Ext())
+			if err != nil {
+				b.Fatal(err)
+			}
+			imageRepo := &TestImageRepo{images: make(map[string]*chart.TiledImage)}
+			cs := chart.NewChartographerService(imageRepo, imgstore.NewRawService(repo), &chart.ImageAdapter{},
+				tileMaxSize, nil, 1, 0)
+
+			img, err := cs.AddImage(ctx, imgSize, imgSize, layout)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			read(b, cs, img)
+		})
+	}
+}
+
+func BenchmarkLayout_RowExport(b *testing.B) {
+	const rows = 100
+
+	benchmarkLayouts(b, func(b *testing.B, cs *chart.ChartographerService, img *chart.TiledImage) {
+		for i := 0; i < b.N; i++ {
+			y := i * rows % img.Height
+			_, err := cs.GetFragment(ctx, img, 0, y, img.Width, rows)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkLayout_RandomFragment(b *testing.B) {
+	const size = 100
+
+	benchmarkLayouts(b, func(b *testing.B, cs *chart.ChartographerService, img *chart.TiledImage) {
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < b.N; i++ {
+			x, y := rnd.Intn(img.Width-size), rnd.Intn(img.Height-size)
+			_, err := cs.GetFragment(ctx, img, x, y, size, size)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// endregion Раскладки тайлов
+
+// region Полный стек в памяти
+
+// newMemoryService создает сервис с настоящими сервисом тайлов и хранилищами в памяти.
+func newMemoryService(format imgstore.Format, limit int64) (*chart.ChartographerService, *imgstore.MemoryRepository) {
+	repo := imgstore.NewMemoryRepo(limit)
+	tileService, err := imgstore.NewService(format, repo)
+	So(err, ShouldBeNil)
+
+	cs := chart.NewChartographerService(kvstore.NewInMemoryStore(), tileService, &chart.ImageAdapter{}, 100, nil, 4, 0)
+	return cs, repo
+}
+
+// colorAt - цвет пикселя (x; y) фрагмента, восстановленного тестом.
+func colorAt(x, y int) color.RGBA {
+	return color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 0xFF}
+}
+
+func TestMemoryStack(t *testing.T) {
+	black := color.RGBA{A: 0xFF}
+
+	for _, format := range []imgstore.Format{imgstore.FormatBmp, imgstore.FormatRaw} {
+		Convey("Фрагменты должны сохраняться и читаться через все слои, формат "+string(format), t, func() {
+			cs, repo := newMemoryService(format, 0)
+
+			img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+			So(err, ShouldBeNil)
+			So(repo.Bytes(), ShouldBeGreaterThan, 0)
+
+			// Фрагмент пересекает четыре тайла и выходит за правую и нижнюю границы изображения.
+			for _, r := range []image.Rectangle{image.Rect(70, 50, 190, 140), image.Rect(200, 150, 300, 250)} {
+				fragment := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+				for y := 0; y < r.Dy(); y++ {
+					for x := 0; x < r.Dx(); x++ {
+						fragment.SetRGBA(x, y, colorAt(r.Min.X+x, r.Min.Y+y))
+					}
+				}
+				err = cs.SetFragment(ctx, img, r.Min.X, r.Min.Y, fragment)
+				So(err, ShouldBeNil)
+			}
+
+			check := func(img *chart.TiledImage) {
+				got, err := cs.GetFragment(ctx, img, 0, 0, img.Width, img.Height)
+				So(err, ShouldBeNil)
+
+				painted := func(x, y int) bool {
+					p := image.Pt(x, y)
+					return p.In(image.Rect(70, 50, 190, 140)) || p.In(image.Rect(200, 150, 300, 250))
+				}
+				mismatch := 0
+				for y := 0; y < img.Height; y++ {
+					for x := 0; x < img.Width; x++ {
+						want := black
+						if painted(x, y) {
+							want = colorAt(x, y)
+						}
+						if got.At(x, y) != want {
+							mismatch++
+						}
+					}
+				}
+				So(mismatch, ShouldEqual, 0)
+			}
+			check(img)
+
+			img, err = cs.Retile(ctx, img.Id, tileutils.Layout{Kind: tileutils.LayoutStrip})
+			So(err, ShouldBeNil)
+			check(img)
+
+			So(cs.DeleteImage(ctx, img.Id), ShouldBeNil)
+			_, err = cs.GetImage(ctx, img.Id)
+			So(errors.Is(err, chart.ErrNotExist), ShouldBeTrue)
+			So(repo.Bytes(), ShouldEqual, 0)
+		})
+	}
+
+	Convey("Изображение, не помещающееся в лимит хранилища, не должно создаваться", t, func() {
+		cs, _ := newMemoryService(imgstore.FormatRaw, 100*100*4)
+
+		_, err := cs.AddImage(ctx, 100, 100, tileutils.Layout{})
+		So(err, ShouldBeNil)
+
+		_, err = cs.AddImage(ctx, 100, 100, tileutils.Layout{})
+		So(errors.Is(err, imgstore.ErrNoSpace), ShouldBeTrue)
+	})
+}
+
+// endregion Полный стек в памяти
+
+// region История изменений
+
+// uniformFragment создает фрагмент размера r, залитый цветом c.
+func uniformFragment(r image.Rectangle, c color.Color) image.Image {
+	fragment := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(fragment, fragment.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return fragment
+}
+
+var (
+	revRed   = color.RGBA{R: 0xFF, A: 0xFF}
+	revGreen = color.RGBA{G: 0xFF, A: 0xFF}
+	// Красный фрагмент 250x180 пересекает 4 тайла, зеленый частично перекрывает его и задевает еще один тайл.
+	revRedRect   = image.Rect(50, 50, 150, 150)
+	revGreenRect = image.Rect(100, 100, 250, 160)
+)
+
+// paintRevisions создает изображение 250x180 и накладывает на него красный, затем зеленый фрагмент.
+func paintRevisions(cs *chart.ChartographerService) *chart.TiledImage {
+	img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+	So(err, ShouldBeNil)
+	So(img.Revision, ShouldEqual, 0)
+
+	So(cs.SetFragment(ctx, img, revRedRect.Min.X, revRedRect.Min.Y, uniformFragment(revRedRect, revRed)), ShouldBeNil)
+	So(cs.SetFragment(ctx, img, revGreenRect.Min.X, revGreenRect.Min.Y, uniformFragment(revGreenRect, revGreen)), ShouldBeNil)
+
+	img, err = cs.GetImage(ctx, img.Id)
+	So(err, ShouldBeNil)
+	return img
+}
+
+// checkRevision проверяет, что изображение img в виде после ревизии revision - это черное изображение
+// с наложенными по порядку фрагментами rects цветов colors.
+func checkRevision(cs *chart.ChartographerService, img *chart.TiledImage, revision int,
+	rects []image.Rectangle, colors []color.RGBA) {
+	got, err := cs.GetRevisionFragment(ctx, img, revision, 0, 0, img.Width, img.Height)
+	So(err, ShouldBeNil)
+
+	mismatch := 0
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			want := color.RGBA{A: 0xFF}
+			for i, r := range rects {
+				if image.Pt(x, y).In(r) {
+					want = colors[i]
+				}
+			}
+			if got.At(x, y) != want {
+				mismatch++
+			}
+		}
+	}
+	So(mismatch, ShouldEqual, 0)
+}
+
+func TestRevisions(t *testing.T) {
+	redRect, greenRect := revRedRect, revGreenRect
+	red, green := revRed, revGreen
+
+	Convey("Каждое наложение фрагмента должно быть ревизией, которую можно прочитать", t, func() {
+		cs, repo := newMemoryService(imgstore.FormatBmp, 0)
+		img := paintRevisions(cs)
+		So(img.Revision, ShouldEqual, 2)
+		So(img.History, ShouldHaveLength, 2)
+		So(img.History[0].Number, ShouldEqual, 1)
+		So(img.History[0].Tiles, ShouldHaveLength, 4)
+		So(img.History[1].Number, ShouldEqual, 2)
+		So(image.Rect(img.History[1].X, img.History[1].Y,
+			img.History[1].X+img.History[1].Width, img.History[1].Y+img.History[1].Height), ShouldResemble, greenRect)
+		So(img.History[1].Tiles, ShouldHaveLength, 2)
+
+		Convey("Копии ревизии должны хранить только измененную часть тайлов", func() {
+			// Зеленый фрагмент пересекает тайлы (100;100)-(200;180) и (200;100)-(250;180).
+			tile, err := imgstore.NewBmpService(repo).GetTile(ctx, img.Id+".r2", 100, 100)
+			So(err, ShouldBeNil)
+			So(tile.Bounds().Size(), ShouldResemble, image.Pt(100, 60))
+			tile, err = imgstore.NewBmpService(repo).GetTile(ctx, img.Id+".r2", 200, 100)
+			So(err, ShouldBeNil)
+			So(tile.Bounds().Size(), ShouldResemble, image.Pt(50, 60))
+		})
+
+		Convey("Ревизии должны читаться в виде после своего наложения", func() {
+			checkRevision(cs, img, 0, nil, nil)
+			checkRevision(cs, img, 1, []image.Rectangle{redRect}, []color.RGBA{red})
+			checkRevision(cs, img, 2, []image.Rectangle{redRect, greenRect}, []color.RGBA{red, green})
+		})
+
+		Convey("Несуществующие ревизии не должны читаться", func() {
+			for _, revision := range []int{-1, 3} {
+				_, err := cs.GetRevisionFragment(ctx, img, revision, 0, 0, 10, 10)
+				So(errors.Is(err, chart.ErrRevisionNotExist), ShouldBeTrue)
+			}
+		})
+
+		Convey("Перераскладка должна удалять историю и сохранять номер ревизии", func() {
+			img, err := cs.Retile(ctx, img.Id, tileutils.Layout{Kind: tileutils.LayoutStrip})
+			So(err, ShouldBeNil)
+			So(img.Revision, ShouldEqual, 2)
+			So(img.History, ShouldBeEmpty)
+
+			checkRevision(cs, img, 2, []image.Rectangle{redRect, greenRect}, []color.RGBA{red, green})
+			_, err = cs.GetRevisionFragment(ctx, img, 1, 0, 0, 10, 10)
+			So(errors.Is(err, chart.ErrRevisionNotExist), ShouldBeTrue)
+		})
+
+		Convey("Сборщик мусора не должен удалять копии тайлов ревизий", func() {
+			c := chart.NewCollector(cs, func(context.Context) ([]string, error) { return repo.Images(), nil }, 0, 0)
+			defer c.Close()
+
+			removed, err := c.Collect(ctx)
+			So(err, ShouldBeNil)
+			So(removed, ShouldBeEmpty)
+			So(repo.Images(), ShouldHaveLength, 3)
+			checkRevision(cs, img, 0, nil, nil)
+		})
+
+		Convey("Удаление изображения должно удалять копии тайлов ревизий", func() {
+			So(cs.DeleteImage(ctx, img.Id), ShouldBeNil)
+			So(repo.Bytes(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Ошибка копирования тайлов не должна менять изображение и историю", t, func() {
+		repo := imgstore.NewMemoryRepo(0)
+		faults := fault.NewInjector(fault.Config{}, 1)
+		cs := chart.NewChartographerService(kvstore.NewInMemoryStore(),
+			imgstore.NewBmpService(imgstore.NewFaultRepo(repo, faults)), &chart.ImageAdapter{}, 100, nil, 4, 0)
+
+		img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+		created := repo.Bytes()
+
+		// Первые сохранения - копии тайлов в ревизию.
+		faults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 2})
+		err = cs.SetFragment(ctx, img, redRect.Min.X, redRect.Min.Y, uniformFragment(redRect, red))
+		So(errors.Is(err, fault.ErrInjected), ShouldBeTrue)
+
+		img, err = cs.GetImage(ctx, img.Id)
+		So(err, ShouldBeNil)
+		So(img.Revision, ShouldEqual, 0)
+		So(repo.Bytes(), ShouldEqual, created)
+	})
+
+	Convey("Ошибка записи тайлов должна возвращать тайлы к прежнему виду из копий", t, func() {
+		repo := imgstore.NewMemoryRepo(0)
+		faults := fault.NewInjector(fault.Config{}, 1)
+		cs := chart.NewChartographerService(kvstore.NewInMemoryStore(),
+			imgstore.NewBmpService(imgstore.NewFaultRepo(repo, faults)), &chart.ImageAdapter{}, 100, nil, 4, 0)
+
+		img, err := cs.AddImage(ctx, 250, 180, tileutils.Layout{})
+		So(err, ShouldBeNil)
+		created := repo.Bytes()
+
+		Convey("Ревизия не должна добавляться, если тайлы восстановлены", func() {
+			// 4 сохранения копий и 2 записи тайлов успешны, следующая запись - нет, восстановление успешно.
+			faults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 6, Failures: 1})
+			err = cs.SetFragment(ctx, img, redRect.Min.X, redRect.Min.Y, uniformFragment(redRect, red))
+			So(errors.Is(err, fault.ErrInjected), ShouldBeTrue)
+
+			img, err = cs.GetImage(ctx, img.Id)
+			So(err, ShouldBeNil)
+			So(img.Revision, ShouldEqual, 0)
+			So(repo.Images(), ShouldHaveLength, 1)
+			So(repo.Bytes(), ShouldEqual, created)
+			checkRevision(cs, img, 0, nil, nil)
+		})
+
+		Convey("Ревизия должна добавляться, если не удалось и восстановление, и ее можно отменить", func() {
+			faults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 6})
+			err = cs.SetFragment(ctx, img, redRect.Min.X, redRect.Min.Y, uniformFragment(redRect, red))
+			So(errors.Is(err, fault.ErrInjected), ShouldBeTrue)
+
+			img, err = cs.GetImage(ctx, img.Id)
+			So(err, ShouldBeNil)
+			So(img.Revision, ShouldEqual, 1)
+			checkRevision(cs, img, 0, nil, nil)
+
+			faults.Set(fault.Config{})
+			img, err = cs.Undo(ctx, img.Id)
+			So(err, ShouldBeNil)
+			checkRevision(cs, img, img.Revision, nil, nil)
+		})
+	})
+}
+
+func TestRevisions_Limit(t *testing.T) {
+	Convey("Ревизии сверх ограничения должны удаляться из истории вместе с копиями тайлов", t, func() {
+		repo := imgstore.NewMemoryRepo(0)
+		cs := chart.NewChartographerService(kvstore.NewInMemoryStore(), imgstore.NewBmpService(repo),
+			&chart.ImageAdapter{}, 100, nil, 4, 1)
+
+		img := paintRevisions(cs)
+		So(img.Revision, ShouldEqual, 2)
+		So(img.History, ShouldHaveLength, 1)
+		So(img.History[0].Number, ShouldEqual, 2)
+		// Текущие тайлы и копии тайлов ревизии 2.
+		So(repo.Images(), ShouldHaveLength, 2)
+
+		checkRevision(cs, img, 1, []image.Rectangle{revRedRect}, []color.RGBA{revRed})
+		_, err := cs.GetRevisionFragment(ctx, img, 0, 0, 0, 10, 10)
+		So(errors.Is(err, chart.ErrRevisionNotExist), ShouldBeTrue)
+
+		img, err = cs.Undo(ctx, img.Id)
+		So(err, ShouldBeNil)
+		checkRevision(cs, img, 3, []image.Rectangle{revRedRect}, []color.RGBA{revRed})
+		_, err = cs.Undo(ctx, img.Id)
+		So(errors.Is(err, chart.ErrNothingToUndo), ShouldBeTrue)
+	})
+}
+
+func TestRevert(t *testing.T) {
+	Convey("Отмена должна возвращать тайлы к виду после ревизии и записываться новой ревизией", t, func() {
+		cs, _ := newMemoryService(imgstore.FormatBmp, 0)
+		img := paintRevisions(cs)
+		red := []image.Rectangle{revRedRect}
+		redGreen := []image.Rectangle{revRedRect, revGreenRect}
+		colors := []color.RGBA{revRed, revGreen}
+
+		Convey("Revert должен отменять и частично перекрывшие фрагменты", func() {
+			img, err := cs.Revert(ctx, img.Id, 1)
+			So(err, ShouldBeNil)
+			So(img.Revision, ShouldEqual, 3)
+			rev := img.History[2]
+			So(*rev.RevertTo, ShouldEqual, 1)
+			So(rev.Tiles, ShouldHaveLength, 2)
+			So(image.Rect(rev.X, rev.Y, rev.X+rev.Width, rev.Y+rev.Height), ShouldResemble, revGreenRect)
+
+			checkRevision(cs, img, 3, red, colors)
+			checkRevision(cs, img, 2, redGreen, colors)
+
+			Convey("Отмену можно отменить возвратом к ревизии до нее", func() {
+				img, err = cs.Revert(ctx, img.Id, 2)
+				So(err, ShouldBeNil)
+				checkRevision(cs, img, img.Revision, redGreen, colors)
+			})
+		})
+
+		Convey("Undo должен отменять изменения по одному, пропуская отмены", func() {
+			img, err := cs.Undo(ctx, img.Id)
+			So(err, ShouldBeNil)
+			So(*img.History[2].RevertTo, ShouldEqual, 1)
+			checkRevision(cs, img, 3, red, colors)
+
+			img, err = cs.Undo(ctx, img.Id)
+			So(err, ShouldBeNil)
+			So(*img.History[3].RevertTo, ShouldEqual, 0)
+			checkRevision(cs, img, 4, nil, nil)
+
+			_, err = cs.Undo(ctx, img.Id)
+			So(errors.Is(err, chart.ErrNothingToUndo), ShouldBeTrue)
+		})
+
+		Convey("Возврат к текущей ревизии не должен менять тайлы", func() {
+			img, err := cs.Revert(ctx, img.Id, 2)
+			So(err, ShouldBeNil)
+			So(img.History[2].Tiles, ShouldBeEmpty)
+			checkRevision(cs, img, 3, redGreen, colors)
+		})
+
+		Convey("Несуществующая ревизия и изображение должны давать ошибку", func() {
+			_, err := cs.Revert(ctx, img.Id, 3)
+			So(errors.Is(err, chart.ErrRevisionNotExist), ShouldBeTrue)
+			_, err = cs.Revert(ctx, "0", 0)
+			So(errors.Is(err, chart.ErrNotExist), ShouldBeTrue)
+			_, err = cs.Undo(ctx, "0")
+			So(errors.Is(err, chart.ErrNotExist), ShouldBeTrue)
+		})
+
+		Convey("После перераскладки нельзя вернуться к ревизиям до нее", func() {
+			img, err := cs.Retile(ctx, img.Id, tileutils.Layout{Kind: tileutils.LayoutStrip})
+			So(err, ShouldBeNil)
+
+			_, err = cs.Revert(ctx, img.Id, 1)
+			So(errors.Is(err, chart.ErrRevisionNotExist), ShouldBeTrue)
+			_, err = cs.Undo(ctx, img.Id)
+			So(errors.Is(err, chart.ErrNothingToUndo), ShouldBeTrue)
+		})
+	})
+}
+
+// endregion История изменений
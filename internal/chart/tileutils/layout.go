@@ -0,0 +1,190 @@
+package tileutils
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Grid - равномерная сетка тайлов размера TileWidth x TileHeight, начиная с точки (0; 0).
+// Крайние тайлы обрезаются до размера изображения.
+type Grid struct {
+	TileWidth, TileHeight int
+}
+
+// Tiles делит прямоугольник размера width x height на тайлы сетки построчно, слева направо и сверху вниз.
+func (g Grid) Tiles(width, height int) []image.Rectangle {
+	tiles := make([]image.Rectangle, 0, (width/g.TileWidth+1)*(height/g.TileHeight+1))
+
+	for y := 0; y < height; y += g.TileHeight {
+		for x := 0; x < width; x += g.TileWidth {
+			tiles = append(tiles, g.tile(width, height, x, y))
+		}
+	}
+
+	return tiles
+}
+
+// Overlapped возвращает тайлы сетки изображения размера width x height, которые пересекаются с фрагментом.
+// Тайлы возвращаются в том же порядке, что и в Tiles.
+// Диапазон строк и столбцов тайлов вычисляется по сетке, поэтому время работы
+// зависит только от количества пересеченных тайлов, а не от количества тайлов изображения.
+func (g Grid) Overlapped(width, height int, fragment image.Rectangle) []image.Rectangle {
+	fragment = fragment.Intersect(image.Rect(0, 0, width, height))
+	if fragment.Empty() {
+		return nil
+	}
+
+	col0, col1 := fragment.Min.X/g.TileWidth, (fragment.Max.X-1)/g.TileWidth
+	row0, row1 := fragment.Min.Y/g.TileHeight, (fragment.Max.Y-1)/g.TileHeight
+
+	overlapped := make([]image.Rectangle, 0, (col1-col0+1)*(row1-row0+1))
+
+	for row := row0; row <= row1; row++ {
+		for col := col0; col <= col1; col++ {
+			overlapped = append(overlapped, g.tile(width, height, col*g.TileWidth, row*g.TileHeight))
+		}
+	}
+
+	return overlapped
+}
+
+// tile возвращает тайл с начальными координатами (x; y), обрезанный до размера изображения.
+func (g Grid) tile(width, height, x, y int) image.Rectangle {
+	w := min(width-x, g.TileWidth)
+	h := min(height-y, g.TileHeight)
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// LayoutKind - способ деления изображения на тайлы.
+type LayoutKind string
+
+const (
+	// LayoutSquare - квадратные тайлы максимального размера. Используется по умолчанию.
+	LayoutSquare LayoutKind = "square"
+	// LayoutRect - прямоугольные тайлы заданного размера.
+	LayoutRect LayoutKind = "rect"
+	// LayoutStrip - горизонтальные полосы на всю ширину изображения, как строки в BMP.
+	// Выгодны при построчном чтении изображения, фрагмент целиком читается из нескольких соседних полос.
+	LayoutStrip LayoutKind = "strip"
+	// LayoutAdaptive - тайлы одинакового размера, подобранного по размерам изображения:
+	// небольшое изображение хранится одним тайлом, у большого нет узких крайних тайлов.
+	LayoutAdaptive LayoutKind = "adaptive"
+)
+
+// ErrLayout означает, что раскладка тайлов задана некорректно или не подходит для изображения.
+var ErrLayout = errors.New("некорректная раскладка тайлов")
+
+// Layout - раскладка тайлов изображения. Нулевое значение соответствует LayoutSquare.
+type Layout struct {
+	Kind LayoutKind
+	// TileWidth и TileHeight - размер тайла для LayoutRect.
+	TileWidth, TileHeight int
+}
+
+// ParseLayout разбирает раскладку из строки вида square, strip, adaptive или rect:WxH, например rect:2000x250.
+// Пустая строка соответствует LayoutSquare.
+// Возможна ошибка ErrLayout.
+func ParseLayout(s string) (Layout, error) {
+	switch LayoutKind(s) {
+	case "", LayoutSquare:
+		return Layout{Kind: LayoutSquare}, nil
+	case LayoutStrip, LayoutAdaptive:
+		return Layout{Kind: LayoutKind(s)}, nil
+	}
+
+	size := strings.TrimPrefix(s, string(LayoutRect)+":")
+	if size == s {
+		return Layout{}, fmt.Errorf("%w: %q, ожидается square, strip, adaptive или rect:WxH", ErrLayout, s)
+	}
+
+	wh := strings.SplitN(size, "x", 2)
+	if len(wh) != 2 {
+		return Layout{}, fmt.Errorf("%w: %q, ожидается rect:WxH", ErrLayout, s)
+	}
+	width, errW := strconv.Atoi(wh[0])
+	height, errH := strconv.Atoi(wh[1])
+	if errW != nil || errH != nil || width < 1 || height < 1 {
+		return Layout{}, fmt.Errorf("%w: %q, ожидается rect:WxH с положительными W и H", ErrLayout, s)
+	}
+
+	return Layout{Kind: LayoutRect, TileWidth: width, TileHeight: height}, nil
+}
+
+func (l Layout) String() string {
+	switch l.Kind {
+	case "":
+		return string(LayoutSquare)
+	case LayoutRect:
+		return fmt.Sprintf("%s:%dx%d", LayoutRect, l.TileWidth, l.TileHeight)
+	}
+
+	return string(l.Kind)
+}
+
+// MaxTiles - максимальное количество тайлов изображения.
+// Ограничивает память под список тайлов и количество файлов изображения,
+// например, для раскладки rect:1x1 на изображении максимального размера.
+const MaxTiles = 1 << 17
+
+// Grid вычисляет сетку тайлов изображения размера width x height.
+// Площадь тайла не превышает tileMaxSize x tileMaxSize, поэтому тайл любой раскладки занимает в памяти
+// не больше квадратного тайла. Количество тайлов не превышает MaxTiles.
+// Возможна ошибка ErrLayout.
+func (l Layout) Grid(width, height, tileMaxSize int) (Grid, error) {
+	grid, err := l.grid(width, height, tileMaxSize)
+	if err != nil {
+		return Grid{}, err
+	}
+
+	count := int64(ceilDiv(width, grid.TileWidth)) * int64(ceilDiv(height, grid.TileHeight))
+	if count > MaxTiles {
+		return Grid{}, fmt.Errorf("%w: раскладка %s делит изображение %dx%d на %d тайлов, максимум %d",
+			ErrLayout, l, width, height, count, MaxTiles)
+	}
+
+	return grid, nil
+}
+
+func (l Layout) grid(width, height, tileMaxSize int) (Grid, error) {
+	maxArea := tileMaxSize * tileMaxSize
+
+	switch l.Kind {
+	case "", LayoutSquare:
+		return Grid{TileWidth: tileMaxSize, TileHeight: tileMaxSize}, nil
+
+	case LayoutRect:
+		if l.TileWidth < 1 || l.TileHeight < 1 {
+			return Grid{}, fmt.Errorf("%w: размер тайла %dx%d", ErrLayout, l.TileWidth, l.TileHeight)
+		}
+		if min(l.TileWidth, width)*min(l.TileHeight, height) > maxArea {
+			return Grid{}, fmt.Errorf("%w: площадь тайла %dx%d больше %dx%d",
+				ErrLayout, l.TileWidth, l.TileHeight, tileMaxSize, tileMaxSize)
+		}
+		return Grid{TileWidth: l.TileWidth, TileHeight: l.TileHeight}, nil
+
+	case LayoutStrip:
+		h := maxArea / width
+		if h < 1 {
+			return Grid{}, fmt.Errorf("%w: строка шириной %d больше площади тайла %dx%d",
+				ErrLayout, width, tileMaxSize, tileMaxSize)
+		}
+		return Grid{TileWidth: width, TileHeight: min(h, height)}, nil
+
+	case LayoutAdaptive:
+		if width*height <= maxArea {
+			return Grid{TileWidth: width, TileHeight: height}, nil
+		}
+		cols := ceilDiv(width, tileMaxSize)
+		rows := ceilDiv(height, tileMaxSize)
+		return Grid{TileWidth: ceilDiv(width, cols), TileHeight: ceilDiv(height, rows)}, nil
+	}
+
+	return Grid{}, fmt.Errorf("%w: %q", ErrLayout, l.Kind)
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
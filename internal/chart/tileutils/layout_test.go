@@ -0,0 +1,112 @@
+package tileutils_test
+
+import (
+	"errors"
+	"image"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+)
+
+func TestParseLayout(t *testing.T) {
+	Convey("Корректные раскладки должны разбираться и печататься обратно", t, func() {
+		for _, s := range []string{"square", "strip", "adaptive", "rect:2000x250"} {
+			layout, err := ParseLayout(s)
+			So(err, ShouldBeNil)
+			So(layout.String(), ShouldEqual, s)
+		}
+
+		layout, err := ParseLayout("rect:30x7")
+		So(err, ShouldBeNil)
+		So(layout, ShouldResemble, Layout{Kind: LayoutRect, TileWidth: 30, TileHeight: 7})
+
+		layout, err = ParseLayout("")
+		So(err, ShouldBeNil)
+		So(layout.Kind, ShouldEqual, LayoutSquare)
+	})
+
+	Convey("Некорректные раскладки должны давать ошибку ErrLayout", t, func() {
+		for _, s := range []string{"hex", "rect", "rect:", "rect:10", "rect:0x10", "rect:10x-1", "rect:axb"} {
+			_, err := ParseLayout(s)
+			So(errors.Is(err, ErrLayout), ShouldBeTrue)
+		}
+	})
+}
+
+func TestLayout_Grid(t *testing.T) {
+	const tileMaxSize = 10
+
+	Convey("Сетка должна вычисляться по раскладке и размеру изображения", t, func() {
+		for _, tc := range []struct {
+			layout        Layout
+			width, height int
+			expected      Grid
+		}{
+			{Layout{}, 25, 25, Grid{TileWidth: 10, TileHeight: 10}},
+			{Layout{Kind: LayoutRect, TileWidth: 50, TileHeight: 2}, 25, 25, Grid{TileWidth: 50, TileHeight: 2}},
+			{Layout{Kind: LayoutStrip}, 25, 25, Grid{TileWidth: 25, TileHeight: 4}},
+			{Layout{Kind: LayoutStrip}, 25, 3, Grid{TileWidth: 25, TileHeight: 3}},
+			{Layout{Kind: LayoutAdaptive}, 8, 12, Grid{TileWidth: 8, TileHeight: 12}},
+			{Layout{Kind: LayoutAdaptive}, 21, 25, Grid{TileWidth: 7, TileHeight: 9}},
+		} {
+			grid, err := tc.layout.Grid(tc.width, tc.height, tileMaxSize)
+			So(err, ShouldBeNil)
+			So(grid, ShouldResemble, tc.expected)
+		}
+	})
+
+	Convey("Тайл не должен превышать площадь tileMaxSize x tileMaxSize", t, func() {
+		_, err := Layout{Kind: LayoutRect, TileWidth: 11, TileHeight: 10}.Grid(25, 25, tileMaxSize)
+		So(errors.Is(err, ErrLayout), ShouldBeTrue)
+
+		_, err = Layout{Kind: LayoutStrip}.Grid(101, 1, tileMaxSize)
+		So(errors.Is(err, ErrLayout), ShouldBeTrue)
+
+		_, err = Layout{Kind: "hex"}.Grid(25, 25, tileMaxSize)
+		So(errors.Is(err, ErrLayout), ShouldBeTrue)
+	})
+
+	Convey("Количество тайлов не должно превышать MaxTiles", t, func() {
+		_, err := Layout{Kind: LayoutRect, TileWidth: 1, TileHeight: 1}.Grid(20_000, 50_000, 1000)
+		So(errors.Is(err, ErrLayout), ShouldBeTrue)
+
+		_, err = Layout{Kind: LayoutRect, TileWidth: 1, TileHeight: 1}.Grid(MaxTiles, 1, 1000)
+		So(err, ShouldBeNil)
+
+		_, err = Layout{Kind: LayoutRect, TileWidth: 1, TileHeight: 1}.Grid(MaxTiles+1, 1, 1000)
+		So(errors.Is(err, ErrLayout), ShouldBeTrue)
+
+		_, err = Layout{}.Grid(20_000, 50_000, 1000)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestGrid_Overlapped(t *testing.T) {
+	Convey("Прямоугольные тайлы, пересекающиеся с фрагментом, должны совпадать с перебором всех тайлов", t, func() {
+		const (
+			width  = 25
+			height = 12
+		)
+		grid := Grid{TileWidth: 7, TileHeight: 5}
+		all := grid.Tiles(width, height)
+		So(all, ShouldHaveLength, 4*3)
+
+		for _, fragment := range []image.Rectangle{
+			image.Rect(0, 0, 1, 1),
+			image.Rect(6, 4, 8, 6),
+			image.Rect(20, 10, 30, 30),
+			image.Rect(-1, -1, 26, 13),
+		} {
+			var expected []image.Rectangle
+			for _, tile := range all {
+				if tile.Overlaps(fragment) {
+					expected = append(expected, tile)
+				}
+			}
+
+			So(grid.Overlapped(width, height, fragment), ShouldResemble, expected)
+		}
+	})
+}
@@ -16,28 +16,11 @@ func min(a, b int) int {
 // CreateTiles делит прямоугольник указанного размера (width и height) на несколько тайлов (прямоугольников)
 // с максимальным размером tileMaxSize
 func CreateTiles(width, height, tileMaxSize int) []image.Rectangle {
-	tiles := make([]image.Rectangle, 0, (width/tileMaxSize+1)*(height/tileMaxSize+1))
-
-	for y := 0; y < height; y += tileMaxSize {
-		for x := 0; x < width; x += tileMaxSize {
-			w := min(width-x, tileMaxSize)
-			h := min(height-y, tileMaxSize)
-			tiles = append(tiles, image.Rect(x, y, x+w, y+h))
-		}
-	}
-
-	return tiles
+	return Grid{TileWidth: tileMaxSize, TileHeight: tileMaxSize}.Tiles(width, height)
 }
 
-// OverlappedTiles возвращает только те тайлы, которые пересекаются с фрагментом.
-func OverlappedTiles(imgTiles []image.Rectangle, fragment image.Rectangle) []image.Rectangle {
-	overlapped := make([]image.Rectangle, 0, len(imgTiles))
-
-	for _, tile := range imgTiles {
-		if tile.Overlaps(fragment) {
-			overlapped = append(overlapped, tile)
-		}
-	}
-
-	return overlapped
+// OverlappedTiles возвращает тайлы изображения размера width x height с максимальным размером тайла tileMaxSize,
+// которые пересекаются с фрагментом. Подробнее в Grid.Overlapped.
+func OverlappedTiles(width, height, tileMaxSize int, fragment image.Rectangle) []image.Rectangle {
+	return Grid{TileWidth: tileMaxSize, TileHeight: tileMaxSize}.Overlapped(width, height, fragment)
 }
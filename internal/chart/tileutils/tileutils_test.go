@@ -1,6 +1,7 @@
 package tileutils_test
 
 import (
+	"fmt"
 	. "github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
 	"image"
 	"testing"
@@ -52,16 +53,56 @@ func TestCreateTiles(t *testing.T) {
 }
 
 func TestOverlappedTiles(t *testing.T) {
-	Convey("", t, func() {
-		fragment := image.Rect(5, 5, 10, 10)
-		tiles := []image.Rectangle{
-			image.Rect(0, 0, 10, 10),   // пересекается
-			image.Rect(50, 50, 10, 10), // не пересекается
+	Convey("Должны возвращаться только тайлы, пересекающиеся с фрагментом, в порядке CreateTiles", t, func() {
+		const (
+			width       = 25
+			height      = 25
+			maxTileSize = 10
+		)
+		all := CreateTiles(width, height, maxTileSize)
+
+		for _, fragment := range []image.Rectangle{
+			image.Rect(5, 5, 10, 10),
+			image.Rect(9, 9, 11, 11),
+			image.Rect(15, 5, 25, 25),
+			image.Rect(-5, -5, 30, 30),
+			image.Rect(20, 20, 21, 21),
+		} {
+			var expected []image.Rectangle
+			for _, tile := range all {
+				if tile.Overlaps(fragment) {
+					expected = append(expected, tile)
+				}
+			}
+
+			So(OverlappedTiles(width, height, maxTileSize, fragment), ShouldResemble, expected)
 		}
+	})
+
+	Convey("Тайлы края изображения должны быть обрезаны до его размера", t, func() {
+		overlapped := OverlappedTiles(25, 25, 10, image.Rect(24, 24, 40, 40))
 
-		overlapped := OverlappedTiles(tiles, fragment)
+		So(overlapped, ShouldResemble, []image.Rectangle{image.Rect(20, 20, 25, 25)})
+	})
 
-		So(overlapped, ShouldHaveLength, 1)
-		So(overlapped[0], ShouldResemble, tiles[0])
+	Convey("Фрагмент вне изображения не пересекается ни с одним тайлом", t, func() {
+		So(OverlappedTiles(25, 25, 10, image.Rect(25, 0, 30, 5)), ShouldBeEmpty)
+		So(OverlappedTiles(25, 25, 10, image.Rect(-5, -5, 0, 0)), ShouldBeEmpty)
 	})
 }
+
+func BenchmarkOverlappedTiles(b *testing.B) {
+	const (
+		width  = 20000
+		height = 50000
+	)
+	fragment := image.Rect(10500, 25500, 11500, 26500)
+
+	for _, tileMaxSize := range []int{1000, 100, 10} {
+		b.Run(fmt.Sprintf("tile=%d", tileMaxSize), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = OverlappedTiles(width, height, tileMaxSize, fragment)
+			}
+		})
+	}
+}
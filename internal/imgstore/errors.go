@@ -0,0 +1,24 @@
+package imgstore
+
+import "errors"
+
+// ErrTruncated означает, что данных изображения меньше, чем следует из его заголовка.
+// Проверяется до декодирования, чтобы заголовок с огромными размерами и маленьким телом
+// не приводил к выделению памяти под все заявленные пиксели.
+var ErrTruncated = errors.New("размер данных изображения меньше заявленного в заголовке")
+
+// ErrRegion означает, что запрошенная область выходит за границы тайла.
+var ErrRegion = errors.New("область выходит за границы тайла")
+
+// ErrMmapUnsupported означает, что отображение файлов в память не поддерживается на текущей платформе.
+var ErrMmapUnsupported = errors.New("mmap не поддерживается на этой платформе")
+
+// ErrNoSpace означает, что тайл не помещается в хранилище с ограниченным размером.
+var ErrNoSpace = errors.New("в хранилище тайлов недостаточно места")
+
+// ErrChecksum означает, что контрольная сумма тайла не совпадает с сохраненной, то есть тайл поврежден.
+var ErrChecksum = errors.New("контрольная сумма тайла не совпадает, тайл поврежден")
+
+// ErrPackCorrupt означает, что упаковка тайлов повреждена не в конце: за некорректной записью есть корректные,
+// поэтому отбросить ее как недописанную нельзя.
+var ErrPackCorrupt = errors.New("упаковка тайлов повреждена")
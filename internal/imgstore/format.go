@@ -0,0 +1,38 @@
+package imgstore
+
+import "fmt"
+
+// Format - формат хранения тайлов.
+type Format string
+
+const (
+	FormatBmp Format = "bmp"
+	FormatRaw Format = "raw"
+)
+
+// Ext возвращает расширение файлов тайлов формата.
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+// ParseFormat проверяет, что формат name поддерживается.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(name); f {
+	case FormatBmp, FormatRaw:
+		return f, nil
+	default:
+		return "", fmt.Errorf("неизвестный формат тайлов %q, поддерживаются: %s, %s", name, FormatBmp, FormatRaw)
+	}
+}
+
+// NewService создает Service, хранящий тайлы в репозитории r в формате f.
+func NewService(f Format, r Repository) (Service, error) {
+	switch f {
+	case FormatBmp:
+		return NewBmpService(r), nil
+	case FormatRaw:
+		return NewRawService(r), nil
+	default:
+		return nil, fmt.Errorf("неизвестный формат тайлов %q", f)
+	}
+}
@@ -0,0 +1,125 @@
+package imgstore
+
+import (
+	"context"
+	"fmt"
+)
+
+// MigrateTiles перекодирует тайлы всех изображений в каталоге dirPath из формата from в формат to.
+// Тайл исходного формата удаляется только после успешного сохранения в новом формате,
+// поэтому прерванную миграцию можно запустить повторно.
+// Миграция выполняется, пока сервис остановлен. Возвращает количество перекодированных тайлов.
+func MigrateTiles(ctx context.Context, dirPath string, from, to Format) (int, error) {
+	if from == to {
+		return 0, fmt.Errorf("исходный и целевой форматы совпадают: %s", from)
+	}
+
+	fromRepo, err := NewFileSystemTileRepo(dirPath, from.Ext())
+	if err != nil {
+		return 0, err
+	}
+	fromService, err := NewService(from, fromRepo)
+	if err != nil {
+		return 0, err
+	}
+
+	toRepo, err := NewFileSystemTileRepo(dirPath, to.Ext())
+	if err != nil {
+		return 0, err
+	}
+	toService, err := NewService(to, toRepo)
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := fromRepo.Images()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, id := range ids {
+		tiles, err := fromRepo.Tiles(id)
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, t := range tiles {
+			img, err := fromService.GetTile(ctx, id, t.X, t.Y)
+			if err != nil {
+				return migrated, fmt.Errorf("тайл (%d; %d) изображения %s: %w", t.X, t.Y, id, err)
+			}
+
+			err = toService.SaveTile(ctx, id, t.X, t.Y, img)
+			if err != nil {
+				return migrated, err
+			}
+
+			err = fromRepo.DeleteTile(id, t.X, t.Y)
+			if err != nil {
+				return migrated, err
+			}
+
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+// CompressTiles сжимает несжатые тайлы формата f в каталоге dirPath, а при decompress - распаковывает сжатые.
+// Как и MigrateTiles, удаляет исходный тайл только после сохранения нового и выполняется, пока сервис остановлен.
+// Возвращает количество обработанных тайлов.
+func CompressTiles(ctx context.Context, dirPath string, f Format, decompress bool) (int, error) {
+	plainRepo, err := NewFileSystemTileRepo(dirPath, f.Ext())
+	if err != nil {
+		return 0, err
+	}
+	flateRepo, err := NewFileSystemTileRepo(dirPath, f.Ext()+FlateExt)
+	if err != nil {
+		return 0, err
+	}
+
+	if decompress {
+		return moveTiles(ctx, flateRepo, NewFlateRepository(flateRepo), plainRepo)
+	}
+	return moveTiles(ctx, plainRepo, plainRepo, NewFlateRepository(flateRepo))
+}
+
+// moveTiles переносит байты тайлов, перечисленных в каталоге list, из src в dst.
+// src и dst могут декорировать хранилища, например, сжимать тайлы.
+func moveTiles(ctx context.Context, list *FileSystemTileRepository, src, dst Repository) (int, error) {
+	ids, err := list.Images()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range ids {
+		tiles, err := list.Tiles(id)
+		if err != nil {
+			return moved, err
+		}
+
+		for _, t := range tiles {
+			b, err := src.GetTile(ctx, id, t.X, t.Y)
+			if err != nil {
+				return moved, fmt.Errorf("тайл (%d; %d) изображения %s: %w", t.X, t.Y, id, err)
+			}
+
+			err = dst.SaveTile(ctx, id, t.X, t.Y, b)
+			if err != nil {
+				return moved, err
+			}
+
+			err = list.DeleteTile(id, t.X, t.Y)
+			if err != nil {
+				return moved, err
+			}
+
+			moved++
+		}
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,90 @@
+package imgstore_test
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+func TestMigrateTiles(t *testing.T) {
+	Convey("После миграции тайлы должны читаться в новом формате с теми же пикселями, "+
+		"а тайлов старого формата не должно остаться", t, func() {
+		dir := t.TempDir()
+
+		bmpRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		bmpService := imgstore.NewBmpService(bmpRepo)
+
+		tiles := map[string][]struct{ x, y int }{
+			"a": {{0, 0}, {2, 0}},
+			"b": {{0, 0}},
+		}
+		img := newColorfulRGBA(2, 2)
+		for id, points := range tiles {
+			for _, p := range points {
+				So(bmpService.SaveTile(ctx, id, p.x, p.y, img), ShouldBeNil)
+			}
+		}
+
+		n, err := imgstore.MigrateTiles(ctx, dir, imgstore.FormatBmp, imgstore.FormatRaw)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+
+		rawRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+		rawService := imgstore.NewRawService(rawRepo)
+
+		for id, points := range tiles {
+			left, err := bmpRepo.Tiles(id)
+			So(err, ShouldBeNil)
+			So(left, ShouldBeEmpty)
+
+			for _, p := range points {
+				got, err := rawService.GetTile(ctx, id, p.x, p.y)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, img)
+			}
+		}
+	})
+}
+
+func TestCompressTiles(t *testing.T) {
+	Convey("После сжатия и распаковки тайлы должны читаться с теми же пикселями", t, func() {
+		dir := t.TempDir()
+
+		plainRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		flateRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext()+imgstore.FlateExt)
+		So(err, ShouldBeNil)
+
+		img := newColorfulRGBA(2, 2)
+		So(imgstore.NewBmpService(plainRepo).SaveTile(ctx, "a", 0, 0, img), ShouldBeNil)
+		So(imgstore.NewBmpService(plainRepo).SaveTile(ctx, "a", 2, 0, img), ShouldBeNil)
+
+		n, err := imgstore.CompressTiles(ctx, dir, imgstore.FormatBmp, false)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+
+		left, err := plainRepo.Tiles("a")
+		So(err, ShouldBeNil)
+		So(left, ShouldBeEmpty)
+
+		got, err := imgstore.NewBmpService(imgstore.NewFlateRepository(flateRepo)).GetTile(ctx, "a", 2, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+
+		n, err = imgstore.CompressTiles(ctx, dir, imgstore.FormatBmp, true)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+
+		left, err = flateRepo.Tiles("a")
+		So(err, ShouldBeNil)
+		So(left, ShouldBeEmpty)
+
+		got, err = imgstore.NewBmpService(plainRepo).GetTile(ctx, "a", 2, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package imgstore
+
+import "os"
+
+func mmapFile(*os.File, int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmapFile([]byte) error {
+	return ErrMmapUnsupported
+}
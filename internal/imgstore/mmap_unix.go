@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package imgstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile отображает первые size байт файла f в память для чтения и записи.
+// Изменения памяти видны другим процессам и попадают в файл (MAP_SHARED).
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
@@ -0,0 +1,126 @@
+package imgstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+)
+
+// Формат raw - заголовок фиксированного размера и упакованные строки пикселей RGB сверху вниз без выравнивания.
+//
+//	0  4 байта  rawMagic
+//	4  4 байта  ширина, little endian
+//	8  4 байта  высота, little endian
+//	12 4 байта  зарезервировано
+//	16 ...      строки по ширина*3 байт
+//
+// В отличие от BMP, не требует перестановки каналов BGR и переворота строк,
+// а смещение любой строки вычисляется по заголовку.
+const (
+	rawMagic        = "CHRT"
+	rawHeaderSize   = 16
+	rawPixelSize    = 3
+	rawWidthOffset  = 4
+	rawHeightOffset = 8
+
+	// rawMaxSide - наибольшая сторона тайла в заголовке. Сторона изображения не превышает 50 000,
+	// поэтому заголовок с большей стороной поврежден.
+	rawMaxSide = 1 << 16
+)
+
+var ErrRawFormat = errors.New("некорректный заголовок raw тайла")
+
+// rawSize возвращает размер raw тайла в байтах.
+// Вычисляется в int64: для сторон до rawMaxSide произведение не переполняется.
+func rawSize(width, height int) int64 {
+	return rawHeaderSize + int64(width)*int64(height)*rawPixelSize
+}
+
+// rawPixelOffset возвращает смещение пикселя (x; y) тайла ширины width от начала данных.
+func rawPixelOffset(width, x, y int) int64 {
+	return rawHeaderSize + (int64(y)*int64(width)+int64(x))*rawPixelSize
+}
+
+func encodeRawHeader(b []byte, width, height int) {
+	copy(b, rawMagic)
+	binary.LittleEndian.PutUint32(b[rawWidthOffset:], uint32(width))
+	binary.LittleEndian.PutUint32(b[rawHeightOffset:], uint32(height))
+}
+
+// decodeRawHeader возвращает размер тайла из заголовка.
+// Стороны больше rawMaxSide означают поврежденный заголовок.
+// Возможна ошибка ErrRawFormat.
+func decodeRawHeader(b []byte) (width, height int, err error) {
+	if len(b) < rawHeaderSize || string(b[:len(rawMagic)]) != rawMagic {
+		return 0, 0, ErrRawFormat
+	}
+
+	width = int(binary.LittleEndian.Uint32(b[rawWidthOffset:]))
+	height = int(binary.LittleEndian.Uint32(b[rawHeightOffset:]))
+	if width > rawMaxSide || height > rawMaxSide {
+		return 0, 0, ErrRawFormat
+	}
+	return width, height, nil
+}
+
+// encodeRaw кодирует изображение в формат raw. Альфа-канал отбрасывается.
+func encodeRaw(img image.Image) []byte {
+	r := img.Bounds()
+	b := make([]byte, rawSize(r.Dx(), r.Dy()))
+	encodeRawHeader(b, r.Dx(), r.Dy())
+
+	putRawPixels(b[rawHeaderSize:], img, r)
+	return b
+}
+
+// putRawPixels упаковывает пиксели прямоугольника r изображения img в dst построчно.
+func putRawPixels(dst []byte, img image.Image, r image.Rectangle) {
+	i := 0
+	if rgba, ok := img.(*image.RGBA); ok {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := rgba.Pix[rgba.PixOffset(r.Min.X, y):rgba.PixOffset(r.Max.X, y)]
+			for j := 0; j < len(row); j += 4 {
+				dst[i], dst[i+1], dst[i+2] = row[j], row[j+1], row[j+2]
+				i += rawPixelSize
+			}
+		}
+		return
+	}
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			dst[i], dst[i+1], dst[i+2] = c.R, c.G, c.B
+			i += rawPixelSize
+		}
+	}
+}
+
+// getRawPixels распаковывает построчно упакованные пиксели src в прямоугольник r изображения dst.
+func getRawPixels(dst *image.RGBA, r image.Rectangle, src []byte) {
+	i := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := dst.Pix[dst.PixOffset(r.Min.X, y):dst.PixOffset(r.Max.X, y)]
+		for j := 0; j < len(row); j += 4 {
+			row[j], row[j+1], row[j+2], row[j+3] = src[i], src[i+1], src[i+2], 0xFF
+			i += rawPixelSize
+		}
+	}
+}
+
+// decodeRaw декодирует raw тайл в непрозрачный image.RGBA с Bounds().Min равным (0; 0).
+// Возможны ошибки ErrRawFormat, ErrTruncated.
+func decodeRaw(b []byte) (*image.RGBA, error) {
+	width, height, err := decodeRawHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) < rawSize(width, height) {
+		return nil, ErrTruncated
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	getRawPixels(img, img.Bounds(), b[rawHeaderSize:])
+	return img, nil
+}
@@ -1,8 +1,68 @@
 package imgstore
 
+import "context"
+
 // Repository - хранилище изображений-тайлов.
+// Операции прекращаются с ошибкой ctx.Err(), если ctx отменен.
 type Repository interface {
-	SaveTile(id string, x int, y int, img []byte) error
-	GetTile(id string, x, y int) ([]byte, error)
-	DeleteImage(id string) error
+	SaveTile(ctx context.Context, id string, x int, y int, img []byte) error
+	GetTile(ctx context.Context, id string, x, y int) ([]byte, error)
+	DeleteImage(ctx context.Context, id string) error
+
+	// ReadTileAt читает len(p) байт тайла, начиная со смещения off, по аналогии с io.ReaderAt.
+	// Позволяет не считывать тайл фиксированной структуры целиком.
+	ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error)
+	// WriteTileAt записывает p в существующий тайл, начиная со смещения off, по аналогии с io.WriterAt.
+	WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error)
+}
+
+// InPlaceWriter - хранилище, сообщающее, изменяет ли WriteTileAt тайл на месте.
+// Хранилища, не реализующие InPlaceWriter, считаются перезаписывающими тайл целиком при каждом WriteTileAt.
+type InPlaceWriter interface {
+	// WritesInPlace возвращает true, если WriteTileAt записывает только переданные байты,
+	// не считывая и не сохраняя тайл заново.
+	WritesInPlace() bool
+}
+
+// writesInPlace сообщает, изменяет ли WriteTileAt хранилища r тайл на месте.
+func writesInPlace(r Repository) bool {
+	w, ok := r.(InPlaceWriter)
+	return ok && w.WritesInPlace()
+}
+
+// TileUpdater - хранилище, изменяющее тайл целиком чтением и записью без потерянных обновлений:
+// одновременное изменение того же тайла не затирается.
+type TileUpdater interface {
+	// UpdateTile считывает тайл (x; y) изображения id и сохраняет результат update.
+	// Если тайл изменился между чтением и сохранением, update вызывается повторно для нового содержимого,
+	// поэтому не должна иметь побочных эффектов. update может изменять переданный срез.
+	UpdateTile(ctx context.Context, id string, x, y int, update func(b []byte) ([]byte, error)) error
+}
+
+// updateTile изменяет тайл хранилища r функцией update: через TileUpdater, если r его реализует,
+// иначе чтением GetTile и записью SaveTile.
+func updateTile(ctx context.Context, r Repository, id string, x, y int, update func(b []byte) ([]byte, error)) error {
+	if u, ok := r.(TileUpdater); ok {
+		return u.UpdateTile(ctx, id, x, y, update)
+	}
+
+	b, err := r.GetTile(ctx, id, x, y)
+	if err != nil {
+		return err
+	}
+	b, err = update(b)
+	if err != nil {
+		return err
+	}
+	return r.SaveTile(ctx, id, x, y, b)
+}
+
+// writeAt записывает p в тайл b, начиная со смещения off, и возвращает измененный тайл.
+// Как и запись в файл, расширяет тайл, если p выходит за его конец.
+func writeAt(b, p []byte, off int64) []byte {
+	if end := off + int64(len(p)); end > int64(len(b)) {
+		b = append(b, make([]byte, end-int64(len(b)))...)
+	}
+	copy(b[off:], p)
+	return b
 }
@@ -0,0 +1,135 @@
+package imgstore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+)
+
+// ChecksumExt - суффикс расширения файлов тайлов с контрольной суммой, например ".bmp.crc".
+// Тайлы с контрольной суммой и без нее различаются по расширению и не смешиваются.
+const ChecksumExt = ".crc"
+
+// Тайл с контрольной суммой - заголовок и данные тайла.
+//
+//	0  4 байта  checksumMagic
+//	4  4 байта  CRC-32C данных, little endian
+//	8  ...      данные тайла
+const (
+	checksumMagic      = "CHRC"
+	checksumHeaderSize = 8
+	checksumOffset     = 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumRepository сохраняет тайлы в декорируемое хранилище вместе с контрольной суммой CRC-32C
+// и сверяет ее при чтении, поэтому повреждение тайла на диске обнаруживается до декодирования.
+//
+// Частичные чтение и запись (ReadTileAt, WriteTileAt) читают и проверяют тайл целиком,
+// поэтому RawService записывает область тайла одним SaveTile, а не построчными WriteTileAt.
+type ChecksumRepository struct {
+	repo Repository
+
+	// mismatches - сколько раз прочитан поврежденный тайл.
+	mismatches int64
+}
+
+// NewChecksumRepo создает ChecksumRepository, сохраняющий тайлы с контрольной суммой в r.
+func NewChecksumRepo(r Repository) *ChecksumRepository {
+	return &ChecksumRepository{repo: r}
+}
+
+// withChecksum возвращает тайл img с заголовком контрольной суммы.
+func withChecksum(img []byte) []byte {
+	b := make([]byte, checksumHeaderSize+len(img))
+	copy(b, checksumMagic)
+	binary.LittleEndian.PutUint32(b[checksumOffset:], crc32.Checksum(img, crc32c))
+	copy(b[checksumHeaderSize:], img)
+	return b
+}
+
+// verify сверяет контрольную сумму тайла (x; y) изображения id и возвращает данные тайла без заголовка.
+// Возможна ошибка ErrChecksum.
+func (r *ChecksumRepository) verify(id string, x, y int, b []byte) ([]byte, error) {
+	if len(b) < checksumHeaderSize || string(b[:len(checksumMagic)]) != checksumMagic ||
+		binary.LittleEndian.Uint32(b[checksumOffset:]) != crc32.Checksum(b[checksumHeaderSize:], crc32c) {
+		atomic.AddInt64(&r.mismatches, 1)
+		return nil, fmt.Errorf("тайл (%d; %d) изображения %s: %w", x, y, id, ErrChecksum)
+	}
+	return b[checksumHeaderSize:], nil
+}
+
+// SaveTile сохраняет тайл с контрольной суммой в декорируемое хранилище.
+func (r *ChecksumRepository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	return r.repo.SaveTile(ctx, id, x, y, withChecksum(img))
+}
+
+// GetTile возвращает тайл, контрольная сумма которого совпала с сохраненной.
+// Возможны ошибка ErrChecksum и ошибки декорируемого хранилища.
+func (r *ChecksumRepository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	b, err := r.repo.GetTile(ctx, id, x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.verify(id, x, y, b)
+}
+
+// DeleteImage удаляет тайлы изображения из декорируемого хранилища.
+func (r *ChecksumRepository) DeleteImage(ctx context.Context, id string) error {
+	return r.repo.DeleteImage(ctx, id)
+}
+
+// ReadTileAt проверяет тайл и копирует из него len(p) байт, начиная со смещения off.
+func (r *ChecksumRepository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	b, err := r.GetTile(ctx, id, x, y)
+	if err != nil {
+		return 0, err
+	}
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTileAt проверяет тайл, записывает в него p, начиная со смещения off, и сохраняет тайл с новой контрольной суммой.
+// Как и запись в файл, расширяет тайл, если p выходит за его конец.
+func (r *ChecksumRepository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	err := r.UpdateTile(ctx, id, x, y, func(b []byte) ([]byte, error) {
+		return writeAt(b, p, off), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// UpdateTile проверяет тайл, передает его update и сохраняет результат с новой контрольной суммой
+// через UpdateTile декорируемого хранилища, если оно его поддерживает.
+func (r *ChecksumRepository) UpdateTile(ctx context.Context, id string, x, y int, update func(b []byte) ([]byte, error)) error {
+	return updateTile(ctx, r.repo, id, x, y, func(b []byte) ([]byte, error) {
+		tile, err := r.verify(id, x, y, b)
+		if err != nil {
+			return nil, err
+		}
+		tile, err = update(tile)
+		if err != nil {
+			return nil, err
+		}
+		return withChecksum(tile), nil
+	})
+}
+
+// Mismatches возвращает, сколько раз был прочитан поврежденный тайл.
+func (r *ChecksumRepository) Mismatches() int64 {
+	return atomic.LoadInt64(&r.mismatches)
+}
@@ -0,0 +1,69 @@
+package imgstore_test
+
+import (
+	"errors"
+	"image"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+func TestChecksumRepository_Transparent(t *testing.T) {
+	Convey("Тайлы, сохраненные с контрольной суммой, должны читаться без изменений", t, func() {
+		for _, format := range []imgstore.Format{imgstore.FormatBmp, imgstore.FormatRaw} {
+			inner := imgstore.NewMemoryRepo(0)
+			service, err := imgstore.NewService(format, imgstore.NewChecksumRepo(inner))
+			So(err, ShouldBeNil)
+
+			img := newColorfulRGBA(5, 4)
+			err = service.SaveTile(ctx, "0", 0, 0, img)
+			So(err, ShouldBeNil)
+
+			got, err := service.GetTile(ctx, "0", 0, 0)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, img)
+
+			r := image.Rect(1, 1, 3, 3)
+			err = service.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+			So(err, ShouldBeNil)
+
+			region := image.NewRGBA(image.Rect(0, 0, 5, 4))
+			err = service.ReadTileRegion(ctx, "0", 0, 0, region.Rect, region)
+			So(err, ShouldBeNil)
+			So(region.At(0, 0), ShouldResemble, img.At(0, 0))
+			So(region.At(2, 2), ShouldResemble, red)
+		}
+	})
+}
+
+func TestChecksumRepository_Corrupted(t *testing.T) {
+	Convey("Поврежденный тайл должен обнаруживаться при любом чтении", t, func() {
+		inner := imgstore.NewMemoryRepo(0)
+		repo := imgstore.NewChecksumRepo(inner)
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte{1, 2, 3, 4}), ShouldBeNil)
+
+		// Один байт данных тайла инвертируется в обход контрольной суммы.
+		b, err := inner.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		_, err = inner.WriteTileAt(ctx, "0", 0, 0, []byte{^b[len(b)-1]}, int64(len(b)-1))
+		So(err, ShouldBeNil)
+
+		_, err = repo.GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, imgstore.ErrChecksum), ShouldBeTrue)
+		_, err = repo.ReadTileAt(ctx, "0", 0, 0, make([]byte, 2), 0)
+		So(errors.Is(err, imgstore.ErrChecksum), ShouldBeTrue)
+		_, err = repo.WriteTileAt(ctx, "0", 0, 0, []byte{5}, 0)
+		So(errors.Is(err, imgstore.ErrChecksum), ShouldBeTrue)
+		So(repo.Mismatches(), ShouldEqual, 3)
+	})
+
+	Convey("Тайл без заголовка контрольной суммы должен считаться поврежденным", t, func() {
+		inner := imgstore.NewMemoryRepo(0)
+		So(inner.SaveTile(ctx, "0", 0, 0, []byte{1, 2}), ShouldBeNil)
+
+		_, err := imgstore.NewChecksumRepo(inner).GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, imgstore.ErrChecksum), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,478 @@
+package imgstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// blobsDir - каталог с содержимым тайлов внутри каталога DedupRepository.
+// Начинается с точки, поэтому не совпадает с id изображения.
+const blobsDir = ".blobs"
+
+// DedupRepository - хранилище изображений-тайлов на диске, в котором одинаковые тайлы хранятся один раз.
+// Содержимое тайла (blob) сохраняется в файл, названный по хэшу SHA-256 содержимого,
+// а файл тайла в каталоге изображения, как в FileSystemTileRepository, содержит только хэш.
+// Одинаковыми бывают черные тайлы новых изображений и копии тайлов.
+//
+// Для каждого blob хранится количество ссылающихся на него тайлов, blob удаляется, когда ссылок не остается.
+// Ссылки восстанавливаются из файлов тайлов при создании хранилища, поэтому отдельно на диске не хранятся.
+// Тайлы с общим blob не изменяются на месте: WriteTileAt сохраняет измененную копию тайла.
+//
+// Blob и файлы тайлов записываются без общей блокировки, она удерживается только при изменении ссылок.
+// Изменения одного тайла упорядочиваются блокировкой тайла.
+type DedupRepository struct {
+	// fs отвечает за расположение файлов тайлов, в которых хранятся хэши.
+	fs *FileSystemTileRepository
+
+	// tileLocks упорядочивают изменения тайлов: запись blob, файла тайла и ссылок.
+	// Тайл соответствует блокировке по хэшу координат, поэтому число блокировок не растет с числом тайлов.
+	// Захватываются до mu.
+	tileLocks [64]sync.Mutex
+
+	// mu защищает tiles, refs и pending. Blob удаляется под mu, поэтому не удаляется,
+	// пока его открывают для чтения или записывают заново.
+	mu sync.RWMutex
+	// tiles - хэши тайлов изображений.
+	tiles map[string]map[image.Point]string
+	// refs - сколько тайлов ссылается на blob.
+	refs map[string]int
+	// pending - сколько начатых сохранений записывают ссылку на blob. Такой blob не удаляется.
+	pending map[string]int
+}
+
+// NewDedupRepo создает хранилище в каталоге dirPath и восстанавливает ссылки на blob по файлам тайлов.
+// Blob, на которые не ссылается ни один тайл, например, после прерванного сохранения, удаляются.
+func NewDedupRepo(dirPath, ext string) (*DedupRepository, error) {
+	fs, err := NewFileSystemTileRepo(dirPath, ext)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Join(dirPath, blobsDir), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &DedupRepository{
+		fs:      fs,
+		tiles:   make(map[string]map[image.Point]string),
+		refs:    make(map[string]int),
+		pending: make(map[string]int),
+	}
+
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load читает хэши тайлов и подсчитывает ссылки на blob.
+func (r *DedupRepository) load() error {
+	ids, err := r.Images()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		points, err := r.fs.Tiles(id)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range points {
+			b, err := os.ReadFile(r.fs.tilePath(id, p.X, p.Y))
+			if err != nil {
+				return err
+			}
+			hash := string(b)
+			if !r.blobExists(hash) {
+				return fmt.Errorf("тайл (%d; %d) изображения %s ссылается на отсутствующий blob %q",
+					p.X, p.Y, id, hash)
+			}
+
+			r.index(id)[p] = hash
+			r.refs[hash]++
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(r.fs.dirPath, blobsDir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// Временные файлы остаются от прерванной записи blob.
+		if strings.Contains(e.Name(), r.fs.ext+TempFileExt) {
+			err = os.Remove(filepath.Join(r.fs.dirPath, blobsDir, e.Name()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// Blob других форматов принадлежат другим хранилищам.
+		if !strings.HasSuffix(e.Name(), r.fs.ext) {
+			continue
+		}
+		if r.refs[strings.TrimSuffix(e.Name(), r.fs.ext)] == 0 {
+			err = os.Remove(filepath.Join(r.fs.dirPath, blobsDir, e.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *DedupRepository) blobPath(hash string) string {
+	return filepath.Join(r.fs.dirPath, blobsDir, hash+r.fs.ext)
+}
+
+func (r *DedupRepository) blobExists(hash string) bool {
+	_, err := os.Stat(r.blobPath(hash))
+	return err == nil
+}
+
+// writeBlob атомарно записывает blob. Временный файл уникален, поэтому одинаковые blob,
+// одновременно сохраняемые разными тайлами, не мешают друг другу.
+func (r *DedupRepository) writeBlob(hash string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Join(r.fs.dirPath, blobsDir), hash+r.fs.ext+TempFileExt+"*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), r.blobPath(hash))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// tileLock возвращает блокировку тайла (x; y) изображения id.
+func (r *DedupRepository) tileLock(id string, x, y int) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = fmt.Fprintf(h, "%s/%d/%d", id, x, y)
+	return &r.tileLocks[h.Sum32()%uint32(len(r.tileLocks))]
+}
+
+// index возвращает хэши тайлов изображения id, создавая их при необходимости. Вызывается под Lock.
+func (r *DedupRepository) index(id string) map[image.Point]string {
+	tiles, ok := r.tiles[id]
+	if !ok {
+		tiles = make(map[image.Point]string)
+		r.tiles[id] = tiles
+	}
+	return tiles
+}
+
+// hash возвращает хэш тайла (x; y) изображения id. Вызывается под mu.
+func (r *DedupRepository) hash(id string, x, y int) (string, error) {
+	hash, ok := r.tiles[id][image.Pt(x, y)]
+	if !ok {
+		return "", &os.PathError{Op: "open", Path: r.fs.tilePath(id, x, y), Err: os.ErrNotExist}
+	}
+	return hash, nil
+}
+
+// writeFile атомарно записывает файл: читатели видят либо прежнее, либо новое содержимое.
+func writeFile(path string, b []byte) error {
+	tmp := path + TempFileExt
+	err := os.WriteFile(tmp, b, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// release уменьшает количество ссылок на blob и удаляет его, если ссылок не осталось. Вызывается под Lock.
+func (r *DedupRepository) release(hash string) error {
+	r.refs[hash]--
+	if r.refs[hash] > 0 {
+		return nil
+	}
+
+	delete(r.refs, hash)
+	return r.removeUnused(hash)
+}
+
+// unpin отменяет начатое сохранение ссылки на blob и удаляет его, если он больше не нужен. Вызывается под Lock.
+func (r *DedupRepository) unpin(hash string) error {
+	r.pending[hash]--
+	if r.pending[hash] == 0 {
+		delete(r.pending, hash)
+	}
+	if r.refs[hash] > 0 {
+		return nil
+	}
+	return r.removeUnused(hash)
+}
+
+// removeUnused удаляет blob, если на него нет ссылок и он не сохраняется. Вызывается под Lock.
+func (r *DedupRepository) removeUnused(hash string) error {
+	if r.pending[hash] > 0 {
+		return nil
+	}
+
+	err := os.Remove(r.blobPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// SaveTile сохраняет blob тайла, если такого содержимого еще нет, и ссылку на него в файл тайла.
+// Blob, на который тайл ссылался ранее, удаляется, если на него больше никто не ссылается.
+func (r *DedupRepository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mu := r.tileLock(id, x, y)
+	mu.Lock()
+	defer mu.Unlock()
+
+	return r.save(id, x, y, img)
+}
+
+// save - SaveTile под блокировкой тайла.
+// Blob и файл тайла записываются без mu: под mu только закрепляется blob, а после записи - обновляются ссылки.
+func (r *DedupRepository) save(id string, x int, y int, img []byte) error {
+	sum := sha256.Sum256(img)
+	hash := hex.EncodeToString(sum[:])
+	pt := image.Pt(x, y)
+
+	r.mu.Lock()
+	old, exists := r.tiles[id][pt]
+	if exists && old == hash {
+		r.mu.Unlock()
+		return nil
+	}
+	// Blob, на который ссылается хотя бы один тайл, уже записан.
+	// Если ссылок нет, blob записывается даже при одновременном сохранении такого же содержимого другим тайлом.
+	write := r.refs[hash] == 0
+	r.pending[hash]++
+	r.mu.Unlock()
+
+	err := r.writeRef(id, x, y, hash, img, write)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		_ = r.unpin(hash)
+		return err
+	}
+
+	r.index(id)[pt] = hash
+	r.refs[hash]++
+	err = r.unpin(hash)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return r.release(old)
+	}
+	return nil
+}
+
+// writeRef записывает blob, если write, и ссылку на него в файл тайла.
+// Ссылка записывается после blob, поэтому после сбоя тайл не ссылается на несуществующий blob.
+func (r *DedupRepository) writeRef(id string, x, y int, hash string, img []byte, write bool) error {
+	if write {
+		err := r.writeBlob(hash, img)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(r.fs.imgDirPath(id), 0777)
+	if err != nil {
+		return err
+	}
+	return writeFile(r.fs.tilePath(id, x, y), []byte(hash))
+}
+
+// openBlob открывает blob тайла (x; y) изображения id.
+// Blob открывается под mu, а читается без него: открытый файл остается доступен для чтения и после удаления.
+func (r *DedupRepository) openBlob(id string, x, y int) (*os.File, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hash, err := r.hash(id, x, y)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(r.blobPath(hash))
+}
+
+// readBlob считывает blob тайла (x; y) изображения id целиком.
+func (r *DedupRepository) readBlob(id string, x, y int) ([]byte, error) {
+	f, err := r.openBlob(id, x, y)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// GetTile считывает blob тайла с координатами (x; y) изображения id.
+// Возможны ошибки типа *os.PathError, например os.ErrNotExist.
+func (r *DedupRepository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return r.readBlob(id, x, y)
+}
+
+// ReadTileAt читает часть blob тайла, начиная со смещения off.
+func (r *DedupRepository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	f, err := r.openBlob(id, x, y)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.ReadAt(p, off)
+}
+
+// WriteTileAt записывает p в копию тайла, начиная со смещения off, и сохраняет копию как новый blob.
+// Blob может принадлежать другим тайлам, поэтому на месте не изменяется.
+func (r *DedupRepository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	err := r.UpdateTile(ctx, id, x, y, func(b []byte) ([]byte, error) {
+		return writeAt(b, p, off), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// UpdateTile считывает blob тайла, передает его update и сохраняет результат под блокировкой тайла.
+func (r *DedupRepository) UpdateTile(ctx context.Context, id string, x, y int, update func(b []byte) ([]byte, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mu := r.tileLock(id, x, y)
+	mu.Lock()
+	defer mu.Unlock()
+
+	b, err := r.readBlob(id, x, y)
+	if err != nil {
+		return err
+	}
+	b, err = update(b)
+	if err != nil {
+		return err
+	}
+	return r.save(id, x, y, b)
+}
+
+// DeleteImage удаляет файлы тайлов изображения и blob, на которые больше никто не ссылается.
+func (r *DedupRepository) DeleteImage(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Тайлы изображения не изменяются, пока удаляются их файлы.
+	for i := range r.tileLocks {
+		r.tileLocks[i].Lock()
+		defer r.tileLocks[i].Unlock()
+	}
+
+	// Сначала удаляются ссылки, чтобы после сбоя не осталось тайлов, ссылающихся на удаленный blob.
+	err := os.RemoveAll(r.fs.imgDirPath(id))
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tiles := r.tiles[id]
+	delete(r.tiles, id)
+	for _, hash := range tiles {
+		err = r.release(hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Images возвращает id изображений, папки которых есть на диске.
+func (r *DedupRepository) Images() ([]string, error) {
+	all, err := r.fs.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := all[:0]
+	for _, id := range all {
+		if id != blobsDir {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// TileSets возвращает id изображений, в папках которых есть тайлы, см. FileSystemTileRepository.TileSets.
+func (r *DedupRepository) TileSets() ([]string, error) {
+	return r.fs.TileSets()
+}
+
+// Blobs возвращает количество уникальных тайлов.
+func (r *DedupRepository) Blobs() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.refs)
+}
+
+// Usage подсчитывает место, занимаемое тайлами: Stored - размер уникальных blob,
+// Original - размер тайлов без дедупликации.
+func (r *DedupRepository) Usage() (Usage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var u Usage
+	for hash, refs := range r.refs {
+		info, err := os.Stat(r.blobPath(hash))
+		if err != nil {
+			return u, err
+		}
+
+		u.Tiles += refs
+		u.Stored += info.Size()
+		u.Original += int64(refs) * info.Size()
+	}
+
+	return u, nil
+}
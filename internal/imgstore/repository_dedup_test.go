@@ -0,0 +1,172 @@
+package imgstore_test
+
+import (
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+// countBlobs возвращает количество файлов с содержимым тайлов в каталоге dir.
+func countBlobs(dir string) int {
+	entries, err := os.ReadDir(filepath.Join(dir, ".blobs"))
+	So(err, ShouldBeNil)
+	return len(entries)
+}
+
+func TestDedupRepo_Shared(t *testing.T) {
+	Convey("Одинаковые тайлы должны храниться один раз и удаляться с последней ссылкой", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewDedupRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+
+		black := []byte{0, 0, 0}
+		So(repo.SaveTile(ctx, "a", 0, 0, black), ShouldBeNil)
+		So(repo.SaveTile(ctx, "a", 10, 0, black), ShouldBeNil)
+		So(repo.SaveTile(ctx, "b", 0, 0, black), ShouldBeNil)
+		So(repo.SaveTile(ctx, "b", 10, 0, []byte{1, 2, 3}), ShouldBeNil)
+		So(repo.Blobs(), ShouldEqual, 2)
+		So(countBlobs(dir), ShouldEqual, 2)
+
+		u, err := repo.Usage()
+		So(err, ShouldBeNil)
+		So(u, ShouldResemble, imgstore.Usage{Tiles: 4, Stored: 6, Original: 12})
+
+		So(repo.DeleteImage(ctx, "a"), ShouldBeNil)
+		So(repo.Blobs(), ShouldEqual, 2)
+		got, err := repo.GetTile(ctx, "b", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, black)
+
+		So(repo.DeleteImage(ctx, "b"), ShouldBeNil)
+		So(repo.Blobs(), ShouldEqual, 0)
+		So(countBlobs(dir), ShouldEqual, 0)
+
+		_, err = repo.GetTile(ctx, "b", 0, 0)
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+	})
+
+	Convey("Перезапись тайла должна освобождать прежнее содержимое", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewDedupRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+
+		So(repo.SaveTile(ctx, "a", 0, 0, []byte{1}), ShouldBeNil)
+		So(repo.SaveTile(ctx, "a", 0, 0, []byte{2}), ShouldBeNil)
+		So(countBlobs(dir), ShouldEqual, 1)
+
+		got, err := repo.GetTile(ctx, "a", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, []byte{2})
+	})
+
+	Convey("Запись части тайла не должна менять тайлы с тем же содержимым", t, func() {
+		repo, err := imgstore.NewDedupRepo(t.TempDir(), imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+		service := imgstore.NewRawService(repo)
+
+		img := newColorfulRGBA(4, 4)
+		So(service.SaveTile(ctx, "a", 0, 0, img), ShouldBeNil)
+		So(service.SaveTile(ctx, "b", 0, 0, img), ShouldBeNil)
+		So(repo.Blobs(), ShouldEqual, 1)
+
+		r := image.Rect(0, 0, 4, 1)
+		So(service.WriteTileRegion(ctx, "a", 0, 0, r, fillRGBA(r, red)), ShouldBeNil)
+		So(repo.Blobs(), ShouldEqual, 2)
+
+		a, err := service.GetTile(ctx, "a", 0, 0)
+		So(err, ShouldBeNil)
+		So(a.At(0, 0), ShouldResemble, red)
+
+		b, err := service.GetTile(ctx, "b", 0, 0)
+		So(err, ShouldBeNil)
+		So(b, ShouldResemble, img)
+	})
+}
+
+func TestDedupRepo_Concurrent(t *testing.T) {
+	Convey("Одновременная запись тайлов с общим содержимым должна сохранять ссылки и blob согласованными", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewDedupRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+
+		const (
+			images = 8
+			tiles  = 4
+			rounds = 20
+		)
+		var wg sync.WaitGroup
+		errs := make(chan error, images*tiles*rounds*2)
+		for i := 0; i < images; i++ {
+			for x := 0; x < tiles; x++ {
+				wg.Add(1)
+				go func(id string, x int) {
+					defer wg.Done()
+					for n := 0; n < rounds; n++ {
+						errs <- repo.SaveTile(ctx, id, x, 0, []byte{byte(n % 3), 0})
+						_, err := repo.WriteTileAt(ctx, id, x, 0, []byte{1}, 1)
+						errs <- err
+					}
+				}(strconv.Itoa(i), x)
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+
+		// Последняя запись каждого тайла - {(rounds-1) % 3, 1}.
+		for i := 0; i < images; i++ {
+			for x := 0; x < tiles; x++ {
+				got, err := repo.GetTile(ctx, strconv.Itoa(i), x, 0)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, []byte{(rounds - 1) % 3, 1})
+			}
+		}
+		So(repo.Blobs(), ShouldEqual, 1)
+		So(countBlobs(dir), ShouldEqual, 1)
+
+		for i := 0; i < images; i++ {
+			So(repo.DeleteImage(ctx, strconv.Itoa(i)), ShouldBeNil)
+		}
+		So(repo.Blobs(), ShouldEqual, 0)
+		So(countBlobs(dir), ShouldEqual, 0)
+	})
+}
+
+func TestDedupRepo_Reopen(t *testing.T) {
+	Convey("Ссылки должны восстанавливаться с диска, а несвязанное содержимое - удаляться", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewDedupRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+
+		So(repo.SaveTile(ctx, "a", 0, 0, []byte{1}), ShouldBeNil)
+		So(repo.SaveTile(ctx, "b", 0, 0, []byte{1}), ShouldBeNil)
+		// Содержимое без ссылок, как после сбоя между сохранением содержимого и ссылки.
+		So(os.WriteFile(filepath.Join(dir, ".blobs", "orphan.bmp"), []byte{2}, 0666), ShouldBeNil)
+		// Временный файл, как после сбоя во время записи содержимого.
+		So(os.WriteFile(filepath.Join(dir, ".blobs", "orphan.bmp.tmp123"), []byte{3}, 0666), ShouldBeNil)
+
+		repo, err = imgstore.NewDedupRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		So(repo.Blobs(), ShouldEqual, 1)
+		So(countBlobs(dir), ShouldEqual, 1)
+
+		ids, err := repo.Images()
+		So(err, ShouldBeNil)
+		So(ids, ShouldHaveLength, 2)
+
+		So(repo.DeleteImage(ctx, "a"), ShouldBeNil)
+		got, err := repo.GetTile(ctx, "b", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, []byte{1})
+	})
+}
@@ -0,0 +1,85 @@
+package imgstore
+
+import (
+	"context"
+
+	"github.com/Dimedrolity/go-chartographer/pkg/fault"
+)
+
+// FaultRepository вносит в операции декорируемого хранилища сбои faults: ошибки, задержки
+// и повреждение прочитанных тайлов. Операции называются по методам Repository и TileUpdater: "SaveTile", "GetTile",
+// "ReadTileAt", "WriteTileAt", "UpdateTile", "DeleteImage". Предназначено для проверки устойчивости к сбоям.
+type FaultRepository struct {
+	repo   Repository
+	faults *fault.Injector
+}
+
+// NewFaultRepo создает FaultRepository, вносящий сбои faults в операции хранилища r.
+func NewFaultRepo(r Repository, faults *fault.Injector) *FaultRepository {
+	return &FaultRepository{repo: r, faults: faults}
+}
+
+func (r *FaultRepository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	err := r.faults.Before(ctx, "SaveTile")
+	if err != nil {
+		return err
+	}
+	return r.repo.SaveTile(ctx, id, x, y, img)
+}
+
+func (r *FaultRepository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	err := r.faults.Before(ctx, "GetTile")
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := r.repo.GetTile(ctx, id, x, y)
+	if err != nil {
+		return nil, err
+	}
+	return r.faults.Corrupt("GetTile", b), nil
+}
+
+func (r *FaultRepository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	err := r.faults.Before(ctx, "ReadTileAt")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.repo.ReadTileAt(ctx, id, x, y, p, off)
+	copy(p[:n], r.faults.Corrupt("ReadTileAt", p[:n]))
+	return n, err
+}
+
+func (r *FaultRepository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	err := r.faults.Before(ctx, "WriteTileAt")
+	if err != nil {
+		return 0, err
+	}
+	return r.repo.WriteTileAt(ctx, id, x, y, p, off)
+}
+
+// UpdateTile изменяет тайл через UpdateTile декорируемого хранилища, если оно его поддерживает.
+// Прочитанный тайл повреждается, как в GetTile.
+func (r *FaultRepository) UpdateTile(ctx context.Context, id string, x, y int, update func(b []byte) ([]byte, error)) error {
+	err := r.faults.Before(ctx, "UpdateTile")
+	if err != nil {
+		return err
+	}
+	return updateTile(ctx, r.repo, id, x, y, func(b []byte) ([]byte, error) {
+		return update(r.faults.Corrupt("UpdateTile", b))
+	})
+}
+
+// WritesInPlace возвращает то же, что декорируемое хранилище.
+func (r *FaultRepository) WritesInPlace() bool {
+	return writesInPlace(r.repo)
+}
+
+func (r *FaultRepository) DeleteImage(ctx context.Context, id string) error {
+	err := r.faults.Before(ctx, "DeleteImage")
+	if err != nil {
+		return err
+	}
+	return r.repo.DeleteImage(ctx, id)
+}
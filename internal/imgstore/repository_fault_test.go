@@ -0,0 +1,45 @@
+package imgstore_test
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/fault"
+)
+
+func TestFaultRepo(t *testing.T) {
+	Convey("Сбой записи не должен доходить до хранилища", t, func() {
+		faults := fault.NewInjector(fault.Config{Ops: []string{"SaveTile"}, ErrorRate: 1}, 1)
+		mem := imgstore.NewMemoryRepo(0)
+		repo := imgstore.NewFaultRepo(mem, faults)
+
+		err := repo.SaveTile(ctx, "0", 0, 0, []byte{1, 2, 3})
+		So(errors.Is(err, fault.ErrInjected), ShouldBeTrue)
+		So(mem.Bytes(), ShouldEqual, 0)
+	})
+
+	Convey("Повреждение прочитанного тайла не должно изменять сохраненный тайл", t, func() {
+		faults := fault.NewInjector(fault.Config{}, 1)
+		mem := imgstore.NewMemoryRepo(0)
+		repo := imgstore.NewFaultRepo(mem, faults)
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte{1, 2, 3}), ShouldBeNil)
+
+		faults.Set(fault.Config{CorruptRate: 1})
+		got, err := repo.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldNotResemble, []byte{1, 2, 3})
+
+		p := make([]byte, 3)
+		n, err := repo.ReadTileAt(ctx, "0", 0, 0, p, 0)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+		So(p, ShouldNotResemble, []byte{1, 2, 3})
+
+		stored, err := mem.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(stored, ShouldResemble, []byte{1, 2, 3})
+	})
+}
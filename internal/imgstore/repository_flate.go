@@ -0,0 +1,199 @@
+package imgstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// FlateExt - суффикс расширения файлов сжатых тайлов, например ".bmp.z".
+// Сжатые и несжатые тайлы одного формата различаются по расширению и не смешиваются.
+const FlateExt = ".z"
+
+// Сжатый тайл - заголовок и поток DEFLATE.
+//
+//	0  4 байта  flateMagic
+//	4  8 байт   размер несжатого тайла, little endian
+//	12 ...      поток DEFLATE
+//
+// Размер в заголовке позволяет выделить память под тайл заранее и подсчитать место без распаковки.
+const (
+	flateMagic      = "CHRZ"
+	flateHeaderSize = 12
+	flateSizeOffset = 4
+
+	// flateMaxSize - максимальный размер несжатого тайла: больше любого тайла изображения 20000x50000.
+	flateMaxSize = 1 << 32
+	// flatePrealloc - сколько памяти под распакованный тайл выделяется заранее, остальная выделяется по мере распаковки.
+	flatePrealloc = 4 << 20
+)
+
+// ErrFlateFormat означает, что данные не являются сжатым тайлом.
+var ErrFlateFormat = errors.New("некорректный заголовок сжатого тайла")
+
+// FlateRepository сжимает тайлы алгоритмом DEFLATE перед сохранением в декорируемое хранилище
+// и распаковывает при чтении, поэтому прозрачен для Service любого формата.
+// Черные и мало закрашенные тайлы сжимаются в сотни раз.
+//
+// Частичные чтение и запись (ReadTileAt, WriteTileAt) распаковывают тайл целиком,
+// поэтому RawService записывает область тайла одним SaveTile, а не построчными WriteTileAt.
+type FlateRepository struct {
+	repo    Repository
+	writers sync.Pool
+
+	// original и compressed - сколько байт тайлов сохранено до и после сжатия.
+	original, compressed int64
+}
+
+// NewFlateRepository создает FlateRepository, сохраняющий сжатые тайлы в r.
+func NewFlateRepository(r Repository) *FlateRepository {
+	return &FlateRepository{repo: r}
+}
+
+// compress сжимает тайл b.
+func (r *FlateRepository) compress(b []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(flateHeaderSize + len(b)/8)
+
+	header := make([]byte, flateHeaderSize)
+	copy(header, flateMagic)
+	binary.LittleEndian.PutUint64(header[flateSizeOffset:], uint64(len(b)))
+	buf.Write(header)
+
+	// Создание flate.Writer выделяет сотни килобайт, поэтому писатели переиспользуются.
+	w, ok := r.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		// BestSpeed: тайлы сжимаются при каждом сохранении, а однотонные области сжимаются хорошо при любом уровне.
+		w, _ = flate.NewWriter(&buf, flate.BestSpeed)
+	}
+	// Запись в bytes.Buffer не возвращает ошибок.
+	_, _ = w.Write(b)
+	_ = w.Close()
+	r.writers.Put(w)
+
+	atomic.AddInt64(&r.original, int64(len(b)))
+	atomic.AddInt64(&r.compressed, int64(buf.Len()))
+	return buf.Bytes()
+}
+
+// decompress распаковывает сжатый тайл b.
+// Поток читается не дальше размера из заголовка, а память выделяется по мере распаковки,
+// поэтому поврежденный заголовок с большим размером не приводит к выделению памяти под несуществующие данные.
+// Возможны ошибки ErrFlateFormat и ErrTruncated.
+func decompress(b []byte) ([]byte, error) {
+	size, err := decodeFlateHeader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if size < flatePrealloc {
+		out.Grow(int(size))
+	} else {
+		out.Grow(flatePrealloc)
+	}
+	n, err := io.Copy(&out, io.LimitReader(flate.NewReader(bytes.NewReader(b[flateHeaderSize:])), size))
+	if err != nil || n != size {
+		return nil, ErrTruncated
+	}
+
+	return out.Bytes(), nil
+}
+
+// decodeFlateHeader возвращает размер несжатого тайла из заголовка.
+// Возможна ошибка ErrFlateFormat.
+func decodeFlateHeader(b []byte) (int64, error) {
+	if len(b) < flateHeaderSize || string(b[:len(flateMagic)]) != flateMagic {
+		return 0, ErrFlateFormat
+	}
+
+	size := binary.LittleEndian.Uint64(b[flateSizeOffset:])
+	// Размер несжатого тайла ограничен размерами изображения, больший размер означает поврежденный заголовок.
+	if size > flateMaxSize {
+		return 0, ErrFlateFormat
+	}
+	return int64(size), nil
+}
+
+// SaveTile сжимает тайл и сохраняет его в декорируемое хранилище.
+func (r *FlateRepository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	return r.repo.SaveTile(ctx, id, x, y, r.compress(img))
+}
+
+// GetTile возвращает распакованный тайл.
+// Возможны ошибки ErrFlateFormat, ErrTruncated и ошибки декорируемого хранилища.
+func (r *FlateRepository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	b, err := r.repo.GetTile(ctx, id, x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(b)
+}
+
+// DeleteImage удаляет тайлы изображения из декорируемого хранилища.
+func (r *FlateRepository) DeleteImage(ctx context.Context, id string) error {
+	return r.repo.DeleteImage(ctx, id)
+}
+
+// ReadTileAt распаковывает тайл и копирует из него len(p) байт, начиная со смещения off.
+func (r *FlateRepository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	b, err := r.GetTile(ctx, id, x, y)
+	if err != nil {
+		return 0, err
+	}
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTileAt распаковывает тайл, записывает в него p, начиная со смещения off, и сохраняет тайл заново.
+// Как и запись в файл, расширяет тайл, если p выходит за его конец.
+func (r *FlateRepository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	err := r.UpdateTile(ctx, id, x, y, func(b []byte) ([]byte, error) {
+		return writeAt(b, p, off), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// UpdateTile распаковывает тайл, передает его update и сохраняет сжатый результат
+// через UpdateTile декорируемого хранилища, если оно его поддерживает.
+func (r *FlateRepository) UpdateTile(ctx context.Context, id string, x, y int, update func(b []byte) ([]byte, error)) error {
+	return updateTile(ctx, r.repo, id, x, y, func(b []byte) ([]byte, error) {
+		tile, err := decompress(b)
+		if err != nil {
+			return nil, err
+		}
+		tile, err = update(tile)
+		if err != nil {
+			return nil, err
+		}
+		return r.compress(tile), nil
+	})
+}
+
+// Original возвращает, сколько байт тайлов сохранено до сжатия.
+func (r *FlateRepository) Original() int64 {
+	return atomic.LoadInt64(&r.original)
+}
+
+// Compressed возвращает, сколько байт тайлов сохранено после сжатия.
+func (r *FlateRepository) Compressed() int64 {
+	return atomic.LoadInt64(&r.compressed)
+}
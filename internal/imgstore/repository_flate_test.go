@@ -0,0 +1,114 @@
+package imgstore_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+// newBlackRGBA создает непрозрачное черное изображение, как у нового изображения.
+func newBlackRGBA(width, height int) *image.RGBA {
+	return fillRGBA(image.Rect(0, 0, width, height), color.RGBA{A: 0xFF})
+}
+
+func TestFlateRepository_Transparent(t *testing.T) {
+	Convey("Тайлы, сохраненные через сжимающее хранилище, должны читаться без изменений", t, func() {
+		for _, format := range []imgstore.Format{imgstore.FormatBmp, imgstore.FormatRaw} {
+			inner := &TestTileRepo{images: make(map[string][]byte)}
+			service, err := imgstore.NewService(format, imgstore.NewFlateRepository(inner))
+			So(err, ShouldBeNil)
+
+			img := newColorfulRGBA(5, 4)
+			err = service.SaveTile(ctx, "0", 0, 0, img)
+			So(err, ShouldBeNil)
+
+			got, err := service.GetTile(ctx, "0", 0, 0)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, img)
+
+			r := image.Rect(1, 1, 3, 3)
+			err = service.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+			So(err, ShouldBeNil)
+
+			region := image.NewRGBA(image.Rect(0, 0, 5, 4))
+			err = service.ReadTileRegion(ctx, "0", 0, 0, region.Rect, region)
+			So(err, ShouldBeNil)
+			So(region.At(0, 0), ShouldResemble, img.At(0, 0))
+			So(region.At(2, 2), ShouldResemble, red)
+		}
+	})
+}
+
+func TestFlateRepository_Ratio(t *testing.T) {
+	Convey("Черный тайл должен занимать меньше процента исходного размера", t, func() {
+		inner := &TestTileRepo{images: make(map[string][]byte)}
+		repo := imgstore.NewFlateRepository(inner)
+
+		err := imgstore.NewBmpService(repo).SaveTile(ctx, "0", 0, 0, newBlackRGBA(1000, 1000))
+		So(err, ShouldBeNil)
+
+		So(repo.Original(), ShouldBeGreaterThan, 3_000_000)
+		So(repo.Compressed(), ShouldEqual, len(inner.images["0"]))
+		So(repo.Compressed()*100, ShouldBeLessThan, repo.Original())
+	})
+}
+
+func TestFlateRepository_Corrupted(t *testing.T) {
+	Convey("Несжатые или обрезанные данные должны давать ошибку", t, func() {
+		inner := &TestTileRepo{images: make(map[string][]byte)}
+		repo := imgstore.NewFlateRepository(inner)
+
+		inner.images["0"] = []byte("BM not compressed")
+		_, err := repo.GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, imgstore.ErrFlateFormat), ShouldBeTrue)
+
+		err = repo.SaveTile(ctx, "1", 0, 0, make([]byte, 1000))
+		So(err, ShouldBeNil)
+		inner.images["1"] = inner.images["1"][:13] // заголовок и 1 байт потока
+		_, err = repo.GetTile(ctx, "1", 0, 0)
+		So(errors.Is(err, imgstore.ErrTruncated), ShouldBeTrue)
+
+		// Размер в заголовке больше распакованных данных: память под заявленный размер не выделяется.
+		err = repo.SaveTile(ctx, "2", 0, 0, make([]byte, 1000))
+		So(err, ShouldBeNil)
+		binary.LittleEndian.PutUint64(inner.images["2"][4:], 1<<32)
+		_, err = repo.GetTile(ctx, "2", 0, 0)
+		So(errors.Is(err, imgstore.ErrTruncated), ShouldBeTrue)
+
+		binary.LittleEndian.PutUint64(inner.images["2"][4:], 1<<32+1)
+		_, err = repo.GetTile(ctx, "2", 0, 0)
+		So(errors.Is(err, imgstore.ErrFlateFormat), ShouldBeTrue)
+	})
+}
+
+func TestFileSystemTileRepo_Usage(t *testing.T) {
+	Convey("Место, занимаемое сжатыми тайлами, должно учитывать исходный размер из заголовка", t, func() {
+		dir := t.TempDir()
+
+		plain, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+		compressed, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatRaw.Ext()+imgstore.FlateExt)
+		So(err, ShouldBeNil)
+
+		img := newBlackRGBA(100, 100)
+		So(imgstore.NewRawService(plain).SaveTile(ctx, "a", 0, 0, img), ShouldBeNil)
+		So(imgstore.NewRawService(imgstore.NewFlateRepository(compressed)).SaveTile(ctx, "a", 100, 0, img), ShouldBeNil)
+		So(imgstore.NewRawService(imgstore.NewFlateRepository(compressed)).SaveTile(ctx, "b", 0, 0, img), ShouldBeNil)
+
+		plainUsage, err := plain.Usage()
+		So(err, ShouldBeNil)
+		So(plainUsage, ShouldResemble, imgstore.Usage{Tiles: 1, Stored: 30016, Original: 30016})
+
+		compressedUsage, err := compressed.Usage()
+		So(err, ShouldBeNil)
+		So(compressedUsage.Tiles, ShouldEqual, 2)
+		So(compressedUsage.Original, ShouldEqual, 2*30016)
+		So(compressedUsage.Stored, ShouldBeLessThan, 30016/10)
+	})
+}
@@ -1,17 +1,22 @@
 package imgstore
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"image"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // FileSystemTileRepository - хранилище изображений-тайлов в файлах на диске.
 type FileSystemTileRepository struct {
 	dirPath string
+	ext     string // Расширение файлов тайлов, соответствует формату хранения, см. Format.Ext.
 }
 
-func NewFileSystemTileRepo(dirPath string) (*FileSystemTileRepository, error) {
+func NewFileSystemTileRepo(dirPath, ext string) (*FileSystemTileRepository, error) {
 	// If path is already a directory, MkdirAll does nothing and returns nil.
 	err := os.MkdirAll(dirPath, os.ModePerm)
 	if err != nil {
@@ -20,6 +25,7 @@ func NewFileSystemTileRepo(dirPath string) (*FileSystemTileRepository, error) {
 
 	repo := &FileSystemTileRepository{
 		dirPath: dirPath,
+		ext:     ext,
 	}
 	return repo, nil
 }
@@ -27,16 +33,21 @@ func NewFileSystemTileRepo(dirPath string) (*FileSystemTileRepository, error) {
 func (r *FileSystemTileRepository) imgDirPath(id string) string {
 	return filepath.Join(r.dirPath, id)
 }
-func tileFilename(x, y int) string {
-	return fmt.Sprintf("Y=%d; X=%d.bmp", y, x)
+func (r *FileSystemTileRepository) tileFilename(x, y int) string {
+	return fmt.Sprintf("Y=%d; X=%d%s", y, x, r.ext)
 }
 func (r *FileSystemTileRepository) tilePath(id string, x, y int) string {
-	return filepath.Join(r.imgDirPath(id), tileFilename(x, y))
+	return filepath.Join(r.imgDirPath(id), r.tileFilename(x, y))
 }
 
 // SaveTile сохраняет тайл-изображение на диск.
-// По id создается папка на диске для тайлов изображения, для каждого тайла создается файл и именуется по координатам "Y=<y>; X=<x>.bmp".
-func (r *FileSystemTileRepository) SaveTile(id string, x int, y int, img []byte) error {
+// По id создается папка на диске для тайлов изображения, для каждого тайла создается файл и именуется
+// по координатам "Y=<y>; X=<x><ext>".
+func (r *FileSystemTileRepository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	dir := r.imgDirPath(id)
 	err := os.MkdirAll(dir, 0777)
 	if err != nil {
@@ -54,13 +65,236 @@ func (r *FileSystemTileRepository) SaveTile(id string, x int, y int, img []byte)
 
 // GetTile считывает с диска изображение-тайл с координатами (x; y) изображения id.
 // Возможны ошибки типа *os.PathError, например os.ErrNotExist.
-func (r *FileSystemTileRepository) GetTile(id string, x, y int) ([]byte, error) {
+func (r *FileSystemTileRepository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	path := r.tilePath(id, x, y)
 	return os.ReadFile(path)
 }
 
+// ReadTileAt читает часть файла тайла, начиная со смещения off.
+func (r *FileSystemTileRepository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(r.tilePath(id, x, y))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.ReadAt(p, off)
+}
+
+// WriteTileAt перезаписывает часть файла существующего тайла, начиная со смещения off.
+func (r *FileSystemTileRepository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(r.tilePath(id, x, y), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.WriteAt(p, off)
+	if err != nil {
+		_ = f.Close()
+		return n, err
+	}
+
+	return n, f.Close()
+}
+
+// WritesInPlace возвращает true: WriteTileAt перезаписывает только часть файла тайла.
+func (r *FileSystemTileRepository) WritesInPlace() bool {
+	return true
+}
+
 // DeleteImage удаляет изображение с диска.
-func (r *FileSystemTileRepository) DeleteImage(id string) error {
+func (r *FileSystemTileRepository) DeleteImage(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// If the path does not exist, RemoveAll returns nil (no error).
 	return os.RemoveAll(filepath.Join(r.dirPath, id))
 }
+
+// DeleteTile удаляет с диска тайл с координатами (x; y) изображения id.
+func (r *FileSystemTileRepository) DeleteTile(id string, x, y int) error {
+	return os.Remove(r.tilePath(id, x, y))
+}
+
+// Images возвращает id изображений, папки которых есть на диске.
+func (r *FileSystemTileRepository) Images() ([]string, error) {
+	entries, err := os.ReadDir(r.dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+
+	return ids, nil
+}
+
+// TileSets возвращает id изображений, в папках которых есть тайлы с расширением репозитория.
+// В отличие от Images, пропускает папки, не принадлежащие хранилищу, например папку журнала метаданных.
+func (r *FileSystemTileRepository) TileSets() ([]string, error) {
+	all, err := r.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := all[:0]
+	for _, id := range all {
+		tiles, err := r.Tiles(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(tiles) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Tiles возвращает координаты тайлов изображения id, сохраненных с расширением репозитория.
+// Файлы с другими именами пропускаются.
+func (r *FileSystemTileRepository) Tiles(id string) ([]image.Point, error) {
+	entries, err := os.ReadDir(r.imgDirPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	tiles := make([]image.Point, 0, len(entries))
+	for _, e := range entries {
+		p, ok := r.parseTileFilename(e.Name())
+		if ok && !e.IsDir() {
+			tiles = append(tiles, p)
+		}
+	}
+
+	return tiles, nil
+}
+
+// Deduplicated сообщает, что в каталоге хранилища лежат тайлы DedupRepository:
+// файлы тайлов содержат не изображения, а хэши содержимого.
+func (r *FileSystemTileRepository) Deduplicated() (bool, error) {
+	info, err := os.Stat(filepath.Join(r.dirPath, blobsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// TempFileExt - часть имени временных файлов, которые хранилища в каталоге, например DedupRepository
+// и PackRepository, и MmapService записывают перед атомарной заменой основного файла. За ней может следовать
+// случайный суффикс уникального имени. FileSystemTileRepository сохраняет тайлы без временных файлов.
+const TempFileExt = ".tmp"
+
+// TempFiles возвращает пути временных файлов в каталоге хранилища и вложенных в него каталогах,
+// в том числе в каталоге содержимого DedupRepository.
+// Временные файлы остаются на диске, если процесс остановился до замены ими основного файла.
+func (r *FileSystemTileRepository) TempFiles() ([]string, error) {
+	var paths []string
+	dirs := []string{r.dirPath}
+	for i := 0; i < len(dirs); i++ {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			path := filepath.Join(dirs[i], e.Name())
+			switch {
+			case e.IsDir() && i == 0:
+				dirs = append(dirs, path)
+			case !e.IsDir() && strings.Contains(e.Name(), TempFileExt):
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// parseTileFilename - обратная к tileFilename функция.
+func (r *FileSystemTileRepository) parseTileFilename(name string) (image.Point, bool) {
+	if !strings.HasSuffix(name, r.ext) {
+		return image.Point{}, false
+	}
+
+	var x, y int
+	_, err := fmt.Sscanf(strings.TrimSuffix(name, r.ext), "Y=%d; X=%d", &y, &x)
+	if err != nil || r.tileFilename(x, y) != name {
+		return image.Point{}, false
+	}
+
+	return image.Pt(x, y), true
+}
+
+// Usage - место, занимаемое тайлами.
+type Usage struct {
+	Tiles int
+	// Stored - сколько байт тайлы занимают на диске.
+	Stored int64
+	// Original - сколько байт тайлы занимали бы без сжатия.
+	Original int64
+}
+
+// Usage подсчитывает место, занимаемое тайлами с расширением репозитория.
+// Исходный размер сжатых тайлов (расширение оканчивается на FlateExt) читается из их заголовков.
+func (r *FileSystemTileRepository) Usage() (Usage, error) {
+	var u Usage
+
+	ids, err := r.Images()
+	if err != nil {
+		return u, err
+	}
+
+	compressed := strings.HasSuffix(r.ext, FlateExt)
+	header := make([]byte, flateHeaderSize)
+	for _, id := range ids {
+		tiles, err := r.Tiles(id)
+		if err != nil {
+			return u, err
+		}
+
+		for _, t := range tiles {
+			info, err := os.Stat(r.tilePath(id, t.X, t.Y))
+			if err != nil {
+				return u, err
+			}
+
+			original := info.Size()
+			if compressed {
+				_, err = r.ReadTileAt(context.Background(), id, t.X, t.Y, header, 0)
+				if err != nil {
+					return u, err
+				}
+				original, err = decodeFlateHeader(header)
+				if err != nil {
+					return u, err
+				}
+			}
+
+			u.Tiles++
+			u.Stored += info.Size()
+			u.Original += original
+		}
+	}
+
+	return u, nil
+}
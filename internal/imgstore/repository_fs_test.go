@@ -1,8 +1,11 @@
 package imgstore_test
 
 import (
+	"context"
 	"errors"
+	"image"
 	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -14,7 +17,7 @@ import (
 
 func TestFileSystemTileRepo_SuccessGet(t *testing.T) {
 	Convey("Проверка сохранения изображений на диске и получения изображения.", t, func() {
-		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir())
+		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatBmp.Ext())
 		So(err, ShouldBeNil)
 
 		const (
@@ -24,10 +27,10 @@ func TestFileSystemTileRepo_SuccessGet(t *testing.T) {
 
 		const id = "0"
 		img := []byte{1, 2, 3, 4, 5}
-		err = tileRepo.SaveTile(id, x, y, img)
+		err = tileRepo.SaveTile(ctx, id, x, y, img)
 		So(err, ShouldBeNil)
 
-		tile, err := tileRepo.GetTile(id, x, y)
+		tile, err := tileRepo.GetTile(ctx, id, x, y)
 		So(err, ShouldBeNil)
 
 		So(tile, ShouldResemble, img)
@@ -36,7 +39,7 @@ func TestFileSystemTileRepo_SuccessGet(t *testing.T) {
 
 func TestFileSystemTileRepo_SuccessDelete(t *testing.T) {
 	Convey("После создания и удаления файла вызов фукнции получения должен вернуть ошибку.", t, func() {
-		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir())
+		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatBmp.Ext())
 		So(err, ShouldBeNil)
 
 		const (
@@ -47,36 +50,154 @@ func TestFileSystemTileRepo_SuccessDelete(t *testing.T) {
 		const id = "0"
 		img := []byte{1, 2, 3, 4, 5}
 
-		err = tileRepo.SaveTile(id, x, y, img)
+		err = tileRepo.SaveTile(ctx, id, x, y, img)
 		So(err, ShouldBeNil)
 
-		_, err = tileRepo.GetTile(id, x, y)
+		_, err = tileRepo.GetTile(ctx, id, x, y)
 		So(err, ShouldBeNil)
 
-		err = tileRepo.DeleteImage(id)
+		err = tileRepo.DeleteImage(ctx, id)
 		So(err, ShouldBeNil)
 
-		_, err = tileRepo.GetTile(id, x, y)
+		_, err = tileRepo.GetTile(ctx, id, x, y)
 		So(err, ShouldNotBeNil)
 	})
 }
 
 func TestFileSystemTileRepo_ErrorGet(t *testing.T) {
 	Convey("При запросе не существующего файла должна быть ошибка.", t, func() {
-		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir())
+		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatBmp.Ext())
 		So(err, ShouldBeNil)
 
-		_, err = tileRepo.GetTile("0", 0, 0)
+		_, err = tileRepo.GetTile(ctx, "0", 0, 0)
 		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
 	})
 }
 
 func TestFileSystemTileRepo_ErrorDelete(t *testing.T) {
 	Convey("При удалении не сущствующего файла не должно быть ошибки", t, func() {
-		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir())
+		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatBmp.Ext())
 		So(err, ShouldBeNil)
 
-		err = tileRepo.DeleteImage("0")
+		err = tileRepo.DeleteImage(ctx, "0")
 		So(err, ShouldBeNil)
 	})
 }
+
+func TestFileSystemTileRepo_List(t *testing.T) {
+	Convey("Images и Tiles должны возвращать сохраненные изображения и тайлы только своего расширения", t, func() {
+		dir := t.TempDir()
+		bmpRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		rawRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+
+		So(bmpRepo.SaveTile(ctx, "a", 0, 0, []byte{1}), ShouldBeNil)
+		So(bmpRepo.SaveTile(ctx, "a", 10, 20, []byte{1}), ShouldBeNil)
+		So(rawRepo.SaveTile(ctx, "a", 30, 40, []byte{1}), ShouldBeNil)
+		So(rawRepo.SaveTile(ctx, "b", 0, 0, []byte{1}), ShouldBeNil)
+
+		ids, err := bmpRepo.Images()
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []string{"a", "b"})
+
+		tiles, err := bmpRepo.Tiles("a")
+		So(err, ShouldBeNil)
+		So(tiles, ShouldHaveLength, 2)
+		So(tiles, ShouldContain, image.Pt(0, 0))
+		So(tiles, ShouldContain, image.Pt(10, 20))
+
+		So(bmpRepo.DeleteTile("a", 10, 20), ShouldBeNil)
+		tiles, err = bmpRepo.Tiles("a")
+		So(err, ShouldBeNil)
+		So(tiles, ShouldResemble, []image.Point{image.Pt(0, 0)})
+	})
+}
+
+func TestFileSystemTileRepo_TempFiles(t *testing.T) {
+	Convey("Временные файлы должны находиться в каталоге хранилища и каталогах изображений", t, func() {
+		dir := t.TempDir()
+		tileRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		So(tileRepo.SaveTile(ctx, "0", 0, 0, []byte{1}), ShouldBeNil)
+
+		So(os.Mkdir(filepath.Join(dir, ".blobs"), 0777), ShouldBeNil)
+		paths := []string{
+			filepath.Join(dir, "meta.tmp"),
+			filepath.Join(dir, ".blobs", "hash.bmp.tmp123"),
+			filepath.Join(dir, "0", "Y=0; X=0.bmp.tmp"),
+		}
+		for _, path := range paths {
+			So(os.WriteFile(path, nil, 0666), ShouldBeNil)
+		}
+
+		got, err := tileRepo.TempFiles()
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, paths)
+	})
+}
+
+func TestFileSystemTileRepo_TileSets(t *testing.T) {
+	Convey("Наборами тайлов должны считаться только папки с тайлами", t, func() {
+		dir := t.TempDir()
+		tileRepo, err := imgstore.NewFileSystemTileRepo(dir, imgstore.FormatBmp.Ext())
+		So(err, ShouldBeNil)
+		So(tileRepo.SaveTile(ctx, "0", 0, 0, []byte{1}), ShouldBeNil)
+
+		So(os.Mkdir(filepath.Join(dir, "meta"), 0777), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, "meta", "images.log"), nil, 0666), ShouldBeNil)
+
+		got, err := tileRepo.TileSets()
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, []string{"0"})
+	})
+}
+
+func TestFileSystemTileRepo_ReadWriteAt(t *testing.T) {
+	Convey("Чтение и запись части файла тайла", t, func() {
+		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+
+		const id = "0"
+		err = tileRepo.SaveTile(ctx, id, 0, 0, []byte{1, 2, 3, 4, 5})
+		So(err, ShouldBeNil)
+
+		n, err := tileRepo.WriteTileAt(ctx, id, 0, 0, []byte{8, 9}, 2)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+
+		p := make([]byte, 3)
+		n, err = tileRepo.ReadTileAt(ctx, id, 0, 0, p, 1)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+		So(p, ShouldResemble, []byte{2, 8, 9})
+
+		tile, err := tileRepo.GetTile(ctx, id, 0, 0)
+		So(err, ShouldBeNil)
+		So(tile, ShouldResemble, []byte{1, 2, 8, 9, 5})
+	})
+
+	Convey("Запись в несуществующий тайл не должна создавать файл", t, func() {
+		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+
+		_, err = tileRepo.WriteTileAt(ctx, "0", 0, 0, []byte{1}, 0)
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+	})
+}
+
+func TestFileSystemTileRepo_Cancelled(t *testing.T) {
+	Convey("Операции с отмененным контекстом должны возвращать ошибку контекста", t, func() {
+		tileRepo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err = tileRepo.SaveTile(cancelled, "0", 0, 0, []byte{1})
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+		_, err = tileRepo.GetTile(cancelled, "0", 0, 0)
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,192 @@
+package imgstore
+
+import (
+	"context"
+	"image"
+	"io"
+	"os"
+	"sync"
+)
+
+// MemoryRepository - потокобезопасное хранилище изображений-тайлов в памяти.
+// Тайлы теряются при остановке процесса, поэтому хранилище подходит для тестов и демонстрационного запуска.
+type MemoryRepository struct {
+	// limit - сколько байт могут занимать тайлы, 0 - без ограничения.
+	limit int64
+
+	mu    sync.RWMutex
+	tiles map[string]map[image.Point][]byte
+	// bytes - размер сохраненных тайлов.
+	bytes int64
+}
+
+// NewMemoryRepo создает хранилище, тайлы в котором могут занимать не больше limit байт. 0 - без ограничения.
+func NewMemoryRepo(limit int64) *MemoryRepository {
+	return &MemoryRepository{
+		limit: limit,
+		tiles: make(map[string]map[image.Point][]byte),
+	}
+}
+
+// grow учитывает изменение размера тайлов на delta байт. Вызывается под Lock.
+// Возможна ошибка ErrNoSpace, тогда размер не изменяется.
+func (r *MemoryRepository) grow(delta int64) error {
+	if r.limit > 0 && delta > 0 && r.bytes+delta > r.limit {
+		return ErrNoSpace
+	}
+	r.bytes += delta
+	return nil
+}
+
+// notExist возвращает ошибку отсутствия тайла, как у хранилища на диске.
+func (r *MemoryRepository) notExist(id string) error {
+	return &os.PathError{Op: "open", Path: id, Err: os.ErrNotExist}
+}
+
+// SaveTile сохраняет копию тайла.
+// Возможна ошибка ErrNoSpace, если тайл не помещается в лимит.
+func (r *MemoryRepository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b := append([]byte(nil), img...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pt := image.Pt(x, y)
+	err := r.grow(int64(len(b) - len(r.tiles[id][pt])))
+	if err != nil {
+		return err
+	}
+
+	tiles, ok := r.tiles[id]
+	if !ok {
+		tiles = make(map[image.Point][]byte)
+		r.tiles[id] = tiles
+	}
+	tiles[pt] = b
+	return nil
+}
+
+// GetTile возвращает копию тайла с координатами (x; y) изображения id.
+// Возможна ошибка типа *os.PathError с os.ErrNotExist.
+func (r *MemoryRepository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b, ok := r.tiles[id][image.Pt(x, y)]
+	if !ok {
+		return nil, r.notExist(id)
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// ReadTileAt копирует часть тайла, начиная со смещения off, по аналогии с io.ReaderAt.
+func (r *MemoryRepository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b, ok := r.tiles[id][image.Pt(x, y)]
+	if !ok {
+		return 0, r.notExist(id)
+	}
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTileAt записывает p в тайл, начиная со смещения off. Как и запись в файл, расширяет тайл.
+// Возможна ошибка ErrNoSpace, если расширенный тайл не помещается в лимит.
+func (r *MemoryRepository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pt := image.Pt(x, y)
+	b, ok := r.tiles[id][pt]
+	if !ok {
+		return 0, r.notExist(id)
+	}
+
+	if end := off + int64(len(p)); end > int64(len(b)) {
+		err := r.grow(end - int64(len(b)))
+		if err != nil {
+			return 0, err
+		}
+		b = append(b, make([]byte, end-int64(len(b)))...)
+		r.tiles[id][pt] = b
+	}
+	return copy(b[off:], p), nil
+}
+
+// WritesInPlace возвращает true: WriteTileAt изменяет байты тайла в памяти.
+func (r *MemoryRepository) WritesInPlace() bool {
+	return true
+}
+
+// DeleteImage удаляет тайлы изображения id.
+func (r *MemoryRepository) DeleteImage(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, b := range r.tiles[id] {
+		r.bytes -= int64(len(b))
+	}
+	delete(r.tiles, id)
+	return nil
+}
+
+// Images возвращает id изображений, тайлы которых есть в хранилище.
+func (r *MemoryRepository) Images() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.tiles))
+	for id := range r.tiles {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Tiles возвращает количество тайлов изображения id.
+func (r *MemoryRepository) Tiles(id string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tiles[id])
+}
+
+// Bytes возвращает размер сохраненных тайлов.
+func (r *MemoryRepository) Bytes() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.bytes
+}
+
+// Limit возвращает, сколько байт могут занимать тайлы, 0 - без ограничения.
+func (r *MemoryRepository) Limit() int64 {
+	return r.limit
+}
@@ -0,0 +1,71 @@
+package imgstore_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+func TestMemoryRepo_Limit(t *testing.T) {
+	Convey("Размер тайлов должен учитываться при сохранении, расширении и удалении и не превышать лимит", t, func() {
+		repo := imgstore.NewMemoryRepo(10)
+
+		So(repo.SaveTile(ctx, "0", 0, 0, make([]byte, 6)), ShouldBeNil)
+		So(repo.SaveTile(ctx, "0", 0, 0, make([]byte, 8)), ShouldBeNil)
+		So(repo.Bytes(), ShouldEqual, 8)
+
+		err := repo.SaveTile(ctx, "1", 0, 0, make([]byte, 3))
+		So(errors.Is(err, imgstore.ErrNoSpace), ShouldBeTrue)
+		_, err = repo.GetTile(ctx, "1", 0, 0)
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+
+		_, err = repo.WriteTileAt(ctx, "0", 0, 0, []byte{1, 2, 3}, 8)
+		So(errors.Is(err, imgstore.ErrNoSpace), ShouldBeTrue)
+		n, err := repo.WriteTileAt(ctx, "0", 0, 0, []byte{1, 2}, 8)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(repo.Bytes(), ShouldEqual, 10)
+
+		So(repo.DeleteImage(ctx, "0"), ShouldBeNil)
+		So(repo.Bytes(), ShouldEqual, 0)
+		So(repo.SaveTile(ctx, "1", 0, 0, make([]byte, 3)), ShouldBeNil)
+	})
+}
+
+func TestMemoryRepo_Concurrent(t *testing.T) {
+	Convey("Одновременные запись и чтение тайлов разных изображений не должны мешать друг другу", t, func() {
+		repo := imgstore.NewMemoryRepo(0)
+		service := imgstore.NewRawService(repo)
+		img := newColorfulRGBA(8, 8)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if err := service.SaveTile(ctx, id, 0, 0, img); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := service.GetTile(ctx, id, 0, 0); err != nil {
+					errs <- err
+				}
+			}(string(rune('a' + i)))
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+		tile, err := repo.GetTile(ctx, "a", 0, 0)
+		So(err, ShouldBeNil)
+		So(repo.Bytes(), ShouldEqual, 16*len(tile))
+	})
+}
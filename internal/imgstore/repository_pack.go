@@ -0,0 +1,772 @@
+package imgstore
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PackExt - суффикс файлов упаковок, например "<id>.bmp.pack".
+const PackExt = ".pack"
+
+// Упаковка - файл, в который последовательно дописываются записи тайлов изображения.
+//
+//	0  4 байта  packMagic
+//	4  4 байта  x тайла, little endian
+//	8  4 байта  y тайла, little endian
+//	12 8 байт   длина тайла, little endian
+//	20 ...      тайл
+//
+// Актуальна последняя запись тайла, предыдущие - мусор, который удаляется уплотнением.
+// Индекс записей хранится в памяти и восстанавливается чтением заголовков при открытии упаковки.
+const (
+	packMagic        = "CHRP"
+	packHeaderSize   = 20
+	packXOffset      = 4
+	packYOffset      = 8
+	packLengthOffset = 12
+)
+
+// packCompactRatio - доля мусора в упаковке, при которой она уплотняется.
+const packCompactRatio = 0.5
+
+// PackRepository - хранилище изображений-тайлов, в котором все тайлы изображения хранятся в одном файле-упаковке.
+// В отличие от FileSystemTileRepository, изображение из тысячи тайлов занимает один файл,
+// что упрощает резервное копирование и не расходует inode.
+//
+// SaveTile дописывает тайл в конец упаковки. WriteTileAt изменяет актуальную запись тайла на месте,
+// если не выходит за ее границы, иначе дописывает измененную копию.
+// Упаковки с большой долей мусора уплотняются в фоне: актуальные записи переписываются в новый файл,
+// который заменяет прежний.
+//
+// Упаковки открываются при первом обращении. Открытых упаковок не больше maxOpen: давно использованные
+// закрываются после завершения начатых операций с ними. Уплотняются только открытые упаковки.
+type PackRepository struct {
+	dirPath string
+	ext     string
+	maxOpen int
+
+	// mu защищает packs, lru и closing.
+	mu    sync.Mutex
+	lru   *list.List // Элементы типа *pack, в начале - недавно использованные.
+	packs map[string]*list.Element
+	// closing - вытесненные упаковки, которые еще закрываются. Канал закрывается, когда упаковка закрыта,
+	// до этого упаковка изображения не открывается повторно.
+	closing map[string]chan struct{}
+
+	// garbage - размер мусора в открытых упаковках, reclaimed - сколько байт освобождено уплотнением.
+	garbage, reclaimed int64
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// pack - открытая упаковка изображения.
+type pack struct {
+	id   string
+	path string
+
+	// wmu упорядочивает запись и уплотнение упаковки. Чтение выполняется параллельно с ними.
+	wmu sync.Mutex
+
+	// mu защищает поля ниже: удерживается на чтение при обращении к файлу и на запись при их изменении.
+	mu    sync.RWMutex
+	f     *os.File
+	index map[image.Point]packEntry
+	// size - длина файла, garbage - размер устаревших записей.
+	size, garbage int64
+	// closed означает, что изображение удалено или хранилище закрыто.
+	closed bool
+	// evicted означает, что упаковка вытеснена из PackRepository.packs и ее нужно открыть заново.
+	// Изменяется под wmu и mu, поэтому читается под любым из них.
+	evicted bool
+}
+
+// packEntry - расположение актуальной записи тайла.
+type packEntry struct {
+	// off - смещение тайла (не заголовка) в файле, length - длина тайла.
+	off, length int64
+}
+
+// NewPackRepo создает хранилище упаковок в каталоге dirPath.
+// Если compactInterval больше 0, упаковки проверяются и уплотняются в фоне с этим периодом.
+// Открытых упаковок не больше maxOpen, при maxOpen <= 0 - не больше одной.
+// После использования необходимо вызвать Close.
+func NewPackRepo(dirPath, ext string, compactInterval time.Duration, maxOpen int) (*PackRepository, error) {
+	err := os.MkdirAll(dirPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxOpen < 1 {
+		maxOpen = 1
+	}
+	r := &PackRepository{
+		dirPath: dirPath,
+		ext:     ext,
+		maxOpen: maxOpen,
+		lru:     list.New(),
+		packs:   make(map[string]*list.Element),
+		closing: make(map[string]chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if compactInterval > 0 {
+		r.wg.Add(1)
+		go r.compactLoop(compactInterval)
+	}
+
+	return r, nil
+}
+
+func (r *PackRepository) packPath(id string) string {
+	return filepath.Join(r.dirPath, id+r.ext+PackExt)
+}
+
+// open возвращает упаковку изображения id, открывая ее при необходимости и вытесняя давно использованные.
+// Если упаковки нет, создает ее при create, иначе возвращает ошибку os.ErrNotExist.
+// Возвращенная упаковка может оказаться вытесненной, поэтому используется через readPack и writePack.
+func (r *PackRepository) open(id string, create bool) (*pack, error) {
+	r.mu.Lock()
+	for {
+		ch, ok := r.closing[id]
+		if !ok {
+			break
+		}
+		r.mu.Unlock()
+		<-ch
+		r.mu.Lock()
+	}
+
+	if e, ok := r.packs[id]; ok {
+		r.lru.MoveToFront(e)
+		r.mu.Unlock()
+		return e.Value.(*pack), nil
+	}
+
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(r.packPath(id), flag, 0666)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+
+	p := &pack{id: id, path: r.packPath(id), f: f, index: make(map[image.Point]packEntry)}
+	err = p.load()
+	if err != nil {
+		r.mu.Unlock()
+		_ = f.Close()
+		return nil, err
+	}
+
+	atomic.AddInt64(&r.garbage, p.garbage)
+	r.packs[id] = r.lru.PushFront(p)
+	var evicted []*pack
+	for r.lru.Len() > r.maxOpen {
+		old := r.lru.Remove(r.lru.Back()).(*pack)
+		delete(r.packs, old.id)
+		r.closing[old.id] = make(chan struct{})
+		evicted = append(evicted, old)
+	}
+	r.mu.Unlock()
+
+	// Упаковка закрывается вне mu: вытесняемая упаковка может использоваться, и блокировки ожидают завершения.
+	for _, old := range evicted {
+		r.evict(old)
+	}
+	return p, nil
+}
+
+// evict закрывает вытесненную упаковку p после завершения начатых операций с ней.
+func (r *PackRepository) evict(p *pack) {
+	p.wmu.Lock()
+	p.mu.Lock()
+	if !p.closed {
+		atomic.AddInt64(&r.garbage, -p.garbage)
+		err := p.f.Close()
+		if err != nil {
+			log.Printf("упаковка %s: закрытие: %v", p.path, err)
+		}
+	}
+	p.evicted = true
+	p.mu.Unlock()
+	p.wmu.Unlock()
+
+	r.mu.Lock()
+	close(r.closing[p.id])
+	delete(r.closing, p.id)
+	r.mu.Unlock()
+}
+
+// readPack возвращает упаковку изображения id, удерживая ее mu на чтение.
+func (r *PackRepository) readPack(id string) (*pack, error) {
+	for {
+		p, err := r.open(id, false)
+		if err != nil {
+			return nil, err
+		}
+
+		p.mu.RLock()
+		if !p.evicted {
+			return p, nil
+		}
+		p.mu.RUnlock()
+	}
+}
+
+// writePack возвращает упаковку изображения id, удерживая ее wmu. Параметр create - как у open.
+func (r *PackRepository) writePack(id string, create bool) (*pack, error) {
+	for {
+		p, err := r.open(id, create)
+		if err != nil {
+			return nil, err
+		}
+
+		p.wmu.Lock()
+		if !p.evicted {
+			return p, nil
+		}
+		p.wmu.Unlock()
+	}
+}
+
+// load восстанавливает индекс по заголовкам записей.
+// Недописанная последняя запись, например после сбоя, отбрасывается. Если за некорректной записью
+// есть корректные, упаковка повреждена в середине и не открывается: возвращается ошибка ErrPackCorrupt.
+func (p *pack) load() error {
+	info, err := p.f.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	var off int64
+	for off+packHeaderSize <= end {
+		pt, length, ok, err := p.header(off, end)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		if old, ok := p.index[pt]; ok {
+			p.garbage += packHeaderSize + old.length
+		}
+		p.index[pt] = packEntry{off: off + packHeaderSize, length: length}
+		off += packHeaderSize + length
+	}
+
+	if off < end {
+		next, found, err := p.findRecord(off, end)
+		if err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("упаковка %s: некорректная запись по смещению %d, следующая запись по смещению %d: %w",
+				p.path, off, next, ErrPackCorrupt)
+		}
+
+		log.Printf("упаковка %s: отброшено %d байт недописанных записей", p.path, end-off)
+		err = p.f.Truncate(off)
+		if err != nil {
+			return err
+		}
+	}
+	p.size = off
+	return nil
+}
+
+// header читает заголовок записи по смещению off и возвращает координаты и длину тайла.
+// ok равен false, если заголовок некорректен или запись не помещается в файл длины end.
+func (p *pack) header(off, end int64) (pt image.Point, length int64, ok bool, err error) {
+	if off+packHeaderSize > end {
+		return pt, 0, false, nil
+	}
+
+	header := make([]byte, packHeaderSize)
+	_, err = p.f.ReadAt(header, off)
+	if err != nil {
+		return pt, 0, false, err
+	}
+	if string(header[:len(packMagic)]) != packMagic {
+		return pt, 0, false, nil
+	}
+
+	length = int64(binary.LittleEndian.Uint64(header[packLengthOffset:]))
+	if length < 0 || off+packHeaderSize+length > end {
+		return pt, 0, false, nil
+	}
+
+	pt = image.Pt(int(int32(binary.LittleEndian.Uint32(header[packXOffset:]))),
+		int(int32(binary.LittleEndian.Uint32(header[packYOffset:]))))
+	return pt, length, true, nil
+}
+
+// findRecord ищет после смещения off корректную запись, целиком лежащую в файле длины end,
+// и возвращает ее смещение.
+func (p *pack) findRecord(off, end int64) (int64, bool, error) {
+	start := off + 1
+	r := bufio.NewReader(io.NewSectionReader(p.f, start, end-start))
+	matched := 0
+	for pos := start; ; pos++ {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+
+		// Символы packMagic не повторяются, поэтому при несовпадении поиск продолжается с текущего байта.
+		switch {
+		case c == packMagic[matched]:
+			matched++
+		case c == packMagic[0]:
+			matched = 1
+		default:
+			matched = 0
+		}
+		if matched < len(packMagic) {
+			continue
+		}
+		matched = 0
+
+		recOff := pos + 1 - int64(len(packMagic))
+		_, _, ok, err := p.header(recOff, end)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return recOff, true, nil
+		}
+	}
+}
+
+// notExist возвращает ошибку отсутствия тайла в упаковке.
+func (p *pack) notExist() error {
+	return &os.PathError{Op: "open", Path: p.path, Err: os.ErrNotExist}
+}
+
+// appendTile дописывает запись тайла в конец упаковки и возвращает размер замененной записи.
+// Вызывается под wmu.
+func (p *pack) appendTile(pt image.Point, img []byte) (int64, error) {
+	b := make([]byte, packHeaderSize+len(img))
+	copy(b, packMagic)
+	binary.LittleEndian.PutUint32(b[packXOffset:], uint32(int32(pt.X)))
+	binary.LittleEndian.PutUint32(b[packYOffset:], uint32(int32(pt.Y)))
+	binary.LittleEndian.PutUint64(b[packLengthOffset:], uint64(len(img)))
+	copy(b[packHeaderSize:], img)
+
+	// Запись за концом файла не мешает читателям, поэтому выполняется под mu на чтение.
+	p.mu.RLock()
+	closed, off := p.closed, p.size
+	if !closed {
+		_, err := p.f.WriteAt(b, off)
+		if err != nil {
+			p.mu.RUnlock()
+			return 0, err
+		}
+	}
+	p.mu.RUnlock()
+	if closed {
+		return 0, p.notExist()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var garbage int64
+	if old, ok := p.index[pt]; ok {
+		garbage = packHeaderSize + old.length
+	}
+	p.index[pt] = packEntry{off: off + packHeaderSize, length: int64(len(img))}
+	p.size = off + int64(len(b))
+	p.garbage += garbage
+	return garbage, nil
+}
+
+// entry возвращает расположение тайла. Вызывается под mu.
+func (p *pack) entry(pt image.Point) (packEntry, error) {
+	e, ok := p.index[pt]
+	if p.closed || !ok {
+		return e, p.notExist()
+	}
+	return e, nil
+}
+
+// SaveTile дописывает тайл в упаковку изображения id, создавая ее при необходимости.
+func (r *PackRepository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p, err := r.writePack(id, true)
+	if err != nil {
+		return err
+	}
+	defer p.wmu.Unlock()
+
+	garbage, err := p.appendTile(image.Pt(x, y), img)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&r.garbage, garbage)
+	return nil
+}
+
+// GetTile считывает актуальную запись тайла с координатами (x; y) изображения id.
+// Возможны ошибки типа *os.PathError, например os.ErrNotExist.
+func (r *PackRepository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p, err := r.readPack(id)
+	if err != nil {
+		return nil, err
+	}
+	defer p.mu.RUnlock()
+
+	e, err := p.entry(image.Pt(x, y))
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, e.length)
+	_, err = p.f.ReadAt(b, e.off)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadTileAt читает часть тайла, начиная со смещения off. Чтение не выходит за границы записи тайла.
+func (r *PackRepository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	pk, err := r.readPack(id)
+	if err != nil {
+		return 0, err
+	}
+	defer pk.mu.RUnlock()
+
+	e, err := pk.entry(image.Pt(x, y))
+	if err != nil {
+		return 0, err
+	}
+	if off >= e.length {
+		return 0, io.EOF
+	}
+
+	buf := p
+	if rest := e.length - off; int64(len(buf)) > rest {
+		buf = buf[:rest]
+	}
+	n, err := pk.f.ReadAt(buf, e.off+off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteTileAt записывает p в тайл, начиная со смещения off.
+// Если p не выходит за конец тайла, актуальная запись изменяется на месте, иначе дописывается расширенная копия.
+func (r *PackRepository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	pk, err := r.writePack(id, false)
+	if err != nil {
+		return 0, err
+	}
+	defer pk.wmu.Unlock()
+
+	pt := image.Pt(x, y)
+	pk.mu.RLock()
+	e, err := pk.entry(pt)
+	if err != nil {
+		pk.mu.RUnlock()
+		return 0, err
+	}
+	if end := off + int64(len(p)); end <= e.length {
+		n, err := pk.f.WriteAt(p, e.off+off)
+		pk.mu.RUnlock()
+		return n, err
+	}
+
+	b := make([]byte, off+int64(len(p)))
+	_, err = pk.f.ReadAt(b[:e.length], e.off)
+	pk.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	copy(b[off:], p)
+
+	garbage, err := pk.appendTile(pt, b)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&r.garbage, garbage)
+	return len(p), nil
+}
+
+// WritesInPlace возвращает true: WriteTileAt в пределах тайла изменяет запись тайла в упаковке на месте.
+func (r *PackRepository) WritesInPlace() bool {
+	return true
+}
+
+// DeleteImage удаляет упаковку изображения id. Отсутствие упаковки не является ошибкой.
+func (r *PackRepository) DeleteImage(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p, err := r.writePack(id, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer p.wmu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Упаковка остается в packs до удаления файла, чтобы ее не открыли повторно.
+	r.mu.Lock()
+	if e, ok := r.packs[id]; ok && e.Value == p {
+		r.lru.Remove(e)
+		delete(r.packs, id)
+	}
+	err = os.Remove(p.path)
+	r.mu.Unlock()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	atomic.AddInt64(&r.garbage, -p.garbage)
+	p.closed = true
+	return p.f.Close()
+}
+
+// Images возвращает id изображений, упаковки которых есть на диске.
+func (r *PackRepository) Images() ([]string, error) {
+	entries, err := os.ReadDir(r.dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := r.ext + PackExt
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), suffix) {
+			ids = append(ids, strings.TrimSuffix(e.Name(), suffix))
+		}
+	}
+	return ids, nil
+}
+
+// Tiles возвращает координаты тайлов изображения id.
+func (r *PackRepository) Tiles(id string) ([]image.Point, error) {
+	p, err := r.readPack(id)
+	if err != nil {
+		return nil, err
+	}
+	defer p.mu.RUnlock()
+
+	tiles := make([]image.Point, 0, len(p.index))
+	for pt := range p.index {
+		tiles = append(tiles, pt)
+	}
+	return tiles, nil
+}
+
+// OpenPacks возвращает количество открытых упаковок.
+func (r *PackRepository) OpenPacks() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lru.Len()
+}
+
+// Garbage возвращает размер устаревших записей в открытых упаковках.
+func (r *PackRepository) Garbage() int64 {
+	return atomic.LoadInt64(&r.garbage)
+}
+
+// Reclaimed возвращает, сколько байт освобождено уплотнением.
+func (r *PackRepository) Reclaimed() int64 {
+	return atomic.LoadInt64(&r.reclaimed)
+}
+
+func (r *PackRepository) compactLoop(interval time.Duration) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := r.Compact(context.Background())
+		if err != nil {
+			log.Printf("уплотнение упаковок тайлов: %v", err)
+		}
+	}
+}
+
+// Compact уплотняет открытые упаковки, в которых доля мусора не меньше packCompactRatio,
+// и возвращает, сколько байт освобождено.
+func (r *PackRepository) Compact(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	packs := make([]*pack, 0, r.lru.Len())
+	for e := r.lru.Front(); e != nil; e = e.Next() {
+		packs = append(packs, e.Value.(*pack))
+	}
+	r.mu.Unlock()
+
+	var total int64
+	for _, p := range packs {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		n, err := p.compact()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		atomic.AddInt64(&r.garbage, -n)
+		atomic.AddInt64(&r.reclaimed, n)
+	}
+	return total, nil
+}
+
+// compact переписывает актуальные записи упаковки в новый файл, если доля мусора достаточна,
+// и возвращает размер отброшенных записей.
+// Запись в упаковку на время уплотнения приостанавливается, чтение продолжается из прежнего файла.
+func (p *pack) compact() (int64, error) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	p.mu.RLock()
+	if p.closed || p.evicted || p.garbage == 0 || float64(p.garbage) < float64(p.size)*packCompactRatio {
+		p.mu.RUnlock()
+		return 0, nil
+	}
+
+	// Пока удерживается wmu, индекс и файл изменяются только здесь.
+	tmpPath := p.path + TempFileExt
+	tmp, index, size, err := p.rewrite(tmpPath)
+	p.mu.RUnlock()
+	if err != nil {
+		if tmp != nil {
+			_ = tmp.Close()
+		}
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err = os.Rename(tmpPath, p.path)
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+
+	old := p.f
+	garbage := p.garbage
+	p.f, p.index, p.size, p.garbage = tmp, index, size, 0
+	_ = old.Close()
+	return garbage, nil
+}
+
+// rewrite записывает актуальные записи упаковки в файл path и возвращает его открытым вместе с новым индексом.
+// Вызывается под wmu и mu на чтение.
+func (p *pack) rewrite(path string) (*os.File, map[image.Point]packEntry, int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	index := make(map[image.Point]packEntry, len(p.index))
+	var size int64
+	for pt, e := range p.index {
+		b := make([]byte, packHeaderSize+e.length)
+		_, err = p.f.ReadAt(b, e.off-packHeaderSize)
+		if err != nil {
+			return f, nil, 0, err
+		}
+		_, err = f.WriteAt(b, size)
+		if err != nil {
+			return f, nil, 0, err
+		}
+
+		index[pt] = packEntry{off: size + packHeaderSize, length: e.length}
+		size += int64(len(b))
+	}
+
+	// Прежний файл заменяется только после того, как новый записан на диск.
+	err = f.Sync()
+	if err != nil {
+		return f, nil, 0, err
+	}
+	return f, index, size, nil
+}
+
+// Close останавливает фоновое уплотнение и закрывает упаковки.
+func (r *PackRepository) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+
+	// Упаковки блокируются после r.mu, как в DeleteImage, поэтому сначала извлекаются из packs.
+	r.mu.Lock()
+	lru := r.lru
+	r.lru = list.New()
+	r.packs = make(map[string]*list.Element)
+	r.mu.Unlock()
+
+	var firstErr error
+	for e := lru.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*pack)
+		p.wmu.Lock()
+		p.mu.Lock()
+		p.closed = true
+		err := p.f.Close()
+		p.mu.Unlock()
+		p.wmu.Unlock()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
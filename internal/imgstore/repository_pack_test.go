@@ -0,0 +1,237 @@
+package imgstore_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+func TestPackRepo_Service(t *testing.T) {
+	Convey("Тайлы изображения должны храниться в одном файле и читаться сервисом любого формата", t, func() {
+		for _, format := range []imgstore.Format{imgstore.FormatBmp, imgstore.FormatRaw} {
+			dir := t.TempDir()
+			repo, err := imgstore.NewPackRepo(dir, format.Ext(), 0, 16)
+			So(err, ShouldBeNil)
+			service, err := imgstore.NewService(format, repo)
+			So(err, ShouldBeNil)
+
+			img := newColorfulRGBA(5, 4)
+			for x := 0; x < 3; x++ {
+				err = service.SaveTile(ctx, "0", x, 0, img)
+				So(err, ShouldBeNil)
+			}
+
+			r := image.Rect(1, 1, 3, 3)
+			err = service.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+			So(err, ShouldBeNil)
+
+			got, err := service.GetTile(ctx, "0", 2, 0)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, img)
+
+			region := image.NewRGBA(image.Rect(0, 0, 5, 4))
+			err = service.ReadTileRegion(ctx, "0", 0, 0, region.Rect, region)
+			So(err, ShouldBeNil)
+			So(region.At(0, 0), ShouldResemble, img.At(0, 0))
+			So(region.At(2, 2), ShouldResemble, red)
+
+			entries, err := os.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Name(), ShouldEqual, "0"+format.Ext()+imgstore.PackExt)
+
+			So(repo.DeleteImage(ctx, "0"), ShouldBeNil)
+			_, err = repo.GetTile(ctx, "0", 0, 0)
+			So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+			entries, err = os.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(entries, ShouldBeEmpty)
+			So(repo.Close(), ShouldBeNil)
+		}
+	})
+}
+
+func TestPackRepo_Reopen(t *testing.T) {
+	Convey("Индекс должен восстанавливаться по файлу, недописанная запись - отбрасываться", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewPackRepo(dir, ".raw", 0, 16)
+		So(err, ShouldBeNil)
+
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte("old")), ShouldBeNil)
+		So(repo.SaveTile(ctx, "0", 1, 0, []byte("second")), ShouldBeNil)
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte("new")), ShouldBeNil)
+		So(repo.Close(), ShouldBeNil)
+
+		// Сбой во время дописывания: заголовок записи есть, тайла нет.
+		path := filepath.Join(dir, "0.raw"+imgstore.PackExt)
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		So(err, ShouldBeNil)
+		_, err = f.Write([]byte("CHRP\x02\x00\x00\x00"))
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		repo, err = imgstore.NewPackRepo(dir, ".raw", 0, 16)
+		So(err, ShouldBeNil)
+		defer repo.Close()
+
+		b, err := repo.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "new")
+		b, err = repo.GetTile(ctx, "0", 1, 0)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "second")
+		So(repo.Garbage(), ShouldEqual, 20+len("old"))
+
+		ids, err := repo.Images()
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []string{"0"})
+		tiles, err := repo.Tiles("0")
+		So(err, ShouldBeNil)
+		So(tiles, ShouldHaveLength, 2)
+
+		info, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(info.Size(), ShouldEqual, 3*20+len("old")+len("second")+len("new"))
+	})
+}
+
+func TestPackRepo_Compact(t *testing.T) {
+	Convey("Уплотнение должно отбрасывать устаревшие записи, сохраняя актуальные тайлы", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewPackRepo(dir, ".raw", 0, 16)
+		So(err, ShouldBeNil)
+		defer repo.Close()
+
+		tile := bytes.Repeat([]byte{1}, 1000)
+		So(repo.SaveTile(ctx, "0", 0, 0, tile), ShouldBeNil)
+		So(repo.SaveTile(ctx, "0", 1, 0, tile), ShouldBeNil)
+
+		n, err := repo.Compact(ctx)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+
+		// Запись за конец тайла дописывает расширенную копию.
+		_, err = repo.WriteTileAt(ctx, "0", 0, 0, []byte{2, 2}, 999)
+		So(err, ShouldBeNil)
+		for i := 0; i < 3; i++ {
+			So(repo.SaveTile(ctx, "0", 1, 0, tile), ShouldBeNil)
+		}
+		So(repo.Garbage(), ShouldEqual, 4*1020)
+
+		n, err = repo.Compact(ctx)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 4*1020)
+		So(repo.Garbage(), ShouldEqual, 0)
+		So(repo.Reclaimed(), ShouldEqual, 4*1020)
+
+		info, err := os.Stat(filepath.Join(dir, "0.raw"+imgstore.PackExt))
+		So(err, ShouldBeNil)
+		So(info.Size(), ShouldEqual, 1020+1021)
+
+		b, err := repo.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(b, ShouldHaveLength, 1001)
+		So(b[998:], ShouldResemble, []byte{1, 2, 2})
+
+		// После уплотнения запись и чтение продолжаются в новом файле.
+		So(repo.SaveTile(ctx, "0", 2, 0, []byte("tile")), ShouldBeNil)
+		p := make([]byte, 10)
+		n2, err := repo.ReadTileAt(ctx, "0", 2, 0, p, 1)
+		So(n2, ShouldEqual, 3)
+		So(string(p[:n2]), ShouldEqual, "ile")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPackRepo_Corrupt(t *testing.T) {
+	Convey("Некорректная запись в середине упаковки должна давать ErrPackCorrupt, не отбрасывая записи за ней", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewPackRepo(dir, ".raw", 0, 16)
+		So(err, ShouldBeNil)
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte("first")), ShouldBeNil)
+		So(repo.SaveTile(ctx, "0", 1, 0, []byte("second")), ShouldBeNil)
+		So(repo.SaveTile(ctx, "0", 2, 0, []byte("third")), ShouldBeNil)
+		So(repo.Close(), ShouldBeNil)
+
+		// Испорчен заголовок второй записи.
+		path := filepath.Join(dir, "0.raw"+imgstore.PackExt)
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		So(err, ShouldBeNil)
+		_, err = f.WriteAt([]byte("XXXX"), int64(20+len("first")))
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+		before, err := os.Stat(path)
+		So(err, ShouldBeNil)
+
+		repo, err = imgstore.NewPackRepo(dir, ".raw", 0, 16)
+		So(err, ShouldBeNil)
+		defer repo.Close()
+
+		_, err = repo.GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, imgstore.ErrPackCorrupt), ShouldBeTrue)
+		So(errors.Is(repo.SaveTile(ctx, "0", 0, 0, []byte("new")), imgstore.ErrPackCorrupt), ShouldBeTrue)
+
+		after, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(after.Size(), ShouldEqual, before.Size())
+	})
+}
+
+func TestPackRepo_MaxOpen(t *testing.T) {
+	Convey("Открытых упаковок должно быть не больше maxOpen, вытесненные - открываться заново", t, func() {
+		dir := t.TempDir()
+		repo, err := imgstore.NewPackRepo(dir, ".raw", 0, 2)
+		So(err, ShouldBeNil)
+		defer repo.Close()
+
+		ids := []string{"0", "1", "2", "3", "4"}
+		for _, id := range ids {
+			So(repo.SaveTile(ctx, id, 0, 0, []byte("old"+id)), ShouldBeNil)
+			So(repo.SaveTile(ctx, id, 0, 0, []byte("tile"+id)), ShouldBeNil)
+			So(repo.OpenPacks(), ShouldBeLessThanOrEqualTo, 2)
+		}
+		// Мусор учитывается только в открытых упаковках.
+		So(repo.Garbage(), ShouldEqual, 2*(20+len("old0")))
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 4*len(ids))
+		for i := 0; i < 4; i++ {
+			for _, id := range ids {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+					b, err := repo.GetTile(ctx, id, 0, 0)
+					if err == nil && string(b) != "tile"+id {
+						err = fmt.Errorf("изображение %s: тайл %q", id, b)
+					}
+					if err == nil {
+						err = repo.SaveTile(ctx, id, 1, 0, []byte("tile"+id))
+					}
+					errs <- err
+				}(id)
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+		So(repo.OpenPacks(), ShouldBeLessThanOrEqualTo, 2)
+
+		So(repo.DeleteImage(ctx, "0"), ShouldBeNil)
+		_, err = repo.GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+		tiles, err := repo.Tiles("4")
+		So(err, ShouldBeNil)
+		So(tiles, ShouldHaveLength, 2)
+	})
+}
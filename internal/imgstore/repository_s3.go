@@ -0,0 +1,186 @@
+package imgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Dimedrolity/go-chartographer/pkg/s3"
+)
+
+// S3Repository - хранилище изображений-тайлов в бакете S3-совместимого объектного хранилища.
+// Позволяет нескольким экземплярам сервиса без состояния работать с общими тайлами.
+//
+// Тайл хранится объектом "<prefix><id>/Y=<y>; X=<x><ext>", поэтому DeleteImage удаляет объекты по префиксу изображения.
+// Объекты не изменяются частично: UpdateTile и WriteTileAt считывают тайл и сохраняют его заново
+// условной записью If-Match. Если тайл изменил другой экземпляр, чтение и изменение повторяются,
+// поэтому обновления не теряются.
+type S3Repository struct {
+	client *s3.Client
+	prefix string
+	ext    string
+
+	// tileLocks упорядочивают чтение-изменение-запись тайлов внутри процесса,
+	// чтобы условная запись не повторялась из-за соседних горутин.
+	// Тайл соответствует блокировке по хэшу ключа, поэтому число блокировок не растет с числом тайлов.
+	tileLocks [64]sync.Mutex
+}
+
+// s3UpdateAttempts - сколько раз UpdateTile считывает и сохраняет тайл, который одновременно изменяют другие экземпляры.
+const s3UpdateAttempts = 8
+
+// ErrConflict означает, что тайл не удалось изменить: его непрерывно изменяют другие экземпляры.
+var ErrConflict = errors.New("тайл одновременно изменяется другими экземплярами")
+
+// NewS3Repo создает хранилище тайлов с расширением ext в бакете клиента client.
+// Ключи объектов начинаются с prefix, что позволяет хранить в одном бакете тайлы нескольких сервисов.
+func NewS3Repo(client *s3.Client, prefix, ext string) *S3Repository {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Repository{client: client, prefix: prefix, ext: ext}
+}
+
+func (r *S3Repository) imgPrefix(id string) string {
+	return r.prefix + id + "/"
+}
+func (r *S3Repository) tileKey(id string, x, y int) string {
+	return r.imgPrefix(id) + fmt.Sprintf("Y=%d; X=%d%s", y, x, r.ext)
+}
+
+// notExist заменяет s3.ErrNotExist на *os.PathError, как у остальных хранилищ.
+func notExist(op, key string, err error) error {
+	if errors.Is(err, s3.ErrNotExist) {
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// SaveTile сохраняет тайл объектом бакета, заменяя существующий.
+func (r *S3Repository) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	return r.client.PutObject(ctx, r.tileKey(id, x, y), img)
+}
+
+// GetTile считывает объект тайла с координатами (x; y) изображения id.
+// Возможны ошибки типа *os.PathError, например os.ErrNotExist, и *s3.ResponseError.
+func (r *S3Repository) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	key := r.tileKey(id, x, y)
+	b, err := r.client.GetObject(ctx, key)
+	if err != nil {
+		return nil, notExist("get", key, err)
+	}
+	return b, nil
+}
+
+// ReadTileAt считывает диапазон байт объекта тайла, начиная со смещения off.
+// Как и io.ReaderAt, возвращает io.EOF, если тайл короче off+len(p).
+func (r *S3Repository) ReadTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	key := r.tileKey(id, x, y)
+	b, err := r.client.GetObjectRange(ctx, key, off, int64(len(p)))
+	if err != nil {
+		return 0, notExist("get", key, err)
+	}
+
+	n := copy(p, b)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTileAt считывает тайл, записывает в него p, начиная со смещения off, и сохраняет тайл заново.
+// Как и запись в файл, расширяет тайл, если p выходит за его конец.
+func (r *S3Repository) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	err := r.UpdateTile(ctx, id, x, y, func(b []byte) ([]byte, error) {
+		return writeAt(b, p, off), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// UpdateTile считывает тайл вместе с ETag, передает его update и сохраняет результат условной записью If-Match.
+// Если тайл изменился после чтения, все повторяется, но не больше s3UpdateAttempts раз.
+// Хранилище, не вернувшее ETag, не поддерживает условную запись, тогда тайл сохраняется без условия.
+// Возможны ошибки ErrConflict, *os.PathError с os.ErrNotExist и ошибки клиента.
+func (r *S3Repository) UpdateTile(ctx context.Context, id string, x, y int, update func(b []byte) ([]byte, error)) error {
+	key := r.tileKey(id, x, y)
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	mu := &r.tileLocks[h.Sum32()%uint32(len(r.tileLocks))]
+	mu.Lock()
+	defer mu.Unlock()
+
+	for attempt := 0; attempt < s3UpdateAttempts; attempt++ {
+		b, etag, err := r.client.GetObjectETag(ctx, key)
+		if err != nil {
+			return notExist("get", key, err)
+		}
+
+		b, err = update(b)
+		if err != nil {
+			return err
+		}
+
+		if etag == "" {
+			return r.client.PutObject(ctx, key, b)
+		}
+		err = r.client.PutObjectIfMatch(ctx, key, b, etag)
+		if !errors.Is(err, s3.ErrPrecondition) {
+			return notExist("put", key, err)
+		}
+	}
+
+	return fmt.Errorf("тайл (%d; %d) изображения %s: %w", x, y, id, ErrConflict)
+}
+
+// DeleteImage удаляет объекты тайлов изображения id.
+func (r *S3Repository) DeleteImage(ctx context.Context, id string) error {
+	_, err := r.client.DeletePrefix(ctx, r.imgPrefix(id))
+	return err
+}
+
+// Images возвращает id изображений, тайлы которых есть в бакете.
+func (r *S3Repository) Images(ctx context.Context) ([]string, error) {
+	_, prefixes, err := r.client.ListObjects(ctx, r.prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(p, r.prefix), "/"))
+	}
+	return ids, nil
+}
+
+// Tiles возвращает координаты тайлов изображения id, сохраненных с расширением репозитория.
+func (r *S3Repository) Tiles(ctx context.Context, id string) ([]image.Point, error) {
+	keys, _, err := r.client.ListObjects(ctx, r.imgPrefix(id), "/")
+	if err != nil {
+		return nil, err
+	}
+
+	tiles := make([]image.Point, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, r.imgPrefix(id))
+		if !strings.HasSuffix(name, r.ext) {
+			continue
+		}
+
+		var x, y int
+		_, err := fmt.Sscanf(strings.TrimSuffix(name, r.ext), "Y=%d; X=%d", &y, &x)
+		if err == nil && r.tileKey(id, x, y) == key {
+			tiles = append(tiles, image.Pt(x, y))
+		}
+	}
+	return tiles, nil
+}
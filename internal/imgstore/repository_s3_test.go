@@ -0,0 +1,179 @@
+package imgstore_test
+
+import (
+	"errors"
+	"image"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+	"github.com/Dimedrolity/go-chartographer/pkg/s3"
+	"github.com/Dimedrolity/go-chartographer/pkg/s3/s3test"
+)
+
+// newS3Repo создает хранилище тайлов в бакете "tiles" сервера srv.
+func newS3Repo(srv *s3test.Server, prefix, ext string) *imgstore.S3Repository {
+	srv.CreateBucket("tiles")
+	client, err := s3.NewClient(s3.Config{
+		Endpoint:   srv.URL,
+		Bucket:     "tiles",
+		MaxRetries: 3,
+		RetryDelay: time.Millisecond,
+	})
+	So(err, ShouldBeNil)
+	return imgstore.NewS3Repo(client, prefix, ext)
+}
+
+func TestS3Repo_Service(t *testing.T) {
+	Convey("Тайлы, сохраненные в бакет, должны читаться и изменяться сервисом любого формата", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+
+		for _, format := range []imgstore.Format{imgstore.FormatBmp, imgstore.FormatRaw} {
+			service, err := imgstore.NewService(format, newS3Repo(srv, "chartographer", format.Ext()))
+			So(err, ShouldBeNil)
+
+			img := newColorfulRGBA(5, 4)
+			err = service.SaveTile(ctx, "0", 0, 0, img)
+			So(err, ShouldBeNil)
+
+			got, err := service.GetTile(ctx, "0", 0, 0)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, img)
+
+			r := image.Rect(1, 1, 3, 3)
+			err = service.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+			So(err, ShouldBeNil)
+
+			region := image.NewRGBA(image.Rect(0, 0, 5, 4))
+			err = service.ReadTileRegion(ctx, "0", 0, 0, region.Rect, region)
+			So(err, ShouldBeNil)
+			So(region.At(0, 0), ShouldResemble, img.At(0, 0))
+			So(region.At(2, 2), ShouldResemble, red)
+		}
+
+		So(srv.Keys("tiles"), ShouldResemble, []string{
+			"chartographer/0/Y=0; X=0" + imgstore.FormatBmp.Ext(),
+			"chartographer/0/Y=0; X=0" + imgstore.FormatRaw.Ext(),
+		})
+	})
+}
+
+func TestS3Repo_Delete(t *testing.T) {
+	Convey("DeleteImage должен удалять объекты только своего изображения и префикса", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		repo := newS3Repo(srv, "a", ".bmp")
+		other := newS3Repo(srv, "b", ".bmp")
+
+		for _, id := range []string{"1", "10"} {
+			for x := 0; x < 3; x++ {
+				So(repo.SaveTile(ctx, id, x, 0, []byte{1}), ShouldBeNil)
+			}
+		}
+		So(other.SaveTile(ctx, "1", 0, 0, []byte{1}), ShouldBeNil)
+
+		ids, err := repo.Images(ctx)
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []string{"1", "10"})
+		tiles, err := repo.Tiles(ctx, "1")
+		So(err, ShouldBeNil)
+		So(tiles, ShouldHaveLength, 3)
+
+		So(repo.DeleteImage(ctx, "1"), ShouldBeNil)
+
+		_, err = repo.GetTile(ctx, "1", 0, 0)
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+		ids, err = repo.Images(ctx)
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []string{"10"})
+		_, err = other.GetTile(ctx, "1", 0, 0)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestS3Repo_Retries(t *testing.T) {
+	Convey("Временная недоступность хранилища не должна приводить к ошибке", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		repo := newS3Repo(srv, "", ".raw")
+
+		srv.FailNext(3, http.StatusServiceUnavailable)
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte("tile")), ShouldBeNil)
+
+		srv.FailNext(2, http.StatusServiceUnavailable)
+		p := make([]byte, 2)
+		n, err := repo.ReadTileAt(ctx, "0", 0, 0, p, 1)
+		So(err, ShouldBeNil)
+		So(string(p[:n]), ShouldEqual, "il")
+
+		srv.FailNext(4, http.StatusServiceUnavailable)
+		_, err = repo.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestS3Repo_UpdateTile(t *testing.T) {
+	Convey("Изменение тайла другим экземпляром между чтением и записью не должно теряться", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		repo := newS3Repo(srv, "", ".raw")
+		other := newS3Repo(srv, "", ".raw")
+
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte("0000")), ShouldBeNil)
+
+		calls := 0
+		err := repo.UpdateTile(ctx, "0", 0, 0, func(b []byte) ([]byte, error) {
+			calls++
+			if calls == 1 {
+				_, err := other.WriteTileAt(ctx, "0", 0, 0, []byte("1"), 0)
+				So(err, ShouldBeNil)
+			}
+			b[3] = '2'
+			return b, nil
+		})
+		So(err, ShouldBeNil)
+		So(calls, ShouldEqual, 2)
+
+		b, err := repo.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "1002")
+	})
+
+	Convey("Тайл, который непрерывно изменяют другие экземпляры, должен давать ошибку ErrConflict", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		repo := newS3Repo(srv, "", ".raw")
+		other := newS3Repo(srv, "", ".raw")
+
+		So(repo.SaveTile(ctx, "0", 0, 0, []byte{0}), ShouldBeNil)
+
+		err := repo.UpdateTile(ctx, "0", 0, 0, func(b []byte) ([]byte, error) {
+			_, err := other.WriteTileAt(ctx, "0", 0, 0, []byte{b[0] + 1}, 0)
+			So(err, ShouldBeNil)
+			return b, nil
+		})
+		So(errors.Is(err, imgstore.ErrConflict), ShouldBeTrue)
+	})
+
+	Convey("Область тайла должна записываться одним чтением и одной записью объекта", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		service := imgstore.NewRawService(newS3Repo(srv, "", ".raw"))
+
+		So(service.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(100, 100)), ShouldBeNil)
+
+		requests := srv.Requests()
+		r := image.Rect(10, 10, 20, 90)
+		So(service.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red)), ShouldBeNil)
+		So(srv.Requests(), ShouldEqual, requests+2)
+
+		got, err := service.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got.At(15, 50), ShouldResemble, red)
+	})
+}
@@ -1,18 +1,36 @@
 package imgstore
 
-import "image"
+import (
+	"context"
+	"image"
+)
 
 // Service определяет операции над тайлами в виде image.Image.
 type Service interface {
 	// SaveTile
 	// Координатами являются (x; y), а не img.Bounds().Min.
-	SaveTile(id string, x int, y int, img image.Image) error
+	SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error
 	// GetTile
 	// У возвращаемого image.Image Bounds().Min равен (0; 0).
 	// Для смещения на (x; y) использовать RectShifter.
-	GetTile(id string, x, y int) (image.Image, error)
-	DeleteImage(id string) error
+	GetTile(ctx context.Context, id string, x, y int) (image.Image, error)
+	DeleteImage(ctx context.Context, id string) error
+
+	// ReadTileRegion копирует в dst пиксели тайла (x; y), попадающие в прямоугольник r.
+	// r задается в координатах изображения и должен лежать внутри тайла и dst.
+	ReadTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, dst *image.RGBA) error
+	// WriteTileRegion записывает в тайл (x; y) пиксели src, попадающие в прямоугольник r.
+	// r задается в координатах изображения и должен лежать внутри тайла и src.
+	WriteTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, src image.Image) error
 
 	Encode(img image.Image) ([]byte, error)
 	Decode(b []byte) (image.Image, error)
+	// DecodeConfig декодирует только заголовок изображения, не выделяя память под пиксели.
+	DecodeConfig(b []byte) (image.Config, error)
+}
+
+// Flusher - Service, накапливающий измененные тайлы в памяти, например WriteBackService.
+// Flush сохраняет накопленные тайлы в хранилище.
+type Flusher interface {
+	Flush() error
 }
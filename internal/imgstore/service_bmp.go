@@ -2,7 +2,11 @@ package imgstore
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"image"
+	"image/draw"
 
 	"golang.org/x/image/bmp"
 )
@@ -21,8 +25,8 @@ func NewBmpService(r Repository) *BmpService {
 
 // GetTile возвращает изображение-тайл с координатами (x; y) изображения id в формате BMP.
 // У возвращаемого image.Image Bounds().Min равен (x; y).
-func (s *BmpService) GetTile(id string, x, y int) (image.Image, error) {
-	tile, err := s.repo.GetTile(id, x, y)
+func (s *BmpService) GetTile(ctx context.Context, id string, x, y int) (image.Image, error) {
+	tile, err := s.repo.GetTile(ctx, id, x, y)
 	if err != nil {
 		return nil, err
 	}
@@ -36,13 +40,13 @@ func (s *BmpService) GetTile(id string, x, y int) (image.Image, error) {
 }
 
 // SaveTile декодирует тайл-изображение в формат BMP и сохраняет.
-func (s *BmpService) SaveTile(id string, x int, y int, img image.Image) error {
+func (s *BmpService) SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error {
 	encode, err := s.Encode(img)
 	if err != nil {
 		return err
 	}
 
-	err = s.repo.SaveTile(id, x, y, encode)
+	err = s.repo.SaveTile(ctx, id, x, y, encode)
 	if err != nil {
 		return err
 	}
@@ -50,13 +54,68 @@ func (s *BmpService) SaveTile(id string, x int, y int, img image.Image) error {
 	return nil
 }
 
+// ReadTileRegion копирует в dst часть тайла.
+// Строки BMP хранятся снизу вверх с выравниванием и в порядке каналов BGR, поэтому тайл декодируется целиком.
+func (s *BmpService) ReadTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, dst *image.RGBA) error {
+	tile, err := s.GetTile(ctx, id, x, y)
+	if err != nil {
+		return err
+	}
+
+	local := r.Sub(image.Pt(x, y))
+	if !local.In(tile.Bounds()) {
+		return ErrRegion
+	}
+
+	draw.Draw(dst, r, tile, local.Min, draw.Src)
+	return nil
+}
+
+// WriteTileRegion накладывает на тайл часть src. Тайл декодируется и перезаписывается целиком.
+func (s *BmpService) WriteTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, src image.Image) error {
+	tile, err := s.GetTile(ctx, id, x, y)
+	if err != nil {
+		return err
+	}
+
+	mutableTile, ok := tile.(draw.Image)
+	if !ok {
+		return errors.New("изображение должно реализовывать draw.Image")
+	}
+
+	local := r.Sub(image.Pt(x, y))
+	if !local.In(tile.Bounds()) {
+		return ErrRegion
+	}
+
+	draw.Draw(mutableTile, local, src, r.Min, draw.Src)
+	return s.SaveTile(ctx, id, x, y, mutableTile)
+}
+
 // DeleteImage удаляет изображение.
-func (s *BmpService) DeleteImage(id string) error {
-	return s.repo.DeleteImage(id)
+func (s *BmpService) DeleteImage(ctx context.Context, id string) error {
+	return s.repo.DeleteImage(ctx, id)
 }
 
 // Encode декодирует image.Image в формат BMP.
 func (s *BmpService) Encode(img image.Image) ([]byte, error) {
+	return encodeBmp(img)
+}
+
+// Decode декодирует байты BMP изображения в image.Image.
+// Перед декодированием проверяется заголовок, см. DecodeConfig.
+func (s *BmpService) Decode(b []byte) (image.Image, error) {
+	return decodeBmp(b)
+}
+
+// DecodeConfig декодирует заголовок BMP изображения и проверяет,
+// что данных достаточно для всех заявленных в заголовке пикселей.
+// Возможна ошибка ErrTruncated и ошибки декодирования заголовка.
+func (s *BmpService) DecodeConfig(b []byte) (image.Config, error) {
+	return decodeBmpConfig(b)
+}
+
+func encodeBmp(img image.Image) ([]byte, error) {
 	buffer := bytes.Buffer{}
 	err := bmp.Encode(&buffer, img)
 	if err != nil {
@@ -66,8 +125,12 @@ func (s *BmpService) Encode(img image.Image) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-// Decode декодирует байты BMP изображения в image.Image.
-func (s *BmpService) Decode(b []byte) (image.Image, error) {
+func decodeBmp(b []byte) (image.Image, error) {
+	_, err := decodeBmpConfig(b)
+	if err != nil {
+		return nil, err
+	}
+
 	img, err := bmp.Decode(bytes.NewReader(b))
 	if err != nil {
 		return nil, err
@@ -75,3 +138,28 @@ func (s *BmpService) Decode(b []byte) (image.Image, error) {
 
 	return img, nil
 }
+
+// Смещения полей заголовка BMP (BITMAPFILEHEADER + BITMAPINFOHEADER).
+const (
+	bmpPixelOffsetPos = 10
+	bmpBitCountPos    = 28
+)
+
+func decodeBmpConfig(b []byte) (image.Config, error) {
+	config, err := bmp.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	// bmp.DecodeConfig успешно прочитал заголовок, значит оба поля присутствуют в b.
+	pixelOffset := int64(binary.LittleEndian.Uint32(b[bmpPixelOffsetPos:]))
+	bitCount := int64(binary.LittleEndian.Uint16(b[bmpBitCountPos:]))
+
+	// Строки BMP выравниваются по 4 байта.
+	rowSize := (bitCount*int64(config.Width) + 31) / 32 * 4
+	if int64(len(b)) < pixelOffset+rowSize*int64(config.Height) {
+		return image.Config{}, ErrTruncated
+	}
+
+	return config, nil
+}
@@ -2,9 +2,12 @@ package imgstore_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"image"
 	"image/color"
+	"io"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -13,6 +16,8 @@ import (
 	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
 )
 
+var ctx = context.Background()
+
 // TestEncodeDecode - тест библиотеки "golang.org/x/image/bmp" для того, чтобы повысить доверие.
 // Библиотека должна кодировать/декодировать верно, должны совпадать все реальные байты с ожидаемыми.
 func TestEncodeDecode(t *testing.T) {
@@ -103,12 +108,12 @@ type TestTileRepo struct {
 	images map[string][]byte
 }
 
-func (r *TestTileRepo) SaveTile(id string, _ int, _ int, img []byte) error {
+func (r *TestTileRepo) SaveTile(ctx context.Context, id string, _ int, _ int, img []byte) error {
 	r.images[id] = img
 	return nil
 }
 
-func (r *TestTileRepo) GetTile(id string, _, _ int) ([]byte, error) {
+func (r *TestTileRepo) GetTile(ctx context.Context, id string, _, _ int) ([]byte, error) {
 	_, ok := r.images[id]
 	if !ok {
 		return nil, errors.New("")
@@ -116,7 +121,26 @@ func (r *TestTileRepo) GetTile(id string, _, _ int) ([]byte, error) {
 	return r.images[id], nil
 }
 
-func (r *TestTileRepo) DeleteImage(id string) error {
+func (r *TestTileRepo) ReadTileAt(ctx context.Context, id string, _, _ int, p []byte, off int64) (int, error) {
+	b, ok := r.images[id]
+	if !ok {
+		return 0, errors.New("")
+	}
+	if off+int64(len(p)) > int64(len(b)) {
+		return copy(p, b[off:]), io.EOF
+	}
+	return copy(p, b[off:]), nil
+}
+
+func (r *TestTileRepo) WriteTileAt(ctx context.Context, id string, _, _ int, p []byte, off int64) (int, error) {
+	b, ok := r.images[id]
+	if !ok {
+		return 0, errors.New("")
+	}
+	return copy(b[off:], p), nil
+}
+
+func (r *TestTileRepo) DeleteImage(ctx context.Context, id string) error {
 	delete(r.images, id)
 	return nil
 }
@@ -137,10 +161,10 @@ func TestBmpService_SuccessGet(t *testing.T) {
 		img.Set(x, y, color.RGBA{A: 255}) // чтобы в SaveTile Decode распознал как 24-битное
 
 		const id = "0"
-		err := bmpService.SaveTile(id, x, y, img)
+		err := bmpService.SaveTile(ctx, id, x, y, img)
 		So(err, ShouldBeNil)
 
-		got, err := bmpService.GetTile(id, x, y)
+		got, err := bmpService.GetTile(ctx, id, x, y)
 		So(err, ShouldBeNil)
 
 		So(got.Bounds(), ShouldResemble, img.Bounds())
@@ -161,16 +185,16 @@ func TestBmpService_SuccessDelete(t *testing.T) {
 		img := image.NewRGBA(image.Rect(x, y, x+width, y+height))
 
 		const id = "0"
-		err := bmpService.SaveTile(id, x, y, img)
+		err := bmpService.SaveTile(ctx, id, x, y, img)
 		So(err, ShouldBeNil)
 
-		_, err = bmpService.GetTile(id, x, y)
+		_, err = bmpService.GetTile(ctx, id, x, y)
 		So(err, ShouldBeNil)
 
-		err = bmpService.DeleteImage(id)
+		err = bmpService.DeleteImage(ctx, id)
 		So(err, ShouldBeNil)
 
-		_, err = bmpService.GetTile(id, x, y)
+		_, err = bmpService.GetTile(ctx, id, x, y)
 		So(err, ShouldNotBeNil)
 	})
 }
@@ -180,7 +204,65 @@ func TestBmpService_ErrorGet(t *testing.T) {
 		tileRepo := &TestTileRepo{images: make(map[string][]byte)}
 		bmpService := imgstore.NewBmpService(tileRepo)
 
-		_, err := bmpService.GetTile("0", 0, 0)
+		_, err := bmpService.GetTile(ctx, "0", 0, 0)
 		So(err, ShouldNotBeNil)
 	})
 }
+
+// bmpHeader создает заголовок 24-битного BMP размера width x height без пикселей.
+func bmpHeader(width, height int) []byte {
+	b := make([]byte, 54)
+	b[0], b[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(b[10:], 54) // смещение пикселей
+	binary.LittleEndian.PutUint32(b[14:], 40) // размер BITMAPINFOHEADER
+	binary.LittleEndian.PutUint32(b[18:], uint32(width))
+	binary.LittleEndian.PutUint32(b[22:], uint32(height))
+	binary.LittleEndian.PutUint16(b[26:], 1)  // плоскости
+	binary.LittleEndian.PutUint16(b[28:], 24) // бит на пиксель
+	return b
+}
+
+func TestBmpService_DecodeConfig(t *testing.T) {
+	Convey("DecodeConfig должен вернуть размер из заголовка", t, func() {
+		bmpService := imgstore.NewBmpService(nil)
+
+		img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+		img.Set(0, 0, color.RGBA{A: 255})
+		b, err := bmpService.Encode(img)
+		So(err, ShouldBeNil)
+
+		config, err := bmpService.DecodeConfig(b)
+		So(err, ShouldBeNil)
+		So(config.Width, ShouldEqual, 3)
+		So(config.Height, ShouldEqual, 2)
+	})
+}
+
+func TestBmpService_Truncated(t *testing.T) {
+	Convey("Заголовок с огромными размерами и без пикселей должен отклоняться до декодирования", t, func() {
+		bmpService := imgstore.NewBmpService(nil)
+		b := bmpHeader(50_000, 50_000)
+
+		_, err := bmpService.DecodeConfig(b)
+		So(errors.Is(err, imgstore.ErrTruncated), ShouldBeTrue)
+
+		_, err = bmpService.Decode(b)
+		So(errors.Is(err, imgstore.ErrTruncated), ShouldBeTrue)
+	})
+
+	Convey("Заголовок с пикселями, выровненными по 4 байта, должен проходить проверку", t, func() {
+		bmpService := imgstore.NewBmpService(nil)
+		const (
+			width   = 3
+			height  = 2
+			rowSize = 12 // 3 пикселя по 3 байта, выровнено по 4
+		)
+		b := append(bmpHeader(width, height), make([]byte, rowSize*height)...)
+
+		_, err := bmpService.DecodeConfig(b)
+		So(err, ShouldBeNil)
+
+		_, err = bmpService.DecodeConfig(b[:len(b)-1])
+		So(errors.Is(err, imgstore.ErrTruncated), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,226 @@
+package imgstore
+
+import (
+	"container/list"
+	"context"
+	"image"
+	"image/draw"
+	"sync"
+)
+
+// CachedService - декоратор Service, хранящий декодированные тайлы в LRU кэше ограниченного размера.
+// Размер тайла в кэше - размер его пикселей image.RGBA.
+// Кэш сбрасывается при SaveTile, WriteTileRegion и DeleteImage, запись выполняется в декорируемый Service.
+type CachedService struct {
+	service  Service
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List // Элементы типа *cachedTile, в начале - недавно использованные.
+	tiles map[cacheKey]*list.Element
+	// gen увеличивается при каждом изменении тайлов. Тайл, загруженный во время изменения, не кэшируется,
+	// так как мог быть прочитан до изменения.
+	gen uint64
+
+	hits, misses uint64
+}
+
+type cacheKey struct {
+	id   string
+	x, y int
+}
+
+type cachedTile struct {
+	key cacheKey
+	img *image.RGBA
+}
+
+func tileBytes(img *image.RGBA) int64 {
+	return int64(len(img.Pix))
+}
+
+// NewCachedService создает кэш тайлов service размером не более maxBytes байт.
+func NewCachedService(service Service, maxBytes int64) *CachedService {
+	return &CachedService{
+		service:  service,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		tiles:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// tile возвращает тайл из кэша или загружает его из декорируемого Service.
+// Возвращаемое изображение нельзя изменять, оно может находиться в кэше.
+func (s *CachedService) tile(ctx context.Context, id string, x, y int) (*image.RGBA, error) {
+	k := cacheKey{id: id, x: x, y: y}
+
+	s.mu.Lock()
+	if e, ok := s.tiles[k]; ok {
+		s.lru.MoveToFront(e)
+		s.hits++
+		img := e.Value.(*cachedTile).img
+		s.mu.Unlock()
+		return img, nil
+	}
+	s.misses++
+	gen := s.gen
+	s.mu.Unlock()
+
+	tile, err := s.service.GetTile(ctx, id, x, y)
+	if err != nil {
+		return nil, err
+	}
+	img := toRGBA(tile)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen == s.gen {
+		s.add(k, img)
+	}
+	return img, nil
+}
+
+// toRGBA возвращает tile в виде image.RGBA с Bounds().Min, равным (0; 0), копируя пиксели при необходимости.
+func toRGBA(tile image.Image) *image.RGBA {
+	if img, ok := tile.(*image.RGBA); ok && img.Rect.Min == (image.Point{}) {
+		return img
+	}
+
+	b := tile.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), tile, b.Min, draw.Src)
+	return img
+}
+
+// add добавляет тайл в кэш, вытесняя давно использованные. Вызывается под mu.
+func (s *CachedService) add(k cacheKey, img *image.RGBA) {
+	size := tileBytes(img)
+	if size > s.maxBytes {
+		return
+	}
+	if e, ok := s.tiles[k]; ok {
+		s.remove(e)
+	}
+
+	for s.bytes+size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+
+	s.tiles[k] = s.lru.PushFront(&cachedTile{key: k, img: img})
+	s.bytes += size
+}
+
+// remove удаляет элемент из кэша. Вызывается под mu.
+func (s *CachedService) remove(e *list.Element) {
+	t := s.lru.Remove(e).(*cachedTile)
+	delete(s.tiles, t.key)
+	s.bytes -= tileBytes(t.img)
+}
+
+// invalidate удаляет из кэша тайлы, для которых match возвращает true.
+func (s *CachedService) invalidate(match func(k cacheKey) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gen++
+	for k, e := range s.tiles {
+		if match(k) {
+			s.remove(e)
+		}
+	}
+}
+
+// invalidateTile удаляет из кэша тайл (x; y) изображения id по ключу, не перебирая кэш.
+func (s *CachedService) invalidateTile(id string, x, y int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gen++
+	if e, ok := s.tiles[cacheKey{id: id, x: x, y: y}]; ok {
+		s.remove(e)
+	}
+}
+
+// GetTile возвращает копию тайла, так как вызывающий код может изменять изображение.
+// У возвращаемого image.Image Bounds().Min равен (0; 0).
+func (s *CachedService) GetTile(ctx context.Context, id string, x, y int) (image.Image, error) {
+	img, err := s.tile(ctx, id, x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	return cloneRGBA(img), nil
+}
+
+// ReadTileRegion копирует в dst часть тайла из кэша.
+func (s *CachedService) ReadTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, dst *image.RGBA) error {
+	img, err := s.tile(ctx, id, x, y)
+	if err != nil {
+		return err
+	}
+
+	local := r.Sub(image.Pt(x, y))
+	if !local.In(img.Rect) {
+		return ErrRegion
+	}
+
+	draw.Draw(dst, r, img, local.Min, draw.Src)
+	return nil
+}
+
+func (s *CachedService) SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error {
+	defer s.invalidateTile(id, x, y)
+	return s.service.SaveTile(ctx, id, x, y, img)
+}
+
+func (s *CachedService) WriteTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, src image.Image) error {
+	defer s.invalidateTile(id, x, y)
+	return s.service.WriteTileRegion(ctx, id, x, y, r, src)
+}
+
+func (s *CachedService) DeleteImage(ctx context.Context, id string) error {
+	defer s.invalidate(func(k cacheKey) bool { return k.id == id })
+	return s.service.DeleteImage(ctx, id)
+}
+
+func (s *CachedService) Encode(img image.Image) ([]byte, error) {
+	return s.service.Encode(img)
+}
+
+func (s *CachedService) Decode(b []byte) (image.Image, error) {
+	return s.service.Decode(b)
+}
+
+func (s *CachedService) DecodeConfig(b []byte) (image.Config, error) {
+	return s.service.DecodeConfig(b)
+}
+
+// Flush сохраняет тайлы, накопленные декорируемым Service, если он реализует Flusher.
+func (s *CachedService) Flush() error {
+	if f, ok := s.service.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Hits возвращает количество обращений к тайлам, найденным в кэше.
+func (s *CachedService) Hits() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits
+}
+
+// Misses возвращает количество обращений к тайлам, загруженным из декорируемого Service.
+func (s *CachedService) Misses() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.misses
+}
+
+// Bytes возвращает размер тайлов в кэше.
+func (s *CachedService) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
@@ -0,0 +1,137 @@
+package imgstore_test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+func newCachedService(maxBytes int64) (*imgstore.CachedService, imgstore.Service) {
+	raw := imgstore.NewRawService(&TestTileRepo{images: make(map[string][]byte)})
+	return imgstore.NewCachedService(raw, maxBytes), raw
+}
+
+func TestCachedService_SamePixels(t *testing.T) {
+	Convey("Тайлы из кэша и без кэша должны совпадать", t, func() {
+		cached, raw := newCachedService(1 << 20)
+
+		err := cached.SaveTile(ctx, "0", 10, 20, newColorfulRGBA(4, 3))
+		So(err, ShouldBeNil)
+
+		expected, err := raw.GetTile(ctx, "0", 10, 20)
+		So(err, ShouldBeNil)
+
+		miss, err := cached.GetTile(ctx, "0", 10, 20)
+		So(err, ShouldBeNil)
+		hit, err := cached.GetTile(ctx, "0", 10, 20)
+		So(err, ShouldBeNil)
+
+		So(miss, ShouldResemble, expected)
+		So(hit, ShouldResemble, expected)
+		So(cached.Misses(), ShouldEqual, 1)
+		So(cached.Hits(), ShouldEqual, 1)
+
+		r := image.Rect(11, 21, 13, 23)
+		expectedRegion := image.NewRGBA(r)
+		err = raw.ReadTileRegion(ctx, "0", 10, 20, r, expectedRegion)
+		So(err, ShouldBeNil)
+
+		region := image.NewRGBA(r)
+		err = cached.ReadTileRegion(ctx, "0", 10, 20, r, region)
+		So(err, ShouldBeNil)
+		So(region, ShouldResemble, expectedRegion)
+		So(cached.Hits(), ShouldEqual, 2)
+	})
+
+	Convey("Изменение полученного тайла не должно изменять кэш", t, func() {
+		cached, _ := newCachedService(1 << 20)
+
+		img := newColorfulRGBA(2, 2)
+		err := cached.SaveTile(ctx, "0", 0, 0, img)
+		So(err, ShouldBeNil)
+
+		got, err := cached.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		got.(*image.RGBA).SetRGBA(0, 0, color.RGBA{R: 255, A: 255})
+
+		got, err = cached.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+	})
+}
+
+func TestCachedService_Invalidate(t *testing.T) {
+	Convey("После изменения тайла должны возвращаться новые пиксели", t, func() {
+		cached, _ := newCachedService(1 << 20)
+
+		err := cached.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+		_, err = cached.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+
+		red := color.RGBA{R: 255, A: 255}
+		src := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		src.SetRGBA(0, 0, red)
+		err = cached.WriteTileRegion(ctx, "0", 0, 0, src.Rect, src)
+		So(err, ShouldBeNil)
+
+		got, err := cached.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got.At(0, 0), ShouldResemble, red)
+
+		img := newColorfulRGBA(3, 3)
+		err = cached.SaveTile(ctx, "0", 0, 0, img)
+		So(err, ShouldBeNil)
+
+		got, err = cached.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+
+		err = cached.DeleteImage(ctx, "0")
+		So(err, ShouldBeNil)
+		So(cached.Bytes(), ShouldEqual, 0)
+
+		_, err = cached.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCachedService_Evict(t *testing.T) {
+	Convey("Кэш не должен превышать размер, вытесняются давно использованные тайлы", t, func() {
+		// Тайл 2x2 занимает 16 байт.
+		cached, _ := newCachedService(32)
+
+		for _, id := range []string{"0", "1", "2"} {
+			err := cached.SaveTile(ctx, id, 0, 0, newColorfulRGBA(2, 2))
+			So(err, ShouldBeNil)
+		}
+
+		_, _ = cached.GetTile(ctx, "0", 0, 0)
+		_, _ = cached.GetTile(ctx, "1", 0, 0)
+		_, _ = cached.GetTile(ctx, "0", 0, 0) // "1" становится давно использованным
+		_, _ = cached.GetTile(ctx, "2", 0, 0)
+		So(cached.Bytes(), ShouldEqual, 32)
+		So(cached.Misses(), ShouldEqual, 3)
+
+		_, _ = cached.GetTile(ctx, "0", 0, 0)
+		So(cached.Misses(), ShouldEqual, 3)
+		_, _ = cached.GetTile(ctx, "1", 0, 0)
+		So(cached.Misses(), ShouldEqual, 4)
+	})
+
+	Convey("Тайл больше кэша не должен кэшироваться", t, func() {
+		cached, _ := newCachedService(8)
+
+		err := cached.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+
+		_, _ = cached.GetTile(ctx, "0", 0, 0)
+		_, _ = cached.GetTile(ctx, "0", 0, 0)
+		So(cached.Misses(), ShouldEqual, 2)
+		So(cached.Bytes(), ShouldEqual, 0)
+	})
+}
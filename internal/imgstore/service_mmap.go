@@ -0,0 +1,412 @@
+package imgstore
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"sync"
+)
+
+// MmapService - хранилище изображений-тайлов формата raw, отображенных в память (mmap).
+// Файл тайла отображается при первом обращении и остается отображенным, поэтому чтение фрагмента
+// копирует пиксели прямо из отображенной памяти, без системных вызовов на каждый тайл.
+// Отображенных тайлов не больше maxMapped: давно использованные вытесняются, их отображение отменяется.
+// Запись части тайла изменяет отображенную память, изменения попадают в файл через страничный кэш ОС.
+//
+// Чтение тайла выполняется под RLock тайла, запись и отмена отображения - под Lock,
+// поэтому память не освобождается, пока из нее копируются пиксели.
+// Encode, Decode и DecodeConfig работают с форматом обмена - BMP.
+type MmapService struct {
+	repo      *FileSystemTileRepository
+	maxMapped int
+
+	mu    sync.Mutex
+	lru   *list.List // Элементы типа *mappedTile, в начале - недавно использованные.
+	tiles map[mmapKey]*list.Element
+	// deleting - сколько удалений изображения выполняется. Пока изображение удаляется, его тайлы не отображаются.
+	deleting map[string]int
+}
+
+type mmapKey struct {
+	id   string
+	x, y int
+}
+
+// mappedTile - отображенный в память файл тайла.
+type mappedTile struct {
+	key mmapKey
+
+	mu sync.RWMutex
+	// data равен nil, пока файл не отображен.
+	data          []byte
+	width, height int
+	// deleted означает, что тайл удален из MmapService.tiles и его нужно получить заново.
+	deleted bool
+}
+
+// NewMmapService создает MmapService поверх файлов репозитория r. Тайлы в r должны храниться в формате raw.
+// Отображенных тайлов не больше maxMapped, при maxMapped <= 0 - не больше одного.
+// На платформах без mmap операции с тайлами возвращают ErrMmapUnsupported.
+func NewMmapService(r *FileSystemTileRepository, maxMapped int) *MmapService {
+	if maxMapped < 1 {
+		maxMapped = 1
+	}
+	return &MmapService{
+		repo:      r,
+		maxMapped: maxMapped,
+		lru:       list.New(),
+		tiles:     make(map[mmapKey]*list.Element),
+		deleting:  make(map[string]int),
+	}
+}
+
+// entry возвращает запись тайла, создавая ее при необходимости и вытесняя давно использованные.
+// Пока изображение удаляется, возвращает ошибку os.ErrNotExist.
+func (s *MmapService) entry(k mmapKey) (*mappedTile, error) {
+	s.mu.Lock()
+	if s.deleting[k.id] > 0 {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("тайл (%d; %d) изображения %s: %w", k.x, k.y, k.id, os.ErrNotExist)
+	}
+
+	if e, ok := s.tiles[k]; ok {
+		s.lru.MoveToFront(e)
+		s.mu.Unlock()
+		return e.Value.(*mappedTile), nil
+	}
+
+	m := &mappedTile{key: k}
+	s.tiles[k] = s.lru.PushFront(m)
+	var evicted []*mappedTile
+	for s.lru.Len() > s.maxMapped {
+		evicted = append(evicted, s.remove(s.lru.Back()))
+	}
+	s.mu.Unlock()
+
+	// Отображение отменяется вне mu: вытесняемый тайл может читаться, и Lock ожидает завершения чтения.
+	for _, v := range evicted {
+		v.mu.Lock()
+		_ = v.unmap()
+		v.deleted = true
+		v.mu.Unlock()
+	}
+	return m, nil
+}
+
+// remove удаляет элемент из tiles и lru и возвращает его тайл. Вызывается под mu.
+func (s *MmapService) remove(e *list.Element) *mappedTile {
+	m := s.lru.Remove(e).(*mappedTile)
+	delete(s.tiles, m.key)
+	return m
+}
+
+// forget удаляет запись m, если она еще хранится.
+func (s *MmapService) forget(m *mappedTile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.tiles[m.key]; ok && e.Value == m {
+		s.remove(e)
+	}
+}
+
+// Mapped возвращает количество записей тайлов, в том числе еще не отображенных.
+func (s *MmapService) Mapped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// rlock возвращает отображенный тайл, удерживая его RLock.
+func (s *MmapService) rlock(k mmapKey) (*mappedTile, error) {
+	for {
+		m, err := s.entry(k)
+		if err != nil {
+			return nil, err
+		}
+
+		m.mu.RLock()
+		if !m.deleted && m.data != nil {
+			return m, nil
+		}
+		m.mu.RUnlock()
+
+		m.mu.Lock()
+		if !m.deleted && m.data == nil {
+			err := m.mapFile(s.repo.tilePath(k.id, k.x, k.y))
+			if err != nil {
+				// Запись тайла, который не удалось отобразить, например удаленного, не хранится.
+				m.deleted = true
+				m.mu.Unlock()
+				s.forget(m)
+				return nil, err
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// lock возвращает запись тайла, удерживая ее Lock. Файл тайла может быть не отображен.
+func (s *MmapService) lock(k mmapKey) (*mappedTile, error) {
+	for {
+		m, err := s.entry(k)
+		if err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		if !m.deleted {
+			return m, nil
+		}
+		m.mu.Unlock()
+	}
+}
+
+// mapFile отображает в память файл тайла формата raw. Вызывается под Lock.
+// Возможны ошибки ErrRawFormat, ErrTruncated, ErrMmapUnsupported и ошибки типа *os.PathError.
+func (m *mappedTile) mapFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	// Отображение остается действительным после закрытия файла.
+	defer f.Close()
+
+	header := make([]byte, rawHeaderSize)
+	_, err = f.ReadAt(header, 0)
+	if err != nil {
+		return ErrRawFormat
+	}
+	width, height, err := decodeRawHeader(header)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Обращение к отображенной памяти за концом файла приводит к SIGBUS, поэтому размер проверяется заранее.
+	size := rawSize(width, height)
+	if info.Size() < size {
+		return ErrTruncated
+	}
+	if int64(int(size)) != size {
+		return ErrRawFormat
+	}
+
+	data, err := mmapFile(f, int(size))
+	if err != nil {
+		return err
+	}
+
+	m.data, m.width, m.height = data, width, height
+	return nil
+}
+
+// unmap отменяет отображение файла тайла. Вызывается под Lock.
+func (m *mappedTile) unmap() error {
+	if m.data == nil {
+		return nil
+	}
+
+	err := munmapFile(m.data)
+	m.data = nil
+	return err
+}
+
+// local переводит r в координаты тайла (x; y).
+// Возможна ошибка ErrRegion.
+func (m *mappedTile) local(x, y int, r image.Rectangle) (image.Rectangle, error) {
+	local := r.Sub(image.Pt(x, y))
+	if local.Empty() || !local.In(image.Rect(0, 0, m.width, m.height)) {
+		return image.Rectangle{}, ErrRegion
+	}
+	return local, nil
+}
+
+// GetTile возвращает копию изображения-тайла с координатами (x; y) изображения id.
+// У возвращаемого image.Image Bounds().Min равен (0; 0).
+func (s *MmapService) GetTile(ctx context.Context, id string, x, y int) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m, err := s.rlock(mmapKey{id: id, x: x, y: y})
+	if err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	img := image.NewRGBA(image.Rect(0, 0, m.width, m.height))
+	getRawPixels(img, img.Bounds(), m.data[rawHeaderSize:])
+	return img, nil
+}
+
+// SaveTile кодирует тайл-изображение в формат raw и заменяет файл тайла новым.
+// Предыдущее отображение файла отменяется, новое создается при следующем обращении.
+//
+// Файл заменяется, а не перезаписывается: файл могут отображать вытесненная запись тайла, из которой еще читают,
+// или другой MmapService, и обращение к их памяти за концом обрезанного файла привело бы к SIGBUS.
+// Прежние отображения продолжают ссылаться на замененный файл.
+func (s *MmapService) SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m, err := s.lock(mmapKey{id: id, x: x, y: y})
+	if err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	err = m.unmap()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.repo.imgDirPath(id), 0777)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.repo.tilePath(id, x, y), encodeRaw(img))
+}
+
+// ReadTileRegion копирует пиксели части тайла из отображенной памяти в dst.
+func (s *MmapService) ReadTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, dst *image.RGBA) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m, err := s.rlock(mmapKey{id: id, x: x, y: y})
+	if err != nil {
+		return err
+	}
+	defer m.mu.RUnlock()
+
+	local, err := m.local(x, y, r)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < local.Dy(); i++ {
+		row := image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1)
+		getRawPixels(dst, row, m.data[rawPixelOffset(m.width, local.Min.X, local.Min.Y+i):])
+	}
+
+	return nil
+}
+
+// WriteTileRegion записывает пиксели src в отображенную память части тайла.
+func (s *MmapService) WriteTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, src image.Image) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m, err := s.lock(mmapKey{id: id, x: x, y: y})
+	if err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if m.data == nil {
+		err := m.mapFile(s.repo.tilePath(id, x, y))
+		if err != nil {
+			return err
+		}
+	}
+
+	local, err := m.local(x, y, r)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < local.Dy(); i++ {
+		row := image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1)
+		putRawPixels(m.data[rawPixelOffset(m.width, local.Min.X, local.Min.Y+i):], src, row)
+	}
+
+	return nil
+}
+
+// DeleteImage отменяет отображение тайлов изображения и удаляет их файлы.
+// Пока файлы удаляются, тайлы изображения не отображаются заново: обращения к ним возвращают os.ErrNotExist.
+func (s *MmapService) DeleteImage(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var tiles []*mappedTile
+
+	s.mu.Lock()
+	s.deleting[id]++
+	for k, e := range s.tiles {
+		if k.id == id {
+			tiles = append(tiles, s.remove(e))
+		}
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.deleting[id]--
+		if s.deleting[id] == 0 {
+			delete(s.deleting, id)
+		}
+		s.mu.Unlock()
+	}()
+
+	for _, m := range tiles {
+		m.mu.Lock()
+		err := m.unmap()
+		m.deleted = true
+		m.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.repo.DeleteImage(ctx, id)
+}
+
+// Close отменяет отображение всех тайлов. Файлы тайлов не удаляются.
+func (s *MmapService) Close() error {
+	s.mu.Lock()
+	lru := s.lru
+	s.lru = list.New()
+	s.tiles = make(map[mmapKey]*list.Element)
+	s.mu.Unlock()
+
+	var firstErr error
+	for e := lru.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*mappedTile)
+		m.mu.Lock()
+		err := m.unmap()
+		m.deleted = true
+		m.mu.Unlock()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Encode кодирует image.Image в формат BMP.
+func (s *MmapService) Encode(img image.Image) ([]byte, error) {
+	return encodeBmp(img)
+}
+
+// Decode декодирует байты BMP изображения в image.Image.
+func (s *MmapService) Decode(b []byte) (image.Image, error) {
+	return decodeBmp(b)
+}
+
+// DecodeConfig декодирует заголовок BMP изображения.
+func (s *MmapService) DecodeConfig(b []byte) (image.Config, error) {
+	return decodeBmpConfig(b)
+}
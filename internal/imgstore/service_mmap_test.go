@@ -0,0 +1,273 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package imgstore_test
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+// TestMmapService - интеграционные тесты, так как файлы тайлов отображаются в память.
+
+func newMmapService(t *testing.T) (*imgstore.MmapService, *imgstore.FileSystemTileRepository) {
+	repo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatRaw.Ext())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := imgstore.NewMmapService(repo, 1024)
+	t.Cleanup(func() { _ = s.Close() })
+	return s, repo
+}
+
+func TestMmapService_SuccessGet(t *testing.T) {
+	Convey("Пиксели тайла после сохранения и получения должны совпадать с исходными", t, func() {
+		s, _ := newMmapService(t)
+
+		img := newColorfulRGBA(3, 2)
+		err := s.SaveTile(ctx, "0", 0, 0, img)
+		So(err, ShouldBeNil)
+
+		got, err := s.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+	})
+}
+
+func TestMmapService_Region(t *testing.T) {
+	Convey("Запись части тайла должна попадать в файл и не изменять остальные пиксели", t, func() {
+		s, repo := newMmapService(t)
+
+		const (
+			x = 10
+			y = 20
+		)
+		err := s.SaveTile(ctx, "0", x, y, newColorfulRGBA(4, 3))
+		So(err, ShouldBeNil)
+
+		red := color.RGBA{R: 255, A: 255}
+		r := image.Rect(x+1, y+1, x+3, y+3)
+		src := image.NewRGBA(r)
+		for py := r.Min.Y; py < r.Max.Y; py++ {
+			for px := r.Min.X; px < r.Max.X; px++ {
+				src.SetRGBA(px, py, red)
+			}
+		}
+		err = s.WriteTileRegion(ctx, "0", x, y, r, src)
+		So(err, ShouldBeNil)
+
+		expected := newColorfulRGBA(4, 3)
+		for py := 1; py < 3; py++ {
+			for px := 1; px < 3; px++ {
+				expected.SetRGBA(px, py, red)
+			}
+		}
+
+		dst := image.NewRGBA(image.Rect(x, y, x+4, y+3))
+		err = s.ReadTileRegion(ctx, "0", x, y, dst.Bounds(), dst)
+		So(err, ShouldBeNil)
+		So(dst.Pix, ShouldResemble, expected.Pix)
+
+		// Другой сервис читает файл, а не отображенную память.
+		got, err := imgstore.NewRawService(repo).GetTile(ctx, "0", x, y)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, expected)
+
+		err = s.ReadTileRegion(ctx, "0", x, y, image.Rect(x+3, y, x+5, y+1), dst)
+		So(errors.Is(err, imgstore.ErrRegion), ShouldBeTrue)
+	})
+}
+
+func TestMmapService_Resave(t *testing.T) {
+	Convey("Повторное сохранение тайла другого размера должно заменять отображение", t, func() {
+		s, _ := newMmapService(t)
+
+		err := s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+		_, err = s.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+
+		img := newColorfulRGBA(5, 4)
+		err = s.SaveTile(ctx, "0", 0, 0, img)
+		So(err, ShouldBeNil)
+
+		got, err := s.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+	})
+}
+
+func TestMmapService_ResaveMapped(t *testing.T) {
+	Convey("Сохранение тайла не должно обрезать файл, который отображает другой сервис", t, func() {
+		s, repo := newMmapService(t)
+		other := imgstore.NewMmapService(repo, 1024)
+		defer other.Close()
+
+		img := newColorfulRGBA(100, 100)
+		So(s.SaveTile(ctx, "0", 0, 0, img), ShouldBeNil)
+		got, err := other.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+
+		// Чтение из обрезанного отображенного файла завершило бы тест сигналом SIGBUS.
+		So(s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(1, 1)), ShouldBeNil)
+		got, err = other.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+
+		tmp, err := repo.TempFiles()
+		So(err, ShouldBeNil)
+		So(tmp, ShouldBeEmpty)
+	})
+}
+
+func TestMmapService_Delete(t *testing.T) {
+	Convey("После удаления отображенного тайла получение должно вернуть ошибку", t, func() {
+		s, _ := newMmapService(t)
+
+		err := s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+		_, err = s.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+
+		err = s.DeleteImage(ctx, "0")
+		So(err, ShouldBeNil)
+
+		_, err = s.GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+	})
+}
+
+func TestMmapService_MaxMapped(t *testing.T) {
+	Convey("Отображенных тайлов должно быть не больше maxMapped, вытесненные - читаться заново", t, func() {
+		repo, err := imgstore.NewFileSystemTileRepo(t.TempDir(), imgstore.FormatRaw.Ext())
+		So(err, ShouldBeNil)
+		s := imgstore.NewMmapService(repo, 2)
+		defer s.Close()
+
+		for i := 0; i < 5; i++ {
+			So(s.SaveTile(ctx, "0", i, 0, newColorfulRGBA(i+1, 2)), ShouldBeNil)
+		}
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 5; i++ {
+				got, err := s.GetTile(ctx, "0", i, 0)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, newColorfulRGBA(i+1, 2))
+				So(s.Mapped(), ShouldBeLessThanOrEqualTo, 2)
+			}
+		}
+	})
+}
+
+func TestMmapService_DeleteConcurrent(t *testing.T) {
+	Convey("Чтение во время удаления не должно оставлять отображения удаленных тайлов", t, func() {
+		s, _ := newMmapService(t)
+
+		const tiles = 16
+		for i := 0; i < tiles; i++ {
+			So(s.SaveTile(ctx, "0", i, 0, newColorfulRGBA(4, 4)), ShouldBeNil)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < tiles; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_, _ = s.GetTile(ctx, "0", i, 0)
+				}
+			}(i)
+		}
+		So(s.DeleteImage(ctx, "0"), ShouldBeNil)
+		wg.Wait()
+
+		So(s.Mapped(), ShouldEqual, 0)
+		_, err := s.GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, os.ErrNotExist), ShouldBeTrue)
+	})
+}
+
+func TestMmapService_Truncated(t *testing.T) {
+	Convey("Файл короче заявленного в заголовке не должен отображаться", t, func() {
+		s, repo := newMmapService(t)
+
+		err := imgstore.NewRawService(repo).SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+		b, err := repo.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		err = repo.SaveTile(ctx, "0", 0, 0, b[:len(b)-1])
+		So(err, ShouldBeNil)
+
+		_, err = s.GetTile(ctx, "0", 0, 0)
+		So(errors.Is(err, imgstore.ErrTruncated), ShouldBeTrue)
+	})
+}
+
+func TestMmapService_Concurrent(t *testing.T) {
+	Convey("Одновременные чтение, запись и пересохранение тайла не должны приводить к гонкам", t, func() {
+		s, _ := newMmapService(t)
+
+		const size = 64
+		err := s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(size, size))
+		So(err, ShouldBeNil)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 3*size)
+		for i := 0; i < size; i++ {
+			row := image.Rect(0, i, size, i+1)
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				errs <- s.WriteTileRegion(ctx, "0", 0, 0, row, image.NewRGBA(row))
+			}()
+			go func() {
+				defer wg.Done()
+				errs <- s.ReadTileRegion(ctx, "0", 0, 0, row, image.NewRGBA(row))
+			}()
+			go func() {
+				defer wg.Done()
+				errs <- s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(size, size))
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+	})
+}
+
+// BenchmarkMmapService_ReadTileRegion - чтение фрагмента 100x100 из тайла, см. BenchmarkService_ReadTileRegion.
+func BenchmarkMmapService_ReadTileRegion(b *testing.B) {
+	repo, err := imgstore.NewFileSystemTileRepo(b.TempDir(), imgstore.FormatRaw.Ext())
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := imgstore.NewMmapService(repo, 1024)
+	defer s.Close()
+
+	err = s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(benchTileSize, benchTileSize))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	r := image.Rect(450, 450, 550, 550)
+	dst := image.NewRGBA(r)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := s.ReadTileRegion(ctx, "0", 0, 0, r, dst)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
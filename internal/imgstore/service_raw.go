@@ -0,0 +1,164 @@
+package imgstore
+
+import (
+	"context"
+	"image"
+)
+
+// RawService - хранилище изображений-тайлов формата raw.
+// Тайлы кодируются без перестановки каналов и переворота строк, поэтому быстрее BMP.
+// Encode, Decode и DecodeConfig работают с форматом обмена - BMP.
+type RawService struct {
+	repo Repository
+}
+
+func NewRawService(r Repository) *RawService {
+	return &RawService{
+		repo: r,
+	}
+}
+
+// GetTile возвращает изображение-тайл с координатами (x; y) изображения id.
+// У возвращаемого image.Image Bounds().Min равен (0; 0).
+func (s *RawService) GetTile(ctx context.Context, id string, x, y int) (image.Image, error) {
+	tile, err := s.repo.GetTile(ctx, id, x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRaw(tile)
+}
+
+// SaveTile кодирует тайл-изображение в формат raw и сохраняет.
+func (s *RawService) SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error {
+	return s.repo.SaveTile(ctx, id, x, y, encodeRaw(img))
+}
+
+// ReadTileRegion считывает из репозитория только строки тайла, пересекающиеся с r.
+func (s *RawService) ReadTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, dst *image.RGBA) error {
+	width, local, err := s.region(ctx, id, x, y, r)
+	if err != nil {
+		return err
+	}
+
+	// Строки области лежат в тайле подряд, поэтому считываются одним вызовом от первого до последнего пикселя.
+	start := rawPixelOffset(width, local.Min.X, local.Min.Y)
+	end := rawPixelOffset(width, local.Max.X, local.Max.Y-1)
+	buf := make([]byte, end-start)
+	_, err = s.repo.ReadTileAt(ctx, id, x, y, buf, start)
+	if err != nil {
+		return err
+	}
+
+	rowSize := width * rawPixelSize
+	for i := 0; i < r.Dy(); i++ {
+		row := image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1)
+		getRawPixels(dst, row, buf[i*rowSize:])
+	}
+
+	return nil
+}
+
+// WriteTileRegion записывает в репозиторий только пиксели тайла, пересекающиеся с r.
+// Если репозиторий изменяет тайлы на месте (InPlaceWriter), пиксели вне r не перезаписываются,
+// поэтому одновременная запись непересекающихся областей тайла безопасна.
+// Иначе тайл изменяется целиком одним чтением и записью (см. TileUpdater).
+func (s *RawService) WriteTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, src image.Image) error {
+	if !writesInPlace(s.repo) {
+		return s.rewriteTileRegion(ctx, id, x, y, r, src)
+	}
+
+	width, local, err := s.region(ctx, id, x, y, r)
+	if err != nil {
+		return err
+	}
+
+	rowSize := r.Dx() * rawPixelSize
+	buf := make([]byte, rowSize*r.Dy())
+	putRawPixels(buf, src, r)
+
+	// Область во всю ширину тайла лежит в нем непрерывно.
+	if local.Dx() == width {
+		_, err = s.repo.WriteTileAt(ctx, id, x, y, buf, rawPixelOffset(width, 0, local.Min.Y))
+		return err
+	}
+
+	for i := 0; i < local.Dy(); i++ {
+		off := rawPixelOffset(width, local.Min.X, local.Min.Y+i)
+		_, err = s.repo.WriteTileAt(ctx, id, x, y, buf[i*rowSize:(i+1)*rowSize], off)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewriteTileRegion считывает тайл целиком, записывает в него пиксели r и сохраняет тайл одной записью.
+// Построчные WriteTileAt в хранилище, перезаписывающем тайл целиком, считывали бы и сохраняли тайл на каждую строку.
+// Возможны ошибки ErrRawFormat, ErrTruncated и ErrRegion.
+func (s *RawService) rewriteTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, src image.Image) error {
+	return updateTile(ctx, s.repo, id, x, y, func(tile []byte) ([]byte, error) {
+		width, height, err := decodeRawHeader(tile)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(tile)) < rawSize(width, height) {
+			return nil, ErrTruncated
+		}
+
+		local := r.Sub(image.Pt(x, y))
+		if local.Empty() || !local.In(image.Rect(0, 0, width, height)) {
+			return nil, ErrRegion
+		}
+
+		rowSize := int64(r.Dx() * rawPixelSize)
+		for i := 0; i < r.Dy(); i++ {
+			off := rawPixelOffset(width, local.Min.X, local.Min.Y+i)
+			putRawPixels(tile[off:off+rowSize], src, image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1))
+		}
+		return tile, nil
+	})
+}
+
+// region считывает заголовок тайла и переводит r в координаты тайла.
+// Возможна ошибка ErrRegion.
+func (s *RawService) region(ctx context.Context, id string, x, y int, r image.Rectangle) (width int, local image.Rectangle, err error) {
+	header := make([]byte, rawHeaderSize)
+	_, err = s.repo.ReadTileAt(ctx, id, x, y, header, 0)
+	if err != nil {
+		return 0, image.Rectangle{}, err
+	}
+
+	width, height, err := decodeRawHeader(header)
+	if err != nil {
+		return 0, image.Rectangle{}, err
+	}
+
+	local = r.Sub(image.Pt(x, y))
+	if local.Empty() || !local.In(image.Rect(0, 0, width, height)) {
+		return 0, image.Rectangle{}, ErrRegion
+	}
+
+	return width, local, nil
+}
+
+// DeleteImage удаляет изображение.
+func (s *RawService) DeleteImage(ctx context.Context, id string) error {
+	return s.repo.DeleteImage(ctx, id)
+}
+
+// Encode кодирует image.Image в формат BMP.
+func (s *RawService) Encode(img image.Image) ([]byte, error) {
+	return encodeBmp(img)
+}
+
+// Decode декодирует байты BMP изображения в image.Image.
+func (s *RawService) Decode(b []byte) (image.Image, error) {
+	return decodeBmp(b)
+}
+
+// DecodeConfig декодирует заголовок BMP изображения.
+func (s *RawService) DecodeConfig(b []byte) (image.Config, error) {
+	return decodeBmpConfig(b)
+}
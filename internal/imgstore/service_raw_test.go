@@ -0,0 +1,336 @@
+package imgstore_test
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+// newColorfulRGBA создает непрозрачное изображение с отличающимися пикселями.
+func newColorfulRGBA(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 0xFF})
+		}
+	}
+	return img
+}
+
+func TestRawService_SuccessGet(t *testing.T) {
+	Convey("Пиксели тайла после сохранения и получения должны совпадать с исходными", t, func() {
+		tileRepo := &TestTileRepo{images: make(map[string][]byte)}
+		rawService := imgstore.NewRawService(tileRepo)
+
+		img := newColorfulRGBA(3, 2)
+
+		const id = "0"
+		err := rawService.SaveTile(ctx, id, 0, 0, img)
+		So(err, ShouldBeNil)
+
+		got, err := rawService.GetTile(ctx, id, 0, 0)
+		So(err, ShouldBeNil)
+
+		So(got, ShouldResemble, img)
+	})
+}
+
+func TestRawService_NotRGBA(t *testing.T) {
+	Convey("Тайл не в модели RGBA и не с началом в (0; 0) должен сохраняться корректно", t, func() {
+		tileRepo := &TestTileRepo{images: make(map[string][]byte)}
+		rawService := imgstore.NewRawService(tileRepo)
+
+		img := image.NewNRGBA(image.Rect(5, 5, 7, 6))
+		red := color.NRGBA{R: 255, A: 255}
+		img.SetNRGBA(6, 5, red)
+
+		const id = "0"
+		err := rawService.SaveTile(ctx, id, 5, 5, img)
+		So(err, ShouldBeNil)
+
+		got, err := rawService.GetTile(ctx, id, 5, 5)
+		So(err, ShouldBeNil)
+
+		So(got.Bounds(), ShouldResemble, image.Rect(0, 0, 2, 1))
+		So(got.At(1, 0), ShouldResemble, color.RGBA{R: 255, A: 255})
+		So(got.At(0, 0), ShouldResemble, color.RGBA{A: 255})
+	})
+}
+
+func TestRawService_ErrorGet(t *testing.T) {
+	Convey("Данные не в формате raw должны возвращать ошибку", t, func() {
+		tileRepo := &TestTileRepo{images: make(map[string][]byte)}
+		rawService := imgstore.NewRawService(tileRepo)
+
+		const id = "0"
+		_ = tileRepo.SaveTile(ctx, id, 0, 0, []byte("BM not raw tile"))
+
+		_, err := rawService.GetTile(ctx, id, 0, 0)
+		So(errors.Is(err, imgstore.ErrRawFormat), ShouldBeTrue)
+	})
+
+	Convey("Данных меньше, чем следует из заголовка", t, func() {
+		tileRepo := &TestTileRepo{images: make(map[string][]byte)}
+		rawService := imgstore.NewRawService(tileRepo)
+
+		const id = "0"
+		_ = rawService.SaveTile(ctx, id, 0, 0, newColorfulRGBA(2, 2))
+		b, _ := tileRepo.GetTile(ctx, id, 0, 0)
+		_ = tileRepo.SaveTile(ctx, id, 0, 0, b[:len(b)-1])
+
+		_, err := rawService.GetTile(ctx, id, 0, 0)
+		So(errors.Is(err, imgstore.ErrTruncated), ShouldBeTrue)
+	})
+
+	Convey("Поврежденный заголовок с огромными сторонами не должен приводить к панике", t, func() {
+		tileRepo := &TestTileRepo{images: make(map[string][]byte)}
+		rawService := imgstore.NewRawService(tileRepo)
+
+		const id = "0"
+		_ = rawService.SaveTile(ctx, id, 0, 0, newColorfulRGBA(2, 2))
+		b, _ := tileRepo.GetTile(ctx, id, 0, 0)
+		// Ширина и высота 0x80000000: произведение переполняет int.
+		copy(b[4:], []byte{0, 0, 0, 0x80, 0, 0, 0, 0x80})
+		_ = tileRepo.SaveTile(ctx, id, 0, 0, b)
+
+		So(func() {
+			_, err := rawService.GetTile(ctx, id, 0, 0)
+			So(errors.Is(err, imgstore.ErrRawFormat), ShouldBeTrue)
+
+			err = rawService.ReadTileRegion(ctx, id, 0, 0, image.Rect(0, 0, 1, 1), image.NewRGBA(image.Rect(0, 0, 1, 1)))
+			So(errors.Is(err, imgstore.ErrRawFormat), ShouldBeTrue)
+		}, ShouldNotPanic)
+	})
+}
+
+// regionServices возвращает хранилища, для которых проверяется чтение и запись части тайла.
+func regionServices() map[string]imgstore.Service {
+	return map[string]imgstore.Service{
+		"raw":          imgstore.NewRawService(&TestTileRepo{images: make(map[string][]byte)}),
+		"raw на месте": imgstore.NewRawService(imgstore.NewMemoryRepo(0)),
+		"bmp":          imgstore.NewBmpService(&TestTileRepo{images: make(map[string][]byte)}),
+	}
+}
+
+func TestService_ReadTileRegion(t *testing.T) {
+	for name, service := range regionServices() {
+		Convey("Часть тайла "+name+" должна совпадать с частью исходного изображения", t, func() {
+			const (
+				x = 10
+				y = 20
+			)
+			img := newColorfulRGBA(4, 3)
+			err := service.SaveTile(ctx, "0", x, y, img)
+			So(err, ShouldBeNil)
+
+			for _, local := range []image.Rectangle{
+				image.Rect(1, 1, 3, 3), // внутри
+				image.Rect(0, 1, 4, 3), // во всю ширину
+				image.Rect(3, 0, 4, 1), // один пиксель
+			} {
+				r := local.Add(image.Pt(x, y))
+				dst := image.NewRGBA(r)
+
+				err = service.ReadTileRegion(ctx, "0", x, y, r, dst)
+				So(err, ShouldBeNil)
+
+				for py := local.Min.Y; py < local.Max.Y; py++ {
+					for px := local.Min.X; px < local.Max.X; px++ {
+						So(dst.RGBAAt(x+px, y+py), ShouldResemble, img.RGBAAt(px, py))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestService_WriteTileRegion(t *testing.T) {
+	for name, service := range regionServices() {
+		Convey("Запись части тайла "+name+" не должна изменять остальные пиксели", t, func() {
+			const (
+				x = 10
+				y = 20
+			)
+			img := newColorfulRGBA(4, 3)
+			err := service.SaveTile(ctx, "0", x, y, img)
+			So(err, ShouldBeNil)
+
+			red := color.RGBA{R: 255, A: 255}
+			expected := newColorfulRGBA(4, 3)
+			for _, local := range []image.Rectangle{
+				image.Rect(1, 1, 3, 2), // внутри
+				image.Rect(0, 2, 4, 3), // во всю ширину
+			} {
+				r := local.Add(image.Pt(x, y))
+				src := image.NewRGBA(r)
+				for py := r.Min.Y; py < r.Max.Y; py++ {
+					for px := r.Min.X; px < r.Max.X; px++ {
+						src.SetRGBA(px, py, red)
+						expected.SetRGBA(px-x, py-y, red)
+					}
+				}
+
+				err = service.WriteTileRegion(ctx, "0", x, y, r, src)
+				So(err, ShouldBeNil)
+			}
+
+			got, err := service.GetTile(ctx, "0", x, y)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, expected)
+		})
+	}
+}
+
+// TestCountingRepo считает обращения к декорируемому хранилищу и не изменяет тайлы на месте.
+type TestCountingRepo struct {
+	imgstore.Repository
+	gets, saves, writes int
+}
+
+func (r *TestCountingRepo) GetTile(ctx context.Context, id string, x, y int) ([]byte, error) {
+	r.gets++
+	return r.Repository.GetTile(ctx, id, x, y)
+}
+
+func (r *TestCountingRepo) SaveTile(ctx context.Context, id string, x int, y int, img []byte) error {
+	r.saves++
+	return r.Repository.SaveTile(ctx, id, x, y, img)
+}
+
+func (r *TestCountingRepo) WriteTileAt(ctx context.Context, id string, x, y int, p []byte, off int64) (int, error) {
+	r.writes++
+	return r.Repository.WriteTileAt(ctx, id, x, y, p, off)
+}
+
+func TestRawService_WriteTileRegionRewrite(t *testing.T) {
+	Convey("Область тайла в хранилище, перезаписывающем тайлы целиком, должна записываться одним SaveTile", t, func() {
+		repo := &TestCountingRepo{Repository: imgstore.NewFlateRepository(imgstore.NewMemoryRepo(0))}
+		service := imgstore.NewRawService(repo)
+
+		img := newColorfulRGBA(100, 100)
+		err := service.SaveTile(ctx, "0", 0, 0, img)
+		So(err, ShouldBeNil)
+
+		r := image.Rect(10, 10, 20, 90)
+		err = service.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+		So(err, ShouldBeNil)
+		So(repo.gets, ShouldEqual, 1)
+		So(repo.saves, ShouldEqual, 2)
+		So(repo.writes, ShouldEqual, 0)
+
+		got, err := service.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got.At(9, 10), ShouldResemble, img.At(9, 10))
+		So(got.At(10, 10), ShouldResemble, red)
+		So(got.At(19, 89), ShouldResemble, red)
+		So(got.At(20, 89), ShouldResemble, img.At(20, 89))
+	})
+
+	Convey("Хранилища должны сообщать, изменяют ли они тайлы на месте", t, func() {
+		memory := imgstore.NewMemoryRepo(0)
+		So(memory.WritesInPlace(), ShouldBeTrue)
+		So(imgstore.NewFaultRepo(memory, nil).WritesInPlace(), ShouldBeTrue)
+
+		_, ok := imgstore.Repository(imgstore.NewFlateRepository(memory)).(imgstore.InPlaceWriter)
+		So(ok, ShouldBeFalse)
+		_, ok = imgstore.Repository(imgstore.NewChecksumRepo(memory)).(imgstore.InPlaceWriter)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestService_RegionOutOfTile(t *testing.T) {
+	for name, service := range regionServices() {
+		Convey("Область за границами тайла "+name+" должна возвращать ошибку ErrRegion", t, func() {
+			err := service.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+			So(err, ShouldBeNil)
+
+			r := image.Rect(1, 1, 3, 3)
+			err = service.ReadTileRegion(ctx, "0", 0, 0, r, image.NewRGBA(r))
+			So(errors.Is(err, imgstore.ErrRegion), ShouldBeTrue)
+
+			err = service.WriteTileRegion(ctx, "0", 0, 0, r, image.NewRGBA(r))
+			So(errors.Is(err, imgstore.ErrRegion), ShouldBeTrue)
+		})
+	}
+}
+
+// Сравнение форматов хранения тайлов на тайле размера по умолчанию.
+
+const benchTileSize = 1000
+
+func benchServices() []struct {
+	name    string
+	service imgstore.Service
+} {
+	return []struct {
+		name    string
+		service imgstore.Service
+	}{
+		{"bmp", imgstore.NewBmpService(&TestTileRepo{images: make(map[string][]byte)})},
+		{"raw", imgstore.NewRawService(&TestTileRepo{images: make(map[string][]byte)})},
+	}
+}
+
+func BenchmarkService_SaveTile(b *testing.B) {
+	img := newColorfulRGBA(benchTileSize, benchTileSize)
+
+	for _, bs := range benchServices() {
+		b.Run(bs.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := bs.service.SaveTile(ctx, "0", 0, 0, img)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkService_GetTile(b *testing.B) {
+	img := newColorfulRGBA(benchTileSize, benchTileSize)
+
+	for _, bs := range benchServices() {
+		err := bs.service.SaveTile(ctx, "0", 0, 0, img)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(bs.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := bs.service.GetTile(ctx, "0", 0, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkService_ReadTileRegion - чтение фрагмента 100x100 из тайла.
+func BenchmarkService_ReadTileRegion(b *testing.B) {
+	img := newColorfulRGBA(benchTileSize, benchTileSize)
+	r := image.Rect(450, 450, 550, 550)
+	dst := image.NewRGBA(r)
+
+	for _, bs := range benchServices() {
+		err := bs.service.SaveTile(ctx, "0", 0, 0, img)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(bs.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := bs.service.ReadTileRegion(ctx, "0", 0, 0, r, dst)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
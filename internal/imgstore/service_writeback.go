@@ -0,0 +1,367 @@
+package imgstore
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"sync"
+	"time"
+)
+
+// Durability - когда запись тайла попадает в декорируемый Service.
+type Durability int
+
+const (
+	// DurabilityAsync - запись подтверждается сразу, тайл сохраняется при сбросе.
+	// При аварийном завершении теряются записи, сделанные после последнего сброса.
+	DurabilityAsync Durability = iota
+	// DurabilitySync - запись подтверждается после сохранения в декорируемом Service, тайлы не накапливаются.
+	DurabilitySync
+)
+
+// ParseDurability возвращает Durability по названию: async или sync.
+func ParseDurability(name string) (Durability, error) {
+	switch name {
+	case "async":
+		return DurabilityAsync, nil
+	case "sync":
+		return DurabilitySync, nil
+	default:
+		return 0, fmt.Errorf("неизвестный режим записи %q, поддерживаются: async, sync", name)
+	}
+}
+
+// WriteBackConfig - параметры WriteBackService.
+type WriteBackConfig struct {
+	Durability Durability
+	// FlushInterval - период фонового сброса измененных тайлов. 0 - только по размеру и при Close.
+	FlushInterval time.Duration
+	// MaxDirtyBytes - размер измененных тайлов, при достижении которого начинается фоновый сброс.
+	// При двукратном превышении сброс выполняется в вызывающей горутине, ограничивая память.
+	MaxDirtyBytes int64
+}
+
+// WriteBackService - декоратор Service, накапливающий измененные тайлы в памяти.
+// Серия фрагментов на одном тайле изменяет декодированный тайл, который затем сохраняется один раз.
+// Тайлы сохраняются в фоне по таймеру, при превышении размера и при Close.
+// Чтение видит еще не сохраненные изменения.
+type WriteBackService struct {
+	service Service
+	config  WriteBackConfig
+
+	mu sync.Mutex
+	// dirty - измененные тайлы, ожидающие сброса.
+	dirty map[cacheKey]*image.RGBA
+	// flushing - тайлы, сохраняемые текущим сбросом. Изменяются только их копии в dirty.
+	flushing map[cacheKey]*image.RGBA
+	// bytes - размер тайлов в dirty и flushing.
+	bytes int64
+	// gen увеличивается по завершении сброса и при удалении изображения:
+	// тайл, загруженный до этого, мог устареть.
+	gen uint64
+
+	// flushMu упорядочивает сбросы и удаление изображений.
+	flushMu sync.Mutex
+
+	kick      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewWriteBackService создает WriteBackService и запускает фоновый сброс.
+// После использования необходимо вызвать Close, чтобы сохранить накопленные тайлы.
+func NewWriteBackService(service Service, config WriteBackConfig) *WriteBackService {
+	s := &WriteBackService{
+		service:  service,
+		config:   config,
+		dirty:    make(map[cacheKey]*image.RGBA),
+		flushing: make(map[cacheKey]*image.RGBA),
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	if config.Durability == DurabilityAsync {
+		s.wg.Add(1)
+		go s.flushLoop()
+	}
+
+	return s
+}
+
+func (s *WriteBackService) flushLoop() {
+	defer s.wg.Done()
+
+	var tick <-chan time.Time
+	if s.config.FlushInterval > 0 {
+		ticker := time.NewTicker(s.config.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick:
+		case <-s.kick:
+		}
+
+		err := s.Flush()
+		if err != nil {
+			log.Printf("сброс измененных тайлов: %v", err)
+		}
+	}
+}
+
+// pending возвращает измененный тайл, ожидающий сброса. Вызывается под mu.
+func (s *WriteBackService) pending(k cacheKey) (*image.RGBA, bool) {
+	if img, ok := s.dirty[k]; ok {
+		return img, true
+	}
+	img, ok := s.flushing[k]
+	return img, ok
+}
+
+// GetTile возвращает копию тайла с несохраненными изменениями или тайл декорируемого Service.
+func (s *WriteBackService) GetTile(ctx context.Context, id string, x, y int) (image.Image, error) {
+	s.mu.Lock()
+	if img, ok := s.pending(cacheKey{id: id, x: x, y: y}); ok {
+		cp := cloneRGBA(img)
+		s.mu.Unlock()
+		return cp, nil
+	}
+	s.mu.Unlock()
+
+	return s.service.GetTile(ctx, id, x, y)
+}
+
+// ReadTileRegion копирует в dst часть тайла с несохраненными изменениями или тайла декорируемого Service.
+func (s *WriteBackService) ReadTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, dst *image.RGBA) error {
+	s.mu.Lock()
+	if img, ok := s.pending(cacheKey{id: id, x: x, y: y}); ok {
+		defer s.mu.Unlock()
+
+		local := r.Sub(image.Pt(x, y))
+		if !local.In(img.Rect) {
+			return ErrRegion
+		}
+		draw.Draw(dst, r, img, local.Min, draw.Src)
+		return nil
+	}
+	s.mu.Unlock()
+
+	return s.service.ReadTileRegion(ctx, id, x, y, r, dst)
+}
+
+// SaveTile запоминает копию тайла до сброса.
+func (s *WriteBackService) SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error {
+	if s.config.Durability == DurabilitySync {
+		return s.service.SaveTile(ctx, id, x, y, img)
+	}
+
+	b := img.Bounds()
+	tile := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(tile, tile.Rect, img, b.Min, draw.Src)
+
+	s.mu.Lock()
+	k := cacheKey{id: id, x: x, y: y}
+	if old, ok := s.dirty[k]; ok {
+		s.bytes -= tileBytes(old)
+	}
+	s.dirty[k] = tile
+	s.bytes += tileBytes(tile)
+	s.mu.Unlock()
+
+	return s.pressure()
+}
+
+// WriteTileRegion изменяет тайл в памяти, при необходимости загружая его из декорируемого Service.
+func (s *WriteBackService) WriteTileRegion(ctx context.Context, id string, x, y int, r image.Rectangle, src image.Image) error {
+	if s.config.Durability == DurabilitySync {
+		return s.service.WriteTileRegion(ctx, id, x, y, r, src)
+	}
+
+	k := cacheKey{id: id, x: x, y: y}
+	local := r.Sub(image.Pt(x, y))
+	for {
+		s.mu.Lock()
+		applied, err := s.applyPending(k, local, r, src)
+		gen := s.gen
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if applied {
+			return s.pressure()
+		}
+
+		tile, err := s.service.GetTile(ctx, id, x, y)
+		if err != nil {
+			return err
+		}
+		img := toRGBA(tile)
+		if !local.In(img.Rect) {
+			return ErrRegion
+		}
+
+		s.mu.Lock()
+		// Пока тайл загружался, его могли изменить или сбросить.
+		applied, err = s.applyPending(k, local, r, src)
+		if err == nil && !applied && gen == s.gen {
+			draw.Draw(img, local, src, r.Min, draw.Src)
+			s.dirty[k] = img
+			s.bytes += tileBytes(img)
+			applied = true
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if applied {
+			return s.pressure()
+		}
+	}
+}
+
+// applyPending накладывает src на тайл, ожидающий сброса, если он есть. Вызывается под mu.
+// Тайл из flushing копируется в dirty, так как сохраняется в данный момент.
+func (s *WriteBackService) applyPending(k cacheKey, local, r image.Rectangle, src image.Image) (bool, error) {
+	img, ok := s.dirty[k]
+	if !ok {
+		flushing, ok := s.flushing[k]
+		if !ok {
+			return false, nil
+		}
+		img = cloneRGBA(flushing)
+		s.dirty[k] = img
+		s.bytes += tileBytes(img)
+	}
+
+	if !local.In(img.Rect) {
+		return false, ErrRegion
+	}
+	draw.Draw(img, local, src, r.Min, draw.Src)
+	return true, nil
+}
+
+// pressure запускает фоновый сброс при превышении MaxDirtyBytes и сбрасывает тайлы сам при двукратном превышении.
+func (s *WriteBackService) pressure() error {
+	if s.config.MaxDirtyBytes <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	bytes := s.bytes
+	s.mu.Unlock()
+
+	if bytes >= 2*s.config.MaxDirtyBytes {
+		return s.Flush()
+	}
+	if bytes >= s.config.MaxDirtyBytes {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// DeleteImage отбрасывает несохраненные тайлы изображения и удаляет его из декорируемого Service.
+func (s *WriteBackService) DeleteImage(ctx context.Context, id string) error {
+	// Сброс, начатый до удаления, не должен восстановить тайлы после него.
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	for k, img := range s.dirty {
+		if k.id == id {
+			delete(s.dirty, k)
+			s.bytes -= tileBytes(img)
+		}
+	}
+	s.gen++
+	s.mu.Unlock()
+
+	return s.service.DeleteImage(ctx, id)
+}
+
+// Flush сохраняет накопленные тайлы в декорируемый Service.
+// Тайлы, которые не удалось сохранить, остаются в памяти до следующего сброса.
+func (s *WriteBackService) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	s.flushing, s.dirty = s.dirty, make(map[cacheKey]*image.RGBA)
+	flushing := s.flushing
+	s.mu.Unlock()
+
+	// Сброс не относится к конкретному запросу и не прерывается его отменой.
+	ctx := context.Background()
+	var firstErr error
+	failed := make(map[cacheKey]*image.RGBA)
+	for k, img := range flushing {
+		err := s.service.SaveTile(ctx, k.id, k.x, k.y, img)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed[k] = img
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, img := range flushing {
+		_, newer := s.dirty[k]
+		if _, ok := failed[k]; ok && !newer {
+			s.dirty[k] = img
+			continue
+		}
+		s.bytes -= tileBytes(img)
+	}
+	s.flushing = make(map[cacheKey]*image.RGBA)
+	s.gen++
+
+	return firstErr
+}
+
+// DirtyBytes возвращает размер несохраненных тайлов.
+func (s *WriteBackService) DirtyBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Close останавливает фоновый сброс и сохраняет накопленные тайлы.
+func (s *WriteBackService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+
+	return s.Flush()
+}
+
+func (s *WriteBackService) Encode(img image.Image) ([]byte, error) {
+	return s.service.Encode(img)
+}
+
+func (s *WriteBackService) Decode(b []byte) (image.Image, error) {
+	return s.service.Decode(b)
+}
+
+func (s *WriteBackService) DecodeConfig(b []byte) (image.Config, error) {
+	return s.service.DecodeConfig(b)
+}
+
+// cloneRGBA копирует пиксели img.
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	cp := image.NewRGBA(img.Rect)
+	copy(cp.Pix, img.Pix)
+	return cp
+}
@@ -0,0 +1,214 @@
+package imgstore_test
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
+)
+
+// TestCountingService - заглушка, считающая сохранения тайлов.
+type TestCountingService struct {
+	imgstore.Service
+
+	mu    sync.Mutex
+	saves int
+}
+
+func (s *TestCountingService) SaveTile(ctx context.Context, id string, x int, y int, img image.Image) error {
+	s.mu.Lock()
+	s.saves++
+	s.mu.Unlock()
+	return s.Service.SaveTile(ctx, id, x, y, img)
+}
+
+func (s *TestCountingService) Saves() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saves
+}
+
+func newWriteBackService(config imgstore.WriteBackConfig) (*imgstore.WriteBackService, *TestCountingService) {
+	inner := &TestCountingService{Service: imgstore.NewRawService(&TestTileRepo{images: make(map[string][]byte)})}
+	return imgstore.NewWriteBackService(inner, config), inner
+}
+
+// fillRGBA создает изображение r, залитое цветом c.
+func fillRGBA(r image.Rectangle, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+var red = color.RGBA{R: 255, A: 255}
+
+func TestWriteBackService_Coalesce(t *testing.T) {
+	Convey("Серия фрагментов на тайле должна сохраняться один раз и быть видна до сохранения", t, func() {
+		s, inner := newWriteBackService(imgstore.WriteBackConfig{})
+		defer s.Close()
+
+		err := inner.Service.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(4, 4))
+		So(err, ShouldBeNil)
+
+		expected := newColorfulRGBA(4, 4)
+		for i := 0; i < 4; i++ {
+			r := image.Rect(i, i, i+1, i+1)
+			err = s.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+			So(err, ShouldBeNil)
+			expected.SetRGBA(i, i, red)
+		}
+		So(inner.Saves(), ShouldEqual, 0)
+		So(s.DirtyBytes(), ShouldEqual, 4*4*4)
+
+		got, err := s.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, expected)
+
+		dst := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		err = s.ReadTileRegion(ctx, "0", 0, 0, dst.Rect, dst)
+		So(err, ShouldBeNil)
+		So(dst, ShouldResemble, expected)
+
+		stale, err := inner.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(stale, ShouldResemble, newColorfulRGBA(4, 4))
+
+		err = s.Flush()
+		So(err, ShouldBeNil)
+		So(inner.Saves(), ShouldEqual, 1)
+		So(s.DirtyBytes(), ShouldEqual, 0)
+
+		flushed, err := inner.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(flushed, ShouldResemble, expected)
+	})
+}
+
+func TestWriteBackService_Triggers(t *testing.T) {
+	Convey("Close должен сохранять накопленные тайлы", t, func() {
+		s, inner := newWriteBackService(imgstore.WriteBackConfig{})
+
+		img := newColorfulRGBA(2, 2)
+		err := s.SaveTile(ctx, "0", 0, 0, img)
+		So(err, ShouldBeNil)
+		So(inner.Saves(), ShouldEqual, 0)
+
+		err = s.Close()
+		So(err, ShouldBeNil)
+
+		got, err := inner.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, img)
+	})
+
+	Convey("Тайлы должны сохраняться по таймеру", t, func() {
+		s, inner := newWriteBackService(imgstore.WriteBackConfig{FlushInterval: time.Millisecond})
+		defer s.Close()
+
+		err := s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for inner.Saves() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		So(inner.Saves(), ShouldEqual, 1)
+	})
+
+	Convey("При двукратном превышении размера тайлы должны сохраняться сразу", t, func() {
+		// Тайл 2x2 занимает 16 байт.
+		s, inner := newWriteBackService(imgstore.WriteBackConfig{MaxDirtyBytes: 16})
+		defer s.Close()
+
+		err := s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+		err = s.SaveTile(ctx, "1", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+
+		So(inner.Saves(), ShouldEqual, 2)
+		So(s.DirtyBytes(), ShouldEqual, 0)
+	})
+}
+
+func TestWriteBackService_Sync(t *testing.T) {
+	Convey("В режиме DurabilitySync запись должна сохраняться сразу", t, func() {
+		s, inner := newWriteBackService(imgstore.WriteBackConfig{Durability: imgstore.DurabilitySync})
+		defer s.Close()
+
+		err := s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+
+		r := image.Rect(0, 0, 1, 1)
+		err = s.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+		So(err, ShouldBeNil)
+
+		So(inner.Saves(), ShouldEqual, 1)
+		got, err := inner.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got.At(0, 0), ShouldResemble, red)
+	})
+}
+
+func TestWriteBackService_Delete(t *testing.T) {
+	Convey("Удаление изображения должно отбрасывать несохраненные тайлы", t, func() {
+		s, inner := newWriteBackService(imgstore.WriteBackConfig{})
+		defer s.Close()
+
+		err := s.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(2, 2))
+		So(err, ShouldBeNil)
+
+		err = s.DeleteImage(ctx, "0")
+		So(err, ShouldBeNil)
+		So(s.DirtyBytes(), ShouldEqual, 0)
+
+		err = s.Flush()
+		So(err, ShouldBeNil)
+		So(inner.Saves(), ShouldEqual, 0)
+
+		_, err = s.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestWriteBackService_Concurrent(t *testing.T) {
+	Convey("Одновременные записи и сбросы не должны терять изменения", t, func() {
+		s, inner := newWriteBackService(imgstore.WriteBackConfig{FlushInterval: time.Millisecond})
+
+		const size = 32
+		err := inner.Service.SaveTile(ctx, "0", 0, 0, newColorfulRGBA(size, size))
+		So(err, ShouldBeNil)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, size)
+		for i := 0; i < size; i++ {
+			r := image.Rect(0, i, size, i+1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- s.WriteTileRegion(ctx, "0", 0, 0, r, fillRGBA(r, red))
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			So(err, ShouldBeNil)
+		}
+
+		err = s.Close()
+		So(err, ShouldBeNil)
+
+		got, err := inner.GetTile(ctx, "0", 0, 0)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, fillRGBA(image.Rect(0, 0, size, size), red))
+	})
+}
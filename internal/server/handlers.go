@@ -1,13 +1,17 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"image"
 	"io"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 
 	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
 )
 
 // TODO использовать библиотеку для парсинга query params
@@ -26,14 +30,28 @@ func (s *Server) createImage(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	img, err := s.chartService.AddImage(width, height)
+	// Раскладка тайлов необязательна, по умолчанию тайлы квадратные.
+	layout, err := tileutils.ParseLayout(req.URL.Query().Get("layout"))
+	if err != nil {
+		http.Error(w, paramError("layout", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := s.chartService.AddImage(req.Context(), width, height, layout)
 
 	var errSize *chart.SizeError
 	if err != nil {
-		if errors.As(err, &errSize) {
+		if errors.As(err, &errSize) || errors.Is(err, tileutils.ErrLayout) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if errors.Is(err, chart.ErrBusy) {
+			busyError(w, err)
+			return
+		}
+		if contextError(w, err) {
+			return
+		}
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -59,17 +77,16 @@ func (s *Server) setFragment(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// пусть width и height будут обязательными параметрами, несмотря на то, что
-	// размеры можно получить при декодировании изображения в теле запроса.
-	// Возможная оптимизация - проверить, что есть пересечение img с width и height,
-	// декодировать только в случае пересечения.
-	_, err = getQueryParamInt(req, "width")
+	// width и height обязательны, несмотря на то, что размеры можно получить при декодировании
+	// изображения в теле запроса: по ним запрос проверяется до чтения тела,
+	// а изображение больше заявленного размера обрезается.
+	width, err := getQueryParamInt(req, "width")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	_, err = getQueryParamInt(req, "height")
+	height, err := getQueryParamInt(req, "height")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -77,35 +94,73 @@ func (s *Server) setFragment(w http.ResponseWriter, req *http.Request) {
 
 	id := chi.URLParam(req, "id")
 
-	img, err := s.chartService.GetImage(id)
+	img, err := s.chartService.GetImage(req.Context(), id)
 	if err != nil {
 		if errors.Is(err, chart.ErrNotExist) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		if contextError(w, err) {
+			return
+		}
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	b, err := io.ReadAll(req.Body)
+	err = s.chartService.ValidateFragment(img, x, y, width, height)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fragment, err := s.chartService.Decode(b)
+	b, ok := s.readBody(w, req)
+	if !ok {
+		return
+	}
+
+	// Заголовок проверяется до декодирования, чтобы не выделять память под пиксели,
+	// размеры которых не соответствуют заявленным.
+	config, err := s.chartService.DecodeConfig(b, width, height)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Резервируется размер из заголовка, так как изображение декодируется целиком и лишь затем обрезается.
+	ctx, release, ok := s.reserve(w, req, config.Width, config.Height)
+	if !ok {
+		return
+	}
+	defer release()
+
+	fragment, err := s.chartService.Decode(b, width, height)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = s.chartService.SetFragment(img, x, y, fragment)
+	err = s.chartService.SetFragment(ctx, img, x, y, fragment)
 	if err != nil {
+		if errors.Is(err, chart.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		if errors.Is(err, chart.ErrNotOverlaps) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if errors.Is(err, chart.ErrRetiling) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, chart.ErrBusy) {
+			busyError(w, err)
+			return
+		}
+		if contextError(w, err) {
+			return
+		}
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -137,27 +192,63 @@ func (s *Server) getFragment(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Ревизия необязательна, по умолчанию фрагмент текущего изображения.
+	hasRevision := req.URL.Query().Has("revision")
+	var revision int
+	if hasRevision {
+		revision, err = getQueryParamInt(req, "revision")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	id := chi.URLParam(req, "id")
 
-	img, err := s.chartService.GetImage(id)
+	img, err := s.chartService.GetImage(req.Context(), id)
 	if err != nil {
 		if errors.Is(err, chart.ErrNotExist) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		if contextError(w, err) {
+			return
+		}
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	fragment, err := s.chartService.GetFragment(img, x, y, width, height)
+	ctx, release, ok := s.reserve(w, req, width, height)
+	if !ok {
+		return
+	}
+	defer release()
+
+	var fragment image.Image
+	if hasRevision {
+		fragment, err = s.chartService.GetRevisionFragment(ctx, img, revision, x, y, width, height)
+	} else {
+		fragment, err = s.chartService.GetFragment(ctx, img, x, y, width, height)
+	}
 
 	var errSize *chart.SizeError
 	if err != nil {
+		if errors.Is(err, chart.ErrRevisionNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		if errors.As(err, &errSize) || errors.Is(err, chart.ErrNotOverlaps) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if errors.Is(err, chart.ErrBusy) {
+			busyError(w, err)
+			return
+		}
+		if contextError(w, err) {
+			return
+		}
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -177,17 +268,231 @@ func (s *Server) getFragment(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "image/bmp")
 }
 
+// readBody читает тело запроса, ограничивая его размер Config.MaxBodySize.
+// При неудаче сам отвечает клиенту ошибкой: 413, если тело превышает ограничение, иначе 400.
+func (s *Server) readBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	limit := s.config.MaxBodySize
+	if limit <= 0 {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+
+		return b, true
+	}
+
+	tooLarge := fmt.Sprintf("размер тела запроса превышает %d байт", limit)
+	if req.ContentLength > limit {
+		http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	b, err := io.ReadAll(http.MaxBytesReader(w, req.Body, limit))
+	if err != nil {
+		// MaxBytesReader возвращает ошибку, прочитав ровно limit байт.
+		if int64(len(b)) >= limit {
+			http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return b, true
+}
+
+// reserve резервирует память под фрагмент, при неудаче сам отвечает клиенту ошибкой.
+// Обрабатывать фрагмент нужно с возвращенным контекстом, см. chart.Service.Reserve.
+func (s *Server) reserve(w http.ResponseWriter, req *http.Request, width, height int) (ctx context.Context, release func(), ok bool) {
+	ctx, release, err := s.chartService.Reserve(req.Context(), width, height)
+	if err != nil {
+		var errSize *chart.SizeError
+		if errors.As(err, &errSize) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil, false
+		}
+		if errors.Is(err, chart.ErrBusy) {
+			busyError(w, err)
+			return nil, nil, false
+		}
+		if contextError(w, err) {
+			return nil, nil, false
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return ctx, release, true
+}
+
 func (s *Server) deleteImage(w http.ResponseWriter, req *http.Request) {
 	id := chi.URLParam(req, "id")
 
-	err := s.chartService.DeleteImage(id)
+	err := s.chartService.DeleteImage(req.Context(), id)
+	if err != nil {
+		if errors.Is(err, chart.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, chart.ErrRetiling) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if contextError(w, err) {
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// retileImage перестраивает тайлы изображения по раскладке из параметра layout.
+// Изображение остается доступным для чтения, в ответе - новая раскладка.
+func (s *Server) retileImage(w http.ResponseWriter, req *http.Request) {
+	layout, err := tileutils.ParseLayout(req.URL.Query().Get("layout"))
+	if err != nil {
+		http.Error(w, paramError("layout", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := chi.URLParam(req, "id")
+
+	img, err := s.chartService.Retile(req.Context(), id, layout)
+	if err != nil {
+		if errors.Is(err, chart.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, tileutils.ErrLayout) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, chart.ErrRetiling) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, chart.ErrBusy) {
+			busyError(w, err)
+			return
+		}
+		if contextError(w, err) {
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write([]byte(img.Layout.String()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// revisions - история изменений изображения.
+type revisions struct {
+	// Current - номер текущей ревизии.
+	Current   int              `json:"current"`
+	Revisions []chart.Revision `json:"revisions"`
+}
+
+// imageRevisions отдает в JSON историю изменений изображения.
+func (s *Server) imageRevisions(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	img, err := s.chartService.GetImage(req.Context(), id)
 	if err != nil {
 		if errors.Is(err, chart.ErrNotExist) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		if contextError(w, err) {
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	history := img.History
+	if history == nil {
+		history = []chart.Revision{}
+	}
+	writeJSON(w, revisions{Current: img.Revision, Revisions: history})
+}
+
+// revertImage возвращает изображение к виду после ревизии из параметра to, в ответе - ревизия отмены.
+func (s *Server) revertImage(w http.ResponseWriter, req *http.Request) {
+	to, err := getQueryParamInt(req, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := chi.URLParam(req, "id")
+
+	img, err := s.chartService.Revert(req.Context(), id, to)
+	writeRevert(w, img, err)
+}
+
+// undoImage отменяет последнее изменение изображения, в ответе - ревизия отмены.
+func (s *Server) undoImage(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	img, err := s.chartService.Undo(req.Context(), id)
+	writeRevert(w, img, err)
+}
+
+// writeRevert отвечает результатом отмены изменений: последней ревизией изображения img или ошибкой err.
+func writeRevert(w http.ResponseWriter, img *chart.TiledImage, err error) {
+	if err != nil {
+		if errors.Is(err, chart.ErrNotExist) || errors.Is(err, chart.ErrRevisionNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, chart.ErrNothingToUndo) || errors.Is(err, chart.ErrRetiling) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, chart.ErrBusy) {
+			busyError(w, err)
+			return
+		}
+		if contextError(w, err) {
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, img.History[len(img.History)-1])
+}
+
+// scrubReport отдает в JSON результат последней проверки целостности тайлов.
+func (s *Server) scrubReport(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, s.config.Scrubber.Report())
+}
+
+// scrub проверяет целостность тайлов всех изображений и отдает результат в JSON.
+func (s *Server) scrub(w http.ResponseWriter, req *http.Request) {
+	report, err := s.config.Scrubber.Scrub(req.Context())
+	if err != nil {
+		if errors.Is(err, chart.ErrScrubRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if contextError(w, err) {
+			return
+		}
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	writeJSON(w, report)
 }
@@ -1,6 +1,11 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -8,13 +13,57 @@ import (
 func (s *Server) setRoutes() {
 	s.router.Use(middleware.Logger)
 
+	if s.config.Metrics != nil {
+		s.router.Handle("/metrics", s.config.Metrics)
+	}
+	if s.config.Scrubber != nil && s.config.AdminToken != "" {
+		s.router.Route("/admin", func(r chi.Router) {
+			r.Use(s.requireAdmin)
+			r.Get("/scrub", s.scrubReport)
+			r.Post("/scrub", s.scrub)
+		})
+	}
+
 	s.router.Route("/chartas", func(r chi.Router) {
-		r.Post("/", s.createImage)
+		r.Post("/", withTimeout(s.config.Timeouts.Create, s.createImage))
 
 		r.Route("/{id}", func(r chi.Router) {
-			r.Post("/", s.setFragment)
-			r.Get("/", s.getFragment)
-			r.Delete("/", s.deleteImage)
+			r.Post("/", withTimeout(s.config.Timeouts.SetFragment, s.setFragment))
+			r.Get("/", withTimeout(s.config.Timeouts.GetFragment, s.getFragment))
+			r.Delete("/", withTimeout(s.config.Timeouts.Delete, s.deleteImage))
+			r.Post("/retile", withTimeout(s.config.Timeouts.Retile, s.retileImage))
+			r.Get("/revisions", s.imageRevisions)
+			// Отмена изменяет тайлы так же, как запись фрагмента, поэтому ограничена тем же сроком.
+			r.Post("/revert", withTimeout(s.config.Timeouts.SetFragment, s.revertImage))
+			r.Post("/undo", withTimeout(s.config.Timeouts.SetFragment, s.undoImage))
 		})
 	})
 }
+
+// requireAdmin пропускает только запросы с токеном AdminToken в заголовке Authorization, остальные получают 401.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	want := []byte("Bearer " + s.config.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "требуется токен администратора", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// withTimeout ограничивает контекст запроса сроком d. При d <= 0 возвращает h.
+func withTimeout(d time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	if d <= 0 {
+		return h
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+
+		h(w, req.WithContext(ctx))
+	}
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -10,15 +13,52 @@ import (
 
 type Config struct {
 	Port string
+	// Metrics отдает метрики приложения по пути /metrics. nil - метрики не отдаются.
+	Metrics http.Handler
+	// MaxBodySize - максимальный размер тела запроса в байтах. 0 - без ограничения.
+	MaxBodySize int64
+	// Timeouts - сроки выполнения операций. 0 - без ограничения.
+	Timeouts Timeouts
+	// Scrubber проверяет целостность тайлов по запросам к /admin/scrub. nil - проверка недоступна.
+	Scrubber Scrubber
+	// AdminToken - токен доступа к путям /admin/, передаваемый в заголовке "Authorization: Bearer <токен>".
+	// Пустой токен - пути /admin/ недоступны.
+	AdminToken string
 }
 
+// Scrubber - проверка целостности тайлов изображений.
+type Scrubber interface {
+	// Scrub проверяет тайлы всех изображений.
+	// Возвращает chart.ErrScrubRunning, если проверка уже выполняется.
+	Scrub(ctx context.Context) (chart.ScrubReport, error)
+	// Report возвращает результат последней завершенной проверки.
+	Report() chart.ScrubReport
+}
+
+// Timeouts - сроки выполнения операций над изображениями, после которых обработка прекращается
+// и клиент получает ответ 503.
+type Timeouts struct {
+	Create      time.Duration
+	SetFragment time.Duration
+	GetFragment time.Duration
+	Delete      time.Duration
+	Retile      time.Duration
+}
+
+// DefaultMaxBodySize вмещает фрагмент максимального размера 5000x5000 по 32 бита на пиксель с заголовком BMP.
+const DefaultMaxBodySize = 100 << 20
+
 func NewConfig(port string) *Config {
-	return &Config{Port: port}
+	return &Config{
+		Port:        port,
+		MaxBodySize: DefaultMaxBodySize,
+	}
 }
 
 type Server struct {
-	config *Config
-	router *chi.Mux
+	config     *Config
+	router     *chi.Mux
+	httpServer *http.Server
 
 	chartService chart.Service
 }
@@ -30,6 +70,10 @@ func NewServer(config *Config, chartService chart.Service) *Server {
 		chartService: chartService,
 	}
 	s.setRoutes()
+	s.httpServer = &http.Server{
+		Addr:    ":" + config.Port,
+		Handler: s,
+	}
 
 	return s
 }
@@ -38,8 +82,17 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.router.ServeHTTP(w, r)
 }
 
+// Run принимает запросы до вызова Shutdown, после которого возвращает nil.
 func (s *Server) Run() error {
-	p := ":" + s.config.Port
+	err := s.httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
 
-	return http.ListenAndServe(p, s)
+// Shutdown перестает принимать запросы и ожидает завершения начатых, но не дольше ctx.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
 }
@@ -2,17 +2,28 @@ package server_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"text/template"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 
 	"github.com/Dimedrolity/go-chartographer/internal/chart"
+	"github.com/Dimedrolity/go-chartographer/internal/chart/tileutils"
+	"github.com/Dimedrolity/go-chartographer/internal/imgstore"
 	"github.com/Dimedrolity/go-chartographer/internal/server"
+	"github.com/Dimedrolity/go-chartographer/pkg/fault"
+	"github.com/Dimedrolity/go-chartographer/pkg/kvstore"
 )
 
 // Может быть подключить библиотеку для создания стабов в рантайме? типа FakeItEasy на C#
@@ -74,7 +85,7 @@ type TestChartServiceCreateMethodSizeErr struct {
 	chart.Service
 }
 
-func (t TestChartServiceCreateMethodSizeErr) AddImage(int, int) (*chart.TiledImage, error) {
+func (t TestChartServiceCreateMethodSizeErr) AddImage(context.Context, int, int, tileutils.Layout) (*chart.TiledImage, error) {
 	return nil, &chart.SizeError{}
 }
 
@@ -111,7 +122,7 @@ type TestChartServiceCreateMethodSuccess struct {
 
 const id = "new"
 
-func (t TestChartServiceCreateMethodSuccess) AddImage(int, int) (*chart.TiledImage, error) {
+func (t TestChartServiceCreateMethodSuccess) AddImage(context.Context, int, int, tileutils.Layout) (*chart.TiledImage, error) {
 	return &chart.TiledImage{
 		Id: id,
 	}, nil
@@ -141,6 +152,41 @@ func TestCreate_Success(t *testing.T) {
 	})
 }
 
+// TestChartServiceCreateMethodLayout - заглушка, запоминающая раскладку тайлов.
+type TestChartServiceCreateMethodLayout struct {
+	chart.Service
+	layout tileutils.Layout
+}
+
+func (t *TestChartServiceCreateMethodLayout) AddImage(_ context.Context, _, _ int, layout tileutils.Layout) (*chart.TiledImage, error) {
+	t.layout = layout
+	return &chart.TiledImage{Id: id}, nil
+}
+
+func TestCreate_Layout(t *testing.T) {
+	Convey("Раскладка тайлов из параметра layout должна передаваться сервису", t, func() {
+		service := &TestChartServiceCreateMethodLayout{}
+		srv := server.NewServer(&server.Config{}, service)
+
+		req := httptest.NewRequest("POST", "/chartas/?width=1&height=1&layout=rect:200x50", nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusCreated)
+		So(service.layout, ShouldResemble, tileutils.Layout{Kind: tileutils.LayoutRect, TileWidth: 200, TileHeight: 50})
+	})
+
+	Convey("Некорректная раскладка должна давать код 400", t, func() {
+		srv := server.NewServer(&server.Config{}, &TestChartServiceCreateMethodLayout{})
+
+		req := httptest.NewRequest("POST", "/chartas/?width=1&height=1&layout=hex", nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
+
 // endregion
 
 // region Удаление изображения
@@ -149,7 +195,7 @@ type TestChartServiceDeleteMethodNotFound struct {
 	chart.Service
 }
 
-func (t TestChartServiceDeleteMethodNotFound) DeleteImage(string) error {
+func (t TestChartServiceDeleteMethodNotFound) DeleteImage(context.Context, string) error {
 	return chart.ErrNotExist
 }
 
@@ -177,7 +223,7 @@ type TestChartServiceDeleteMethodSuccess struct {
 	chart.Service
 }
 
-func (t TestChartServiceDeleteMethodSuccess) DeleteImage(string) error {
+func (t TestChartServiceDeleteMethodSuccess) DeleteImage(context.Context, string) error {
 	return nil
 }
 
@@ -270,10 +316,10 @@ type TestChartServiceGetMethodNotFound struct {
 	chart.Service
 }
 
-func (t TestChartServiceGetMethodNotFound) GetFragment(*chart.TiledImage, int, int, int, int) (image.Image, error) {
+func (t TestChartServiceGetMethodNotFound) GetFragment(context.Context, *chart.TiledImage, int, int, int, int) (image.Image, error) {
 	return nil, nil
 }
-func (t TestChartServiceGetMethodNotFound) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceGetMethodNotFound) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, chart.ErrNotExist
 }
 
@@ -300,12 +346,15 @@ type TestChartServiceGetMethodSizeError struct {
 	chart.Service
 }
 
-func (t TestChartServiceGetMethodSizeError) GetFragment(*chart.TiledImage, int, int, int, int) (image.Image, error) {
+func (t TestChartServiceGetMethodSizeError) GetFragment(context.Context, *chart.TiledImage, int, int, int, int) (image.Image, error) {
 	return nil, &chart.SizeError{}
 }
-func (t TestChartServiceGetMethodSizeError) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceGetMethodSizeError) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, nil
 }
+func (t TestChartServiceGetMethodSizeError) Reserve(ctx context.Context, _, _ int) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
 
 func TestGet_SizeErr(t *testing.T) {
 	srv := server.NewServer(&server.Config{}, &TestChartServiceGetMethodSizeError{})
@@ -330,12 +379,15 @@ type TestChartServiceGetMethodNotOverlaps struct {
 	chart.Service
 }
 
-func (t TestChartServiceGetMethodNotOverlaps) GetFragment(*chart.TiledImage, int, int, int, int) (image.Image, error) {
+func (t TestChartServiceGetMethodNotOverlaps) GetFragment(context.Context, *chart.TiledImage, int, int, int, int) (image.Image, error) {
 	return nil, chart.ErrNotOverlaps
 }
-func (t TestChartServiceGetMethodNotOverlaps) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceGetMethodNotOverlaps) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, nil
 }
+func (t TestChartServiceGetMethodNotOverlaps) Reserve(ctx context.Context, _, _ int) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
 
 func TestGet_NotOverlaps(t *testing.T) {
 	srv := server.NewServer(&server.Config{}, &TestChartServiceGetMethodNotOverlaps{})
@@ -360,12 +412,15 @@ type TestChartServiceGetMethodSuccess struct {
 	chart.Service
 }
 
-func (t TestChartServiceGetMethodSuccess) GetFragment(*chart.TiledImage, int, int, int, int) (image.Image, error) {
+func (t TestChartServiceGetMethodSuccess) GetFragment(context.Context, *chart.TiledImage, int, int, int, int) (image.Image, error) {
 	return image.Image(image.Rectangle{}), nil
 }
-func (t TestChartServiceGetMethodSuccess) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceGetMethodSuccess) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, nil
 }
+func (t TestChartServiceGetMethodSuccess) Reserve(ctx context.Context, _, _ int) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
 func (t TestChartServiceGetMethodSuccess) Encode(image.Image) ([]byte, error) {
 	return nil, nil
 }
@@ -402,10 +457,10 @@ type TestChartServiceSetMethodWrongSize struct {
 	chart.Service
 }
 
-func (t TestChartServiceSetMethodWrongSize) SetFragment(*chart.TiledImage, int, int, image.Image) error {
+func (t TestChartServiceSetMethodWrongSize) SetFragment(context.Context, *chart.TiledImage, int, int, image.Image) error {
 	return nil
 }
-func (t TestChartServiceSetMethodWrongSize) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceSetMethodWrongSize) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, nil
 }
 
@@ -475,7 +530,7 @@ type TestChartServiceSetMethodNotFound struct {
 	chart.Service
 }
 
-func (t TestChartServiceSetMethodNotFound) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceSetMethodNotFound) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, chart.ErrNotExist
 }
 
@@ -502,13 +557,22 @@ type TestChartServiceSetMethodNotOverlaps struct {
 	chart.Service
 }
 
-func (t TestChartServiceSetMethodNotOverlaps) SetFragment(*chart.TiledImage, int, int, image.Image) error {
+func (t TestChartServiceSetMethodNotOverlaps) SetFragment(context.Context, *chart.TiledImage, int, int, image.Image) error {
 	return chart.ErrNotOverlaps
 }
-func (t TestChartServiceSetMethodNotOverlaps) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceSetMethodNotOverlaps) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, nil
 }
-func (t TestChartServiceSetMethodNotOverlaps) Decode([]byte) (image.Image, error) {
+func (t TestChartServiceSetMethodNotOverlaps) Reserve(ctx context.Context, _, _ int) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
+func (t TestChartServiceSetMethodNotOverlaps) ValidateFragment(*chart.TiledImage, int, int, int, int) error {
+	return nil
+}
+func (t TestChartServiceSetMethodNotOverlaps) DecodeConfig([]byte, int, int) (image.Config, error) {
+	return image.Config{Width: 1, Height: 1}, nil
+}
+func (t TestChartServiceSetMethodNotOverlaps) Decode([]byte, int, int) (image.Image, error) {
 	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
 	img.Set(0, 0, color.RGBA{A: 0xFF})
 	return img, nil
@@ -538,16 +602,25 @@ type TestChartServiceSetMethodSuccess struct {
 	chart.Service
 }
 
-func (t TestChartServiceSetMethodSuccess) AddImage(int, int) (*chart.TiledImage, error) {
+func (t TestChartServiceSetMethodSuccess) AddImage(context.Context, int, int, tileutils.Layout) (*chart.TiledImage, error) {
 	return nil, nil
 }
-func (t TestChartServiceSetMethodSuccess) SetFragment(*chart.TiledImage, int, int, image.Image) error {
+func (t TestChartServiceSetMethodSuccess) SetFragment(context.Context, *chart.TiledImage, int, int, image.Image) error {
 	return nil
 }
-func (t TestChartServiceSetMethodSuccess) GetImage(string) (*chart.TiledImage, error) {
+func (t TestChartServiceSetMethodSuccess) GetImage(context.Context, string) (*chart.TiledImage, error) {
 	return nil, nil
 }
-func (t TestChartServiceSetMethodSuccess) Decode([]byte) (image.Image, error) {
+func (t TestChartServiceSetMethodSuccess) Reserve(ctx context.Context, _, _ int) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
+func (t TestChartServiceSetMethodSuccess) ValidateFragment(*chart.TiledImage, int, int, int, int) error {
+	return nil
+}
+func (t TestChartServiceSetMethodSuccess) DecodeConfig([]byte, int, int) (image.Config, error) {
+	return image.Config{Width: 1, Height: 1}, nil
+}
+func (t TestChartServiceSetMethodSuccess) Decode([]byte, int, int) (image.Image, error) {
 	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
 	img.Set(0, 0, color.RGBA{A: 0xFF})
 	return img, nil
@@ -575,3 +648,842 @@ func TestSet_Success(t *testing.T) {
 }
 
 // endregion
+
+// region Проверка тела запроса
+
+type TestChartServiceSetMethodInvalidFragment struct {
+	TestChartServiceSetMethodSuccess
+}
+
+func (t TestChartServiceSetMethodInvalidFragment) ValidateFragment(*chart.TiledImage, int, int, int, int) error {
+	return chart.ErrNotOverlaps
+}
+
+// TestBody - тело запроса, запоминающее факт чтения.
+type TestBody struct {
+	read bool
+}
+
+func (b *TestBody) Read([]byte) (int, error) {
+	b.read = true
+	return 0, io.EOF
+}
+
+func TestSet_InvalidFragmentBodyNotRead(t *testing.T) {
+	srv := server.NewServer(&server.Config{}, &TestChartServiceSetMethodInvalidFragment{})
+
+	Convey("Фрагмент, не пересекающийся с изображением, должен отклоняться до чтения тела запроса", t, func() {
+		body := &TestBody{}
+		req := httptest.NewRequest("POST", "/chartas/0/?x=0&y=0&width=1&height=1", body)
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+		So(body.read, ShouldBeFalse)
+	})
+}
+
+type TestChartServiceSetMethodDeclaredSize struct {
+	TestChartServiceSetMethodSuccess
+}
+
+func (t TestChartServiceSetMethodDeclaredSize) DecodeConfig([]byte, int, int) (image.Config, error) {
+	return image.Config{}, &chart.DeclaredSizeError{}
+}
+
+func TestSet_DeclaredSize(t *testing.T) {
+	srv := server.NewServer(&server.Config{}, &TestChartServiceSetMethodDeclaredSize{})
+
+	Convey("Размер в заголовке изображения не совпадает с заявленным", t, func() {
+		req := httptest.NewRequest("POST", "/chartas/0/?x=0&y=0&width=1&height=1", &bytes.Buffer{})
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
+
+func TestSet_BodyTooLarge(t *testing.T) {
+	const maxBodySize = 10
+	srv := server.NewServer(&server.Config{MaxBodySize: maxBodySize}, &TestChartServiceSetMethodSuccess{})
+
+	const url = "/chartas/0/?x=0&y=0&width=1&height=1"
+
+	Convey("Content-Length больше ограничения", t, func() {
+		req := httptest.NewRequest("POST", url, bytes.NewReader(make([]byte, maxBodySize+1)))
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+	})
+	Convey("Content-Length неизвестен, тело больше ограничения", t, func() {
+		body := io.MultiReader(bytes.NewReader(make([]byte, maxBodySize+1)))
+		req := httptest.NewRequest("POST", url, body)
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+	})
+	Convey("Тело в пределах ограничения", t, func() {
+		req := httptest.NewRequest("POST", url, bytes.NewReader(make([]byte, maxBodySize)))
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+// endregion
+
+// region Нехватка памяти
+
+type TestChartServiceBusy struct {
+	chart.Service
+}
+
+func (t TestChartServiceBusy) GetImage(context.Context, string) (*chart.TiledImage, error) {
+	return nil, nil
+}
+func (t TestChartServiceBusy) Reserve(context.Context, int, int) (context.Context, func(), error) {
+	return nil, nil, chart.ErrBusy
+}
+func (t TestChartServiceBusy) ValidateFragment(*chart.TiledImage, int, int, int, int) error {
+	return nil
+}
+func (t TestChartServiceBusy) DecodeConfig([]byte, int, int) (image.Config, error) {
+	return image.Config{Width: 1, Height: 1}, nil
+}
+
+func TestBusy(t *testing.T) {
+	srv := server.NewServer(&server.Config{}, &TestChartServiceBusy{})
+
+	tmpl, _ := template.New("right request").Parse("/chartas/{{.Id}}/?x={{.X}}&y={{.Y}}&width={{.Width}}&height={{.Height}}")
+
+	testBusy := func(method string) {
+		b := bytes.Buffer{}
+		err := tmpl.Execute(&b, &Fragment{Id: "0", X: 0, Y: 0, Width: 1, Height: 1})
+		So(err, ShouldBeNil)
+		url := b.String()
+		req := httptest.NewRequest(method, url, &bytes.Buffer{})
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		So(w.Header().Get("Retry-After"), ShouldNotBeEmpty)
+	}
+
+	Convey("get", t, func() {
+		testBusy("GET")
+	})
+	Convey("set", t, func() {
+		testBusy("POST")
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Если задан обработчик метрик, он должен отвечать по пути /metrics", t, func() {
+		metrics := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("metric 1\n"))
+		})
+		srv := server.NewServer(&server.Config{Metrics: metrics}, &TestChartService{})
+
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldEqual, "metric 1\n")
+	})
+}
+
+// endregion
+
+// region Сроки выполнения
+
+type TestChartServiceSlow struct {
+	TestChartServiceGetMethodSuccess
+}
+
+// GetFragment ожидает отмены контекста запроса.
+func (t TestChartServiceSlow) GetFragment(ctx context.Context, _ *chart.TiledImage, _, _, _, _ int) (image.Image, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	Convey("По истечении срока операции сервер должен отвечать кодом 503", t, func() {
+		config := &server.Config{Timeouts: server.Timeouts{GetFragment: 10 * time.Millisecond}}
+		srv := server.NewServer(config, &TestChartServiceSlow{})
+
+		req := httptest.NewRequest("GET", "/chartas/0/?x=0&y=0&width=1&height=1", nil)
+		w := httptest.NewRecorder()
+
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+	})
+
+	Convey("Отмена запроса клиентом должна прекращать обработку", t, func() {
+		srv := server.NewServer(&server.Config{}, &TestChartServiceSlow{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("GET", "/chartas/0/?x=0&y=0&width=1&height=1", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		go cancel()
+		srv.ServeHTTP(w, req)
+
+		So(w.Code, ShouldNotEqual, http.StatusOK)
+	})
+}
+
+// endregion
+
+// region Перераскладка тайлов
+
+// TestChartServiceRetile - заглушка, возвращающая err или изображение с переданной раскладкой.
+type TestChartServiceRetile struct {
+	chart.Service
+	err error
+}
+
+func (t TestChartServiceRetile) Retile(_ context.Context, id string, layout tileutils.Layout) (*chart.TiledImage, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &chart.TiledImage{Id: id, Layout: layout}, nil
+}
+
+func TestRetile(t *testing.T) {
+	retile := func(service chart.Service, url string) *httptest.ResponseRecorder {
+		srv := server.NewServer(&server.Config{}, service)
+		req := httptest.NewRequest("POST", url, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	Convey("В ответе должна быть новая раскладка", t, func() {
+		w := retile(TestChartServiceRetile{}, "/chartas/0/retile?layout=strip")
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldEqual, "strip")
+	})
+
+	Convey("Коды ответа на ошибки", t, func() {
+		So(retile(TestChartServiceRetile{}, "/chartas/0/retile?layout=hex").Code,
+			ShouldEqual, http.StatusBadRequest)
+		So(retile(TestChartServiceRetile{err: tileutils.ErrLayout}, "/chartas/0/retile").Code,
+			ShouldEqual, http.StatusBadRequest)
+		So(retile(TestChartServiceRetile{err: chart.ErrNotExist}, "/chartas/0/retile").Code,
+			ShouldEqual, http.StatusNotFound)
+		So(retile(TestChartServiceRetile{err: chart.ErrRetiling}, "/chartas/0/retile").Code,
+			ShouldEqual, http.StatusConflict)
+	})
+}
+
+// endregion
+
+// region Полный стек в памяти
+
+// newMemoryServer создает сервер с настоящим сервисом изображений и хранилищами в памяти.
+func newMemoryServer() *server.Server {
+	tileService := imgstore.NewBmpService(imgstore.NewMemoryRepo(0))
+	chartService := chart.NewChartographerService(kvstore.NewInMemoryStore(), tileService, &chart.ImageAdapter{},
+		100, nil, 4, 0)
+	return server.NewServer(server.NewConfig(""), chartService)
+}
+
+func TestMemoryStack(t *testing.T) {
+	Convey("Изображение должно создаваться, восстанавливаться, читаться и удаляться по HTTP", t, func() {
+		srv := newMemoryServer()
+		do := func(method, url string, body []byte) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+			return w
+		}
+		codec := imgstore.NewBmpService(nil)
+
+		w := do("POST", "/chartas/?width=250&height=180", nil)
+		So(w.Code, ShouldEqual, http.StatusCreated)
+		id := w.Body.String()
+
+		red := color.RGBA{R: 0xFF, A: 0xFF}
+		fragment := image.NewRGBA(image.Rect(0, 0, 50, 40))
+		draw.Draw(fragment, fragment.Rect, image.NewUniform(red), image.Point{}, draw.Src)
+		b, err := codec.Encode(fragment)
+		So(err, ShouldBeNil)
+
+		w = do("POST", "/chartas/"+id+"/?x=80&y=80&width=50&height=40", b)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		w = do("GET", "/chartas/"+id+"/?x=70&y=70&width=70&height=60", nil)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		got, err := codec.Decode(w.Body.Bytes())
+		So(err, ShouldBeNil)
+		So(got.Bounds(), ShouldResemble, image.Rect(0, 0, 70, 60))
+		So(color.RGBAModel.Convert(got.At(5, 5)), ShouldResemble, color.RGBA{A: 0xFF})
+		So(color.RGBAModel.Convert(got.At(10, 10)), ShouldResemble, red)
+		So(color.RGBAModel.Convert(got.At(59, 49)), ShouldResemble, red)
+		So(color.RGBAModel.Convert(got.At(60, 50)), ShouldResemble, color.RGBA{A: 0xFF})
+
+		So(do("POST", "/chartas/"+id+"/retile?layout=strip", nil).Code, ShouldEqual, http.StatusOK)
+		So(do("GET", "/chartas/"+id+"/?x=80&y=80&width=1&height=1", nil).Code, ShouldEqual, http.StatusOK)
+
+		So(do("DELETE", "/chartas/"+id+"/", nil).Code, ShouldEqual, http.StatusOK)
+		So(do("GET", "/chartas/"+id+"/?x=0&y=0&width=1&height=1", nil).Code, ShouldEqual, http.StatusNotFound)
+	})
+}
+
+// endregion Полный стек в памяти
+
+// region Сбои хранилищ
+
+// faultStack - сервер с настоящим сервисом изображений и хранилищами в памяти, в операции которых вносятся сбои.
+type faultStack struct {
+	srv        *server.Server
+	tiles      *imgstore.MemoryRepository
+	tileFaults *fault.Injector
+	metaFaults *fault.Injector
+	codec      *imgstore.BmpService
+}
+
+func newFaultStack(timeouts server.Timeouts) *faultStack {
+	s := &faultStack{
+		tiles:      imgstore.NewMemoryRepo(0),
+		tileFaults: fault.NewInjector(fault.Config{}, 1),
+		metaFaults: fault.NewInjector(fault.Config{}, 1),
+		codec:      imgstore.NewBmpService(nil),
+	}
+	tileService := imgstore.NewBmpService(imgstore.NewFaultRepo(s.tiles, s.tileFaults))
+	imageRepo := kvstore.NewFaultStore(kvstore.NewInMemoryStore(), s.metaFaults)
+	chartService := chart.NewChartographerService(imageRepo, tileService, &chart.ImageAdapter{}, 100, nil, 4, 0)
+
+	config := server.NewConfig("")
+	config.Timeouts = timeouts
+	s.srv = server.NewServer(config, chartService)
+	return s
+}
+
+func (s *faultStack) do(method, url string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	s.srv.ServeHTTP(w, req)
+	return w
+}
+
+// create создает изображение 250x180 из тайлов 100x100 без сбоев и возвращает его id.
+func (s *faultStack) create() string {
+	w := s.do("POST", "/chartas/?width=250&height=180", nil)
+	So(w.Code, ShouldEqual, http.StatusCreated)
+	return w.Body.String()
+}
+
+// set закрашивает цветом c прямоугольник r изображения id и возвращает код ответа.
+func (s *faultStack) set(id string, r image.Rectangle, c color.RGBA) int {
+	fragment := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(fragment, fragment.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	b, err := s.codec.Encode(fragment)
+	So(err, ShouldBeNil)
+
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+	return s.do("POST", url, b).Code
+}
+
+// get возвращает прямоугольник r изображения id с начальными координатами (0;0).
+func (s *faultStack) get(id string, r image.Rectangle) image.Image {
+	url := fmt.Sprintf("/chartas/%s/?x=%d&y=%d&width=%d&height=%d", id, r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+	w := s.do("GET", url, nil)
+	So(w.Code, ShouldEqual, http.StatusOK)
+	img, err := s.codec.Decode(w.Body.Bytes())
+	So(err, ShouldBeNil)
+	return img
+}
+
+// uniform проверяет, что прямоугольник r изображения img закрашен одним цветом, и возвращает его.
+func uniform(img image.Image, r image.Rectangle) (color.RGBA, bool) {
+	first := color.RGBAModel.Convert(img.At(r.Min.X, r.Min.Y)).(color.RGBA)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if color.RGBAModel.Convert(img.At(x, y)) != first {
+				return first, false
+			}
+		}
+	}
+	return first, true
+}
+
+var (
+	faultRed   = color.RGBA{R: 0xFF, A: 0xFF}
+	faultBlack = color.RGBA{A: 0xFF}
+)
+
+func TestFaults_Create(t *testing.T) {
+	Convey("Ошибка сохранения тайлов при создании изображения должна давать 500", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		s.tileFaults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 2})
+
+		So(s.do("POST", "/chartas/?width=250&height=180", nil).Code, ShouldEqual, http.StatusInternalServerError)
+		So(s.tiles.Bytes(), ShouldEqual, 0)
+
+		s.tileFaults.Set(fault.Config{})
+		id := s.create()
+		c, ok := uniform(s.get(id, image.Rect(0, 0, 250, 180)), image.Rect(0, 0, 250, 180))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+	})
+
+	Convey("Ошибка сохранения метаданных должна давать 500 и не создавать тайлов", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		s.metaFaults.Set(fault.Config{Ops: []string{"Add"}, ErrorRate: 1})
+
+		So(s.do("POST", "/chartas/?width=250&height=180", nil).Code, ShouldEqual, http.StatusInternalServerError)
+		So(s.tiles.Bytes(), ShouldEqual, 0)
+	})
+}
+
+func TestFaults_SetFragment(t *testing.T) {
+	// Фрагмент пересекает 4 тайла по четверти каждого.
+	rect := image.Rect(50, 50, 150, 150)
+	quarters := []image.Rectangle{
+		image.Rect(0, 0, 50, 50), image.Rect(50, 0, 100, 50),
+		image.Rect(0, 50, 50, 100), image.Rect(50, 50, 100, 100),
+	}
+
+	// Запись фрагмента сначала сохраняет 4 копии четвертей в ревизию, затем записывает 4 тайла.
+	Convey("Ошибка записи посреди фрагмента должна давать 500 и оставлять изображение прежним", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		s.tileFaults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 6, Failures: 1})
+
+		So(s.set(id, rect, faultRed), ShouldEqual, http.StatusInternalServerError)
+
+		s.tileFaults.Set(fault.Config{})
+		c, ok := uniform(s.get(id, rect), image.Rect(0, 0, 100, 100))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+		So(s.do("GET", "/chartas/"+id+"/revisions", nil).Body.String(), ShouldEqual, `{"current":0,"revisions":[]}`)
+	})
+
+	Convey("Ошибка записи и восстановления должна давать 500 и ревизию с частью измененных тайлов", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		s.tileFaults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 6})
+
+		So(s.set(id, rect, faultRed), ShouldEqual, http.StatusInternalServerError)
+
+		s.tileFaults.Set(fault.Config{})
+		got := s.get(id, rect)
+		red := 0
+		for _, q := range quarters {
+			c, ok := uniform(got, q)
+			So(ok, ShouldBeTrue)
+			So(c, ShouldBeIn, faultRed, faultBlack)
+			if c == faultRed {
+				red++
+			}
+		}
+		So(red, ShouldEqual, 2)
+
+		Convey("Отмена должна вернуть изображение к прежнему виду", func() {
+			So(s.do("POST", "/chartas/"+id+"/undo", nil).Code, ShouldEqual, http.StatusOK)
+			c, ok := uniform(s.get(id, rect), image.Rect(0, 0, 100, 100))
+			So(ok, ShouldBeTrue)
+			So(c, ShouldResemble, faultBlack)
+		})
+
+		Convey("Повторная запись после устранения сбоя должна применить фрагмент целиком", func() {
+			So(s.set(id, rect, faultRed), ShouldEqual, http.StatusOK)
+			c, ok := uniform(s.get(id, rect), image.Rect(0, 0, 100, 100))
+			So(ok, ShouldBeTrue)
+			So(c, ShouldResemble, faultRed)
+		})
+	})
+
+	Convey("Ошибка чтения тайлов при записи фрагмента должна давать 500 и не изменять изображение", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		s.tileFaults.Set(fault.Config{Ops: []string{"GetTile"}, ErrorRate: 1})
+
+		So(s.set(id, rect, faultRed), ShouldEqual, http.StatusInternalServerError)
+
+		s.tileFaults.Set(fault.Config{})
+		c, ok := uniform(s.get(id, image.Rect(0, 0, 250, 180)), image.Rect(0, 0, 250, 180))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+	})
+
+	Convey("Ошибка чтения метаданных должна давать 500, а не 404", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		s.metaFaults.Set(fault.Config{Ops: []string{"Get"}, ErrorRate: 1})
+
+		So(s.set(id, rect, faultRed), ShouldEqual, http.StatusInternalServerError)
+	})
+}
+
+func TestFaults_GetFragment(t *testing.T) {
+	Convey("Ошибка чтения тайлов должна давать 500", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		s.tileFaults.Set(fault.Config{Ops: []string{"GetTile"}, ErrorRate: 1})
+
+		So(s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=10&height=10", nil).Code,
+			ShouldEqual, http.StatusInternalServerError)
+	})
+
+	Convey("Задержка хранилища дольше срока получения фрагмента должна давать 503", t, func() {
+		s := newFaultStack(server.Timeouts{GetFragment: 20 * time.Millisecond})
+		id := s.create()
+		s.tileFaults.Set(fault.Config{Ops: []string{"GetTile"}, Latency: time.Minute})
+
+		So(s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=10&height=10", nil).Code,
+			ShouldEqual, http.StatusServiceUnavailable)
+	})
+
+	Convey("Повреждение прочитанных тайлов не должно приводить к панике и изменять сохраненные тайлы", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		So(s.set(id, image.Rect(0, 0, 250, 180), faultRed), ShouldEqual, http.StatusOK)
+
+		s.tileFaults.Set(fault.Config{Ops: []string{"GetTile"}, CorruptRate: 1})
+		for i := 0; i < 20; i++ {
+			code := s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=250&height=180", nil).Code
+			So(code, ShouldBeIn, http.StatusOK, http.StatusInternalServerError)
+		}
+		So(s.tileFaults.Injected(), ShouldBeGreaterThan, 0)
+
+		s.tileFaults.Set(fault.Config{})
+		c, ok := uniform(s.get(id, image.Rect(0, 0, 250, 180)), image.Rect(0, 0, 250, 180))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultRed)
+	})
+}
+
+func TestFaults_Retile(t *testing.T) {
+	Convey("Ошибка перераскладки должна давать 500, не оставлять новых тайлов и не изменять изображение", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		So(s.set(id, image.Rect(50, 50, 150, 150), faultRed), ShouldEqual, http.StatusOK)
+		before := s.tiles.Bytes()
+
+		for _, cfg := range []fault.Config{
+			{Ops: []string{"SaveTile"}, FailAfter: 1},
+			{Ops: []string{"GetTile"}, FailAfter: 3},
+		} {
+			s.tileFaults.Set(cfg)
+			So(s.do("POST", "/chartas/"+id+"/retile?layout=strip", nil).Code, ShouldEqual, http.StatusInternalServerError)
+			s.tileFaults.Set(fault.Config{})
+			So(s.tiles.Bytes(), ShouldEqual, before)
+		}
+
+		s.metaFaults.Set(fault.Config{Ops: []string{"Add"}, ErrorRate: 1})
+		So(s.do("POST", "/chartas/"+id+"/retile?layout=strip", nil).Code, ShouldEqual, http.StatusInternalServerError)
+		s.metaFaults.Set(fault.Config{})
+		So(s.tiles.Bytes(), ShouldEqual, before)
+
+		c, ok := uniform(s.get(id, image.Rect(50, 50, 150, 150)), image.Rect(0, 0, 100, 100))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultRed)
+		c, ok = uniform(s.get(id, image.Rect(150, 0, 250, 50)), image.Rect(0, 0, 100, 50))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+	})
+}
+
+func TestFaults_Delete(t *testing.T) {
+	Convey("Ошибка удаления метаданных должна давать 500 и оставлять изображение доступным", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		before := s.tiles.Bytes()
+		s.metaFaults.Set(fault.Config{Ops: []string{"Delete"}, ErrorRate: 1})
+
+		So(s.do("DELETE", "/chartas/"+id+"/", nil).Code, ShouldEqual, http.StatusInternalServerError)
+
+		s.metaFaults.Set(fault.Config{})
+		So(s.tiles.Bytes(), ShouldEqual, before)
+		s.get(id, image.Rect(0, 0, 10, 10))
+	})
+
+	Convey("Ошибка удаления тайлов не должна мешать удалению изображения, тайлы остаются сборщику мусора", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		s.tileFaults.Set(fault.Config{Ops: []string{"DeleteImage"}, ErrorRate: 1})
+
+		So(s.do("DELETE", "/chartas/"+id+"/", nil).Code, ShouldEqual, http.StatusOK)
+		So(s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=10&height=10", nil).Code, ShouldEqual, http.StatusNotFound)
+		So(s.tiles.Bytes(), ShouldBeGreaterThan, 0)
+	})
+}
+
+// endregion Сбои хранилищ
+
+// region Проверка целостности
+
+// TestScrubber - заглушка проверки целостности, возвращающая report или err.
+type TestScrubber struct {
+	report chart.ScrubReport
+	err    error
+	runs   int
+}
+
+func (s *TestScrubber) Scrub(context.Context) (chart.ScrubReport, error) {
+	if s.err != nil {
+		return chart.ScrubReport{}, s.err
+	}
+	s.runs++
+	return s.report, nil
+}
+
+func (s *TestScrubber) Report() chart.ScrubReport {
+	return s.report
+}
+
+const adminToken = "secret"
+
+// newScrubServer создает сервер с проверкой целостности scrubber, доступной по токену adminToken.
+func newScrubServer(scrubber *TestScrubber) *server.Server {
+	config := server.NewConfig("")
+	config.Scrubber = scrubber
+	config.AdminToken = adminToken
+	return server.NewServer(config, nil)
+}
+
+// adminRequest создает запрос к /admin/scrub с токеном token.
+func adminRequest(method, token string) *http.Request {
+	req := httptest.NewRequest(method, "/admin/scrub", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestServer_Scrub(t *testing.T) {
+	report := chart.ScrubReport{
+		Images: 1, Tiles: 6,
+		Corrupted: []chart.CorruptTile{{Image: "0", TileSet: "0", X: 100, Y: 0, Error: "поврежден", Restored: true}},
+	}
+
+	Convey("GET /admin/scrub должен отдавать последний отчет без новой проверки", t, func() {
+		scrubber := &TestScrubber{report: report}
+		srv := newScrubServer(scrubber)
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, adminRequest("GET", adminToken))
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+		So(w.Body.String(), ShouldContainSubstring, `"corrupted":[{"image":"0","tileSet":"0","x":100,"y":0,"error":"поврежден","restored":true}]`)
+		So(scrubber.runs, ShouldEqual, 0)
+	})
+
+	Convey("POST /admin/scrub должен выполнять проверку", t, func() {
+		scrubber := &TestScrubber{report: report}
+		srv := newScrubServer(scrubber)
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, adminRequest("POST", adminToken))
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldContainSubstring, `"tiles":6`)
+		So(scrubber.runs, ShouldEqual, 1)
+
+		Convey("Ошибка проверки должна давать 500", func() {
+			scrubber.err = errors.New("хранилище недоступно")
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, adminRequest("POST", adminToken))
+
+			So(w.Code, ShouldEqual, http.StatusInternalServerError)
+		})
+
+		Convey("Запуск во время выполняющейся проверки должен давать 409", func() {
+			scrubber.err = chart.ErrScrubRunning
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, adminRequest("POST", adminToken))
+
+			So(w.Code, ShouldEqual, http.StatusConflict)
+		})
+	})
+
+	Convey("Запросы без токена администратора или с другим токеном должны давать 401", t, func() {
+		scrubber := &TestScrubber{report: report}
+		srv := newScrubServer(scrubber)
+
+		for _, req := range []*http.Request{
+			httptest.NewRequest("POST", "/admin/scrub", nil),
+			adminRequest("POST", "other"),
+			adminRequest("GET", ""),
+		} {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		}
+		So(scrubber.runs, ShouldEqual, 0)
+	})
+
+	Convey("Без токена администратора путь /admin/scrub должен отсутствовать", t, func() {
+		config := server.NewConfig("")
+		config.Scrubber = &TestScrubber{report: report}
+		srv := server.NewServer(config, nil)
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", "/admin/scrub", nil))
+
+		So(w.Code, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Без проверки целостности путь /admin/scrub должен отсутствовать", t, func() {
+		srv := server.NewServer(server.NewConfig(""), nil)
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/admin/scrub", nil))
+
+		So(w.Code, ShouldEqual, http.StatusNotFound)
+	})
+}
+
+// endregion Проверка целостности
+
+// region История изменений
+
+func TestRevisions(t *testing.T) {
+	Convey("История изменений должна отдаваться в JSON, а фрагмент - читаться в виде после ревизии", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		whole := image.Rect(0, 0, 250, 180)
+		So(s.set(id, image.Rect(50, 50, 150, 150), faultRed), ShouldEqual, http.StatusOK)
+
+		w := s.do("GET", "/chartas/"+id+"/revisions", nil)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+		var got struct {
+			Current   int
+			Revisions []chart.Revision
+		}
+		So(json.Unmarshal(w.Body.Bytes(), &got), ShouldBeNil)
+		So(got.Current, ShouldEqual, 1)
+		So(got.Revisions, ShouldHaveLength, 1)
+		So(got.Revisions[0].Number, ShouldEqual, 1)
+		So(got.Revisions[0].Width, ShouldEqual, 100)
+		So(got.Revisions[0].Tiles, ShouldContain, chart.TilePoint{X: 0, Y: 0})
+		So(w.Body.String(), ShouldContainSubstring, `"tiles":[{"x":0,"y":0}`)
+
+		w = s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=250&height=180&revision=0", nil)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		img, err := s.codec.Decode(w.Body.Bytes())
+		So(err, ShouldBeNil)
+		c, ok := uniform(img, whole)
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+
+		c, ok = uniform(s.get(id, image.Rect(50, 50, 150, 150)), image.Rect(0, 0, 100, 100))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultRed)
+	})
+
+	Convey("Ревизия нового изображения должна быть нулевой с пустой историей", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+
+		w := s.do("GET", "/chartas/"+id+"/revisions", nil)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldEqual, `{"current":0,"revisions":[]}`)
+	})
+
+	Convey("Несуществующая ревизия должна давать 404, некорректная - 400", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+
+		So(s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=10&height=10&revision=1", nil).Code,
+			ShouldEqual, http.StatusNotFound)
+		So(s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=10&height=10&revision=a", nil).Code,
+			ShouldEqual, http.StatusBadRequest)
+		So(s.do("GET", "/chartas/"+id+"/?x=0&y=0&width=10&height=10&revision=", nil).Code,
+			ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("История несуществующего изображения должна давать 404", t, func() {
+		s := newFaultStack(server.Timeouts{})
+
+		So(s.do("GET", "/chartas/0/revisions", nil).Code, ShouldEqual, http.StatusNotFound)
+	})
+}
+
+func TestRevert(t *testing.T) {
+	rect := image.Rect(50, 50, 150, 150)
+
+	Convey("Отмена должна возвращать изображение к ревизии и отвечать ревизией отмены в JSON", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		So(s.set(id, rect, faultRed), ShouldEqual, http.StatusOK)
+
+		w := s.do("POST", "/chartas/"+id+"/revert?to=0", nil)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		var rev chart.Revision
+		So(json.Unmarshal(w.Body.Bytes(), &rev), ShouldBeNil)
+		So(rev.Number, ShouldEqual, 2)
+		So(*rev.RevertTo, ShouldEqual, 0)
+
+		c, ok := uniform(s.get(id, rect), image.Rect(0, 0, 100, 100))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+
+		So(s.do("POST", "/chartas/"+id+"/revert?to=1", nil).Code, ShouldEqual, http.StatusOK)
+		c, ok = uniform(s.get(id, rect), image.Rect(0, 0, 100, 100))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultRed)
+	})
+
+	Convey("Undo должен отменять последнее изменение, а без изменений давать 409", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		So(s.do("POST", "/chartas/"+id+"/undo", nil).Code, ShouldEqual, http.StatusConflict)
+
+		So(s.set(id, rect, faultRed), ShouldEqual, http.StatusOK)
+		So(s.do("POST", "/chartas/"+id+"/undo", nil).Code, ShouldEqual, http.StatusOK)
+		c, ok := uniform(s.get(id, rect), image.Rect(0, 0, 100, 100))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+	})
+
+	Convey("Некорректные запросы отмены", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+
+		So(s.do("POST", "/chartas/"+id+"/revert", nil).Code, ShouldEqual, http.StatusBadRequest)
+		So(s.do("POST", "/chartas/"+id+"/revert?to=a", nil).Code, ShouldEqual, http.StatusBadRequest)
+		So(s.do("POST", "/chartas/"+id+"/revert?to=1", nil).Code, ShouldEqual, http.StatusNotFound)
+		So(s.do("POST", "/chartas/0/revert?to=0", nil).Code, ShouldEqual, http.StatusNotFound)
+		So(s.do("POST", "/chartas/0/undo", nil).Code, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Ошибка восстановления тайлов должна давать 500, а отмена - оставаться в истории", t, func() {
+		s := newFaultStack(server.Timeouts{})
+		id := s.create()
+		So(s.set(id, rect, faultRed), ShouldEqual, http.StatusOK)
+
+		// Копии 4 тайлов в ревизию отмены сохраняются, восстановление тайлов - нет.
+		s.tileFaults.Set(fault.Config{Ops: []string{"SaveTile"}, FailAfter: 4})
+		So(s.do("POST", "/chartas/"+id+"/undo", nil).Code, ShouldEqual, http.StatusInternalServerError)
+
+		s.tileFaults.Set(fault.Config{})
+		w := s.do("GET", "/chartas/"+id+"/revisions", nil)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		var got struct{ Current int }
+		So(json.Unmarshal(w.Body.Bytes(), &got), ShouldBeNil)
+		So(got.Current, ShouldEqual, 2)
+
+		So(s.do("POST", "/chartas/"+id+"/revert?to=0", nil).Code, ShouldEqual, http.StatusOK)
+		c, ok := uniform(s.get(id, rect), image.Rect(0, 0, 100, 100))
+		So(ok, ShouldBeTrue)
+		So(c, ShouldResemble, faultBlack)
+	})
+}
+
+// endregion История изменений
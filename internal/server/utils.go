@@ -1,12 +1,42 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 )
 
+// retryAfter - через сколько секунд клиенту стоит повторить запрос, отклоненный из-за нехватки памяти.
+const retryAfter = "1"
+
+// busyError отвечает кодом 503 с заголовком Retry-After.
+func busyError(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", retryAfter)
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// contextError отвечает на ошибку отмены контекста запроса и возвращает true, если err - такая ошибка.
+// По истечении срока операции отвечает кодом 503. Если клиент отключился, ответ никто не прочитает.
+func contextError(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "время обработки запроса истекло", http.StatusServiceUnavailable)
+		return true
+	}
+	if errors.Is(err, context.Canceled) {
+		http.Error(w, err.Error(), statusClientClosedRequest)
+		return true
+	}
+
+	return false
+}
+
+// statusClientClosedRequest - нестандартный код ответа на запрос, отмененный клиентом, как в nginx.
+// Попадает только в журнал запросов.
+const statusClientClosedRequest = 499
+
 func paramError(name string, err error) error {
 	return fmt.Errorf(
 		"некорректный параметр запроса - %v: %w", name, err)
@@ -32,3 +62,18 @@ func getQueryParamInt(req *http.Request, name string) (int, error) {
 
 	return i, nil
 }
+
+// writeJSON отвечает значением v в формате JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
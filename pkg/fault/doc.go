@@ -0,0 +1,3 @@
+// Package fault - внесение сбоев (ошибок, задержек и повреждения данных) в операции хранилищ
+// для проверки устойчивости к ним.
+package fault
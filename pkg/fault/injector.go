@@ -0,0 +1,148 @@
+package fault
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjected - ошибка, которую Injector возвращает по умолчанию.
+var ErrInjected = errors.New("внесенный сбой хранилища")
+
+// Config - какие сбои вносить в операции хранилища.
+type Config struct {
+	// Ops - имена операций, в которые вносятся сбои, например "SaveTile". Пусто - во все операции.
+	Ops []string
+	// ErrorRate - вероятность ошибки операции от 0 до 1.
+	ErrorRate float64
+	// FailAfter - после скольких успешных операций все последующие завершаются ошибкой. 0 - не используется.
+	FailAfter int
+	// Failures - сколько операций после FailAfter завершаются ошибкой, последующие снова успешны. 0 - все.
+	Failures int
+	// Err - возвращаемая ошибка. nil - ErrInjected.
+	Err error
+	// Latency - задержка перед операцией. Ожидание прерывается отменой контекста.
+	Latency time.Duration
+	// CorruptRate - вероятность повреждения прочитанных данных от 0 до 1.
+	CorruptRate float64
+}
+
+// Injector - потокобезопасный источник сбоев для декораторов хранилищ.
+// Перед операцией декоратор вызывает Before, после чтения - Corrupt.
+//
+// nil *Injector не вносит сбоев.
+type Injector struct {
+	mu  sync.Mutex
+	cfg Config
+	rnd *rand.Rand
+	// calls - сколько операций из cfg.Ops выполнено с последнего Set.
+	calls int
+	// injected - сколько сбоев внесено за все время.
+	injected int
+}
+
+// NewInjector создает Injector со сбоями cfg. Случайные сбои определяются seed, поэтому воспроизводимы.
+func NewInjector(cfg Config, seed int64) *Injector {
+	return &Injector{
+		cfg: cfg,
+		rnd: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Set заменяет вносимые сбои и обнуляет счетчик операций для FailAfter.
+// Пустой Config отключает сбои.
+func (in *Injector) Set(cfg Config) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.cfg = cfg
+	in.calls = 0
+}
+
+// Injected возвращает, сколько сбоев внесено.
+func (in *Injector) Injected() int {
+	if in == nil {
+		return 0
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	return in.injected
+}
+
+// matches проверяет, вносятся ли сбои в операцию op. Вызывается под mu.
+func (in *Injector) matches(op string) bool {
+	if len(in.cfg.Ops) == 0 {
+		return true
+	}
+	for _, o := range in.cfg.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Before вызывается перед операцией op: выдерживает задержку и решает, завершить ли операцию ошибкой.
+// Возможны ошибки Config.Err (ErrInjected) и ctx.Err().
+func (in *Injector) Before(ctx context.Context, op string) error {
+	if in == nil {
+		return nil
+	}
+
+	in.mu.Lock()
+	if !in.matches(op) {
+		in.mu.Unlock()
+		return nil
+	}
+	in.calls++
+	fail := (in.cfg.FailAfter > 0 && in.calls > in.cfg.FailAfter &&
+		(in.cfg.Failures == 0 || in.calls <= in.cfg.FailAfter+in.cfg.Failures)) ||
+		(in.cfg.ErrorRate > 0 && in.rnd.Float64() < in.cfg.ErrorRate)
+	if fail {
+		in.injected++
+	}
+	latency, err := in.cfg.Latency, in.cfg.Err
+	in.mu.Unlock()
+
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+
+	if !fail {
+		return nil
+	}
+	if err == nil {
+		err = ErrInjected
+	}
+	return err
+}
+
+// Corrupt возвращает данные b, прочитанные операцией op, возможно, с инвертированным случайным байтом.
+// Поврежденные данные - копия, b не изменяется.
+func (in *Injector) Corrupt(op string, b []byte) []byte {
+	if in == nil || len(b) == 0 {
+		return b
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if !in.matches(op) || in.cfg.CorruptRate <= 0 || in.rnd.Float64() >= in.cfg.CorruptRate {
+		return b
+	}
+	in.injected++
+
+	c := append([]byte(nil), b...)
+	c[in.rnd.Intn(len(c))] ^= 0xFF
+	return c
+}
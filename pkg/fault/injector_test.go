@@ -0,0 +1,95 @@
+package fault_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/Dimedrolity/go-chartographer/pkg/fault"
+)
+
+var ctx = context.Background()
+
+func TestInjector_Errors(t *testing.T) {
+	Convey("После FailAfter успешных операций все последующие должны завершаться ошибкой", t, func() {
+		in := NewInjector(Config{FailAfter: 2}, 1)
+
+		So(in.Before(ctx, "Save"), ShouldBeNil)
+		So(in.Before(ctx, "Save"), ShouldBeNil)
+		So(errors.Is(in.Before(ctx, "Save"), ErrInjected), ShouldBeTrue)
+		So(errors.Is(in.Before(ctx, "Get"), ErrInjected), ShouldBeTrue)
+		So(in.Injected(), ShouldEqual, 2)
+
+		in.Set(Config{})
+		So(in.Before(ctx, "Save"), ShouldBeNil)
+	})
+
+	Convey("Ошибкой должны завершаться только Failures операций после FailAfter", t, func() {
+		in := NewInjector(Config{FailAfter: 1, Failures: 2}, 1)
+
+		So(in.Before(ctx, "Save"), ShouldBeNil)
+		So(errors.Is(in.Before(ctx, "Save"), ErrInjected), ShouldBeTrue)
+		So(errors.Is(in.Before(ctx, "Save"), ErrInjected), ShouldBeTrue)
+		So(in.Before(ctx, "Save"), ShouldBeNil)
+		So(in.Injected(), ShouldEqual, 2)
+	})
+
+	Convey("Сбои должны вноситься только в операции Ops и возвращать заданную ошибку", t, func() {
+		errDisk := errors.New("диск")
+		in := NewInjector(Config{Ops: []string{"Save"}, ErrorRate: 1, Err: errDisk}, 1)
+
+		So(in.Before(ctx, "Get"), ShouldBeNil)
+		So(in.Before(ctx, "Save"), ShouldEqual, errDisk)
+	})
+
+	Convey("Доля ошибок должна соответствовать ErrorRate", t, func() {
+		in := NewInjector(Config{ErrorRate: 0.3}, 1)
+
+		failed := 0
+		for i := 0; i < 1000; i++ {
+			if in.Before(ctx, "Save") != nil {
+				failed++
+			}
+		}
+		So(failed, ShouldBeBetween, 250, 350)
+	})
+
+	Convey("nil Injector не должен вносить сбоев", t, func() {
+		var in *Injector
+
+		So(in.Before(ctx, "Save"), ShouldBeNil)
+		So(in.Corrupt("Get", []byte{1}), ShouldResemble, []byte{1})
+		So(in.Injected(), ShouldEqual, 0)
+	})
+}
+
+func TestInjector_Latency(t *testing.T) {
+	Convey("Задержка должна прерываться отменой контекста", t, func() {
+		in := NewInjector(Config{Latency: time.Hour}, 1)
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		So(errors.Is(in.Before(ctx, "Get"), context.DeadlineExceeded), ShouldBeTrue)
+	})
+}
+
+func TestInjector_Corrupt(t *testing.T) {
+	Convey("Поврежденные данные должны отличаться одним байтом, а исходные - не изменяться", t, func() {
+		in := NewInjector(Config{CorruptRate: 1}, 1)
+		b := []byte{1, 2, 3, 4}
+
+		c := in.Corrupt("Get", b)
+		So(b, ShouldResemble, []byte{1, 2, 3, 4})
+		diff := 0
+		for i := range b {
+			if b[i] != c[i] {
+				diff++
+			}
+		}
+		So(diff, ShouldEqual, 1)
+		So(in.Injected(), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,46 @@
+package kvstore
+
+import "errors"
+
+// SetCompactMin задает, сколько записей должно быть в журнале, чтобы переписывать его во время работы.
+func SetCompactMin(s *LogStore, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compactMin = n
+}
+
+// TearNextWrite делает следующую запись в журнал недописанной: дописываются только n байт и возвращается ошибка.
+// truncateErr - ошибка, которую вернет отрезание недописанной записи.
+func TearNextWrite(s *LogStore, n int, truncateErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.f = &tornFile{logFile: s.f, n: n, truncateErr: truncateErr}
+}
+
+type tornFile struct {
+	logFile
+	n           int
+	torn        bool
+	truncateErr error
+}
+
+func (f *tornFile) Write(p []byte) (int, error) {
+	if f.torn {
+		return f.logFile.Write(p)
+	}
+	f.torn = true
+	n, err := f.logFile.Write(p[:f.n])
+	if err != nil {
+		return n, err
+	}
+	return n, errTorn
+}
+
+func (f *tornFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.logFile.Truncate(size)
+}
+
+var errTorn = errors.New("нет места на диске")
@@ -0,0 +1,48 @@
+package kvstore
+
+import (
+	"context"
+
+	"github.com/Dimedrolity/go-chartographer/pkg/fault"
+)
+
+// FaultStore вносит в операции декорируемого хранилища сбои faults: ошибки и задержки.
+// Операции называются по методам: "Add", "Get", "Delete". Предназначено для проверки устойчивости к сбоям.
+type FaultStore struct {
+	store  Store
+	faults *fault.Injector
+}
+
+// NewFaultStore создает FaultStore, вносящий сбои faults в операции хранилища s.
+func NewFaultStore(s Store, faults *fault.Injector) *FaultStore {
+	return &FaultStore{store: s, faults: faults}
+}
+
+func (s *FaultStore) Add(key string, value interface{}) error {
+	err := s.faults.Before(context.Background(), "Add")
+	if err != nil {
+		return err
+	}
+	return s.store.Add(key, value)
+}
+
+func (s *FaultStore) Get(key string) (interface{}, error) {
+	err := s.faults.Before(context.Background(), "Get")
+	if err != nil {
+		return nil, err
+	}
+	return s.store.Get(key)
+}
+
+func (s *FaultStore) Delete(key string) error {
+	err := s.faults.Before(context.Background(), "Delete")
+	if err != nil {
+		return err
+	}
+	return s.store.Delete(key)
+}
+
+// Keys возвращает ключи декорируемого хранилища без сбоев: операция не обращается к диску.
+func (s *FaultStore) Keys() []string {
+	return s.store.Keys()
+}
@@ -0,0 +1,32 @@
+package kvstore_test
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/Dimedrolity/go-chartographer/pkg/fault"
+	. "github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+)
+
+func TestFaultStore(t *testing.T) {
+	Convey("Сбой операции не должен доходить до хранилища, после отключения сбоев операции должны выполняться", t, func() {
+		faults := fault.NewInjector(fault.Config{Ops: []string{"Add", "Delete"}, ErrorRate: 1}, 1)
+		store := NewInMemoryStore()
+		s := NewFaultStore(store, faults)
+
+		So(errors.Is(s.Add("0", 42), fault.ErrInjected), ShouldBeTrue)
+		_, err := store.Get("0")
+		So(errors.Is(err, ErrNotExist), ShouldBeTrue)
+
+		faults.Set(fault.Config{})
+		So(s.Add("0", 42), ShouldBeNil)
+
+		faults.Set(fault.Config{Ops: []string{"Delete"}, ErrorRate: 1})
+		So(errors.Is(s.Delete("0"), fault.ErrInjected), ShouldBeTrue)
+		got, err := s.Get("0")
+		So(err, ShouldBeNil)
+		So(got, ShouldEqual, 42)
+	})
+}
@@ -3,7 +3,11 @@ package kvstore
 // Store - key/value хранилище.
 // Ключом является string, так как он гарантированно имеет хэш и может использоваться в качестве ключа map.
 type Store interface {
-	Add(key string, value interface{})
+	// Add сохраняет value по ключу key, заменяя прежнее значение.
+	// Ошибку возвращают хранилища, сохраняющие значения вне памяти.
+	Add(key string, value interface{}) error
 	Get(key string) (interface{}, error)
 	Delete(key string) error
+	// Keys возвращает ключи сохраненных значений в произвольном порядке.
+	Keys() []string
 }
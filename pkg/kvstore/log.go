@@ -0,0 +1,318 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Decoder восстанавливает значение из JSON, в котором оно было сохранено LogStore.
+type Decoder func(b []byte) (interface{}, error)
+
+// logRecord - строка журнала LogStore.
+type logRecord struct {
+	Key string `json:"key"`
+	// Value отсутствует у записи удаления.
+	Value json.RawMessage `json:"value,omitempty"`
+	Del   bool            `json:"del,omitempty"`
+}
+
+// compactMinRecords - сколько записей должно быть в журнале, чтобы переписывать его во время работы.
+// Без ограничения журнал с несколькими значениями переписывался бы через каждые несколько изменений.
+const compactMinRecords = 1024
+
+// logFile - открытый на дописывание журнал.
+type logFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// LogStore - потокобезопасное key/value хранилище, значения которого хранятся в памяти
+// и сохраняются в журнал на диске: каждое изменение дописывается строкой JSON и синхронизируется с диском.
+// При открытии журнал воспроизводится. Если устаревших записей больше, чем актуальных, журнал переписывается:
+// при открытии и во время работы, когда в нем не меньше compactMinRecords записей.
+//
+// Значения сохраняются функцией json.Marshal, поэтому должны ею поддерживаться.
+type LogStore struct {
+	path   string
+	decode Decoder
+	// compactMin - сколько записей должно быть в журнале, чтобы переписывать его во время работы.
+	compactMin int
+
+	mu    sync.Mutex
+	f     logFile
+	store map[string]interface{}
+	// size и records - длина журнала в байтах и количество записей в нем.
+	size    int64
+	records int
+	// broken - почему журнал нельзя дописывать: недописанную запись не удалось отрезать.
+	broken error
+}
+
+// NewLogStore открывает журнал path, создавая его при необходимости, и восстанавливает значения функцией decode.
+// Недописанная последняя строка, например после сбоя, отбрасывается.
+// После использования необходимо вызвать Close.
+func NewLogStore(path string, decode Decoder) (*LogStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LogStore{
+		path:       path,
+		decode:     decode,
+		compactMin: compactMinRecords,
+		store:      make(map[string]interface{}),
+	}
+
+	err = s.replay()
+	if err != nil {
+		return nil, err
+	}
+	if s.records > 2*len(s.store) {
+		err = s.rewrite()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay восстанавливает значения из журнала, его длину и количество записей в нем.
+func (s *LogStore) replay() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var off int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			s.size = off
+			if len(line) > 0 {
+				log.Printf("журнал %s: отброшена недописанная запись", s.path)
+				return f.Truncate(off)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec logRecord
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			return fmt.Errorf("журнал %s, смещение %d: %w", s.path, off, err)
+		}
+		if rec.Del {
+			delete(s.store, rec.Key)
+		} else {
+			value, err := s.decode(rec.Value)
+			if err != nil {
+				return fmt.Errorf("журнал %s, ключ %s: %w", s.path, rec.Key, err)
+			}
+			s.store[rec.Key] = value
+		}
+
+		s.records++
+		off += int64(len(line))
+	}
+}
+
+// rewrite атомарно заменяет журнал записями актуальных значений.
+// Открытый журнал s.f после этого указывает на замененный файл, см. compact.
+func (s *LogStore) rewrite() error {
+	var buf bytes.Buffer
+	for key, value := range s.store {
+		line, err := encodeRecord(key, value, false)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	s.size = int64(buf.Len())
+	s.records = len(s.store)
+	return nil
+}
+
+// compact переписывает журнал, если устаревших записей в нем больше, чем актуальных. Вызывается под mu.
+// Ошибка переписывания не мешает дописывать прежний журнал, поэтому только выводится в лог.
+func (s *LogStore) compact() {
+	if s.records < s.compactMin || s.records <= 2*len(s.store) {
+		return
+	}
+
+	err := s.rewrite()
+	if err != nil {
+		log.Printf("журнал %s: переписывание: %v", s.path, err)
+		return
+	}
+
+	// Прежний файл заменен, дописывать нужно новый.
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		s.broken = err
+		return
+	}
+	_ = s.f.Close()
+	s.f = f
+}
+
+func encodeRecord(key string, value interface{}, del bool) ([]byte, error) {
+	rec := logRecord{Key: key, Del: del}
+	if !del {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		rec.Value = b
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// append дописывает запись в журнал и синхронизирует его с диском. Вызывается под mu.
+// Запись, которую не удалось дописать, отрезается, чтобы не оказаться в середине журнала:
+// при открытии такая запись дает ошибку. Если отрезать не удалось, журнал больше не дописывается.
+func (s *LogStore) append(key string, value interface{}, del bool) error {
+	if s.f == nil {
+		return errors.New("журнал закрыт")
+	}
+	if s.broken != nil {
+		return fmt.Errorf("журнал %s поврежден: %w", s.path, s.broken)
+	}
+
+	line, err := encodeRecord(key, value, del)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.Write(line)
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		truncErr := s.f.Truncate(s.size)
+		if truncErr == nil {
+			truncErr = s.f.Sync()
+		}
+		if truncErr != nil {
+			s.broken = truncErr
+		}
+		return err
+	}
+
+	s.size += int64(len(line))
+	s.records++
+	return nil
+}
+
+// Add сохраняет значение в журнал и, если запись удалась, в память.
+func (s *LogStore) Add(key string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.append(key, value, false)
+	if err != nil {
+		return err
+	}
+	s.store[key] = value
+	s.compact()
+	return nil
+}
+
+func (s *LogStore) Get(key string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.store[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return value, nil
+}
+
+// Delete записывает удаление в журнал и удаляет значение из памяти.
+func (s *LogStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store[key]; !ok {
+		return ErrNotExist
+	}
+
+	err := s.append(key, nil, true)
+	if err != nil {
+		return err
+	}
+	delete(s.store, key)
+	s.compact()
+	return nil
+}
+
+// Keys возвращает ключи сохраненных значений.
+func (s *LogStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.store))
+	for key := range s.store {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close закрывает журнал. Последующие изменения завершаются ошибкой.
+func (s *LogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
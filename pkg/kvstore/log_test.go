@@ -0,0 +1,176 @@
+package kvstore_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/Dimedrolity/go-chartographer/pkg/kvstore"
+)
+
+type point struct {
+	X, Y int
+}
+
+func decodePoint(b []byte) (interface{}, error) {
+	p := &point{}
+	err := json.Unmarshal(b, p)
+	return p, err
+}
+
+func TestLogStore_Reopen(t *testing.T) {
+	Convey("После повторного открытия журнала значения должны восстанавливаться", t, func() {
+		path := filepath.Join(t.TempDir(), "meta", "log")
+		store, err := NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+
+		So(store.Add("a", &point{1, 2}), ShouldBeNil)
+		So(store.Add("b", &point{3, 4}), ShouldBeNil)
+		So(store.Add("a", &point{5, 6}), ShouldBeNil)
+		So(store.Delete("b"), ShouldBeNil)
+		So(errors.Is(store.Delete("b"), ErrNotExist), ShouldBeTrue)
+		So(store.Close(), ShouldBeNil)
+
+		store, err = NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		defer store.Close()
+
+		got, err := store.Get("a")
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, &point{5, 6})
+		_, err = store.Get("b")
+		So(errors.Is(err, ErrNotExist), ShouldBeTrue)
+		So(store.Keys(), ShouldResemble, []string{"a"})
+
+		// Устаревших записей было больше актуальных, журнал переписан.
+		b, err := os.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(strings.Count(string(b), "\n"), ShouldEqual, 1)
+	})
+}
+
+func TestLogStore_Truncated(t *testing.T) {
+	Convey("Недописанная последняя запись должна отбрасываться", t, func() {
+		path := filepath.Join(t.TempDir(), "log")
+		store, err := NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		So(store.Add("a", &point{1, 2}), ShouldBeNil)
+		So(store.Close(), ShouldBeNil)
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		So(err, ShouldBeNil)
+		_, err = f.WriteString(`{"key":"b","val`)
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		store, err = NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		So(store.Keys(), ShouldResemble, []string{"a"})
+		So(store.Add("c", &point{}), ShouldBeNil)
+		So(store.Close(), ShouldBeNil)
+
+		store, err = NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		defer store.Close()
+		_, err = store.Get("c")
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Поврежденная запись в середине журнала должна давать ошибку", t, func() {
+		path := filepath.Join(t.TempDir(), "log")
+		So(os.WriteFile(path, []byte("garbage\n{\"key\":\"a\",\"value\":{}}\n"), 0666), ShouldBeNil)
+
+		_, err := NewLogStore(path, decodePoint)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLogStore_Closed(t *testing.T) {
+	Convey("Изменение закрытого журнала должно возвращать ошибку и не менять значения", t, func() {
+		store, err := NewLogStore(filepath.Join(t.TempDir(), "log"), decodePoint)
+		So(err, ShouldBeNil)
+		So(store.Close(), ShouldBeNil)
+
+		So(store.Add("a", &point{}), ShouldNotBeNil)
+		_, err = store.Get("a")
+		So(errors.Is(err, ErrNotExist), ShouldBeTrue)
+	})
+}
+
+func TestLogStore_TornWrite(t *testing.T) {
+	Convey("Недописанная запись должна отрезаться, а журнал - открываться", t, func() {
+		path := filepath.Join(t.TempDir(), "log")
+		store, err := NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		So(store.Add("a", &point{1, 2}), ShouldBeNil)
+
+		TearNextWrite(store, 5, nil)
+		So(store.Add("b", &point{3, 4}), ShouldNotBeNil)
+		_, err = store.Get("b")
+		So(errors.Is(err, ErrNotExist), ShouldBeTrue)
+
+		So(store.Add("c", &point{5, 6}), ShouldBeNil)
+		So(store.Close(), ShouldBeNil)
+
+		store, err = NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		defer store.Close()
+		got, err := store.Get("c")
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, &point{5, 6})
+		So(store.Keys(), ShouldHaveLength, 2)
+	})
+
+	Convey("Если недописанную запись не удалось отрезать, журнал не должен дописываться", t, func() {
+		path := filepath.Join(t.TempDir(), "log")
+		store, err := NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		So(store.Add("a", &point{1, 2}), ShouldBeNil)
+
+		TearNextWrite(store, 5, errors.New("ошибка ввода-вывода"))
+		So(store.Add("b", &point{3, 4}), ShouldNotBeNil)
+		So(store.Add("c", &point{5, 6}), ShouldNotBeNil)
+		So(store.Delete("a"), ShouldNotBeNil)
+		So(store.Keys(), ShouldResemble, []string{"a"})
+		So(store.Close(), ShouldBeNil)
+
+		// Недописанная запись последняя, поэтому отбрасывается при открытии.
+		store, err = NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		defer store.Close()
+		So(store.Keys(), ShouldResemble, []string{"a"})
+	})
+}
+
+func TestLogStore_Compact(t *testing.T) {
+	Convey("Журнал, в котором устаревших записей больше актуальных, должен переписываться во время работы", t, func() {
+		path := filepath.Join(t.TempDir(), "log")
+		store, err := NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		SetCompactMin(store, 4)
+
+		for i := 0; i < 10; i++ {
+			So(store.Add("a", &point{i, i}), ShouldBeNil)
+		}
+		So(store.Add("b", &point{}), ShouldBeNil)
+
+		b, err := os.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(strings.Count(string(b), "\n"), ShouldBeLessThan, 4)
+
+		So(store.Close(), ShouldBeNil)
+		store, err = NewLogStore(path, decodePoint)
+		So(err, ShouldBeNil)
+		defer store.Close()
+		got, err := store.Get("a")
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, &point{9, 9})
+		_, err = store.Get("b")
+		So(err, ShouldBeNil)
+	})
+}
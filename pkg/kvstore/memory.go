@@ -18,10 +18,11 @@ func NewInMemoryStore() *InMemoryStore {
 	}
 }
 
-func (r *InMemoryStore) Add(key string, value interface{}) {
+func (r *InMemoryStore) Add(key string, value interface{}) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.add(key, value)
+	return nil
 }
 
 func (r *InMemoryStore) add(key string, value interface{}) {
@@ -60,3 +61,15 @@ func (r *InMemoryStore) delete(key string) error {
 
 	return nil
 }
+
+// Keys возвращает ключи сохраненных значений.
+func (r *InMemoryStore) Keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.store))
+	for key := range r.store {
+		keys = append(keys, key)
+	}
+	return keys
+}
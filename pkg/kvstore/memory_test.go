@@ -64,3 +64,16 @@ func TestFileSystemTileRepo_Get(t *testing.T) {
 		So(errors.Is(err, ErrNotExist), ShouldBeTrue)
 	})
 }
+
+func TestInMemoryStore_Keys(t *testing.T) {
+	Convey("Keys должен возвращать ключи сохраненных и не удаленных значений", t, func() {
+		store := NewInMemoryStore()
+		So(store.Keys(), ShouldBeEmpty)
+
+		_ = store.Add("0", 1)
+		_ = store.Add("1", 2)
+		_ = store.Delete("0")
+
+		So(store.Keys(), ShouldResemble, []string{"1"})
+	})
+}
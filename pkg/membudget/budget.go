@@ -0,0 +1,110 @@
+package membudget
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrExhausted = errors.New("бюджет памяти исчерпан")
+
+// Budget - потокобезопасный бюджет памяти в байтах.
+// Перед выделением памяти необходимо зарезервировать её объем методом Reserve,
+// после освобождения памяти - вернуть методом Release.
+//
+// nil *Budget означает отсутствие ограничения.
+type Budget struct {
+	limit int64
+	wait  time.Duration // Сколько ожидать освобождения памяти, прежде чем вернуть ErrExhausted.
+
+	mu       sync.Mutex
+	used     int64
+	released chan struct{} // Закрывается при каждом освобождении памяти, чтобы разбудить ожидающих.
+}
+
+func NewBudget(limit int64, wait time.Duration) *Budget {
+	return &Budget{
+		limit:    limit,
+		wait:     wait,
+		released: make(chan struct{}),
+	}
+}
+
+// Reserve резервирует n байт.
+// Если свободной памяти недостаточно, ожидает её освобождения не дольше wait.
+// Запрос, превышающий весь бюджет, отклоняется сразу.
+// Ожидание прерывается отменой ctx.
+// Возможны ошибки ErrExhausted и ctx.Err().
+func (b *Budget) Reserve(ctx context.Context, n int64) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	if n > b.limit {
+		return ErrExhausted
+	}
+
+	var timeout <-chan time.Time
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		if b.wait <= 0 {
+			return ErrExhausted
+		}
+		if timeout == nil {
+			timer := time.NewTimer(b.wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-released:
+		case <-timeout:
+			return ErrExhausted
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release возвращает в бюджет n байт, ранее зарезервированных Reserve.
+func (b *Budget) Release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// Used возвращает объем зарезервированной памяти.
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.used
+}
+
+// Limit возвращает размер бюджета.
+func (b *Budget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+
+	return b.limit
+}
@@ -0,0 +1,93 @@
+package membudget_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/Dimedrolity/go-chartographer/pkg/membudget"
+)
+
+var ctx = context.Background()
+
+func TestBudget_ReserveRelease(t *testing.T) {
+	Convey("Резервирование в пределах бюджета должно учитываться в Used, освобождение - возвращать память", t, func() {
+		b := NewBudget(10, 0)
+
+		So(b.Reserve(ctx, 4), ShouldBeNil)
+		So(b.Reserve(ctx, 6), ShouldBeNil)
+		So(b.Used(), ShouldEqual, 10)
+
+		b.Release(4)
+		So(b.Used(), ShouldEqual, 6)
+	})
+}
+
+func TestBudget_Exhausted(t *testing.T) {
+	Convey("Без ожидания резервирование сверх бюджета должно вернуть ошибку", t, func() {
+		b := NewBudget(10, 0)
+
+		So(b.Reserve(ctx, 8), ShouldBeNil)
+		err := b.Reserve(ctx, 3)
+		So(errors.Is(err, ErrExhausted), ShouldBeTrue)
+		So(b.Used(), ShouldEqual, 8)
+	})
+
+	Convey("Запрос больше всего бюджета должен отклоняться сразу, даже с ожиданием", t, func() {
+		b := NewBudget(10, time.Hour)
+
+		err := b.Reserve(ctx, 11)
+		So(errors.Is(err, ErrExhausted), ShouldBeTrue)
+	})
+}
+
+func TestBudget_Wait(t *testing.T) {
+	Convey("Резервирование должно дождаться освобождения памяти", t, func() {
+		b := NewBudget(10, time.Second)
+		So(b.Reserve(ctx, 10), ShouldBeNil)
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			b.Release(5)
+		}()
+
+		So(b.Reserve(ctx, 5), ShouldBeNil)
+		So(b.Used(), ShouldEqual, 10)
+	})
+
+	Convey("Резервирование должно вернуть ошибку, если память не освободилась за время ожидания", t, func() {
+		b := NewBudget(10, 10*time.Millisecond)
+		So(b.Reserve(ctx, 10), ShouldBeNil)
+
+		err := b.Reserve(ctx, 1)
+		So(errors.Is(err, ErrExhausted), ShouldBeTrue)
+	})
+
+	Convey("Отмена контекста должна прерывать ожидание", t, func() {
+		b := NewBudget(10, time.Hour)
+		So(b.Reserve(ctx, 10), ShouldBeNil)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		err := b.Reserve(cancelled, 1)
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+		So(b.Used(), ShouldEqual, 10)
+	})
+}
+
+func TestBudget_Nil(t *testing.T) {
+	Convey("nil бюджет не должен ограничивать память", t, func() {
+		var b *Budget
+
+		So(b.Reserve(ctx, 1<<40), ShouldBeNil)
+		b.Release(1 << 40)
+		So(b.Used(), ShouldEqual, 0)
+	})
+}
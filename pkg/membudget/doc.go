@@ -0,0 +1,2 @@
+// Package membudget - ограничение объема памяти, одновременно занимаемого обрабатываемыми данными.
+package membudget
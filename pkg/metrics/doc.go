@@ -0,0 +1,2 @@
+// Package metrics - реестр метрик приложения, отдаваемых по HTTP в текстовом формате Prometheus.
+package metrics
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type metricType string
+
+const (
+	gaugeType   metricType = "gauge"
+	counterType metricType = "counter"
+)
+
+type metric struct {
+	name, help string
+	typ        metricType
+	value      func() float64
+}
+
+// Registry - потокобезопасный реестр метрик.
+// Значения не хранятся в реестре, а вычисляются функциями в момент запроса,
+// поэтому источник метрики сам отвечает за её актуальность.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// GaugeFunc регистрирует метрику, значение которой может как расти, так и уменьшаться.
+func (r *Registry) GaugeFunc(name, help string, value func() float64) {
+	r.add(metric{name: name, help: help, typ: gaugeType, value: value})
+}
+
+// CounterFunc регистрирует монотонно растущую метрику.
+func (r *Registry) CounterFunc(name, help string, value func() float64) {
+	r.add(metric{name: name, help: help, typ: counterType, value: value})
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP отдает значения всех метрик в порядке регистрации.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, m := range metrics {
+		v := strconv.FormatFloat(m.value(), 'g', -1, 64)
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.typ, m.name, v)
+		if err != nil {
+			return
+		}
+	}
+}
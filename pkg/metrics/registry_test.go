@@ -0,0 +1,35 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	. "github.com/Dimedrolity/go-chartographer/pkg/metrics"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("Метрики должны отдаваться в текстовом формате Prometheus со значениями на момент запроса", t, func() {
+		r := NewRegistry()
+
+		used := 1.0
+		r.GaugeFunc("mem_used_bytes", "Занятая память.", func() float64 { return used })
+		r.CounterFunc("hits_total", "Попадания.", func() float64 { return 42 })
+
+		used = 2.5
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldEqual,
+			"# HELP mem_used_bytes Занятая память.\n"+
+				"# TYPE mem_used_bytes gauge\n"+
+				"mem_used_bytes 2.5\n"+
+				"# HELP hits_total Попадания.\n"+
+				"# TYPE hits_total counter\n"+
+				"hits_total 42\n")
+	})
+}
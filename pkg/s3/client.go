@@ -0,0 +1,338 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config - параметры подключения к бакету.
+type Config struct {
+	// Endpoint - адрес хранилища, например "https://s3.eu-central-1.amazonaws.com" или "http://localhost:9000".
+	// Бакет указывается в пути запроса (path-style), как принято у S3-совместимых хранилищ.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Credentials - ключи доступа. Без ключей запросы не подписываются (анонимный доступ).
+	Credentials Credentials
+
+	// MaxRetries - сколько раз повторить запрос после временной ошибки: сетевой ошибки, кода 5xx или 429.
+	MaxRetries int
+	// RetryDelay - пауза перед первым повтором, каждая следующая пауза вдвое дольше.
+	RetryDelay time.Duration
+
+	// HTTPClient - клиент HTTP. nil - http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// DefaultRegion используется, если регион не указан. S3-совместимые хранилища обычно принимают любой регион.
+const DefaultRegion = "us-east-1"
+
+// Client выполняет запросы к объектам одного бакета.
+// Безопасен для одновременного использования из нескольких горутин.
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+}
+
+// NewClient создает клиента бакета cfg.Bucket.
+func NewClient(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("s3: некорректный адрес хранилища %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: не указан бакет")
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultRegion
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+
+	return &Client{cfg: cfg, endpoint: u}, nil
+}
+
+// Bucket возвращает имя бакета.
+func (c *Client) Bucket() string {
+	return c.cfg.Bucket
+}
+
+// PutObject записывает объект key, заменяя существующий.
+func (c *Client) PutObject(ctx context.Context, key string, body []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// PutObjectIfMatch записывает объект key, только если его текущий ETag равен etag (условная запись If-Match).
+// Позволяет нескольким клиентам изменять объект чтением и записью без потерянных обновлений.
+// Возможны ошибки ErrPrecondition, если объект изменился после чтения, и ErrNotExist, если он удален.
+func (c *Client) PutObjectIfMatch(ctx context.Context, key string, body []byte, etag string) error {
+	header := http.Header{}
+	header.Set("If-Match", etag)
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// GetObject считывает объект key.
+// Возможна ошибка ErrNotExist.
+func (c *Client) GetObject(ctx context.Context, key string) ([]byte, error) {
+	b, _, err := c.GetObjectETag(ctx, key)
+	return b, err
+}
+
+// GetObjectETag считывает объект key и его ETag для условной записи PutObjectIfMatch.
+// ETag пуст, если хранилище его не вернуло.
+// Возможна ошибка ErrNotExist.
+func (c *Client) GetObjectETag(ctx context.Context, key string) ([]byte, string, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, resp.Header.Get("ETag"), nil
+}
+
+// GetObjectRange считывает n байт объекта key, начиная со смещения off.
+// Если объект короче, возвращает доступные байты; если off за концом объекта - пустой срез.
+// Возможна ошибка ErrNotExist.
+func (c *Client) GetObjectRange(ctx context.Context, key string, off, n int64) ([]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	resp, err := c.do(ctx, http.MethodGet, key, nil, header, nil)
+	var errResp *ResponseError
+	if errors.As(err, &errResp) && errResp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Хранилище, не поддерживающее Range, возвращает объект целиком с кодом 200.
+	if resp.StatusCode == http.StatusOK {
+		if off >= int64(len(b)) {
+			return nil, nil
+		}
+		b = b[off:]
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+	}
+	return b, nil
+}
+
+// DeleteObject удаляет объект key. Удаление отсутствующего объекта не является ошибкой.
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listResult - ответ ListObjectsV2.
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// ListObjects возвращает ключи объектов, начинающихся с prefix.
+// Если delimiter не пуст, ключи, содержащие delimiter после prefix, группируются:
+// вместо них в prefixes возвращается их общая часть до delimiter включительно.
+func (c *Client) ListObjects(ctx context.Context, prefix, delimiter string) (keys, prefixes []string, err error) {
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": prefix}
+		if delimiter != "" {
+			query["delimiter"] = delimiter
+		}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("s3: ответ ListObjectsV2: %w", err)
+		}
+
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return keys, prefixes, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// DeletePrefix удаляет все объекты, ключи которых начинаются с prefix, и возвращает их количество.
+func (c *Client) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	keys, _, err := c.ListObjects(ctx, prefix, "")
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		err = c.DeleteObject(ctx, key)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// do выполняет запрос к объекту key (или к бакету, если key пуст), повторяя его после временных ошибок.
+// Ответ с кодом не 2xx возвращается как *ResponseError, код 404 - как ErrNotExist, код 412 - как ErrPrecondition.
+func (c *Client) do(ctx context.Context, method, key string, query map[string]string, header http.Header,
+	body []byte) (*http.Response, error) {
+	delay := c.cfg.RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := c.try(ctx, method, key, query, header, body)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= c.cfg.MaxRetries || !retryable(ctx, err) {
+			return nil, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// retryable сообщает, имеет ли смысл повторить запрос, завершившийся ошибкой err.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var errResp *ResponseError
+	if errors.As(err, &errResp) {
+		return errResp.temporary()
+	}
+	// Отсутствие объекта и изменение объекта повтором не исправляются, остальные ошибки - сетевые.
+	return !errors.Is(err, ErrNotExist) && !errors.Is(err, ErrPrecondition)
+}
+
+// try выполняет одну попытку запроса.
+func (c *Client) try(ctx context.Context, method, key string, query map[string]string, header http.Header,
+	body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	base := strings.TrimSuffix(c.endpoint.EscapedPath(), "/")
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + c.cfg.Bucket + "/" + key
+	u.RawPath = base + "/" + escape(c.cfg.Bucket, false) + "/" + escape(key, true)
+	params := make([]string, 0, len(query))
+	for k, v := range query {
+		params = append(params, escape(k, false)+"="+escape(v, false))
+	}
+	u.RawQuery = strings.Join(params, "&")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if c.cfg.Credentials.AccessKey != "" {
+		payloadHash := emptyHash
+		if len(body) > 0 {
+			payloadHash = hashHex(body)
+		}
+		sign(req, c.cfg.Credentials, c.cfg.Region, payloadHash, time.Now())
+	}
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	errResp := responseError(resp)
+	if resp.StatusCode == http.StatusNotFound && key != "" && errResp.Code != "NoSuchBucket" {
+		return nil, fmt.Errorf("%w: %s", ErrNotExist, key)
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("%w: %s", ErrPrecondition, key)
+	}
+	return nil, errResp
+}
+
+// responseError читает описание ошибки из тела ответа.
+func responseError(resp *http.Response) *ResponseError {
+	errResp := &ResponseError{StatusCode: resp.StatusCode}
+
+	var body struct {
+		Code    string
+		Message string
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(b, &body) == nil {
+		errResp.Code = body.Code
+		errResp.Message = body.Message
+	}
+	return errResp
+}
@@ -0,0 +1,6 @@
+// Package s3 - минимальный клиент S3-совместимого объектного хранилища (AWS S3, MinIO, Ceph RGW):
+// запись, чтение, удаление и перечисление объектов бакета с подписью запросов AWS Signature V4
+// и повтором запросов при временных ошибках.
+//
+// Пакет s3test содержит S3-совместимый сервер в памяти для тестов.
+package s3
@@ -0,0 +1,32 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotExist означает, что объекта нет в бакете.
+var ErrNotExist = errors.New("объект не найден")
+
+// ErrPrecondition означает, что условие запроса не выполнено, например, объект изменился после чтения.
+var ErrPrecondition = errors.New("условие запроса не выполнено")
+
+// ResponseError - ответ хранилища с кодом ошибки.
+type ResponseError struct {
+	StatusCode int
+	// Code и Message - из XML-тела ответа, если оно есть, например "NoSuchBucket".
+	Code    string
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: код ответа %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: код ответа %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// temporary сообщает, имеет ли смысл повторить запрос: хранилище перегружено или временно недоступно.
+func (e *ResponseError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == 429
+}
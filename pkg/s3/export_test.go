@@ -0,0 +1,4 @@
+package s3
+
+// Sign открывает подпись запросов для проверки на примерах из документации AWS.
+var Sign = sign
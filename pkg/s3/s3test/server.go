@@ -0,0 +1,275 @@
+// Package s3test - S3-совместимый сервер в памяти для тестов клиентов объектного хранилища.
+// Поддерживает запись (в том числе условную, If-Match), чтение (в том числе диапазона байт),
+// удаление объектов и ListObjectsV2, а также внедрение временных ошибок для проверки повторов.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server - S3-совместимый сервер, хранящий объекты в памяти. Бакеты указываются в пути запроса (path-style).
+type Server struct {
+	*httptest.Server
+
+	// MaxKeys - сколько ключей возвращается в одном ответе ListObjectsV2. Меньшее значение проверяет постраничный вывод.
+	MaxKeys int
+	// AccessKey - если не пуст, запросы должны быть подписаны этим ключом, иначе сервер отвечает 403.
+	// Подпись не проверяется, сверяется только ключ.
+	AccessKey string
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	// fail - сколько следующих запросов завершится ошибкой failCode.
+	fail     int
+	failCode int
+	requests int
+}
+
+// NewServer запускает сервер без бакетов. После использования сервер нужно остановить методом Close.
+func NewServer() *Server {
+	s := &Server{
+		MaxKeys: 1000,
+		buckets: make(map[string]map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// CreateBucket создает пустой бакет, если его еще нет.
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[name]; !ok {
+		s.buckets[name] = make(map[string][]byte)
+	}
+}
+
+// Keys возвращает отсортированные ключи объектов бакета.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FailNext заставляет сервер ответить кодом code на n следующих запросов.
+func (s *Server) FailNext(n, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = n
+	s.failCode = code
+}
+
+// Requests возвращает количество полученных запросов, включая завершенные внедренной ошибкой.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if s.fail > 0 {
+		s.fail--
+		writeError(w, s.failCode, "SlowDown", "внедренная ошибка")
+		return
+	}
+
+	if s.AccessKey != "" &&
+		!strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "запрос не подписан")
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "бакет "+bucket+" не найден")
+		return
+	}
+
+	if key == "" {
+		if req.Method != http.MethodGet || req.URL.Query().Get("list-type") != "2" {
+			writeError(w, http.StatusNotImplemented, "NotImplemented", "поддерживается только ListObjectsV2")
+			return
+		}
+		s.list(w, req, objects)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		if match := req.Header.Get("If-Match"); match != "" {
+			cur, ok := objects[key]
+			if !ok {
+				writeError(w, http.StatusNotFound, "NoSuchKey", "объект "+key+" не найден")
+				return
+			}
+			if etag(cur) != match {
+				writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "объект "+key+" изменился")
+				return
+			}
+		}
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		objects[key] = b
+		w.Header().Set("ETag", etag(b))
+	case http.MethodGet, http.MethodHead:
+		b, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "объект "+key+" не найден")
+			return
+		}
+		serveObject(w, req, b)
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+	}
+}
+
+// etag возвращает ETag объекта b - MD5 содержимого в кавычках, как у объектов S3, записанных одним запросом.
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// serveObject отвечает объектом b или его диапазоном из заголовка Range вида "bytes=first-last".
+func serveObject(w http.ResponseWriter, req *http.Request, b []byte) {
+	w.Header().Set("ETag", etag(b))
+	rng := req.Header.Get("Range")
+	if rng == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(b)
+		}
+		return
+	}
+
+	var first, last int
+	_, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last)
+	if err != nil || first > last {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "некорректный Range "+rng)
+		return
+	}
+	if first >= len(b) {
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rng)
+		return
+	}
+	if last >= len(b) {
+		last = len(b) - 1
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(b)))
+	w.Header().Set("Content-Length", strconv.Itoa(last-first+1))
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(b[first : last+1])
+	}
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Prefix                string
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string   `xml:",omitempty"`
+	Contents              []object `xml:",omitempty"`
+	CommonPrefixes        []prefix `xml:",omitempty"`
+}
+
+type object struct {
+	Key  string
+	Size int
+}
+
+type prefix struct {
+	Prefix string
+}
+
+// list отвечает на ListObjectsV2. Маркер продолжения - последний выданный ключ или общий префикс.
+func (s *Server) list(w http.ResponseWriter, req *http.Request, objects map[string][]byte) {
+	q := req.URL.Query()
+	pre, delimiter, after := q.Get("prefix"), q.Get("delimiter"), q.Get("continuation-token")
+
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		if strings.HasPrefix(k, pre) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	res := listResult{Prefix: pre}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		entry := k
+		if delimiter != "" {
+			if i := strings.Index(k[len(pre):], delimiter); i >= 0 {
+				entry = k[:len(pre)+i+len(delimiter)]
+			}
+		}
+		if entry <= after || seen[entry] {
+			continue
+		}
+		// Ключи общего префикса, выданного на предыдущей странице, больше маркера, но повторно не выдаются.
+		if delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(k, after) {
+			continue
+		}
+		if res.KeyCount == s.MaxKeys {
+			res.IsTruncated = true
+			break
+		}
+		seen[entry] = true
+		res.KeyCount++
+		res.NextContinuationToken = entry
+
+		if entry == k {
+			res.Contents = append(res.Contents, object{Key: k, Size: len(objects[k])})
+		} else {
+			res.CommonPrefixes = append(res.CommonPrefixes, prefix{Prefix: entry})
+		}
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+func writeError(w http.ResponseWriter, code int, s3Code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	_, _ = fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, s3Code, message)
+}